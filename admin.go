@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"distributed_file_storage/crypto"
+	"distributed_file_storage/server"
+	"distributed_file_storage/store"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// unixPrefix admin 地址以 unix: 开头时监听 unix socket
+const unixPrefix = "unix:"
+
+// newAdminHandler 返回节点状态和运维操作的接口。keyFile 为空时不能轮换主密钥，reload 为空时不能重新加载配置。
+// token 不为空时运维操作(POST)需要 Authorization: Bearer <token>
+func newAdminHandler(s *server.FileServer, keyFile, token string, reload func() (reloadResult, error)) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		status, err := s.Status()
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	})
+	mux.HandleFunc("POST /gc", requireToken(token, func(w http.ResponseWriter, r *http.Request) {
+		report, err := s.GC(r.Context())
+		if errors.Is(err, server.ErrGCUnsupported) {
+			writeAPIError(w, http.StatusNotImplemented, err)
+			return
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}))
+	mux.HandleFunc("POST /rotate-key", requireToken(token, func(w http.ResponseWriter, r *http.Request) {
+		res, err := rotateKey(s, keyFile, r.URL.Query().Get("retire") == "true")
+		if errors.Is(err, errNoKeyFile) {
+			writeAPIError(w, http.StatusConflict, err)
+			return
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	}))
+	mux.HandleFunc("POST /migrate-ids", requireToken(token, func(w http.ResponseWriter, r *http.Request) {
+		report, err := s.MigrateObjectIDs()
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}))
+	mux.HandleFunc("POST /reload", requireToken(token, func(w http.ResponseWriter, r *http.Request) {
+		if reload == nil {
+			writeAPIError(w, http.StatusNotImplemented, errors.New("reload is not supported"))
+			return
+		}
+		res, err := reload()
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	}))
+
+	return mux
+}
+
+// requireToken 检查请求中的 Bearer 令牌，token 为空时不检查
+func requireToken(token string, h http.HandlerFunc) http.HandlerFunc {
+	want := []byte("Bearer " + token)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			writeAPIError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// errNoKeyFile 节点的主密钥不是从 key 文件读取的，轮换后的密钥无法保存
+var errNoKeyFile = errors.New("key rotation requires key.source: file")
+
+// rotateResult POST /rotate-key 的结果，retire 时只有 Retired
+type rotateResult struct {
+	*server.RotateReport
+	Retired int `json:"retired"`
+}
+
+// rotateLock 同一时间只有一次轮换或停用，key 文件和内存中的主密钥保持一致
+var rotateLock sync.Mutex
+
+// rotateKey 生成新的主密钥并重新包装数据密钥，轮换完成后把内存中的主密钥写入 key 文件。
+// 轮换之前新主密钥先加入 previous_keys，轮换中断后重启也能解开已经重新包装的数据密钥。
+// retire 时停用并删除 previous_keys
+func rotateKey(s *server.FileServer, keyFile string, retire bool) (rotateResult, error) {
+	if keyFile == "" {
+		return rotateResult{}, errNoKeyFile
+	}
+	rotateLock.Lock()
+	defer rotateLock.Unlock()
+
+	keys, err := loadOrCreateKeyFile(keyFile)
+	if err != nil {
+		return rotateResult{}, err
+	}
+
+	if retire {
+		// key 文件中多出的旧主密钥不影响读取，先停用内存中的
+		retired := s.RetireKeys()
+		keys.Previous = nil
+		if err := writeKeyFile(keyFile, keys); err != nil {
+			return rotateResult{}, err
+		}
+		return rotateResult{Retired: retired}, nil
+	}
+
+	newKey := crypto.NewEncryptionKey()
+	staged := keys
+	staged.Previous = append(append([][]byte(nil), keys.Previous...), newKey)
+	if err := writeKeyFile(keyFile, staged); err != nil {
+		return rotateResult{}, err
+	}
+
+	report, err := s.RotateKey(newKey)
+	if err != nil {
+		return rotateResult{RotateReport: &report}, err
+	}
+	keys.EncKey, keys.Previous = newKey, s.PreviousKeys()
+	if err := writeKeyFile(keyFile, keys); err != nil {
+		return rotateResult{RotateReport: &report}, err
+	}
+	return rotateResult{RotateReport: &report}, nil
+}
+
+// listenAdmin 监听 TCP 地址或 unix:<path>，unix socket 残留的旧文件会被删除
+func listenAdmin(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// adminClient 返回能连接 TCP 或 unix socket 的 HTTP 客户端和请求的基础 URL
+func adminClient(addr string) (*http.Client, string) {
+	path, ok := strings.CutPrefix(addr, unixPrefix)
+	if !ok {
+		return &http.Client{Timeout: 10 * time.Second}, "http://" + addr
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}
+	return &http.Client{Transport: transport, Timeout: 10 * time.Second}, "http://admin"
+}
+
+// adminPost 发送运维操作请求，FS_ADMIN_TOKEN 不为空时带上 admin 令牌
+func adminPost(c *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("FS_ADMIN_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return c.Do(req)
+}
+
+// runNodeStatus 查询正在运行的节点的 admin 接口
+func runNodeStatus(args []string) int {
+	fset := flag.NewFlagSet("node status", flag.ContinueOnError)
+	addr := fset.String("admin", envOr("FS_ADMIN", defaultAdminAddr), "admin address of the node, host:port or unix:<path> (env FS_ADMIN)")
+	asJSON := fset.Bool("json", false, "print machine readable JSON output")
+	if err := fset.Parse(args); err != nil || fset.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: fs node status [flags]")
+		return exitUsage
+	}
+
+	c, base := adminClient(*addr)
+	resp, err := c.Get(base + "/status")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fs:", err)
+		return exitError
+	}
+	defer resp.Body.Close()
+
+	var status server.Status
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		fmt.Fprintln(os.Stderr, "fs:", err)
+		return exitError
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(status)
+		return exitOK
+	}
+
+	fmt.Printf("node:      %s\n", status.NodeID)
+	fmt.Printf("listen:    %s\n", status.ListenAddr)
+	fmt.Printf("version:   %s (protocol %d, %s)\n", status.Version, status.ProtocolVersion, status.GoVersion)
+	fmt.Printf("started:   %s\n", status.StartedAt.Local().Format(time.RFC3339))
+	fmt.Printf("objects:   %d (%d bytes)\n", status.Store.Objects, status.Store.Bytes)
+	fmt.Printf("replicas:  %d (%d bytes)\n", status.Replicas.Objects, status.Replicas.Bytes)
+	fmt.Printf("capacity:  %s\n", formatLimit(status.Quota.Used, status.Quota.Capacity))
+	fmt.Printf("transfers: %d\n", len(status.Transfers))
+	fmt.Printf("key:       %s (%d previous)\n", status.MasterKeyID, status.PreviousKeys)
+	fmt.Printf("share key: %s\n", status.ShareKey)
+	auth := "optional"
+	if status.AuthRequired {
+		auth = "required"
+	}
+	fmt.Printf("identity:  %s (auth %s)\n", status.Identity, auth)
+	if gc := status.LastGC; gc != nil {
+		fmt.Printf("last gc:   %s, %d bytes reclaimed\n", gc.StartedAt.Local().Format(time.RFC3339), gc.BytesReclaimed)
+	}
+	if a := status.Audit; a != nil {
+		fmt.Printf("audit:     %s, entry %d, head %s\n", a.File, a.Seq, a.Head)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nPEER\tDIRECTION\tCONNECTED\tSCORE\tIDENTITY")
+	for _, p := range status.Peers {
+		direction := "inbound"
+		if p.Outbound {
+			direction = "outbound"
+		}
+		identity := "-"
+		if p.Identity != "" {
+			identity = p.Identity[:16]
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%.1f\t%s\n", p.Addr, direction, p.ConnectedAt.Local().Format(time.DateTime), p.Score, identity)
+	}
+	if len(status.Bans) > 0 {
+		fmt.Fprintln(tw, "\nBANNED\tIP\tUNTIL\tREASON")
+		for _, b := range status.Bans {
+			identity, ip := "-", "-"
+			if b.Identity != "" {
+				identity = b.Identity[:16]
+			}
+			if b.IP != "" {
+				ip = b.IP
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", identity, ip, b.Until.Local().Format(time.DateTime), b.Reason)
+		}
+	}
+
+	fmt.Fprintln(tw, "\nOWNER\tOBJECTS\tBYTES")
+	for _, o := range status.Quota.Owners {
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", o.ID, o.Objects, formatLimit(o.Bytes, o.Quota))
+	}
+	tw.Flush()
+
+	return exitOK
+}
+
+// formatLimit 输出 "已用/上限"，没有上限时只输出已用
+func formatLimit(used, limit int64) string {
+	if limit == 0 {
+		return fmt.Sprintf("%d bytes", used)
+	}
+	return fmt.Sprintf("%d/%d bytes", used, limit)
+}
+
+// runNodeGC 让正在运行的节点立即执行一次垃圾回收
+func runNodeGC(args []string) int {
+	fset := flag.NewFlagSet("node gc", flag.ContinueOnError)
+	addr := fset.String("admin", envOr("FS_ADMIN", defaultAdminAddr), "admin address of the node, host:port or unix:<path> (env FS_ADMIN)")
+	asJSON := fset.Bool("json", false, "print machine readable JSON output")
+	if err := fset.Parse(args); err != nil || fset.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: fs node gc [flags]")
+		return exitUsage
+	}
+
+	c, base := adminClient(*addr)
+	// 限速的回收可能需要较长时间
+	c.Timeout = 0
+	resp, err := adminPost(c, base+"/gc")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fs:", err)
+		return exitError
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr apiError
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		fmt.Fprintln(os.Stderr, "fs:", apiErr.Error)
+		return exitError
+	}
+
+	var report store.GCReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		fmt.Fprintln(os.Stderr, "fs:", err)
+		return exitError
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+		return exitOK
+	}
+
+	printGCReport(report)
+	return exitOK
+}
+
+// runNodeRotateKey 让正在运行的节点轮换主密钥，或者停用轮换前的主密钥
+func runNodeRotateKey(args []string) int {
+	fset := flag.NewFlagSet("node rotate-key", flag.ContinueOnError)
+	addr := fset.String("admin", envOr("FS_ADMIN", defaultAdminAddr), "admin address of the node, host:port or unix:<path> (env FS_ADMIN)")
+	retire := fset.Bool("retire", false, "forget the previous master keys; data keys still wrapped by them become unreadable")
+	asJSON := fset.Bool("json", false, "print machine readable JSON output")
+	if err := fset.Parse(args); err != nil || fset.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: fs node rotate-key [flags]")
+		return exitUsage
+	}
+
+	path := "/rotate-key"
+	if *retire {
+		path += "?retire=true"
+	}
+	c, base := adminClient(*addr)
+	c.Timeout = 0
+	resp, err := adminPost(c, base+path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fs:", err)
+		return exitError
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr apiError
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		fmt.Fprintln(os.Stderr, "fs:", apiErr.Error)
+		return exitError
+	}
+
+	var res rotateResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		fmt.Fprintln(os.Stderr, "fs:", err)
+		return exitError
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(res)
+		return exitOK
+	}
+
+	if *retire {
+		fmt.Printf("retired %d previous master keys\n", res.Retired)
+		return exitOK
+	}
+	fmt.Printf("new master key: %s\n", res.KeyID)
+	fmt.Printf("rewrapped:      %d data keys\n", res.Rewrapped)
+	fmt.Printf("adopted:        %d objects without a data key\n", res.Adopted)
+	if res.Failed > 0 {
+		fmt.Printf("failed:         %d\n", res.Failed)
+		return exitError
+	}
+	return exitOK
+}
+
+// runNodeMigrateIDs 让正在运行的节点把旧对象的副本改用 HMAC 标识
+func runNodeMigrateIDs(args []string) int {
+	fset := flag.NewFlagSet("node migrate-ids", flag.ContinueOnError)
+	addr := fset.String("admin", envOr("FS_ADMIN", defaultAdminAddr), "admin address of the node, host:port or unix:<path> (env FS_ADMIN)")
+	asJSON := fset.Bool("json", false, "print machine readable JSON output")
+	if err := fset.Parse(args); err != nil || fset.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: fs node migrate-ids [flags]")
+		return exitUsage
+	}
+
+	c, base := adminClient(*addr)
+	c.Timeout = 0
+	resp, err := adminPost(c, base+"/migrate-ids")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fs:", err)
+		return exitError
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr apiError
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		fmt.Fprintln(os.Stderr, "fs:", apiErr.Error)
+		return exitError
+	}
+
+	var report server.MigrateReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		fmt.Fprintln(os.Stderr, "fs:", err)
+		return exitError
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+		return exitOK
+	}
+
+	fmt.Printf("migrated: %d objects\n", report.Migrated)
+	if report.Failed > 0 {
+		fmt.Printf("failed:   %d\n", report.Failed)
+		return exitError
+	}
+	return exitOK
+}
+
+// runNodeReload 让正在运行的节点重新加载 gate 规则，与向节点发送 SIGHUP 相同
+func runNodeReload(args []string) int {
+	fset := flag.NewFlagSet("node reload", flag.ContinueOnError)
+	addr := fset.String("admin", envOr("FS_ADMIN", defaultAdminAddr), "admin address of the node, host:port or unix:<path> (env FS_ADMIN)")
+	asJSON := fset.Bool("json", false, "print machine readable JSON output")
+	if err := fset.Parse(args); err != nil || fset.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: fs node reload [flags]")
+		return exitUsage
+	}
+
+	c, base := adminClient(*addr)
+	resp, err := adminPost(c, base+"/reload")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fs:", err)
+		return exitError
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr apiError
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		fmt.Fprintln(os.Stderr, "fs:", apiErr.Error)
+		return exitError
+	}
+
+	var res reloadResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		fmt.Fprintln(os.Stderr, "fs:", err)
+		return exitError
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(res)
+		return exitOK
+	}
+
+	fmt.Printf("allow:            %s\n", formatList(res.Gate.Allow))
+	fmt.Printf("deny:             %s\n", formatList(res.Gate.Deny))
+	fmt.Printf("allow identities: %d\n", len(res.Gate.AllowIdentities))
+	fmt.Printf("deny identities:  %d\n", len(res.Gate.DenyIdentities))
+	fmt.Printf("closed:           %d connections\n", res.Closed)
+	return exitOK
+}
+
+func formatList(items []string) string {
+	if len(items) == 0 {
+		return "-"
+	}
+	return strings.Join(items, ", ")
+}
+
+func printGCReport(r store.GCReport) {
+	fmt.Printf("scanned:      %d files and directories in %s\n", r.Scanned, r.Duration.Round(time.Millisecond))
+	fmt.Printf("incomplete:   %d\n", r.IncompleteFiles)
+	fmt.Printf("unreferenced: %d\n", r.UnreferencedFiles)
+	fmt.Printf("empty dirs:   %d\n", r.EmptyDirs)
+	fmt.Printf("reclaimed:    %d bytes\n", r.BytesReclaimed)
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"distributed_file_storage/crypto"
+	"distributed_file_storage/p2p"
+	"distributed_file_storage/server"
+	"distributed_file_storage/store"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminStatusOverUnixSocket(t *testing.T) {
+	s := server.NewFileServer(server.FileServerOpts{
+		EncKey:            crypto.NewEncryptionKey(),
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: store.CASPathTransformFunc,
+		Transport:         p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddr: ":3999"}),
+	})
+	assert.Nil(t, s.Store("foo", bytes.NewReader([]byte("12345"))))
+
+	addr := unixPrefix + filepath.Join(t.TempDir(), "admin.sock")
+	ln, err := listenAdmin(addr)
+	assert.Nil(t, err)
+	defer ln.Close()
+	go http.Serve(ln, newAdminHandler(s, "", "", nil))
+
+	c, base := adminClient(addr)
+	resp, err := c.Get(base + "/status")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	var status server.Status
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&status))
+	assert.Equal(t, s.ID, status.NodeID)
+	assert.Equal(t, ":3999", status.ListenAddr)
+	assert.Equal(t, server.ProtocolVersion, status.ProtocolVersion)
+	assert.Equal(t, store.Usage{Objects: 1, Bytes: 5}, status.Store)
+	assert.Empty(t, status.Peers)
+}
+
+func TestAdminToken(t *testing.T) {
+	s := server.NewFileServer(server.FileServerOpts{
+		EncKey:            crypto.NewEncryptionKey(),
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: store.CASPathTransformFunc,
+		Transport:         p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddr: ":3997"}),
+	})
+	h := newAdminHandler(s, "", "secret", nil)
+
+	post := func(auth string) int {
+		req := httptest.NewRequest(http.MethodPost, "/rotate-key", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusUnauthorized, post(""))
+	assert.Equal(t, http.StatusUnauthorized, post("Bearer wrong"))
+	// 令牌正确时才会执行，没有 key 文件所以无法轮换
+	assert.Equal(t, http.StatusConflict, post("Bearer secret"))
+
+	// 查询状态不需要令牌
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestAdminRotateKey(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "node.key")
+	keys, err := loadOrCreateKeyFile(keyFile)
+	assert.Nil(t, err)
+
+	s := server.NewFileServer(server.FileServerOpts{
+		ID:                keys.ID,
+		EncKey:            keys.EncKey,
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: store.CASPathTransformFunc,
+		Transport:         p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddr: ":3998"}),
+	})
+	assert.Nil(t, s.Store("foo", bytes.NewReader([]byte("12345"))))
+
+	// 没有 key 文件时无法保存新的主密钥
+	_, err = rotateKey(s, "", false)
+	assert.NotNil(t, err)
+
+	res, err := rotateKey(s, keyFile, false)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res.Rewrapped)
+
+	// 轮换完成后 key 文件和内存中的密钥一致，重启后两个主密钥都可用
+	rotated, err := loadOrCreateKeyFile(keyFile)
+	assert.Nil(t, err)
+	assert.Equal(t, keys.ID, rotated.ID)
+	assert.Equal(t, res.KeyID, crypto.KeyID(rotated.EncKey))
+	assert.Equal(t, [][]byte{keys.EncKey}, rotated.Previous)
+	assert.Equal(t, keys.NameKey, rotated.NameKey)
+
+	res, err = rotateKey(s, keyFile, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, res.Retired)
+	retired, err := loadOrCreateKeyFile(keyFile)
+	assert.Nil(t, err)
+	assert.Empty(t, retired.Previous)
+	assert.Equal(t, rotated.EncKey, retired.EncKey)
+}
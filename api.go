@@ -0,0 +1,322 @@
+package main
+
+import (
+	"distributed_file_storage/codec"
+	"distributed_file_storage/server"
+	"distributed_file_storage/store"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultAPIAddr   = "127.0.0.1:7000"
+	defaultAdminAddr = "127.0.0.1:7100"
+)
+
+// apiServer 节点对本地客户端(fs put/get/...)暴露的 HTTP 接口
+type apiServer struct {
+	s *server.FileServer
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type putResult struct {
+	Key       string     `json:"key"`
+	Size      int64      `json:"size"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Version   string     `json:"version,omitempty"`
+}
+
+type shareResult struct {
+	server.Share
+	Recipient string `json:"recipient"`
+	Token     string `json:"token"` // 交给接收方，fs get -shared <token>
+}
+
+type tokenResult struct {
+	Token       string `json:"token"`
+	Subject     string `json:"subject"`
+	Permissions string `json:"permissions"`
+}
+
+type peersResult struct {
+	Peers []string `json:"peers"`
+}
+
+// newAPIHandler token 不为空时所有请求都需要 Authorization: Bearer <token>
+func newAPIHandler(s *server.FileServer, token string) http.Handler {
+	a := &apiServer{s: s}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /objects", a.handleList)
+	mux.HandleFunc("PUT /objects/{key...}", a.handlePut)
+	mux.HandleFunc("GET /objects/{key...}", a.handleGet)
+	mux.HandleFunc("DELETE /objects/{key...}", a.handleDelete)
+	mux.HandleFunc("GET /stat/{key...}", a.handleStat)
+	mux.HandleFunc("GET /versions/{key...}", a.handleVersions)
+	mux.HandleFunc("POST /rollback/{key...}", a.handleRollback)
+	mux.HandleFunc("POST /share/{key...}", a.handleShare)
+	mux.HandleFunc("GET /shared/{share...}", a.handleGetShared)
+	mux.HandleFunc("POST /tokens", a.handleToken)
+	mux.HandleFunc("GET /peers", a.handlePeers)
+
+	return requireToken(token, mux.ServeHTTP)
+}
+
+func (a *apiServer) handlePut(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if key == "" {
+		writeAPIError(w, http.StatusBadRequest, errors.New("missing key"))
+		return
+	}
+
+	opts, err := putOpts(r.URL.Query())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := a.s.Put(key, r.Body, opts); err != nil {
+		writeAPIError(w, statusFor(err), err)
+		return
+	}
+
+	meta, err := a.s.Stat(key)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, putResult{Key: key, Size: meta.Size, ExpiresAt: meta.ExpiresAt, Version: meta.Version})
+}
+
+// putOpts 解析 PUT 的查询参数 ttl(如 24h)、expires_at(RFC 3339) 和 codec
+func putOpts(q url.Values) (server.PutOpts, error) {
+	var opts server.PutOpts
+
+	if v := q.Get("codec"); v != "" {
+		if _, err := codec.Parse(v); err != nil {
+			return opts, err
+		}
+		opts.Codec = v
+	}
+
+	if v := q.Get("ttl"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl <= 0 {
+			return opts, fmt.Errorf("invalid ttl %q", v)
+		}
+		opts.TTL = ttl
+	}
+	if v := q.Get("expires_at"); v != "" {
+		if opts.TTL > 0 {
+			return opts, errors.New("ttl and expires_at are mutually exclusive")
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid expires_at %q", v)
+		}
+		if !t.After(time.Now()) {
+			return opts, fmt.Errorf("expires_at %q is in the past", v)
+		}
+		opts.ExpiresAt = t
+	}
+
+	return opts, nil
+}
+
+func (a *apiServer) handleGet(w http.ResponseWriter, r *http.Request) {
+	rd, err := a.s.GetVersion(r.PathValue("key"), r.URL.Query().Get("version"))
+	if err != nil {
+		writeAPIError(w, statusFor(err), err)
+		return
+	}
+	defer rd.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	io.Copy(w, rd)
+}
+
+func (a *apiServer) handleDelete(w http.ResponseWriter, r *http.Request) {
+	var (
+		key     = r.PathValue("key")
+		version = r.URL.Query().Get("version")
+		err     error
+	)
+	if version == "" {
+		err = a.s.Delete(key)
+	} else {
+		err = a.s.DeleteVersion(key, version)
+	}
+	if err != nil {
+		writeAPIError(w, statusFor(err), err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *apiServer) handleVersions(w http.ResponseWriter, r *http.Request) {
+	versions, err := a.s.ListVersions(r.PathValue("key"))
+	if err != nil {
+		writeAPIError(w, statusFor(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, versions)
+}
+
+// handleRollback 把 ?version= 指定的版本恢复为最新版本
+func (a *apiServer) handleRollback(w http.ResponseWriter, r *http.Request) {
+	key, version := r.PathValue("key"), r.URL.Query().Get("version")
+	if version == "" {
+		writeAPIError(w, http.StatusBadRequest, errors.New("missing version"))
+		return
+	}
+
+	if err := a.s.Rollback(key, version); err != nil {
+		writeAPIError(w, statusFor(err), err)
+		return
+	}
+
+	meta, err := a.s.Stat(key)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, meta)
+}
+
+func (a *apiServer) handleStat(w http.ResponseWriter, r *http.Request) {
+	meta, err := a.s.Stat(r.PathValue("key"))
+	if err != nil {
+		writeAPIError(w, statusFor(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, meta)
+}
+
+func (a *apiServer) handleList(w http.ResponseWriter, r *http.Request) {
+	metas, err := a.s.List()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if metas == nil {
+		metas = []store.ObjectMeta{}
+	}
+
+	writeJSON(w, http.StatusOK, metas)
+}
+
+// handleShare 把文件共享给 ?recipient= 指定的公钥
+func (a *apiServer) handleShare(w http.ResponseWriter, r *http.Request) {
+	recipient := r.URL.Query().Get("recipient")
+	if recipient == "" {
+		writeAPIError(w, http.StatusBadRequest, errors.New("missing recipient"))
+		return
+	}
+
+	share, err := a.s.Share(r.PathValue("key"), recipient)
+	if err != nil {
+		writeAPIError(w, statusFor(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, shareResult{Share: share, Recipient: recipient, Token: share.String()})
+}
+
+func (a *apiServer) handleGetShared(w http.ResponseWriter, r *http.Request) {
+	share, err := server.ParseShare(r.PathValue("share"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	share.Token = r.URL.Query().Get("token")
+
+	rd, err := a.s.GetShared(share)
+	if err != nil {
+		writeAPIError(w, statusFor(err), err)
+		return
+	}
+	defer rd.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	io.Copy(w, rd)
+}
+
+// handleToken 签发授权令牌给 ?subject=，有 ?parent= 时委托签发给本节点的令牌
+func (a *apiServer) handleToken(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	opts := server.TokenOpts{Subject: q.Get("subject"), Key: q.Get("key")}
+	if v := q.Get("permissions"); v != "" {
+		perms, err := server.ParsePermissions(v)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		opts.Permissions = perms
+	}
+	if v := q.Get("ttl"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl <= 0 {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid ttl %q", v))
+			return
+		}
+		opts.TTL = ttl
+	}
+
+	var (
+		token string
+		err   error
+	)
+	if parent := q.Get("parent"); parent != "" {
+		token, err = a.s.DelegateToken(parent, opts)
+	} else {
+		token, err = a.s.IssueToken(opts)
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	chain, _ := server.ParseToken(token)
+	last := chain[len(chain)-1]
+	writeJSON(w, http.StatusOK, tokenResult{Token: token, Subject: last.Subject, Permissions: last.Perms.String()})
+}
+
+func (a *apiServer) handlePeers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, peersResult{Peers: a.s.Peers()})
+}
+
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, server.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, server.ErrObjectTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, server.ErrPermissionDenied):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiError{Error: err.Error()})
+}
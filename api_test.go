@@ -0,0 +1,86 @@
+package main
+
+import (
+	"distributed_file_storage/crypto"
+	"distributed_file_storage/p2p"
+	"distributed_file_storage/server"
+	"distributed_file_storage/store"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPI(t *testing.T) {
+	s := server.NewFileServer(server.FileServerOpts{
+		EncKey:            crypto.NewEncryptionKey(),
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: store.CASPathTransformFunc,
+		Transport:         p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddr: ":0"}),
+	})
+	ts := httptest.NewServer(newAPIHandler(s, ""))
+	defer ts.Close()
+
+	do := func(method, path, body string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		assert.Nil(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		return resp
+	}
+
+	resp := do(http.MethodPut, "/objects/dir/foo.txt", "some bytes")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = do(http.MethodGet, "/objects/dir/foo.txt", "")
+	b, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "some bytes", string(b))
+
+	resp = do(http.MethodGet, "/stat/dir/foo.txt", "")
+	var meta store.ObjectMeta
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&meta))
+	assert.Equal(t, "dir/foo.txt", meta.Key)
+	assert.Equal(t, int64(10), meta.Size)
+
+	resp = do(http.MethodGet, "/objects", "")
+	var metas []store.ObjectMeta
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&metas))
+	assert.Len(t, metas, 1)
+
+	resp = do(http.MethodDelete, "/objects/dir/foo.txt", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = do(http.MethodGet, "/objects/dir/foo.txt", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = do(http.MethodDelete, "/objects/dir/foo.txt", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestAPIToken(t *testing.T) {
+	s := server.NewFileServer(server.FileServerOpts{
+		EncKey:            crypto.NewEncryptionKey(),
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: store.CASPathTransformFunc,
+		Transport:         p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddr: ":0"}),
+	})
+	h := newAPIHandler(s, "secret")
+
+	do := func(method, path, auth string) int {
+		req := httptest.NewRequest(method, path, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	// 签发令牌和读取文件都需要 API 令牌
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodPost, "/tokens?subject="+s.ID, ""))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/objects", "Bearer wrong"))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/objects", "Bearer secret"))
+}
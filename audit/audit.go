@@ -0,0 +1,394 @@
+// Package audit 实现只追加的审计日志：每条记录包含上一条记录的哈希，修改、删除或插入记录都能被 Verify 发现
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrTampered 日志中的记录与哈希链不一致
+var ErrTampered = errors.New("audit log tampered")
+
+// genesis 第一条记录的 Prev
+var genesis = strings.Repeat("0", sha256.Size*2)
+
+const (
+	ResultOK     = "ok"
+	ResultDenied = "denied"
+	ResultError  = "error"
+)
+
+// Entry 一条审计记录，Seq、Prev 和 Hash 由 Log.Append 填写
+type Entry struct {
+	Seq     uint64    `json:"seq"`
+	Time    time.Time `json:"time"`
+	Op      string    `json:"op"`             // put | get | delete 或者远端请求的消息名，如 store_file
+	Actor   string    `json:"actor"`          // 发起操作的身份(签名公钥)，未知时为空
+	Peer    string    `json:"peer,omitempty"` // 远端请求的来源地址
+	Owner   string    `json:"owner"`
+	Key     string    `json:"key"`
+	Version string    `json:"version,omitempty"`
+	Size    int64     `json:"size,omitempty"`
+	Result  string    `json:"result"` // ok | denied | error
+	Error   string    `json:"error,omitempty"`
+	Prev    string    `json:"prev"`
+	Hash    string    `json:"hash,omitempty"`
+}
+
+// sum 计算记录的哈希，覆盖除 Hash 之外的所有字段
+func (e Entry) sum() (string, error) {
+	e.Hash = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:]), nil
+}
+
+// LogOpts 审计日志文件和轮换
+type LogOpts struct {
+	Path     string // 当前写入的文件，轮换后的文件是 <Path>.<第一条记录的 Seq>
+	MaxSize  int64  // 当前文件超过多少字节时轮换，0 表示不轮换
+	MaxFiles int    // 保留多少个轮换后的文件，0 表示全部保留。删除旧文件后只能从剩下的第一条记录开始校验
+}
+
+// Log 只追加的审计日志，可以并发写入
+type Log struct {
+	LogOpts
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	seq  uint64 // 最后一条记录的 Seq
+	head string // 最后一条记录的 Hash
+}
+
+// NewLog 打开或创建审计日志，从最后一条记录继续哈希链。进程崩溃留下的不完整的最后一行会被截掉
+func NewLog(opts LogOpts) (*Log, error) {
+	l := &Log{LogOpts: opts, head: genesis}
+
+	if err := l.recover(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(opts.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.f, l.size = f, info.Size()
+	return l, nil
+}
+
+// recover 读取最后一条记录。当前文件为空时使用最新的轮换文件
+func (l *Log) recover() error {
+	files, err := segments(l.Path)
+	if err != nil {
+		return err
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		last, err := lastEntry(files[i], i == len(files)-1)
+		if err != nil {
+			return err
+		}
+		if last != nil {
+			l.seq, l.head = last.Seq, last.Hash
+			return nil
+		}
+	}
+	return nil
+}
+
+// lastEntry 返回文件中的最后一条记录，文件为空时返回 nil。repair 时截掉不完整的最后一行
+func lastEntry(path string, repair bool) (*Entry, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if end := bytes.LastIndexByte(b, '\n') + 1; end < len(b) {
+		if !repair {
+			return nil, fmt.Errorf("%s: incomplete last line: %w", path, ErrTampered)
+		}
+		if err := os.Truncate(path, int64(end)); err != nil {
+			return nil, err
+		}
+		b = b[:end]
+	}
+	b = bytes.TrimSuffix(b, []byte("\n"))
+	if len(b) == 0 {
+		return nil, nil
+	}
+
+	var e Entry
+	if err := json.Unmarshal(b[bytes.LastIndexByte(b, '\n')+1:], &e); err != nil {
+		return nil, fmt.Errorf("%s: last line: %v: %w", path, err, ErrTampered)
+	}
+	return &e, nil
+}
+
+// Append 写入一条记录，填写 Seq、Prev 和 Hash，Time 为空时使用当前时间
+func (l *Log) Append(e Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return os.ErrClosed
+	}
+	if l.MaxSize > 0 && l.size >= l.MaxSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("rotate audit log: %w", err)
+		}
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+	e.Seq, e.Prev = l.seq+1, l.head
+	hash, err := e.sum()
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	n, err := l.f.Write(append(b, '\n'))
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	l.seq, l.head = e.Seq, e.Hash
+	return nil
+}
+
+// rotate 把当前文件重命名为 <Path>.<Seq>，删除超过 MaxFiles 的旧文件
+func (l *Log) rotate() error {
+	if l.size == 0 {
+		return nil
+	}
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	l.f = nil
+
+	first, err := firstEntry(l.Path)
+	if err == nil {
+		err = os.Rename(l.Path, fmt.Sprintf("%s.%d", l.Path, first.Seq))
+	}
+
+	// 重命名失败时继续写入原来的文件
+	f, openErr := os.OpenFile(l.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if openErr != nil {
+		return openErr
+	}
+	info, statErr := f.Stat()
+	if statErr != nil {
+		f.Close()
+		return statErr
+	}
+	l.f, l.size = f, info.Size()
+	if err != nil {
+		return err
+	}
+
+	if l.MaxFiles <= 0 {
+		return nil
+	}
+	files, err := segments(l.Path)
+	if err != nil {
+		return err
+	}
+	rotated := files[:len(files)-1]
+	for len(rotated) > l.MaxFiles {
+		if err := os.Remove(rotated[0]); err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+func firstEntry(path string) (Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Entry{}, err
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return Entry{}, err
+	}
+	var e Entry
+	err = json.Unmarshal(line, &e)
+	return e, err
+}
+
+// Head 返回最后一条记录的 Seq 和 Hash。把它保存在别处，之后可以确认日志没有被截短
+func (l *Log) Head() (uint64, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.seq, l.head
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// segments 按顺序返回轮换后的文件和当前文件(不存在时不包括)
+func segments(path string) ([]string, error) {
+	matches, err := filepath.Glob(globEscape(path) + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	type segment struct {
+		path string
+		seq  uint64
+	}
+	var rotated []segment
+	for _, m := range matches {
+		seq, err := strconv.ParseUint(strings.TrimPrefix(m, path+"."), 10, 64)
+		if err != nil {
+			continue
+		}
+		rotated = append(rotated, segment{m, seq})
+	}
+	sort.Slice(rotated, func(i, j int) bool { return rotated[i].seq < rotated[j].seq })
+
+	files := make([]string, 0, len(rotated)+1)
+	for _, s := range rotated {
+		files = append(files, s.path)
+	}
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	}
+	return files, nil
+}
+
+func globEscape(path string) string {
+	r := strings.NewReplacer(`*`, `\*`, `?`, `\?`, `[`, `\[`, `\`, `\\`)
+	return r.Replace(path)
+}
+
+// Report Verify 的结果
+type Report struct {
+	Files   []string `json:"files"`
+	Entries int      `json:"entries"`
+	First   uint64   `json:"first"` // 第一条记录的 Seq，大于 1 表示更早的文件已经被删除
+	Last    uint64   `json:"last"`
+	Head    string   `json:"head"` // 最后一条记录的 Hash
+}
+
+// Verify 按顺序校验 path 及其轮换文件中的每一条记录，发现不一致时返回包装了 ErrTampered 的错误
+func Verify(path string) (Report, error) {
+	files, err := segments(path)
+	if err != nil {
+		return Report{}, err
+	}
+	if len(files) == 0 {
+		return Report{}, fmt.Errorf("%s: %w", path, os.ErrNotExist)
+	}
+
+	report := Report{Files: files}
+	prev := ""
+	for _, file := range files {
+		if err := verifyFile(file, &report, &prev); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+func verifyFile(path string, report *Report, prev *string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for lineNo := 1; ; lineNo++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err == io.EOF {
+			return fmt.Errorf("%s:%d: incomplete line: %w", path, lineNo, ErrTampered)
+		}
+		if err != nil {
+			return err
+		}
+
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return fmt.Errorf("%s:%d: %v: %w", path, lineNo, err, ErrTampered)
+		}
+		if err := check(e, report, *prev); err != nil {
+			return fmt.Errorf("%s:%d: entry %d: %w", path, lineNo, e.Seq, err)
+		}
+		*prev = e.Hash
+	}
+}
+
+// check 校验一条记录的哈希以及它与上一条记录的链接，prev 为空表示这是剩下的第一条记录
+func check(e Entry, report *Report, prev string) error {
+	sum, err := e.sum()
+	if err != nil {
+		return err
+	}
+	if sum != e.Hash {
+		return fmt.Errorf("hash mismatch: %w", ErrTampered)
+	}
+
+	if prev == "" {
+		if e.Seq == 1 && e.Prev != genesis {
+			return fmt.Errorf("first entry does not start the chain: %w", ErrTampered)
+		}
+		report.First = e.Seq
+	} else {
+		if e.Prev != prev {
+			return fmt.Errorf("previous hash mismatch: %w", ErrTampered)
+		}
+		if e.Seq != report.Last+1 {
+			return fmt.Errorf("expected entry %d: %w", report.Last+1, ErrTampered)
+		}
+	}
+
+	report.Entries++
+	report.Last, report.Head = e.Seq, e.Hash
+	return nil
+}
@@ -0,0 +1,86 @@
+package audit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := NewLog(LogOpts{Path: path})
+	assert.Nil(t, err)
+	for _, op := range []string{"put", "get", "delete"} {
+		assert.Nil(t, l.Append(Entry{Op: op, Owner: "node", Key: "photo.jpg", Result: ResultOK}))
+	}
+	assert.Nil(t, l.Close())
+
+	report, err := Verify(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, report.Entries)
+	assert.Equal(t, uint64(1), report.First)
+	seq, head := l.Head()
+	assert.Equal(t, uint64(3), seq)
+	assert.Equal(t, head, report.Head)
+
+	// 重新打开后继续哈希链，不完整的最后一行被截掉
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	f.WriteString(`{"seq":4,"op":"pu`)
+	f.Close()
+	l, err = NewLog(LogOpts{Path: path})
+	assert.Nil(t, err)
+	assert.Nil(t, l.Append(Entry{Op: "put", Key: "notes.txt", Result: ResultDenied}))
+	l.Close()
+	report, err = Verify(path)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), report.Last)
+
+	// 修改一条记录
+	b, _ := os.ReadFile(path)
+	os.WriteFile(path, bytes.Replace(b, []byte("photo.jpg"), []byte("other.jpg"), 1), 0o600)
+	_, err = Verify(path)
+	assert.ErrorIs(t, err, ErrTampered)
+
+	// 删除一条记录(包括它的哈希)
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	os.WriteFile(path, bytes.Join(append(lines[:1:1], lines[2:]...), nil), 0o600)
+	_, err = Verify(path)
+	assert.ErrorIs(t, err, ErrTampered)
+}
+
+func TestLogRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := NewLog(LogOpts{Path: path, MaxSize: 1, MaxFiles: 2})
+	assert.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, l.Append(Entry{Op: "get", Key: "k", Result: ResultOK}))
+	}
+	l.Close()
+
+	// 每条记录一个文件，只保留最新的两个轮换文件
+	files, err := segments(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{path + ".3", path + ".4", path}, files)
+
+	report, err := Verify(path)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), report.First)
+	assert.Equal(t, uint64(5), report.Last)
+
+	// 重新打开时从最新的记录继续
+	l, err = NewLog(LogOpts{Path: path, MaxSize: 1, MaxFiles: 2})
+	assert.Nil(t, err)
+	assert.Nil(t, l.Append(Entry{Op: "get", Key: "k", Result: ResultOK}))
+	l.Close()
+	report, err = Verify(path)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(6), report.Last)
+
+	// 删除中间的轮换文件会断开哈希链
+	os.Remove(path + ".5")
+	_, err = Verify(path)
+	assert.ErrorIs(t, err, ErrTampered)
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"distributed_file_storage/store"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// errNotFound 节点返回 404 时的错误，对应 exitNotFound
+var errNotFound = errors.New("not found")
+
+// client 通过节点的 HTTP 接口访问正在运行的节点
+type client struct {
+	base  string
+	token string // FS_API_TOKEN，节点设置了 api_token 时需要
+	http  *http.Client
+}
+
+// clientFlags 所有客户端命令共用的参数
+type clientFlags struct {
+	fset *flag.FlagSet
+	node *string
+	json *bool
+}
+
+func newClientFlags(name string) *clientFlags {
+	fset := flag.NewFlagSet(name, flag.ContinueOnError)
+	node := os.Getenv("FS_NODE")
+	if node == "" {
+		node = defaultAPIAddr
+	}
+
+	return &clientFlags{
+		fset: fset,
+		node: fset.String("node", node, "client API address of the node (env FS_NODE)"),
+		json: fset.Bool("json", false, "print machine readable JSON output"),
+	}
+}
+
+func (f *clientFlags) client() *client {
+	base := *f.node
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	return &client{
+		base:  strings.TrimRight(base, "/"),
+		token: os.Getenv("FS_API_TOKEN"),
+		http:  &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+func (c *client) do(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var apiErr apiError
+	json.NewDecoder(resp.Body).Decode(&apiErr)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", errNotFound, apiErr.Error)
+	}
+	if apiErr.Error == "" {
+		apiErr.Error = resp.Status
+	}
+	return nil, errors.New(apiErr.Error)
+}
+
+func (c *client) doJSON(method, path string, body io.Reader, v any) error {
+	resp, err := c.do(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func objectPath(prefix, key string) string {
+	return prefix + (&url.URL{Path: key}).EscapedPath()
+}
+
+func runPut(args []string) int {
+	f := newClientFlags("put")
+	ttl := f.fset.Duration("ttl", 0, "delete the file after this long, e.g. 24h")
+	expires := f.fset.String("expires", "", "delete the file at this time (RFC 3339)")
+	compress := f.fset.String("compress", "", "compress with none, gzip, zstd or auto (default: the node's compression setting)")
+	if err := f.fset.Parse(args); err != nil || f.fset.NArg() < 1 || f.fset.NArg() > 2 {
+		fmt.Fprintln(os.Stderr, "usage: fs put [flags] <key> [file]")
+		return exitUsage
+	}
+	key := f.fset.Arg(0)
+
+	var body io.Reader = os.Stdin
+	if f.fset.NArg() == 2 {
+		file, err := os.Open(f.fset.Arg(1))
+		if err != nil {
+			return fail(f, err)
+		}
+		defer file.Close()
+		body = file
+	}
+
+	q := url.Values{}
+	if *ttl != 0 {
+		q.Set("ttl", ttl.String())
+	}
+	if *expires != "" {
+		q.Set("expires_at", *expires)
+	}
+	if *compress != "" {
+		q.Set("codec", *compress)
+	}
+	path := objectPath("/objects/", key)
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+
+	var res putResult
+	if err := f.client().doJSON(http.MethodPut, path, body, &res); err != nil {
+		return fail(f, err)
+	}
+
+	return output(f, res, func() {
+		fmt.Printf("stored %s (%d bytes)\n", res.Key, res.Size)
+		if res.ExpiresAt != nil {
+			fmt.Printf("expires %s\n", res.ExpiresAt.Local().Format(time.RFC3339))
+		}
+	})
+}
+
+func runGet(args []string) int {
+	f := newClientFlags("get")
+	out := f.fset.String("o", "", "write the file here instead of stdout")
+	version := f.fset.String("version", "", "fetch this version instead of the latest")
+	shared := f.fset.Bool("shared", false, "the argument is a token from fs share of another owner")
+	token := f.fset.String("token", "", "authorization token from fs token, for nodes that require authorization (with -shared)")
+	if err := f.fset.Parse(args); err != nil || f.fset.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: fs get [flags] <key>")
+		return exitUsage
+	}
+	key := f.fset.Arg(0)
+
+	path := withVersion(objectPath("/objects/", key), *version)
+	if *shared {
+		path = objectPath("/shared/", key)
+		if *token != "" {
+			path += "?" + url.Values{"token": {*token}}.Encode()
+		}
+	}
+	resp, err := f.client().do(http.MethodGet, path, nil)
+	if err != nil {
+		return fail(f, err)
+	}
+	defer resp.Body.Close()
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return fail(f, err)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		return fail(f, err)
+	}
+	if *out == "" {
+		return exitOK
+	}
+
+	return output(f, putResult{Key: key, Size: n}, func() {
+		fmt.Printf("fetched %s (%d bytes) to %s\n", key, n, *out)
+	})
+}
+
+func runRm(args []string) int {
+	f := newClientFlags("rm")
+	version := f.fset.String("version", "", "delete only this version")
+	if err := f.fset.Parse(args); err != nil || f.fset.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: fs rm [flags] <key>")
+		return exitUsage
+	}
+	key := f.fset.Arg(0)
+
+	if err := f.client().doJSON(http.MethodDelete, withVersion(objectPath("/objects/", key), *version), nil, nil); err != nil {
+		return fail(f, err)
+	}
+
+	if *version != "" {
+		return output(f, map[string]string{"deleted": key, "version": *version}, func() {
+			fmt.Printf("deleted %s version %s\n", key, *version)
+		})
+	}
+	return output(f, map[string]string{"deleted": key}, func() {
+		fmt.Printf("deleted %s\n", key)
+	})
+}
+
+func runVersions(args []string) int {
+	f := newClientFlags("versions")
+	if err := f.fset.Parse(args); err != nil || f.fset.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: fs versions [flags] <key>")
+		return exitUsage
+	}
+
+	var versions []store.ObjectMeta
+	if err := f.client().doJSON(http.MethodGet, objectPath("/versions/", f.fset.Arg(0)), nil, &versions); err != nil {
+		return fail(f, err)
+	}
+
+	return output(f, versions, func() {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for i, meta := range versions {
+			latest := ""
+			if i == 0 {
+				latest = "latest"
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", meta.Version, meta.Size, meta.ModTime.Local().Format(time.DateTime), latest)
+		}
+		tw.Flush()
+	})
+}
+
+func runRollback(args []string) int {
+	f := newClientFlags("rollback")
+	if err := f.fset.Parse(args); err != nil || f.fset.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "usage: fs rollback [flags] <key> <version>")
+		return exitUsage
+	}
+	key, version := f.fset.Arg(0), f.fset.Arg(1)
+
+	var meta store.ObjectMeta
+	if err := f.client().doJSON(http.MethodPost, withVersion(objectPath("/rollback/", key), version), nil, &meta); err != nil {
+		return fail(f, err)
+	}
+
+	return output(f, meta, func() {
+		fmt.Printf("restored %s from %s as version %s\n", key, version, meta.Version)
+	})
+}
+
+// withVersion 在请求路径后加上 ?version=，version 为空时不变
+func withVersion(path, version string) string {
+	if version == "" {
+		return path
+	}
+	return path + "?" + url.Values{"version": {version}}.Encode()
+}
+
+func runLs(args []string) int {
+	f := newClientFlags("ls")
+	if err := f.fset.Parse(args); err != nil || f.fset.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: fs ls [flags]")
+		return exitUsage
+	}
+
+	var metas []store.ObjectMeta
+	if err := f.client().doJSON(http.MethodGet, "/objects", nil, &metas); err != nil {
+		return fail(f, err)
+	}
+
+	return output(f, metas, func() {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, meta := range metas {
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", meta.Size, meta.ModTime.Local().Format(time.DateTime), meta.Key)
+		}
+		tw.Flush()
+	})
+}
+
+func runStat(args []string) int {
+	f := newClientFlags("stat")
+	if err := f.fset.Parse(args); err != nil || f.fset.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: fs stat [flags] <key>")
+		return exitUsage
+	}
+
+	var meta store.ObjectMeta
+	if err := f.client().doJSON(http.MethodGet, objectPath("/stat/", f.fset.Arg(0)), nil, &meta); err != nil {
+		return fail(f, err)
+	}
+
+	return output(f, meta, func() {
+		fmt.Printf("key:      %s\nsize:     %d\nmodified: %s\n", meta.Key, meta.Size, meta.ModTime.Local().Format(time.RFC3339))
+		if meta.Version != "" {
+			fmt.Printf("version:  %s\n", meta.Version)
+		}
+		if meta.Codec != "" {
+			fmt.Printf("codec:    %s (%d bytes on disk)\n", meta.Codec, meta.DiskSize())
+		}
+		if meta.Encrypted {
+			fmt.Printf("encrypted: yes\n")
+		}
+		if len(meta.Shares) > 0 {
+			fmt.Printf("shared:   %d recipients\n", len(meta.Shares))
+		}
+		if meta.ExpiresAt != nil {
+			fmt.Printf("expires:  %s\n", meta.ExpiresAt.Local().Format(time.RFC3339))
+		}
+	})
+}
+
+func runShare(args []string) int {
+	f := newClientFlags("share")
+	if err := f.fset.Parse(args); err != nil || f.fset.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "usage: fs share [flags] <key> <recipient share key>")
+		return exitUsage
+	}
+	key, recipient := f.fset.Arg(0), f.fset.Arg(1)
+
+	path := objectPath("/share/", key) + "?" + url.Values{"recipient": {recipient}}.Encode()
+	var res shareResult
+	if err := f.client().doJSON(http.MethodPost, path, nil, &res); err != nil {
+		return fail(f, err)
+	}
+
+	return output(f, res, func() {
+		fmt.Printf("shared %s, the recipient can fetch it with:\n  fs get -shared %s\n", key, res.Token)
+	})
+}
+
+func runToken(args []string) int {
+	f := newClientFlags("token")
+	perms := f.fset.String("perm", "read", "permissions to grant: read, write, delete (comma separated) or all")
+	ttl := f.fset.Duration("ttl", 0, "how long the token is valid (default 24h, or the remaining time of -delegate)")
+	key := f.fset.String("key", "", "grant access to this file only instead of the whole namespace")
+	parent := f.fset.String("delegate", "", "delegate this token, issued to the node, instead of issuing a new one")
+	if err := f.fset.Parse(args); err != nil || f.fset.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: fs token [flags] <subject identity>")
+		return exitUsage
+	}
+
+	q := url.Values{"subject": {f.fset.Arg(0)}}
+	if *parent != "" {
+		q.Set("parent", *parent)
+		// 委托时没有指定的权限与上一环相同
+		f.fset.Visit(func(fl *flag.Flag) {
+			if fl.Name == "perm" {
+				q.Set("permissions", *perms)
+			}
+		})
+	} else {
+		q.Set("permissions", *perms)
+	}
+	if *ttl != 0 {
+		q.Set("ttl", ttl.String())
+	}
+	if *key != "" {
+		q.Set("key", *key)
+	}
+
+	var res tokenResult
+	if err := f.client().doJSON(http.MethodPost, "/tokens?"+q.Encode(), nil, &res); err != nil {
+		return fail(f, err)
+	}
+
+	return output(f, res, func() {
+		fmt.Println(res.Token)
+	})
+}
+
+func runPeers(args []string) int {
+	f := newClientFlags("peers")
+	if err := f.fset.Parse(args); err != nil || f.fset.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: fs peers [flags]")
+		return exitUsage
+	}
+
+	var res peersResult
+	if err := f.client().doJSON(http.MethodGet, "/peers", nil, &res); err != nil {
+		return fail(f, err)
+	}
+
+	return output(f, res, func() {
+		for _, addr := range res.Peers {
+			fmt.Println(addr)
+		}
+	})
+}
+
+// output 根据 -json 决定输出 JSON 还是给人看的文本
+func output(f *clientFlags, v any, text func()) int {
+	if *f.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(v)
+	} else {
+		text()
+	}
+	return exitOK
+}
+
+// fail 打印错误并返回对应的退出码
+func fail(f *clientFlags, err error) int {
+	if *f.json {
+		json.NewEncoder(os.Stderr).Encode(apiError{Error: err.Error()})
+	} else {
+		fmt.Fprintln(os.Stderr, "fs:", err)
+	}
+
+	if errors.Is(err, errNotFound) {
+		return exitNotFound
+	}
+	return exitError
+}
@@ -0,0 +1,125 @@
+// Package codec 提供存储前的压缩(gzip、zstd)以及按内容采样自动选择压缩算法
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// 保存在对象元数据中的压缩算法名称，None 表示没有压缩
+const (
+	None = ""
+	Gzip = "gzip"
+	Zstd = "zstd"
+
+	// Auto 不是真正的算法，由 Detect 根据数据的前 SampleSize 字节选择
+	Auto = "auto"
+)
+
+// SampleSize Detect 需要的采样大小
+const SampleSize = 64 * 1024
+
+// minSampleSize 比这更小的数据不值得压缩
+const minSampleSize = 512
+
+// Parse 校验配置或请求中的算法名称，"none" 等同于 None
+func Parse(name string) (string, error) {
+	switch name {
+	case "", "none":
+		return None, nil
+	case Gzip, Zstd, Auto:
+		return name, nil
+	}
+	return "", fmt.Errorf("unknown codec %q (want none, gzip, zstd or auto)", name)
+}
+
+// NewWriter 返回把压缩数据写入 w 的 WriteCloser，Close 不会关闭 w
+func NewWriter(codec string, w io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case None:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unknown codec %q", codec)
+}
+
+// NewReader 返回解压 r 的 ReadCloser，Close 同时关闭 r
+func NewReader(codec string, r io.ReadCloser) (io.ReadCloser, error) {
+	switch codec {
+	case None:
+		return r, nil
+	case Gzip:
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		return readCloser{zr, func() error { zr.Close(); return r.Close() }}, nil
+	case Zstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		return readCloser{zr, func() error { zr.Close(); return r.Close() }}, nil
+	}
+	r.Close()
+	return nil, fmt.Errorf("unknown codec %q", codec)
+}
+
+// 已经压缩过的常见格式，再压缩一次只会浪费 CPU
+var compressedMagic = [][]byte{
+	{0x1f, 0x8b},                         // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},             // zstd
+	{0x50, 0x4b, 0x03, 0x04},             // zip, docx, jar
+	{0x89, 0x50, 0x4e, 0x47},             // png
+	{0xff, 0xd8, 0xff},                   // jpeg
+	{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}, // xz
+	{0x42, 0x5a, 0x68},                   // bzip2
+	{0x37, 0x7a, 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+}
+
+// sampleEncoder 只用于 EncodeAll，可以并发使用
+var sampleEncoder = sync.OnceValue(func() *zstd.Encoder {
+	enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	return enc
+})
+
+// Detect 压缩一段采样，能节省 10% 以上时选择 zstd，否则不压缩
+func Detect(sample []byte) string {
+	if len(sample) < minSampleSize {
+		return None
+	}
+	for _, magic := range compressedMagic {
+		if bytes.HasPrefix(sample, magic) {
+			return None
+		}
+	}
+
+	out := sampleEncoder().EncodeAll(sample, make([]byte, 0, len(sample)))
+	if len(out) < len(sample)*9/10 {
+		return Zstd
+	}
+	return None
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r readCloser) Close() error { return r.close() }
@@ -0,0 +1,69 @@
+package codec
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	data := []byte(strings.Repeat(`{"level":"info","msg":"request served"}`+"\n", 1000))
+
+	for _, codec := range []string{None, Gzip, Zstd} {
+		var buf bytes.Buffer
+		w, err := NewWriter(codec, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if codec != None && buf.Len() >= len(data)/10 {
+			t.Errorf("%s: %d bytes compressed to %d", codec, len(data), buf.Len())
+		}
+
+		r, err := NewReader(codec, io.NopCloser(&buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(b, data) {
+			t.Errorf("%s: round trip failed: %v", codec, err)
+		}
+	}
+}
+
+func TestDetect(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.Read(random)
+
+	tests := []struct {
+		name   string
+		sample []byte
+		want   string
+	}{
+		{"logs", []byte(strings.Repeat("GET /objects/a 200 12ms\n", 200)), Zstd},
+		{"random", random, None},
+		{"gzip", append([]byte{0x1f, 0x8b}, bytes.Repeat([]byte{0}, 4096)...), None},
+		{"small", []byte("tiny"), None},
+	}
+
+	for _, tt := range tests {
+		if have := Detect(tt.sample); have != tt.want {
+			t.Errorf("%s: have %q, want %q", tt.name, have, tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	if c, err := Parse("none"); err != nil || c != None {
+		t.Errorf("none: have %q, %v", c, err)
+	}
+	if _, err := Parse("brotli"); err == nil {
+		t.Errorf("expected an error for an unknown codec")
+	}
+}
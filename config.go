@@ -0,0 +1,712 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"distributed_file_storage/codec"
+	"distributed_file_storage/crypto"
+	"distributed_file_storage/p2p"
+	"distributed_file_storage/server"
+	"distributed_file_storage/store"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config 节点配置，可以来自配置文件、环境变量和命令行参数(优先级依次升高)
+type Config struct {
+	NodeID        string            `yaml:"node_id,omitempty"`
+	Listen        string            `yaml:"listen"`
+	API           string            `yaml:"api"`
+	APIToken      string            `yaml:"api_token"`   // 客户端接口需要的 Bearer 令牌，监听非回环地址时必须设置
+	Admin         string            `yaml:"admin"`       // host:port 或 unix:<path>，为空时不开启
+	AdminToken    string            `yaml:"admin_token"` // admin 运维操作需要的 Bearer 令牌，监听非回环地址时必须设置
+	StorageRoot   string            `yaml:"storage_root"`
+	PathTransform string            `yaml:"path_transform"`
+	Bootstrap     []string          `yaml:"bootstrap"`
+	Replication   ReplicationConfig `yaml:"replication"`
+	Erasure       ErasureConfig     `yaml:"erasure"`
+	Versioning    bool              `yaml:"versioning"`      // 为本节点的文件保留历史版本
+	Compression   string            `yaml:"compression"`     // none | gzip | zstd | auto
+	EncryptAtRest bool              `yaml:"encrypt_at_rest"` // 本节点的文件在本地磁盘上也加密保存
+	Padding       string            `yaml:"padding"`         // none | padme | buckets
+	Key           KeyConfig         `yaml:"key"`
+	Limits        LimitsConfig      `yaml:"limits"`
+	Quota         QuotaConfig       `yaml:"quota"`
+	Auth          AuthConfig        `yaml:"auth"`
+	Reputation    ReputationConfig  `yaml:"reputation"`
+	Gate          GateConfig        `yaml:"gate"`
+	Audit         AuditConfig       `yaml:"audit"`
+	GC            GCConfig          `yaml:"gc"`
+	Expiry        ExpiryConfig      `yaml:"expiry"`
+	Metrics       MetricsConfig     `yaml:"metrics"`
+	Log           LogConfig         `yaml:"log"`
+	Tracing       TracingConfig     `yaml:"tracing"`
+}
+
+type ReplicationConfig struct {
+	Factor int `yaml:"factor"` // 0 表示复制到所有已连接节点
+}
+
+// ErasureConfig 纠删码存储模式，data_shards 和 parity_shards 都大于 0 时代替完整副本
+type ErasureConfig struct {
+	DataShards     int           `yaml:"data_shards"`
+	ParityShards   int           `yaml:"parity_shards"`
+	RepairInterval time.Duration `yaml:"repair_interval"` // 多久检查一次丢失的分片，0 表示不检查
+}
+
+// KeyConfig 加密密钥的来源
+type KeyConfig struct {
+	Source string `yaml:"source"`         // file | env | ephemeral(重启后无法解密之前保存的文件，只用于测试)
+	File   string `yaml:"file,omitempty"` // 为空时是 <storage_root>.key，不存在时生成
+	Env    string `yaml:"env,omitempty"`  // 存放十六进制密钥的环境变量名
+}
+
+// LimitsConfig 防止其他节点占用过多资源，0 表示不限制
+type LimitsConfig struct {
+	MaxMessageSize      int64         `yaml:"max_message_size"` // 0 表示 1 MiB
+	MaxObjectSize       int64         `yaml:"max_object_size"`
+	MaxPeers            int           `yaml:"max_peers"`
+	MaxConnections      int           `yaml:"max_connections"`        // 同时打开的连接数
+	MaxConnectionsPerIP int           `yaml:"max_connections_per_ip"` // 来自同一个 IP 的入站连接数
+	HandshakeTimeout    time.Duration `yaml:"handshake_timeout"`
+	IdleTimeout         time.Duration `yaml:"idle_timeout"`    // 没有心跳，空闲的连接也会被断开
+	MinStreamRate       int64         `yaml:"min_stream_rate"` // 数据流的最低速率(字节/秒)，0 表示 64 KiB/s
+}
+
+// QuotaConfig 其他节点写入本节点的上限，单位字节，0 表示不限制
+type QuotaConfig struct {
+	Capacity     int64            `yaml:"capacity"`
+	DefaultOwner int64            `yaml:"default_owner"`
+	Owners       map[string]int64 `yaml:"owners,omitempty"` // owner id -> 配额
+}
+
+// AuthConfig 其他节点请求的授权规则
+type AuthConfig struct {
+	Required      bool            `yaml:"required"`       // 拒绝没有签名或没有权限的请求
+	SignedObjects bool            `yaml:"signed_objects"` // 拒绝没有上传者签名的副本
+	ACL           []ACLRuleConfig `yaml:"acl,omitempty"`
+}
+
+// ACLRuleConfig 允许 principal 对 owner 的命名空间(或其中一个对象)进行的操作
+type ACLRuleConfig struct {
+	Principal   string `yaml:"principal"`        // 请求方的身份(签名公钥)，* 表示任何节点
+	Owner       string `yaml:"owner"`            // owner id，* 表示所有 owner
+	Object      string `yaml:"object,omitempty"` // 对象标识，为空表示整个命名空间
+	Permissions string `yaml:"permissions"`      // read,write,delete 或 all
+}
+
+// authOpts 转换成 server.AuthOpts，调用前已经校验过
+func (a AuthConfig) authOpts() server.AuthOpts {
+	opts := server.AuthOpts{Required: a.Required, SignedObjects: a.SignedObjects}
+	for _, rule := range a.ACL {
+		perms, _ := server.ParsePermissions(rule.Permissions)
+		opts.ACL = append(opts.ACL, server.ACLRule{
+			Principal:   rule.Principal,
+			Owner:       rule.Owner,
+			Object:      rule.Object,
+			Permissions: perms,
+		})
+	}
+	return opts
+}
+
+// ReputationConfig 不当行为的扣分和封禁
+type ReputationConfig struct {
+	BanScore    float64       `yaml:"ban_score"`          // 分数低于它时封禁
+	BanDuration time.Duration `yaml:"ban_duration"`       // 封禁多久
+	HalfLife    time.Duration `yaml:"half_life"`          // 分数衰减一半的时间
+	BanFile     string        `yaml:"ban_file,omitempty"` // 为空时是 <storage_root>.bans.json
+	BanIP       bool          `yaml:"ban_ip"`             // 封禁身份时同时封禁它的 IP
+}
+
+// GateConfig 按地址和身份过滤连接，拒绝列表优先，允许列表为空表示不限制。
+// 修改后可以用 fs node reload 或 SIGHUP 重新加载
+type GateConfig struct {
+	Allow           []string `yaml:"allow,omitempty" json:"allow,omitempty"` // CIDR 或 IP，握手之前检查入站连接
+	Deny            []string `yaml:"deny,omitempty" json:"deny,omitempty"`
+	AllowIdentities []string `yaml:"allow_identities,omitempty" json:"allow_identities,omitempty"` // 节点的签名公钥，握手之后检查
+	DenyIdentities  []string `yaml:"deny_identities,omitempty" json:"deny_identities,omitempty"`
+}
+
+// rules 转换成 p2p.GateRules
+func (g GateConfig) rules() (p2p.GateRules, error) {
+	allow, err := p2p.ParseCIDRs(g.Allow)
+	if err != nil {
+		return p2p.GateRules{}, fieldError("gate.allow", err.Error())
+	}
+	deny, err := p2p.ParseCIDRs(g.Deny)
+	if err != nil {
+		return p2p.GateRules{}, fieldError("gate.deny", err.Error())
+	}
+	rules := p2p.GateRules{AllowCIDRs: allow, DenyCIDRs: deny}
+	for _, id := range g.AllowIdentities {
+		rules.AllowIdentities = append(rules.AllowIdentities, strings.ToLower(id))
+	}
+	for _, id := range g.DenyIdentities {
+		rules.DenyIdentities = append(rules.DenyIdentities, strings.ToLower(id))
+	}
+	return rules, nil
+}
+
+// AuditConfig 记录存储操作和远端请求的审计日志，可以用 fs node verify-audit 校验
+type AuditConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	File     string `yaml:"file,omitempty"` // 为空时是 <storage_root>.audit.log
+	MaxSize  int64  `yaml:"max_size"`       // 超过多少字节时轮换，0 表示不轮换
+	MaxFiles int    `yaml:"max_files"`      // 保留多少个轮换后的文件，0 表示全部保留
+}
+
+// GCConfig 后台垃圾回收，清理中断的写入、孤立的元数据和空目录
+type GCConfig struct {
+	Interval       time.Duration `yaml:"interval"`         // 0 表示不自动回收
+	GracePeriod    time.Duration `yaml:"grace_period"`     // 比这更新的文件不处理
+	FilesPerSecond int           `yaml:"files_per_second"` // I/O 限速，0 表示不限制
+}
+
+type ExpiryConfig struct {
+	Interval time.Duration `yaml:"interval"` // 多久清理一次过期对象，0 表示不清理
+}
+
+type MetricsConfig struct {
+	Listen string `yaml:"listen"` // /metrics 的监听地址，为空时不开启
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level"`  // debug | info | warn | error | off
+	Format string `yaml:"format"` // text | json
+}
+
+type TracingConfig struct {
+	OTLPEndpoint string `yaml:"otlp_endpoint"` // OTLP/HTTP collector 地址，为空时不导出 span
+	ServiceName  string `yaml:"service_name"`
+}
+
+const (
+	keySourceFile      = "file"
+	keySourceEnv       = "env"
+	keySourceEphemeral = "ephemeral"
+)
+
+func defaultConfig() Config {
+	return Config{
+		Listen:        ":3000",
+		API:           defaultAPIAddr,
+		Admin:         defaultAdminAddr,
+		PathTransform: "cas",
+		Compression:   "none",
+		Padding:       "none",
+		Key: KeyConfig{
+			Source: keySourceFile,
+		},
+		Limits: LimitsConfig{
+			HandshakeTimeout: 10 * time.Second,
+		},
+		Reputation: ReputationConfig{
+			BanScore:    -100,
+			BanDuration: time.Hour,
+			HalfLife:    10 * time.Minute,
+		},
+		Audit: AuditConfig{
+			Enabled: true,
+			MaxSize: 64 << 20,
+		},
+		GC: GCConfig{
+			Interval:       time.Hour,
+			GracePeriod:    time.Hour,
+			FilesPerSecond: 1000,
+		},
+		Expiry: ExpiryConfig{
+			Interval: time.Minute,
+		},
+		Erasure: ErasureConfig{
+			RepairInterval: 10 * time.Minute,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		Tracing: TracingConfig{
+			ServiceName: "fs",
+		},
+	}
+}
+
+// loadConfig 读取配置文件，path 为空时返回默认配置
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return cfg, fmt.Errorf("config %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// envOverride 一个可以通过环境变量覆盖的配置项
+type envOverride struct {
+	name  string
+	field string
+	set   func(*Config, string) error
+}
+
+var envOverrides = []envOverride{
+	{"FS_NODE_ID", "node_id", func(c *Config, v string) error { c.NodeID = v; return nil }},
+	{"FS_LISTEN", "listen", func(c *Config, v string) error { c.Listen = v; return nil }},
+	{"FS_API", "api", func(c *Config, v string) error { c.API = v; return nil }},
+	{"FS_API_TOKEN", "api_token", func(c *Config, v string) error { c.APIToken = v; return nil }},
+	{"FS_ADMIN_LISTEN", "admin", func(c *Config, v string) error { c.Admin = v; return nil }},
+	{"FS_ADMIN_TOKEN", "admin_token", func(c *Config, v string) error { c.AdminToken = v; return nil }},
+	{"FS_STORAGE_ROOT", "storage_root", func(c *Config, v string) error { c.StorageRoot = v; return nil }},
+	{"FS_PATH_TRANSFORM", "path_transform", func(c *Config, v string) error { c.PathTransform = v; return nil }},
+	{"FS_BOOTSTRAP", "bootstrap", func(c *Config, v string) error { c.Bootstrap = splitList(v); return nil }},
+	{"FS_REPLICATION_FACTOR", "replication.factor", func(c *Config, v string) error { return parseInt(v, &c.Replication.Factor) }},
+	{"FS_ERASURE_DATA_SHARDS", "erasure.data_shards", func(c *Config, v string) error { return parseInt(v, &c.Erasure.DataShards) }},
+	{"FS_ERASURE_PARITY_SHARDS", "erasure.parity_shards", func(c *Config, v string) error { return parseInt(v, &c.Erasure.ParityShards) }},
+	{"FS_ERASURE_REPAIR_INTERVAL", "erasure.repair_interval", func(c *Config, v string) error {
+		return parseDuration(v, &c.Erasure.RepairInterval)
+	}},
+	{"FS_VERSIONING", "versioning", func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		c.Versioning = b
+		return err
+	}},
+	{"FS_ENCRYPT_AT_REST", "encrypt_at_rest", func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		c.EncryptAtRest = b
+		return err
+	}},
+	{"FS_COMPRESSION", "compression", func(c *Config, v string) error { c.Compression = v; return nil }},
+	{"FS_PADDING", "padding", func(c *Config, v string) error { c.Padding = v; return nil }},
+	{"FS_KEY_SOURCE", "key.source", func(c *Config, v string) error { c.Key.Source = v; return nil }},
+	{"FS_KEY_FILE", "key.file", func(c *Config, v string) error { c.Key.File = v; return nil }},
+	{"FS_KEY_ENV", "key.env", func(c *Config, v string) error { c.Key.Env = v; return nil }},
+	{"FS_MAX_MESSAGE_SIZE", "limits.max_message_size", func(c *Config, v string) error { return parseInt64(v, &c.Limits.MaxMessageSize) }},
+	{"FS_MAX_OBJECT_SIZE", "limits.max_object_size", func(c *Config, v string) error { return parseInt64(v, &c.Limits.MaxObjectSize) }},
+	{"FS_MAX_PEERS", "limits.max_peers", func(c *Config, v string) error { return parseInt(v, &c.Limits.MaxPeers) }},
+	{"FS_MAX_CONNECTIONS", "limits.max_connections", func(c *Config, v string) error { return parseInt(v, &c.Limits.MaxConnections) }},
+	{"FS_MAX_CONNECTIONS_PER_IP", "limits.max_connections_per_ip", func(c *Config, v string) error {
+		return parseInt(v, &c.Limits.MaxConnectionsPerIP)
+	}},
+	{"FS_HANDSHAKE_TIMEOUT", "limits.handshake_timeout", func(c *Config, v string) error { return parseDuration(v, &c.Limits.HandshakeTimeout) }},
+	{"FS_IDLE_TIMEOUT", "limits.idle_timeout", func(c *Config, v string) error { return parseDuration(v, &c.Limits.IdleTimeout) }},
+	{"FS_MIN_STREAM_RATE", "limits.min_stream_rate", func(c *Config, v string) error { return parseInt64(v, &c.Limits.MinStreamRate) }},
+	{"FS_QUOTA_CAPACITY", "quota.capacity", func(c *Config, v string) error { return parseInt64(v, &c.Quota.Capacity) }},
+	{"FS_QUOTA_DEFAULT_OWNER", "quota.default_owner", func(c *Config, v string) error { return parseInt64(v, &c.Quota.DefaultOwner) }},
+	{"FS_AUTH_REQUIRED", "auth.required", func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		c.Auth.Required = b
+		return err
+	}},
+	{"FS_AUTH_SIGNED_OBJECTS", "auth.signed_objects", func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		c.Auth.SignedObjects = b
+		return err
+	}},
+	{"FS_BAN_SCORE", "reputation.ban_score", func(c *Config, v string) error { return parseFloat(v, &c.Reputation.BanScore) }},
+	{"FS_BAN_DURATION", "reputation.ban_duration", func(c *Config, v string) error { return parseDuration(v, &c.Reputation.BanDuration) }},
+	{"FS_BAN_FILE", "reputation.ban_file", func(c *Config, v string) error { c.Reputation.BanFile = v; return nil }},
+	{"FS_BAN_IP", "reputation.ban_ip", func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		c.Reputation.BanIP = b
+		return err
+	}},
+	{"FS_GATE_ALLOW", "gate.allow", func(c *Config, v string) error { c.Gate.Allow = splitList(v); return nil }},
+	{"FS_GATE_DENY", "gate.deny", func(c *Config, v string) error { c.Gate.Deny = splitList(v); return nil }},
+	{"FS_AUDIT", "audit.enabled", func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		c.Audit.Enabled = b
+		return err
+	}},
+	{"FS_AUDIT_FILE", "audit.file", func(c *Config, v string) error { c.Audit.File = v; return nil }},
+	{"FS_GC_INTERVAL", "gc.interval", func(c *Config, v string) error { return parseDuration(v, &c.GC.Interval) }},
+	{"FS_EXPIRY_INTERVAL", "expiry.interval", func(c *Config, v string) error { return parseDuration(v, &c.Expiry.Interval) }},
+	{"FS_METRICS_LISTEN", "metrics.listen", func(c *Config, v string) error { c.Metrics.Listen = v; return nil }},
+	{"FS_LOG_LEVEL", "log.level", func(c *Config, v string) error { c.Log.Level = v; return nil }},
+	{"FS_LOG_FORMAT", "log.format", func(c *Config, v string) error { c.Log.Format = v; return nil }},
+	{"FS_OTLP_ENDPOINT", "tracing.otlp_endpoint", func(c *Config, v string) error { c.Tracing.OTLPEndpoint = v; return nil }},
+}
+
+// applyEnv 用 FS_* 环境变量覆盖配置
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	for _, o := range envOverrides {
+		v, ok := lookup(o.name)
+		if !ok {
+			continue
+		}
+		if err := o.set(c, v); err != nil {
+			return fmt.Errorf("config: %s (from %s): invalid value %q", o.field, o.name, v)
+		}
+	}
+	return nil
+}
+
+// Validate 校验配置，错误信息中带上出错的字段名
+func (c *Config) Validate() error {
+	if c.Listen == "" {
+		return fieldError("listen", "must not be empty")
+	}
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fieldError("listen", err.Error())
+	}
+	if c.API != "" {
+		host, _, err := net.SplitHostPort(c.API)
+		if err != nil {
+			return fieldError("api", err.Error())
+		}
+		// 客户端接口可以读写和删除本节点的所有文件并签发令牌
+		if c.APIToken == "" && !isLoopback(host) {
+			return fieldError("api_token", "required when api listens on a non-loopback address")
+		}
+	}
+	if c.Admin != "" && !strings.HasPrefix(c.Admin, unixPrefix) {
+		host, _, err := net.SplitHostPort(c.Admin)
+		if err != nil {
+			return fieldError("admin", err.Error())
+		}
+		if c.AdminToken == "" && !isLoopback(host) {
+			return fieldError("admin_token", "required when admin listens on a non-loopback address")
+		}
+	}
+	if _, err := pathTransformByName(c.PathTransform); err != nil {
+		return fieldError("path_transform", err.Error())
+	}
+	for i, addr := range c.Bootstrap {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fieldError(fmt.Sprintf("bootstrap[%d]", i), err.Error())
+		}
+	}
+	if c.Replication.Factor < 0 {
+		return fieldError("replication.factor", "must not be negative")
+	}
+	if c.Erasure.DataShards < 0 {
+		return fieldError("erasure.data_shards", "must not be negative")
+	}
+	if c.Erasure.ParityShards < 0 {
+		return fieldError("erasure.parity_shards", "must not be negative")
+	}
+	if (c.Erasure.DataShards > 0) != (c.Erasure.ParityShards > 0) {
+		return fieldError("erasure.parity_shards", "data_shards and parity_shards must both be set")
+	}
+	if c.Erasure.DataShards+c.Erasure.ParityShards > server.MaxShards {
+		return fieldError("erasure.data_shards", fmt.Sprintf("at most %d shards in total", server.MaxShards))
+	}
+	if c.Erasure.RepairInterval < 0 {
+		return fieldError("erasure.repair_interval", "must not be negative")
+	}
+	if _, err := codec.Parse(c.Compression); err != nil {
+		return fieldError("compression", err.Error())
+	}
+	if _, err := crypto.ParsePadding(c.Padding); err != nil {
+		return fieldError("padding", err.Error())
+	}
+
+	switch c.Key.Source {
+	case keySourceFile:
+	case keySourceEnv:
+		if c.Key.Env == "" {
+			return fieldError("key.env", "required when key.source is env")
+		}
+		if c.NodeID == "" {
+			return fieldError("node_id", "required when key.source is env")
+		}
+		if _, err := decodeEncKey(os.Getenv(c.Key.Env)); err != nil {
+			return fieldError("key.env", fmt.Sprintf("$%s: %s", c.Key.Env, err))
+		}
+	case keySourceEphemeral:
+	default:
+		return fieldError("key.source", fmt.Sprintf("unknown source %q (want file, env or ephemeral)", c.Key.Source))
+	}
+
+	if c.Limits.MaxMessageSize < 0 || c.Limits.MaxMessageSize > math.MaxUint32 {
+		return fieldError("limits.max_message_size", fmt.Sprintf("must be between 0 and %d", uint32(math.MaxUint32)))
+	}
+	if c.Limits.MaxObjectSize < 0 {
+		return fieldError("limits.max_object_size", "must not be negative")
+	}
+	if c.Limits.MaxPeers < 0 {
+		return fieldError("limits.max_peers", "must not be negative")
+	}
+	if c.Limits.MaxConnections < 0 {
+		return fieldError("limits.max_connections", "must not be negative")
+	}
+	if c.Limits.MaxConnectionsPerIP < 0 {
+		return fieldError("limits.max_connections_per_ip", "must not be negative")
+	}
+	if c.Limits.HandshakeTimeout < 0 {
+		return fieldError("limits.handshake_timeout", "must not be negative")
+	}
+	if c.Limits.IdleTimeout < 0 {
+		return fieldError("limits.idle_timeout", "must not be negative")
+	}
+	if c.Limits.MinStreamRate < 0 {
+		return fieldError("limits.min_stream_rate", "must not be negative")
+	}
+	if c.Quota.Capacity < 0 {
+		return fieldError("quota.capacity", "must not be negative")
+	}
+	if c.Quota.DefaultOwner < 0 {
+		return fieldError("quota.default_owner", "must not be negative")
+	}
+	for id, limit := range c.Quota.Owners {
+		if limit < 0 {
+			return fieldError(fmt.Sprintf("quota.owners[%s]", id), "must not be negative")
+		}
+	}
+	for i, rule := range c.Auth.ACL {
+		field := fmt.Sprintf("auth.acl[%d]", i)
+		if rule.Principal == "" {
+			return fieldError(field+".principal", "must not be empty (use * for any node)")
+		}
+		if rule.Owner == "" {
+			return fieldError(field+".owner", "must not be empty (use * for every owner)")
+		}
+		if _, err := server.ParsePermissions(rule.Permissions); err != nil {
+			return fieldError(field+".permissions", err.Error())
+		}
+	}
+	if c.Reputation.BanScore >= 0 {
+		return fieldError("reputation.ban_score", "must be negative")
+	}
+	if c.Reputation.BanDuration < 0 {
+		return fieldError("reputation.ban_duration", "must not be negative")
+	}
+	if c.Reputation.HalfLife < 0 {
+		return fieldError("reputation.half_life", "must not be negative")
+	}
+	if _, err := c.Gate.rules(); err != nil {
+		return err
+	}
+	if err := checkIdentities("gate.allow_identities", c.Gate.AllowIdentities); err != nil {
+		return err
+	}
+	if err := checkIdentities("gate.deny_identities", c.Gate.DenyIdentities); err != nil {
+		return err
+	}
+	if c.Audit.MaxSize < 0 {
+		return fieldError("audit.max_size", "must not be negative")
+	}
+	if c.Audit.MaxFiles < 0 {
+		return fieldError("audit.max_files", "must not be negative")
+	}
+	if c.GC.Interval < 0 {
+		return fieldError("gc.interval", "must not be negative")
+	}
+	if c.GC.GracePeriod < 0 {
+		return fieldError("gc.grace_period", "must not be negative")
+	}
+	if c.GC.FilesPerSecond < 0 {
+		return fieldError("gc.files_per_second", "must not be negative")
+	}
+	if c.Expiry.Interval < 0 {
+		return fieldError("expiry.interval", "must not be negative")
+	}
+	if c.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Listen); err != nil {
+			return fieldError("metrics.listen", err.Error())
+		}
+	}
+	if _, err := logLevelByName(c.Log.Level); err != nil {
+		return fieldError("log.level", err.Error())
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		return fieldError("log.format", fmt.Sprintf("unknown format %q (want text or json)", c.Log.Format))
+	}
+	if c.Tracing.OTLPEndpoint != "" {
+		if u, err := url.Parse(c.Tracing.OTLPEndpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			return fieldError("tracing.otlp_endpoint", "must be an absolute http(s) URL")
+		}
+	}
+
+	return nil
+}
+
+// storageRoot 返回存储目录，为空时是 <listen>_network
+func (c *Config) storageRoot() string {
+	if c.StorageRoot == "" {
+		return c.Listen + "_network"
+	}
+	return c.StorageRoot
+}
+
+// keyFile 返回 key 文件，为空时是 <storage_root>.key
+func (c *Config) keyFile() string {
+	if c.Key.File == "" {
+		return c.storageRoot() + ".key"
+	}
+	return c.Key.File
+}
+
+// auditFile 返回审计日志文件，默认是 <storage_root>.audit.log
+func (c *Config) auditFile() string {
+	if c.Audit.File == "" {
+		return c.storageRoot() + ".audit.log"
+	}
+	return c.Audit.File
+}
+
+// loadKeys 按 key.source 取得节点 ID 和加密密钥
+func (c *Config) loadKeys() (keySet, error) {
+	var (
+		keys keySet
+		err  error
+	)
+
+	switch c.Key.Source {
+	case keySourceFile:
+		keys, err = loadOrCreateKeyFile(c.keyFile())
+	case keySourceEnv:
+		keys.EncKey, err = decodeEncKey(os.Getenv(c.Key.Env))
+	default:
+		// id 为空时 NewFileServer 使用签名公钥
+		keys = keySet{EncKey: crypto.NewEncryptionKey()}
+	}
+	if err != nil {
+		return keySet{}, err
+	}
+
+	if c.NodeID != "" {
+		keys.ID = c.NodeID
+	}
+	return keys, nil
+}
+
+// redacted 在 dump 的输出中代替令牌
+const redacted = "<redacted>"
+
+// dump 输出实际生效的配置，令牌被替换成 redacted
+func (c *Config) dump() ([]byte, error) {
+	out := *c
+	for _, secret := range []*string{&out.APIToken, &out.AdminToken} {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	return yaml.Marshal(&out)
+}
+
+// logLevelOff 比所有日志级别都高，用来关闭日志
+const logLevelOff = slog.Level(100)
+
+func logLevelByName(name string) (slog.Level, error) {
+	switch name {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	case "off":
+		return logLevelOff, nil
+	}
+	return 0, fmt.Errorf("unknown level %q (want debug, info, warn, error or off)", name)
+}
+
+// newLogger 按 log 配置创建输出到 stderr 的 logger
+func (c *Config) newLogger() *slog.Logger {
+	level, _ := logLevelByName(c.Log.Level)
+	opts := &slog.HandlerOptions{Level: level}
+
+	if c.Log.Format == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+}
+
+func pathTransformByName(name string) (store.PathTransformFunc, error) {
+	switch name {
+	case "cas":
+		return store.CASPathTransformFunc, nil
+	case "default":
+		return store.DefaultPathTransformFunc, nil
+	}
+	return nil, fmt.Errorf("unknown path transform %q (want cas or default)", name)
+}
+
+func decodeEncKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("must be 32 hex encoded bytes")
+	}
+	return key, nil
+}
+
+// checkIdentities 检查列表中的每一项都是十六进制的签名公钥
+func checkIdentities(field string, ids []string) error {
+	for i, id := range ids {
+		if b, err := hex.DecodeString(id); err != nil || len(b) != ed25519.PublicKeySize {
+			return fieldError(fmt.Sprintf("%s[%d]", field, i), "must be a hex encoded signing public key")
+		}
+	}
+	return nil
+}
+
+// isLoopback host 是否只能从本机访问，空的 host 会监听所有地址
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func fieldError(field, msg string) error {
+	return fmt.Errorf("config: %s: %s", field, msg)
+}
+
+func parseInt(v string, dst *int) error {
+	n, err := strconv.Atoi(v)
+	*dst = n
+	return err
+}
+
+func parseInt64(v string, dst *int64) error {
+	n, err := strconv.ParseInt(v, 10, 64)
+	*dst = n
+	return err
+}
+
+func parseFloat(v string, dst *float64) error {
+	f, err := strconv.ParseFloat(v, 64)
+	*dst = f
+	return err
+}
+
+func parseDuration(v string, dst *time.Duration) error {
+	d, err := time.ParseDuration(v)
+	*dst = d
+	return err
+}
+
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.yaml")
+	data := `
+listen: ":4000"
+storage_root: /tmp/fs
+bootstrap: [":3000", "10.0.0.2:3000"]
+replication:
+  factor: 2
+key:
+  source: file
+  file: node.key
+`
+	assert.Nil(t, os.WriteFile(path, []byte(data), 0o644))
+
+	cfg, err := loadConfig(path)
+	assert.Nil(t, err)
+	assert.Equal(t, ":4000", cfg.Listen)
+	assert.Equal(t, defaultAPIAddr, cfg.API)
+	assert.Equal(t, []string{":3000", "10.0.0.2:3000"}, cfg.Bootstrap)
+	assert.Equal(t, 2, cfg.Replication.Factor)
+	assert.Nil(t, cfg.Validate())
+
+	env := map[string]string{
+		"FS_LISTEN":          ":5000",
+		"FS_MAX_OBJECT_SIZE": "1024",
+	}
+	lookup := func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	}
+	assert.Nil(t, cfg.applyEnv(lookup))
+	assert.Equal(t, ":5000", cfg.Listen)
+	assert.Equal(t, int64(1024), cfg.Limits.MaxObjectSize)
+
+	env["FS_MAX_PEERS"] = "lots"
+	assert.ErrorContains(t, cfg.applyEnv(lookup), "limits.max_peers")
+}
+
+func TestLoadConfigUnknownField(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte("listen_addr: \":4000\"\n"), 0o644))
+
+	_, err := loadConfig(path)
+	assert.ErrorContains(t, err, "listen_addr")
+}
+
+func TestConfigDump(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.APIToken, cfg.AdminToken = "api-secret", "admin-secret"
+
+	b, err := cfg.dump()
+	assert.Nil(t, err)
+	assert.NotContains(t, string(b), "secret")
+	assert.Contains(t, string(b), "admin_token: <redacted>")
+	// 只替换输出，配置本身不变
+	assert.Equal(t, "admin-secret", cfg.AdminToken)
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		field  string
+		modify func(*Config)
+	}{
+		{"listen", func(c *Config) { c.Listen = "" }},
+		{"api_token", func(c *Config) { c.API = ":7000" }},
+		{"admin_token", func(c *Config) { c.Admin = "0.0.0.0:7100" }},
+		{"path_transform", func(c *Config) { c.PathTransform = "md5" }},
+		{"bootstrap[1]", func(c *Config) { c.Bootstrap = []string{":3000", "nope"} }},
+		{"compression", func(c *Config) { c.Compression = "brotli" }},
+		{"padding", func(c *Config) { c.Padding = "random" }},
+		{"replication.factor", func(c *Config) { c.Replication.Factor = -1 }},
+		{"key.env", func(c *Config) { c.Key.Source = keySourceEnv }},
+		{"key.source", func(c *Config) { c.Key.Source = "vault" }},
+		{"limits.max_message_size", func(c *Config) { c.Limits.MaxMessageSize = 1 << 32 }},
+		{"limits.max_object_size", func(c *Config) { c.Limits.MaxObjectSize = -1 }},
+		{"limits.max_connections_per_ip", func(c *Config) { c.Limits.MaxConnectionsPerIP = -1 }},
+		{"limits.idle_timeout", func(c *Config) { c.Limits.IdleTimeout = -time.Second }},
+		{"limits.min_stream_rate", func(c *Config) { c.Limits.MinStreamRate = -1 }},
+		{"quota.capacity", func(c *Config) { c.Quota.Capacity = -1 }},
+		{"quota.owners[abc]", func(c *Config) { c.Quota.Owners = map[string]int64{"abc": -1} }},
+		{"auth.acl[0].owner", func(c *Config) { c.Auth.ACL = []ACLRuleConfig{{Principal: "*", Permissions: "read"}} }},
+		{"auth.acl[0].permissions", func(c *Config) { c.Auth.ACL = []ACLRuleConfig{{Principal: "*", Owner: "*", Permissions: "admin"}} }},
+		{"erasure.parity_shards", func(c *Config) { c.Erasure.DataShards = 4 }},
+		{"erasure.data_shards", func(c *Config) { c.Erasure.DataShards, c.Erasure.ParityShards = 250, 10 }},
+		{"reputation.ban_score", func(c *Config) { c.Reputation.BanScore = 10 }},
+		{"reputation.half_life", func(c *Config) { c.Reputation.HalfLife = -time.Second }},
+		{"gate.allow", func(c *Config) { c.Gate.Allow = []string{"10.0.0.0/33"} }},
+		{"gate.deny_identities[0]", func(c *Config) { c.Gate.DenyIdentities = []string{"node-1"} }},
+		{"audit.max_files", func(c *Config) { c.Audit.MaxFiles = -1 }},
+		{"gc.interval", func(c *Config) { c.GC.Interval = -time.Second }},
+		{"expiry.interval", func(c *Config) { c.Expiry.Interval = -time.Second }},
+		{"log.level", func(c *Config) { c.Log.Level = "verbose" }},
+		{"log.format", func(c *Config) { c.Log.Format = "logfmt" }},
+	}
+
+	for _, tt := range tests {
+		cfg := defaultConfig()
+		tt.modify(&cfg)
+		assert.ErrorContains(t, cfg.Validate(), "config: "+tt.field+":")
+	}
+}
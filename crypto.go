@@ -1,92 +0,0 @@
-package main
-
-import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/md5"
-	"crypto/rand"
-	"encoding/hex"
-	"io"
-)
-
-// 公钥
-func generateID() string {
-	buf := make([]byte, 32)
-	io.ReadFull(rand.Reader, buf)
-	return hex.EncodeToString(buf)
-}
-
-func hashKey(key string) string {
-	hasher := md5.Sum([]byte(key))
-	return hex.EncodeToString(hasher[:])
-}
-
-func newEncryptionKey() []byte {
-	keyBuf := make([]byte, 32)
-	if _, err := io.ReadFull(rand.Reader, keyBuf); err != nil {
-		panic(err)
-	}
-	return keyBuf
-}
-
-func copyStream(stream cipher.Stream, src io.Reader, dst io.Writer) (int, error) {
-	var (
-		buf = make([]byte, 32*1024)
-		nw  = aes.BlockSize
-	)
-	for {
-		n, err := src.Read(buf)
-		if n > 0 {
-			stream.XORKeyStream(buf, buf[:n])
-			nn, err := dst.Write(buf[:n])
-			if err != nil {
-				return 0, err
-			}
-			nw += nn
-		}
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return 0, err
-		}
-	}
-
-	return nw, nil
-}
-
-func copyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return 0, err
-	}
-
-	// 读取 IV
-	iv := make([]byte, aes.BlockSize)
-	if _, err = src.Read(iv); err != nil {
-		return 0, err
-	}
-
-	stream := cipher.NewCTR(block, iv)
-	return copyStream(stream, src, dst)
-}
-
-func copyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return 0, err
-	}
-
-	iv := make([]byte, aes.BlockSize)
-	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
-		return 0, err
-	}
-
-	// 先写入 IV
-	if _, err = dst.Write(iv); err != nil {
-		return 0, err
-	}
-
-	stream := cipher.NewCTR(block, iv)
-	return copyStream(stream, src, dst)
-}
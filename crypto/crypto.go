@@ -0,0 +1,147 @@
+// Package crypto 提供节点 ID、key 哈希以及 AES-CTR 流加解密
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+)
+
+// GenerateID 生成节点 ID(公钥)
+func GenerateID() string {
+	buf := make([]byte, 32)
+	io.ReadFull(rand.Reader, buf)
+	return hex.EncodeToString(buf)
+}
+
+// HashKey 旧版本发送给其他节点的对象标识(md5)。任何人都可以计算，
+// 只在迁移到 ObjectID 之前写入的对象上使用
+func HashKey(key string) string {
+	hasher := md5.Sum([]byte(key))
+	return hex.EncodeToString(hasher[:])
+}
+
+// ObjectID 发送给其他节点的对象标识：以 owner 的 secret 为密钥的 HMAC-SHA256，
+// 没有 secret 的节点无法由文件名算出标识
+func ObjectID(secret []byte, key string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// DeriveKey 由 key 派生出一个用于 purpose 的 32 字节密钥
+func DeriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// NewEncryptionKey 生成 32 字节的 AES-256 密钥
+func NewEncryptionKey() []byte {
+	keyBuf := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, keyBuf); err != nil {
+		panic(err)
+	}
+	return keyBuf
+}
+
+func copyStream(stream cipher.Stream, src io.Reader, dst io.Writer) (int, error) {
+	var (
+		buf = make([]byte, 32*1024)
+		nw  = aes.BlockSize
+	)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			stream.XORKeyStream(buf, buf[:n])
+			nn, err := dst.Write(buf[:n])
+			if err != nil {
+				return 0, err
+			}
+			nw += nn
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return nw, nil
+}
+
+// CopyDecrypt 从 src 读取 IV 和密文，把明文写入 dst，返回值包含 IV 的长度
+func CopyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return 0, err
+	}
+
+	// 读取 IV
+	iv := make([]byte, aes.BlockSize)
+	if _, err = io.ReadFull(src, iv); err != nil {
+		return 0, err
+	}
+
+	stream := cipher.NewCTR(block, iv)
+	return copyStream(stream, src, dst)
+}
+
+// CopyEncrypt 先向 dst 写入随机 IV，再写入 src 的密文，返回值包含 IV 的长度
+func CopyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return 0, err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
+		return 0, err
+	}
+
+	// 先写入 IV
+	if _, err = dst.Write(iv); err != nil {
+		return 0, err
+	}
+
+	stream := cipher.NewCTR(block, iv)
+	return copyStream(stream, src, dst)
+}
+
+// EncryptReader 返回读出 IV 和 src 密文的 Reader，格式与 CopyEncrypt 相同
+func EncryptReader(key []byte, src io.Reader) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+
+	stream := cipher.StreamReader{S: cipher.NewCTR(block, iv), R: src}
+	return io.MultiReader(bytes.NewReader(iv), stream), nil
+}
+
+// DecryptReader 从 src 读取 IV，返回读出明文的 Reader
+func DecryptReader(key []byte, src io.Reader) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err = io.ReadFull(src, iv); err != nil {
+		return nil, err
+	}
+
+	return cipher.StreamReader{S: cipher.NewCTR(block, iv), R: src}, nil
+}
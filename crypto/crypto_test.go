@@ -0,0 +1,229 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestCopyEncryptDecrypt(t *testing.T) {
+	payload := "Foo not Bar"
+	src := bytes.NewBuffer([]byte(payload))
+	dst := new(bytes.Buffer)
+	key := NewEncryptionKey()
+
+	_, err := CopyEncrypt(key, src, dst)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fmt.Println(dst.String())
+
+	out := new(bytes.Buffer)
+	nw, err := CopyDecrypt(key, dst, out)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if nw != 16+len(payload) {
+		t.Fail()
+	}
+
+	if out.String() != payload {
+		t.Errorf("decryption failed!!!")
+	}
+
+	fmt.Println(out.String())
+}
+
+func TestEncryptDecryptReader(t *testing.T) {
+	payload := bytes.Repeat([]byte("Foo not Bar "), 10000)
+	key := NewEncryptionKey()
+
+	er, err := EncryptReader(key, bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, _ := io.ReadAll(er)
+	if len(ciphertext) != 16+len(payload) || bytes.Contains(ciphertext, []byte("Foo not Bar")) {
+		t.Fatalf("unexpected ciphertext of %d bytes", len(ciphertext))
+	}
+
+	// 与 CopyEncrypt/CopyDecrypt 的格式相同
+	out := new(bytes.Buffer)
+	if _, err := CopyDecrypt(key, bytes.NewReader(ciphertext), out); err != nil || !bytes.Equal(out.Bytes(), payload) {
+		t.Errorf("CopyDecrypt: %v", err)
+	}
+
+	dr, err := DecryptReader(key, bytes.NewReader(ciphertext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, _ := io.ReadAll(dr); !bytes.Equal(plaintext, payload) {
+		t.Errorf("decryption failed")
+	}
+}
+
+func TestWrapKey(t *testing.T) {
+	master, other := NewEncryptionKey(), NewEncryptionKey()
+	dataKey := NewEncryptionKey()
+
+	wrapped, err := WrapKey(master, dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if WrappedKeyID(wrapped) != KeyID(master) || KeyID(master) == KeyID(other) {
+		t.Errorf("unexpected key id in %q", wrapped)
+	}
+
+	if have, err := UnwrapKey(master, wrapped); err != nil || !bytes.Equal(have, dataKey) {
+		t.Errorf("unwrap: %v", err)
+	}
+	if _, err := UnwrapKey(other, wrapped); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("have %v, want ErrWrongKey", err)
+	}
+
+	// 篡改密文
+	tampered := []byte(wrapped)
+	tampered[len(tampered)-2] ^= 1
+	if _, err := UnwrapKey(master, string(tampered)); err == nil {
+		t.Errorf("expected an error for a tampered key")
+	}
+}
+
+func TestObjectID(t *testing.T) {
+	secret, other := NewEncryptionKey(), NewEncryptionKey()
+	name := "picture_1.png"
+
+	id := ObjectID(secret, name)
+	if id != ObjectID(secret, name) {
+		t.Fatalf("object id is not deterministic")
+	}
+	if len(id) != 64 || id == ObjectID(secret, "picture_2.png") {
+		t.Errorf("unexpected object id %q", id)
+	}
+
+	// 不知道 secret 时，对文件名做哈希(md5、sha256)或者用其他 secret 都得不到相同的标识
+	sum := sha256.Sum256([]byte(name))
+	for _, guess := range []string{HashKey(name), hex.EncodeToString(sum[:]), ObjectID(other, name), ObjectID(nil, name)} {
+		if guess == id {
+			t.Errorf("object id %q can be computed without the secret", id)
+		}
+	}
+
+	if !bytes.Equal(DeriveKey(secret, "a"), DeriveKey(secret, "a")) || bytes.Equal(DeriveKey(secret, "a"), DeriveKey(secret, "b")) {
+		t.Errorf("DeriveKey must be deterministic and depend on the purpose")
+	}
+}
+
+func TestPaddedSize(t *testing.T) {
+	cases := []struct {
+		scheme string
+		n      int64
+		want   int64
+	}{
+		{PaddingNone, 1000, 1000},
+		{PaddingPadme, 0, 0},
+		{PaddingPadme, 9, 10},
+		{PaddingPadme, 1000, 1024},
+		{PaddingPadme, 1025, 1088},
+		{PaddingPadme, 1 << 20, 1 << 20},
+		{PaddingBuckets, 1, MinBucket},
+		{PaddingBuckets, MinBucket + 1, 2 * MinBucket},
+		{PaddingBuckets, 1 << 20, 1 << 20},
+	}
+	for _, c := range cases {
+		if have := PaddedSize(c.scheme, c.n); have != c.want {
+			t.Errorf("PaddedSize(%q, %d) = %d, want %d", c.scheme, c.n, have, c.want)
+		}
+	}
+
+	// Padmé 的开销不超过 12%
+	for n := int64(2); n < 1<<16; n += 7 {
+		if have := PaddedSize(PaddingPadme, n); have < n || float64(have-n) > 0.12*float64(n) {
+			t.Fatalf("PaddedSize(padme, %d) = %d", n, have)
+		}
+	}
+}
+
+func TestPadReader(t *testing.T) {
+	payload := []byte("Foo not Bar")
+	key := NewEncryptionKey()
+
+	var ciphertext bytes.Buffer
+	padded := PadReader(PaddingBuckets, bytes.NewReader(payload), PadHeader{Size: int64(len(payload)), RawSize: 42})
+	if _, err := CopyEncrypt(key, padded, &ciphertext); err != nil {
+		t.Fatal(err)
+	}
+	if ciphertext.Len() != 16+MinBucket {
+		t.Errorf("have %d bytes of ciphertext, want %d", ciphertext.Len(), 16+MinBucket)
+	}
+
+	var plaintext bytes.Buffer
+	if _, err := CopyDecrypt(key, &ciphertext, &plaintext); err != nil {
+		t.Fatal(err)
+	}
+	r, h, err := UnpadReader(&plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	if !bytes.Equal(b, payload) || h.RawSize != 42 {
+		t.Errorf("have %q (%+v) after removing the padding", b, h)
+	}
+}
+
+func TestSealKey(t *testing.T) {
+	private, other := NewShareKey(), NewShareKey()
+	recipient, err := SharePublicKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey := NewEncryptionKey()
+
+	sealed, err := SealKey(recipient, dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := SealKey(recipient, dataKey); again == sealed {
+		t.Errorf("sealing twice must use a new ephemeral key")
+	}
+
+	if have, err := OpenKey(private, sealed); err != nil || !bytes.Equal(have, dataKey) {
+		t.Errorf("open: %v", err)
+	}
+	if _, err := OpenKey(other, sealed); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("have %v, want ErrWrongKey", err)
+	}
+	if _, err := SealKey("not a key", dataKey); err == nil {
+		t.Errorf("expected an error for a malformed public key")
+	}
+}
+
+func TestSign(t *testing.T) {
+	key, other := NewSignKey(), NewSignKey()
+	message := []byte("get 3f2a/9c1e")
+	sig := Sign(key, message)
+
+	if err := Verify(SignPublicKey(key), message, sig); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+	if err := Verify(SignPublicKey(other), message, sig); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("have %v, want ErrBadSignature", err)
+	}
+	if err := Verify(SignPublicKey(key), []byte("delete 3f2a/9c1e"), sig); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("have %v, want ErrBadSignature for a different message", err)
+	}
+	if err := Verify("not a key", message, sig); err == nil {
+		t.Errorf("expected an error for a malformed public key")
+	}
+
+	restored, err := SignKeyFromSeed(key.Seed())
+	if err != nil || SignPublicKey(restored) != SignPublicKey(key) {
+		t.Errorf("restoring from the seed changed the key (%v)", err)
+	}
+}
@@ -0,0 +1,86 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// 信封加密：每个对象使用随机的数据密钥加密内容，数据密钥再用节点的主密钥(AES-GCM)包装，
+// 包装后的数据密钥以 "<主密钥 ID>:<base64(nonce|密文)>" 的形式保存在对象元数据中
+
+// ErrWrongKey 包装数据密钥使用的不是给定的主密钥，或者数据被篡改
+var ErrWrongKey = errors.New("data key was not wrapped with this master key")
+
+// KeyID 主密钥的 ID，用来判断一个数据密钥是由哪个主密钥包装的
+func KeyID(master []byte) string {
+	sum := sha256.Sum256(master)
+	return hex.EncodeToString(sum[:8])
+}
+
+// WrappedKeyID 返回包装数据密钥的主密钥 ID
+func WrappedKeyID(wrapped string) string {
+	id, _, _ := strings.Cut(wrapped, ":")
+	return id
+}
+
+// WrapKey 用主密钥加密数据密钥
+func WrapKey(master, dataKey []byte) (string, error) {
+	gcm, err := newGCM(master)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	id := KeyID(master)
+	sealed := gcm.Seal(nonce, nonce, dataKey, []byte(id))
+
+	return id + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// UnwrapKey 用主密钥解开 WrapKey 的结果
+func UnwrapKey(master []byte, wrapped string) ([]byte, error) {
+	id, encoded, ok := strings.Cut(wrapped, ":")
+	if !ok {
+		return nil, fmt.Errorf("malformed wrapped key")
+	}
+	if id != KeyID(master) {
+		return nil, ErrWrongKey
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("malformed wrapped key: %w", err)
+	}
+	gcm, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("malformed wrapped key")
+	}
+
+	dataKey, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(id))
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+	return dataKey, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
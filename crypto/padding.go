@@ -0,0 +1,90 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// 填充：加密之前在数据前面加上长度头，末尾补 0 到 PaddedSize，
+// 其他节点只能看到填充后的长度，真实长度只在密文中
+
+const (
+	PaddingNone    = ""
+	PaddingPadme   = "padme"   // Padmé：开销不超过 12%，长度只泄露 O(log log n) 位
+	PaddingBuckets = "buckets" // 2 的幂，最小 MinBucket，开销最多一倍
+)
+
+// MinBucket buckets 方案的最小长度
+const MinBucket = 4096
+
+// PadHeaderSize 长度头的字节数
+const PadHeaderSize = 16
+
+// ParsePadding 解析填充方案的名字，none 与空相同
+func ParsePadding(name string) (string, error) {
+	switch name {
+	case "", "none":
+		return PaddingNone, nil
+	case PaddingPadme, PaddingBuckets:
+		return name, nil
+	}
+	return "", fmt.Errorf("unknown padding %q (want none, padme or buckets)", name)
+}
+
+// PaddedSize 返回 n 字节按 scheme 填充后的长度
+func PaddedSize(scheme string, n int64) int64 {
+	switch scheme {
+	case PaddingPadme:
+		if n < 2 {
+			return n
+		}
+		e := bits.Len64(uint64(n)) - 1
+		s := bits.Len64(uint64(e))
+		mask := int64(1)<<(e-s) - 1
+		return (n + mask) &^ mask
+	case PaddingBuckets:
+		if n <= MinBucket {
+			return MinBucket
+		}
+		return int64(1) << bits.Len64(uint64(n-1))
+	}
+	return n
+}
+
+// PadHeader 填充前的数据长度和压缩前的长度
+type PadHeader struct {
+	Size    int64
+	RawSize int64
+}
+
+// PadReader 返回长度头、src 的 h.Size 字节和补齐到 PaddedSize(scheme, PadHeaderSize+h.Size) 的 0
+func PadReader(scheme string, src io.Reader, h PadHeader) io.Reader {
+	var header bytes.Buffer
+	binary.Write(&header, binary.LittleEndian, []int64{h.Size, h.RawSize})
+
+	padding := PaddedSize(scheme, PadHeaderSize+h.Size) - PadHeaderSize - h.Size
+	return io.MultiReader(&header, io.LimitReader(src, h.Size), io.LimitReader(zeros{}, padding))
+}
+
+// UnpadReader 读取 PadReader 写入的长度头，返回只读出原始数据的 Reader
+func UnpadReader(r io.Reader) (io.Reader, PadHeader, error) {
+	var sizes [2]int64
+	if err := binary.Read(r, binary.LittleEndian, &sizes); err != nil {
+		return nil, PadHeader{}, fmt.Errorf("padding header: %w", err)
+	}
+	h := PadHeader{Size: sizes[0], RawSize: sizes[1]}
+	if h.Size < 0 || h.RawSize < 0 {
+		return nil, h, fmt.Errorf("malformed padding header")
+	}
+	return io.LimitReader(r, h.Size), h, nil
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
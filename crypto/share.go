@@ -0,0 +1,117 @@
+package crypto
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// 共享：数据密钥用接收方的 X25519 公钥加密。发送方每次生成临时密钥对，
+// 由 ECDH 的结果派生出 AES-GCM 密钥，只有接收方的私钥能解开。
+// 加密后的数据密钥形如 "x25519:<base64(临时公钥|nonce|密文)>"
+
+const sealedKeyPrefix = "x25519:"
+
+// NewShareKey 生成接收共享文件用的 X25519 私钥
+func NewShareKey() []byte {
+	return NewEncryptionKey()
+}
+
+// SharePublicKey 返回私钥对应的公钥(hex)，发给需要共享文件给自己的 owner
+func SharePublicKey(private []byte) (string, error) {
+	key, err := ecdh.X25519().NewPrivateKey(private)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// SealKey 用接收方的公钥(hex)加密数据密钥
+func SealKey(recipient string, dataKey []byte) (string, error) {
+	b, err := hex.DecodeString(recipient)
+	if err != nil {
+		return "", fmt.Errorf("recipient public key: %w", err)
+	}
+	pub, err := ecdh.X25519().NewPublicKey(b)
+	if err != nil {
+		return "", fmt.Errorf("recipient public key: %w", err)
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	shared, err := ephemeral.ECDH(pub)
+	if err != nil {
+		return "", err
+	}
+
+	epub := ephemeral.PublicKey().Bytes()
+	gcm, err := newGCM(sealKEK(shared, epub, pub.Bytes()))
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := append(append(epub, nonce...), gcm.Seal(nil, nonce, dataKey, epub)...)
+	return sealedKeyPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// OpenKey 用私钥解开 SealKey 的结果
+func OpenKey(private []byte, sealed string) ([]byte, error) {
+	encoded, ok := strings.CutPrefix(sealed, sealedKeyPrefix)
+	if !ok {
+		return nil, fmt.Errorf("malformed shared key")
+	}
+	b, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("malformed shared key: %w", err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+
+	const pubSize = 32
+	if len(b) < pubSize {
+		return nil, fmt.Errorf("malformed shared key")
+	}
+	epub, err := ecdh.X25519().NewPublicKey(b[:pubSize])
+	if err != nil {
+		return nil, err
+	}
+	shared, err := key.ECDH(epub)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(sealKEK(shared, b[:pubSize], key.PublicKey().Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < pubSize+gcm.NonceSize() {
+		return nil, fmt.Errorf("malformed shared key")
+	}
+
+	nonce := b[pubSize : pubSize+gcm.NonceSize()]
+	dataKey, err := gcm.Open(nil, nonce, b[pubSize+gcm.NonceSize():], b[:pubSize])
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+	return dataKey, nil
+}
+
+// sealKEK 由 ECDH 的结果和双方的公钥派生出加密数据密钥的密钥
+func sealKEK(shared, ephemeral, recipient []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("fs share"))
+	h.Write(shared)
+	h.Write(ephemeral)
+	h.Write(recipient)
+	return h.Sum(nil)
+}
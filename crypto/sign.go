@@ -0,0 +1,55 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 节点身份：Ed25519 签名密钥。节点对发给其他节点的请求和签发的授权令牌签名，
+// 新节点的 ID 就是签名公钥(hex)
+
+// ErrBadSignature 签名与公钥或内容不匹配
+var ErrBadSignature = errors.New("bad signature")
+
+// NewSignKey 生成签名密钥，key 文件中只保存 32 字节的 seed
+func NewSignKey() ed25519.PrivateKey {
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := io.ReadFull(rand.Reader, seed); err != nil {
+		panic(err)
+	}
+	return ed25519.NewKeyFromSeed(seed)
+}
+
+// SignKeyFromSeed 由 seed 恢复签名密钥
+func SignKeyFromSeed(seed []byte) (ed25519.PrivateKey, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("sign key seed must be %d bytes, have %d", ed25519.SeedSize, len(seed))
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// SignPublicKey 返回签名公钥(hex)
+func SignPublicKey(key ed25519.PrivateKey) string {
+	return hex.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// Sign 对 message 签名
+func Sign(key ed25519.PrivateKey, message []byte) []byte {
+	return ed25519.Sign(key, message)
+}
+
+// Verify 用公钥(hex)校验签名
+func Verify(publicKey string, message, sig []byte) error {
+	b, err := hex.DecodeString(publicKey)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return fmt.Errorf("malformed public key %q", publicKey)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(b), message, sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
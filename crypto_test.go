@@ -1,37 +0,0 @@
-package main
-
-import (
-	"bytes"
-	"fmt"
-	"testing"
-)
-
-func TestCopyEncryptDecrypt(t *testing.T) {
-	payload := "Foo not Bar"
-	src := bytes.NewBuffer([]byte(payload))
-	dst := new(bytes.Buffer)
-	key := newEncryptionKey()
-
-	_, err := copyEncrypt(key, src, dst)
-	if err != nil {
-		t.Error(err)
-	}
-
-	fmt.Println(dst.String())
-
-	out := new(bytes.Buffer)
-	nw, err := copyDecrypt(key, dst, out)
-	if err != nil {
-		t.Error(err)
-	}
-
-	if nw != 16+len(payload) {
-		t.Fail()
-	}
-
-	if out.String() != payload {
-		t.Errorf("decryption failed!!!")
-	}
-
-	fmt.Println(out.String())
-}
@@ -2,9 +2,16 @@ module distributed_file_storage
 
 go 1.22.2
 
+require (
+	github.com/klauspost/compress v1.17.11
+	github.com/klauspost/reedsolomon v1.12.4
+	github.com/stretchr/testify v1.10.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/klauspost/cpuid/v2 v2.2.8 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.10.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	golang.org/x/sys v0.24.0 // indirect
 )
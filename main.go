@@ -1,75 +1,87 @@
 package main
 
 import (
-	"bytes"
-	"distributed_file_storage/p2p"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"time"
+	"os"
 )
 
-func makeServer(listenAddr string, nodes ...string) *FileServer {
-	tcpTransportOpts := p2p.TCPTransportOpts{
-		ListenAddr:    listenAddr,
-		HandshakeFunc: p2p.NOPHandshakeFunc,
-		Decoder:       p2p.DefaultDecoder{},
-	}
-	tcpTransport := p2p.NewTCPTransport(tcpTransportOpts)
+// 退出码
+const (
+	exitOK       = 0
+	exitError    = 1
+	exitUsage    = 2
+	exitNotFound = 3
+)
 
-	fileServerOpts := FileServerOpts{
-		EncKey:            newEncryptionKey(),
-		StorageRoot:       listenAddr + "_network",
-		PathTransformFunc: CASPathTransformFunc,
-		Transport:         tcpTransport,
-		BootstrapNodes:    nodes,
-	}
+const usage = `usage: fs <command> [flags] [args]
 
-	s := NewFileServer(fileServerOpts)
+node commands:
+  node start        start a storage node
+  node config       print the effective node configuration
+  node status       show the status of a running node
+  node gc           run garbage collection on a running node now
+  node rotate-key   rotate the master key of a running node (-retire to drop old keys)
+  node migrate-ids  rename replicas stored under legacy md5 names on peers
+  node reload       re-read the gate rules of a running node (same as SIGHUP)
+  node verify-audit <file>
+                    check the hash chain of an audit log and its rotated files
 
-	tcpTransport.OnPeer = s.OnPeer
+client commands:
+  put <key> [file]   store a file (reads stdin when file is omitted, -ttl to expire it)
+  get <key>          fetch a file (writes stdout unless -o is given)
+  rm <key>           delete a file
+  ls                 list files owned by the node
+  stat <key>         show file metadata
+  versions <key>     list the versions of a file
+  rollback <key> <version>
+                     restore an old version as the latest
+  share <key> <recipient>
+                     share a file with the node whose share key is given (fs get -shared to fetch it)
+  token <identity>   grant another node access to this node's files on peers that require authorization
+  peers              list connected peers
 
-	return s
-}
+run "fs <command> -h" for the flags of a command
+`
 
 func main() {
-	s1 := makeServer(":3000", "")
-	s2 := makeServer(":4000", ":3000") // 在4000启动，想要连接3000
-	s3 := makeServer(":5000", ":3000", ":4000")
-	//s1 监听 :3000（作为服务端）
-	//s2 监听 :4000，并尝试连接 s1 的 :3000（作为客户端）
-
-	//当 s2（:4000）调用 Dial(":3000") 与 s1（:3000）建立 TCP 连接时：
-	//s1 作为服务端，使用固定端口 3000 监听连接。
-	//s2 作为客户端，发起连接时需要一个本地端口与服务端通信，但代码中并未指定该端口（由操作系统自动分配）。
-
-	go s1.Start()
-	time.Sleep(500 * time.Millisecond)
-
-	go s2.Start()
-	time.Sleep(500 * time.Millisecond)
-
-	go s3.Start()
-	time.Sleep(500 * time.Millisecond)
-
-	for i := 0; i < 20; i++ {
-		key := fmt.Sprintf("picture_%d.png", i)
-		data := bytes.NewReader([]byte("my big data file here!"))
-		s3.Store(key, data)
-
-		if err := s3.store.Delete(s3.ID, key); err != nil {
-			log.Fatal(err)
-		}
+	os.Exit(run(os.Args[1:]))
+}
 
-		r, err := s3.Get(key)
-		if err != nil {
-			log.Fatal(err)
-		}
+func run(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return exitUsage
+	}
 
-		b, err := ioutil.ReadAll(r)
-		if err != nil {
-			log.Fatal(err)
-		}
-		fmt.Println(string(b))
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "node":
+		return runNode(args)
+	case "put":
+		return runPut(args)
+	case "get":
+		return runGet(args)
+	case "rm":
+		return runRm(args)
+	case "ls":
+		return runLs(args)
+	case "stat":
+		return runStat(args)
+	case "versions":
+		return runVersions(args)
+	case "rollback":
+		return runRollback(args)
+	case "share":
+		return runShare(args)
+	case "token":
+		return runToken(args)
+	case "peers":
+		return runPeers(args)
+	case "help", "-h", "--help":
+		fmt.Fprint(os.Stdout, usage)
+		return exitOK
 	}
+
+	fmt.Fprintf(os.Stderr, "fs: unknown command %q\n\n%s", cmd, usage)
+	return exitUsage
 }
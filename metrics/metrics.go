@@ -0,0 +1,237 @@
+// Package metrics 提供计数器、仪表和直方图，并按 Prometheus 文本格式导出
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets 默认的直方图分桶(秒)，与 Prometheus 客户端一致
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type collector interface {
+	write(w io.Writer, name string)
+}
+
+type entry struct {
+	name string
+	help string
+	kind string
+	c    collector
+}
+
+// Registry 保存所有指标，同名指标重复注册时后注册的覆盖先注册的
+type Registry struct {
+	mu      sync.Mutex
+	entries map[string]entry
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		entries: make(map[string]entry),
+	}
+}
+
+func (r *Registry) register(name, help, kind string, c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.entries[name] = entry{name: name, help: help, kind: kind, c: c}
+}
+
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	r.register(name, help, "counter", c)
+	return c
+}
+
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	r.register(name, help, "gauge", g)
+	return g
+}
+
+// NewGaugeFunc 注册一个在导出时才计算值的仪表
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(name, help, "gauge", gaugeFunc(fn))
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{
+		buckets: append([]float64(nil), buckets...),
+		counts:  make([]uint64, len(buckets)),
+	}
+	sort.Float64s(h.buckets)
+	r.register(name, help, "histogram", h)
+	return h
+}
+
+// WriteTo 按名称顺序以 Prometheus 文本格式输出所有指标
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	entries := make([]entry, 0, len(r.entries))
+	for _, e := range r.entries {
+		entries = append(entries, e)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+
+	cw := &countingWriter{w: w}
+	for _, e := range entries {
+		fmt.Fprintf(cw, "# HELP %s %s\n", e.name, e.help)
+		fmt.Fprintf(cw, "# TYPE %s %s\n", e.name, e.kind)
+		e.c.write(cw, e.name)
+	}
+
+	return cw.n, cw.err
+}
+
+// Handler 返回 /metrics 的 HTTP 处理器
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+// Counter 只增不减的计数器
+type Counter struct {
+	mu sync.Mutex
+	v  float64
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		return
+	}
+	c.mu.Lock()
+	c.v += v
+	c.mu.Unlock()
+}
+
+func (c *Counter) Value() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.v
+}
+
+func (c *Counter) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(c.Value()))
+}
+
+// Gauge 可增可减的仪表
+type Gauge struct {
+	mu sync.Mutex
+	v  float64
+}
+
+func (g *Gauge) Set(v float64) {
+	g.mu.Lock()
+	g.v = v
+	g.mu.Unlock()
+}
+
+func (g *Gauge) Add(v float64) {
+	g.mu.Lock()
+	g.v += v
+	g.mu.Unlock()
+}
+
+func (g *Gauge) Value() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.v
+}
+
+func (g *Gauge) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(g.Value()))
+}
+
+type gaugeFunc func() float64
+
+func (f gaugeFunc) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(f()))
+}
+
+// Histogram 按分桶统计观测值的分布
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64 // 落在每个分桶(不累计)的次数
+	count   uint64
+	sum     float64
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+func (h *Histogram) write(w io.Writer, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(le), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	s := strconv.FormatFloat(v, 'g', -1, 64)
+	if strings.Contains(s, "e+") {
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return s
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
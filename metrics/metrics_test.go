@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryWriteTo(t *testing.T) {
+	r := NewRegistry()
+
+	c := r.NewCounter("fs_bytes_total", "Bytes.")
+	c.Add(1024)
+	c.Inc()
+	c.Add(-5)
+
+	r.NewGaugeFunc("fs_peers", "Peers.", func() float64 { return 3 })
+
+	h := r.NewHistogram("fs_duration_seconds", "Duration.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	buf := new(bytes.Buffer)
+	_, err := r.WriteTo(buf)
+	assert.Nil(t, err)
+
+	want := `# HELP fs_bytes_total Bytes.
+# TYPE fs_bytes_total counter
+fs_bytes_total 1025
+# HELP fs_duration_seconds Duration.
+# TYPE fs_duration_seconds histogram
+fs_duration_seconds_bucket{le="0.1"} 1
+fs_duration_seconds_bucket{le="1"} 2
+fs_duration_seconds_bucket{le="+Inf"} 3
+fs_duration_seconds_sum 5.55
+fs_duration_seconds_count 3
+# HELP fs_peers Peers.
+# TYPE fs_peers gauge
+fs_peers 3
+`
+	assert.Equal(t, want, buf.String())
+}
+
+func TestFormatFloat(t *testing.T) {
+	assert.Equal(t, "123456789012", formatFloat(123456789012))
+	assert.Equal(t, "0.005", formatFloat(0.005))
+}
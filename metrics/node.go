@@ -0,0 +1,53 @@
+package metrics
+
+// Metrics 一个节点的所有指标，FileServer 和 TCPTransport 共用同一个实例
+type Metrics struct {
+	*Registry
+
+	BytesStored         *Counter
+	BytesServed         *Counter
+	StoreDuration       *Histogram
+	GetDuration         *Histogram
+	DecodeErrors        *Counter
+	HandshakeFailures   *Counter
+	QuotaRejections     *Counter
+	GCRuns              *Counter
+	GCReclaimedBytes    *Counter
+	GCReclaimedFiles    *Counter
+	ExpiredObjects      *Counter
+	ShardsRestored      *Counter
+	AuthRejections      *Counter
+	SignatureRejections *Counter
+	ConnectionsRejected *Counter
+	ConnectionsGated    *Counter
+	PeersDisconnected   *Counter
+	PeersBanned         *Counter
+	AuditErrors         *Counter
+}
+
+func New() *Metrics {
+	r := NewRegistry()
+
+	return &Metrics{
+		Registry:            r,
+		BytesStored:         r.NewCounter("fs_bytes_stored_total", "Bytes written to the local store, including replicas received from peers."),
+		BytesServed:         r.NewCounter("fs_bytes_served_total", "Bytes sent to peers in response to get requests."),
+		StoreDuration:       r.NewHistogram("fs_store_duration_seconds", "Time taken by FileServer.Store.", DefBuckets),
+		GetDuration:         r.NewHistogram("fs_get_duration_seconds", "Time taken by FileServer.Get.", DefBuckets),
+		DecodeErrors:        r.NewCounter("fs_decode_errors_total", "Messages from peers that could not be decoded."),
+		HandshakeFailures:   r.NewCounter("fs_handshake_failures_total", "Peer connections dropped because the handshake failed."),
+		QuotaRejections:     r.NewCounter("fs_quota_rejections_total", "Files from peers rejected because of an owner quota or the node capacity."),
+		GCRuns:              r.NewCounter("fs_gc_runs_total", "Completed garbage collection runs."),
+		GCReclaimedBytes:    r.NewCounter("fs_gc_reclaimed_bytes_total", "Bytes removed by garbage collection."),
+		GCReclaimedFiles:    r.NewCounter("fs_gc_reclaimed_files_total", "Incomplete and unreferenced files removed by garbage collection."),
+		ExpiredObjects:      r.NewCounter("fs_expired_objects_total", "Objects removed because their expiry time passed."),
+		ShardsRestored:      r.NewCounter("fs_erasure_shards_restored_total", "Erasure coded shards re-encoded and sent to peers after being lost."),
+		AuthRejections:      r.NewCounter("fs_auth_rejections_total", "Requests from peers rejected because of a missing or bad signature or a missing permission."),
+		SignatureRejections: r.NewCounter("fs_signature_rejections_total", "Objects rejected because of a missing, untrusted or bad uploader signature."),
+		ConnectionsRejected: r.NewCounter("fs_connections_rejected_total", "Inbound connections refused because of the total or per IP connection limit."),
+		ConnectionsGated:    r.NewCounter("fs_connections_gated_total", "Connections refused or closed because their address or identity is not allowed by the gate rules."),
+		PeersDisconnected:   r.NewCounter("fs_peers_disconnected_total", "Peer connections closed for an oversized message or object, a bad frame or a read timeout."),
+		PeersBanned:         r.NewCounter("fs_peers_banned_total", "Peer IPs temporarily banned because their reputation score fell below the ban score."),
+		AuditErrors:         r.NewCounter("fs_audit_errors_total", "Audit log entries that could not be written."),
+	}
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"distributed_file_storage/audit"
+	"distributed_file_storage/codec"
+	"distributed_file_storage/crypto"
+	"distributed_file_storage/metrics"
+	"distributed_file_storage/p2p"
+	"distributed_file_storage/server"
+	"distributed_file_storage/store"
+	"distributed_file_storage/trace"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// nodeKeys 节点身份与加密密钥，保存在 key 文件中以便重启后仍能访问自己的文件
+type nodeKeys struct {
+	ID           string   `json:"id"`
+	EncKey       string   `json:"enc_key"`
+	PreviousKeys []string `json:"previous_keys,omitempty"` // 轮换前还没有停用的主密钥
+	NameKey      string   `json:"name_key,omitempty"`      // 计算其他节点上的对象标识，不随主密钥轮换
+	ShareKey     string   `json:"share_key,omitempty"`     // 接收其他 owner 共享文件的 X25519 私钥
+	SignKey      string   `json:"sign_key,omitempty"`      // 签名身份密钥的 seed，新节点的 id 是它的公钥
+}
+
+// keySet 解码后的节点身份和主密钥
+type keySet struct {
+	ID       string
+	EncKey   []byte
+	Previous [][]byte
+	NameKey  []byte
+	ShareKey []byte
+	SignKey  ed25519.PrivateKey
+}
+
+// loadOrCreateKeyFile 读取 key 文件，不存在时生成新的身份并写入
+func loadOrCreateKeyFile(path string) (keySet, error) {
+	signKey := crypto.NewSignKey()
+	newKeys := keySet{
+		ID:       crypto.SignPublicKey(signKey),
+		EncKey:   crypto.NewEncryptionKey(),
+		NameKey:  crypto.NewEncryptionKey(),
+		ShareKey: crypto.NewShareKey(),
+		SignKey:  signKey,
+	}
+	if path == "" {
+		return newKeys, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return newKeys, writeKeyFile(path, newKeys)
+	}
+	if err != nil {
+		return keySet{}, err
+	}
+
+	var file nodeKeys
+	if err := json.Unmarshal(b, &file); err != nil {
+		return keySet{}, fmt.Errorf("key file %s: %w", path, err)
+	}
+	keys := keySet{ID: file.ID}
+	if keys.EncKey, err = decodeEncKey(file.EncKey); err != nil {
+		return keySet{}, fmt.Errorf("key file %s: enc_key %s", path, err)
+	}
+	for i, s := range file.PreviousKeys {
+		key, err := decodeEncKey(s)
+		if err != nil {
+			return keySet{}, fmt.Errorf("key file %s: previous_keys[%d] %s", path, i, err)
+		}
+		keys.Previous = append(keys.Previous, key)
+	}
+	if keys.ID == "" {
+		return keySet{}, fmt.Errorf("key file %s: missing id", path)
+	}
+
+	if file.NameKey != "" {
+		if keys.NameKey, err = decodeEncKey(file.NameKey); err != nil {
+			return keySet{}, fmt.Errorf("key file %s: name_key %s", path, err)
+		}
+	}
+	if file.ShareKey != "" {
+		if keys.ShareKey, err = decodeEncKey(file.ShareKey); err != nil {
+			return keySet{}, fmt.Errorf("key file %s: share_key %s", path, err)
+		}
+	}
+
+	if file.SignKey != "" {
+		seed, err := hex.DecodeString(file.SignKey)
+		if err == nil {
+			keys.SignKey, err = crypto.SignKeyFromSeed(seed)
+		}
+		if err != nil {
+			return keySet{}, fmt.Errorf("key file %s: sign_key %s", path, err)
+		}
+	}
+
+	// 旧的 key 文件没有 name_key、share_key 或 sign_key，生成之后写回。
+	// 这时 id 不是签名公钥，开启 auth.required 的节点需要在 ACL 中授权它
+	if keys.NameKey == nil || keys.ShareKey == nil || keys.SignKey == nil {
+		if keys.NameKey == nil {
+			keys.NameKey = crypto.NewEncryptionKey()
+		}
+		if keys.ShareKey == nil {
+			keys.ShareKey = crypto.NewShareKey()
+		}
+		if keys.SignKey == nil {
+			keys.SignKey = crypto.NewSignKey()
+		}
+		return keys, writeKeyFile(path, keys)
+	}
+
+	return keys, nil
+}
+
+// writeKeyFile 先写临时文件再重命名，轮换密钥时中断也不会丢失密钥
+func writeKeyFile(path string, keys keySet) error {
+	file := nodeKeys{
+		ID:       keys.ID,
+		EncKey:   hex.EncodeToString(keys.EncKey),
+		NameKey:  hex.EncodeToString(keys.NameKey),
+		ShareKey: hex.EncodeToString(keys.ShareKey),
+		SignKey:  hex.EncodeToString(keys.SignKey.Seed()),
+	}
+	for _, key := range keys.Previous {
+		file.PreviousKeys = append(file.PreviousKeys, hex.EncodeToString(key))
+	}
+	b, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func makeServer(cfg Config, keys keySet, gate *p2p.Gate, auditLog *audit.Log, m *metrics.Metrics, logger *slog.Logger, tracer *trace.Tracer) *server.FileServer {
+	tcpTransportOpts := p2p.TCPTransportOpts{
+		ListenAddr: cfg.Listen,
+		Decoder:    p2p.DefaultDecoder{MaxSize: cfg.Limits.MaxMessageSize},
+		Metrics:    m,
+		Logger:     logger,
+
+		MaxConns:         cfg.Limits.MaxConnections,
+		MaxConnsPerIP:    cfg.Limits.MaxConnectionsPerIP,
+		HandshakeTimeout: cfg.Limits.HandshakeTimeout,
+		IdleTimeout:      cfg.Limits.IdleTimeout,
+	}
+	tcpTransport := p2p.NewTCPTransport(tcpTransportOpts)
+
+	root := cfg.storageRoot()
+	banFile := cfg.Reputation.BanFile
+	if banFile == "" {
+		banFile = root + ".bans.json"
+	}
+	pathTransform, _ := pathTransformByName(cfg.PathTransform)
+	compression, _ := codec.Parse(cfg.Compression)
+	padding, _ := crypto.ParsePadding(cfg.Padding)
+
+	fileServerOpts := server.FileServerOpts{
+		ID:                keys.ID,
+		EncKey:            keys.EncKey,
+		PreviousKeys:      keys.Previous,
+		NameKey:           keys.NameKey,
+		ShareKey:          keys.ShareKey,
+		SignKey:           keys.SignKey,
+		StorageRoot:       root,
+		PathTransformFunc: pathTransform,
+		Transport:         tcpTransport,
+		BootstrapNodes:    cfg.Bootstrap,
+		ReplicationFactor: cfg.Replication.Factor,
+		MaxObjectSize:     cfg.Limits.MaxObjectSize,
+		MaxPeers:          cfg.Limits.MaxPeers,
+		MinStreamRate:     cfg.Limits.MinStreamRate,
+		Versioning:        cfg.Versioning,
+		Compression:       compression,
+		EncryptAtRest:     cfg.EncryptAtRest,
+		Padding:           padding,
+		Erasure: server.ErasureOpts{
+			DataShards:     cfg.Erasure.DataShards,
+			ParityShards:   cfg.Erasure.ParityShards,
+			RepairInterval: cfg.Erasure.RepairInterval,
+		},
+		Auth: cfg.Auth.authOpts(),
+		Reputation: server.ReputationOpts{
+			BanScore:    cfg.Reputation.BanScore,
+			BanDuration: cfg.Reputation.BanDuration,
+			HalfLife:    cfg.Reputation.HalfLife,
+			BanFile:     banFile,
+			BanIP:       cfg.Reputation.BanIP,
+		},
+		Quota: server.QuotaOpts{
+			Capacity:     cfg.Quota.Capacity,
+			DefaultOwner: cfg.Quota.DefaultOwner,
+			Owners:       cfg.Quota.Owners,
+		},
+		GCInterval: cfg.GC.Interval,
+		GCOpts: store.GCOpts{
+			GracePeriod:    cfg.GC.GracePeriod,
+			FilesPerSecond: cfg.GC.FilesPerSecond,
+		},
+		ExpiryInterval: cfg.Expiry.Interval,
+		AuditLog:       auditLog,
+		Metrics:        m,
+		Logger:         logger,
+		Tracer:         tracer,
+	}
+
+	s := server.NewFileServer(fileServerOpts)
+
+	// 签名密钥为空时由 NewFileServer 派生，握手使用同一个身份
+	tcpTransport.HandshakeFunc = p2p.IdentityHandshake(s.SignKey)
+	// 被封禁的节点和 gate 规则拒绝的连接一样在握手前后被拒绝
+	tcpTransport.Gater = p2p.Gaters{gate, s}
+	tcpTransport.OnPeer = s.OnPeer
+	tcpTransport.OnPeerClose = s.OnPeerClose
+	tcpTransport.OnMisbehave = s.OnMisbehave
+
+	return s
+}
+
+// nodeConfig 解析 node 子命令的参数，依次应用配置文件、环境变量和命令行参数
+func nodeConfig(name string, args []string) (Config, error) {
+	fset := flag.NewFlagSet(name, flag.ContinueOnError)
+	var (
+		configFile  = fset.String("config", os.Getenv("FS_CONFIG"), "node configuration file (env FS_CONFIG)")
+		listen      = fset.String("listen", "", "peer-to-peer listen address")
+		bootstrap   = fset.String("bootstrap", "", "comma separated list of peers to connect to")
+		root        = fset.String("root", "", "storage root (default <listen>_network)")
+		keyFile     = fset.String("key-file", "", "file holding the node id and encryption key, created if missing")
+		apiAddr     = fset.String("api", "", "client API listen address")
+		adminAddr   = fset.String("admin", "", "admin status listen address, host:port or unix:<path>")
+		metricsAddr = fset.String("metrics", "", "listen address of the Prometheus /metrics endpoint")
+		logLevel    = fset.String("log-level", "", "log level: debug, info, warn, error or off")
+		logFormat   = fset.String("log-format", "", "log format: text or json")
+	)
+	if err := fset.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return cfg, err
+	}
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return cfg, err
+	}
+
+	fset.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen = *listen
+		case "bootstrap":
+			cfg.Bootstrap = splitList(*bootstrap)
+		case "root":
+			cfg.StorageRoot = *root
+		case "key-file":
+			cfg.Key.Source = keySourceFile
+			cfg.Key.File = *keyFile
+		case "api":
+			cfg.API = *apiAddr
+		case "admin":
+			cfg.Admin = *adminAddr
+		case "metrics":
+			cfg.Metrics.Listen = *metricsAddr
+		case "log-level":
+			cfg.Log.Level = *logLevel
+		case "log-format":
+			cfg.Log.Format = *logFormat
+		}
+	})
+
+	return cfg, cfg.Validate()
+}
+
+func runNode(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: fs node start|config|status|gc|rotate-key|migrate-ids|reload|verify-audit [flags]")
+		return exitUsage
+	}
+
+	switch args[0] {
+	case "start":
+		return runNodeStart(args[1:])
+	case "config":
+		return runNodeConfig(args[1:])
+	case "status":
+		return runNodeStatus(args[1:])
+	case "gc":
+		return runNodeGC(args[1:])
+	case "rotate-key":
+		return runNodeRotateKey(args[1:])
+	case "migrate-ids":
+		return runNodeMigrateIDs(args[1:])
+	case "reload":
+		return runNodeReload(args[1:])
+	case "verify-audit":
+		return runNodeVerifyAudit(args[1:])
+	}
+
+	fmt.Fprintln(os.Stderr, "usage: fs node start|config|status|gc|rotate-key|migrate-ids|reload|verify-audit [flags]")
+	return exitUsage
+}
+
+func runNodeStart(args []string) int {
+	cfg, err := nodeConfig("node start", args)
+	if errors.Is(err, flag.ErrHelp) {
+		return exitUsage
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fs:", err)
+		return exitUsage
+	}
+
+	keys, err := cfg.loadKeys()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fs:", err)
+		return exitError
+	}
+
+	logger := cfg.newLogger()
+	slog.SetDefault(logger)
+
+	var exporter trace.Exporter
+	if cfg.Tracing.OTLPEndpoint != "" {
+		exporter = trace.NewOTLPExporter(trace.OTLPExporterOpts{
+			Endpoint:    cfg.Tracing.OTLPEndpoint,
+			ServiceName: cfg.Tracing.ServiceName,
+			Logger:      logger,
+		})
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			exporter.Shutdown(ctx)
+		}()
+	}
+
+	rules, _ := cfg.Gate.rules()
+	gate := p2p.NewGate(rules)
+
+	var auditLog *audit.Log
+	if cfg.Audit.Enabled {
+		auditLog, err = audit.NewLog(audit.LogOpts{
+			Path:     cfg.auditFile(),
+			MaxSize:  cfg.Audit.MaxSize,
+			MaxFiles: cfg.Audit.MaxFiles,
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "fs: audit:", err)
+			return exitError
+		}
+		defer auditLog.Close()
+	}
+
+	m := metrics.New()
+	s := makeServer(cfg, keys, gate, auditLog, m, logger, trace.NewTracer(exporter))
+	reload := func() (reloadResult, error) {
+		return reloadGate(args, gate, s.Transport.(*p2p.TCPTransport))
+	}
+
+	// 只有 key 文件能保存轮换后的主密钥
+	keyFile := ""
+	if cfg.Key.Source == keySourceFile {
+		keyFile = cfg.keyFile()
+	}
+
+	if cfg.API != "" {
+		go func() {
+			logger.Info("client API listening", "addr", cfg.API)
+			if err := http.ListenAndServe(cfg.API, newAPIHandler(s, cfg.APIToken)); err != nil {
+				logger.Error("client API error", "err", err)
+				s.Stop()
+			}
+		}()
+	}
+
+	if cfg.Admin != "" {
+		ln, err := listenAdmin(cfg.Admin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "fs: admin:", err)
+			return exitError
+		}
+		defer ln.Close()
+
+		go func() {
+			logger.Info("admin listening", "addr", cfg.Admin)
+			if err := http.Serve(ln, newAdminHandler(s, keyFile, cfg.AdminToken, reload)); err != nil && !errors.Is(err, net.ErrClosed) {
+				logger.Error("admin error", "err", err)
+			}
+		}()
+	}
+
+	if cfg.Metrics.Listen != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("GET /metrics", m.Handler())
+			logger.Info("metrics listening", "addr", cfg.Metrics.Listen)
+			if err := http.ListenAndServe(cfg.Metrics.Listen, mux); err != nil {
+				logger.Error("metrics error", "err", err)
+			}
+		}()
+	}
+
+	go func() {
+		sigch := make(chan os.Signal, 1)
+		signal.Notify(sigch, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+		for sig := range sigch {
+			if sig != syscall.SIGHUP {
+				break
+			}
+			if res, err := reload(); err != nil {
+				logger.Error("reload failed, keeping the current gate rules", "err", err)
+			} else {
+				logger.Info("reloaded gate rules", "closed", res.Closed)
+			}
+		}
+		s.Stop()
+	}()
+
+	if err := s.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, "fs:", err)
+		return exitError
+	}
+
+	return exitOK
+}
+
+// runNodeVerifyAudit 校验审计日志及其轮换文件的哈希链，不需要节点在运行
+func runNodeVerifyAudit(args []string) int {
+	fset := flag.NewFlagSet("node verify-audit", flag.ContinueOnError)
+	asJSON := fset.Bool("json", false, "print machine readable JSON output")
+	if err := fset.Parse(args); err != nil || fset.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: fs node verify-audit [flags] <file>")
+		return exitUsage
+	}
+
+	report, err := audit.Verify(fset.Arg(0))
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		fmt.Printf("files:   %d\n", len(report.Files))
+		fmt.Printf("entries: %d (%d to %d)\n", report.Entries, report.First, report.Last)
+		fmt.Printf("head:    %s\n", report.Head)
+		if report.First > 1 {
+			fmt.Println("note:    entries before the first one were rotated away and cannot be checked")
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fs:", err)
+		return exitError
+	}
+	return exitOK
+}
+
+// reloadResult POST /reload 的结果
+type reloadResult struct {
+	Gate   GateConfig `json:"gate"`
+	Closed int        `json:"closed"` // 新规则不再允许而被关闭的连接数
+}
+
+// reloadGate 重新读取配置文件和环境变量中的 gate 规则，关闭不再允许的连接。
+// 配置无效时保留当前规则
+func reloadGate(args []string, gate *p2p.Gate, tr *p2p.TCPTransport) (reloadResult, error) {
+	cfg, err := nodeConfig("node start", args)
+	if err != nil {
+		return reloadResult{}, err
+	}
+	rules, err := cfg.Gate.rules()
+	if err != nil {
+		return reloadResult{}, err
+	}
+	gate.SetRules(rules)
+	return reloadResult{Gate: cfg.Gate, Closed: tr.Regate()}, nil
+}
+
+// runNodeConfig 打印合并文件、环境变量和参数之后实际生效的配置
+func runNodeConfig(args []string) int {
+	cfg, err := nodeConfig("node config", args)
+	if errors.Is(err, flag.ErrHelp) {
+		return exitUsage
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fs:", err)
+		return exitUsage
+	}
+
+	b, err := cfg.dump()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fs:", err)
+		return exitError
+	}
+	os.Stdout.Write(b)
+
+	return exitOK
+}
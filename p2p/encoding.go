@@ -1,10 +1,31 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"io"
 )
 
+// MaxMessageSize 没有设置 DefaultDecoder.MaxSize 时一条消息(不包括数据流)的最大字节数
+const MaxMessageSize = 1 << 20
+
+var (
+	// ErrMessageTooLarge 消息超过解码器的上限，发送方不可信，连接会被断开
+	ErrMessageTooLarge = errors.New("message too large")
+	// ErrBadFrame 消息既不是 IncomingMessage 也不是 IncomingStream
+	ErrBadFrame = errors.New("bad frame")
+)
+
+// EncodeMessage 在消息前加上 IncomingMessage 和 4 字节长度，整条消息用一次 Send 发送
+func EncodeMessage(payload []byte) []byte {
+	frame := make([]byte, 5, 5+len(payload))
+	frame[0] = IncomingMessage
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	return append(frame, payload...)
+}
+
 type Decoder interface {
 	Decode(io.Reader, *RPC) error
 }
@@ -15,12 +36,14 @@ func (dec GOBDecoder) Decode(r io.Reader, rpc *RPC) error {
 	return gob.NewDecoder(r).Decode(rpc)
 }
 
-type DefaultDecoder struct{}
+type DefaultDecoder struct {
+	MaxSize int64 // 一条消息的最大字节数，0 表示 MaxMessageSize
+}
 
 func (dec DefaultDecoder) Decode(r io.Reader, rpc *RPC) error {
 	peekBuf := make([]byte, 1)
-	if _, err := r.Read(peekBuf); err != nil {
-		return nil
+	if _, err := io.ReadFull(r, peekBuf); err != nil {
+		return err
 	}
 
 	// 流传输，不通过网络解码
@@ -29,14 +52,28 @@ func (dec DefaultDecoder) Decode(r io.Reader, rpc *RPC) error {
 		rpc.Stream = true
 		return nil
 	}
+	if peekBuf[0] != IncomingMessage {
+		return fmt.Errorf("frame type %#x: %w", peekBuf[0], ErrBadFrame)
+	}
 
-	buf := make([]byte, 1028)
-	n, err := r.Read(buf)
-	if err != nil {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
 		return err
 	}
+	maxSize := dec.MaxSize
+	if maxSize <= 0 {
+		maxSize = MaxMessageSize
+	}
+	if int64(size) > maxSize {
+		// 不读取消息内容，调用方应该断开连接
+		return fmt.Errorf("message of %d bytes exceeds the limit of %d: %w", size, maxSize, ErrMessageTooLarge)
+	}
 
-	rpc.Payload = buf[:n]
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	rpc.Payload = buf
 
 	return nil
 }
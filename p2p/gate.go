@@ -0,0 +1,145 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrGated 连接的地址或身份被 Gater 拒绝
+var ErrGated = errors.New("connection gated")
+
+// Gater 决定是否接受一个连接，TCPTransportOpts.Gater 为空时接受所有连接
+type Gater interface {
+	// AllowAddr 在接受入站连接之后、握手之前调用
+	AllowAddr(addr net.Addr) error
+	// AllowPeer 在握手之后调用，入站和出站连接都会检查
+	AllowPeer(p Peer) error
+}
+
+// Gaters 依次检查多个 Gater，任何一个拒绝时拒绝连接
+type Gaters []Gater
+
+func (gs Gaters) AllowAddr(addr net.Addr) error {
+	for _, g := range gs {
+		if err := g.AllowAddr(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (gs Gaters) AllowPeer(p Peer) error {
+	for _, g := range gs {
+		if err := g.AllowPeer(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GateRules 地址和身份的允许、拒绝列表。拒绝列表优先，允许列表不为空时只接受其中的地址或身份
+type GateRules struct {
+	AllowCIDRs      []netip.Prefix
+	DenyCIDRs       []netip.Prefix
+	AllowIdentities []string // 签名公钥(hex)，需要 IdentityHandshake
+	DenyIdentities  []string
+}
+
+// ParseCIDRs 解析 CIDR 列表，单个 IP 视为只包含它的网段
+func ParseCIDRs(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("%q is neither an IP nor a CIDR", s)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither an IP nor a CIDR", s)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Gate 按 GateRules 过滤连接，规则可以在运行时替换
+type Gate struct {
+	rules atomic.Pointer[GateRules]
+}
+
+func NewGate(rules GateRules) *Gate {
+	g := &Gate{}
+	g.SetRules(rules)
+	return g
+}
+
+// SetRules 替换规则，已经建立的连接需要调用 TCPTransport.Regate 重新检查
+func (g *Gate) SetRules(rules GateRules) {
+	g.rules.Store(&rules)
+}
+
+func (g *Gate) Rules() GateRules {
+	return *g.rules.Load()
+}
+
+func (g *Gate) AllowAddr(addr net.Addr) error {
+	rules := g.rules.Load()
+	if len(rules.AllowCIDRs) == 0 && len(rules.DenyCIDRs) == 0 {
+		return nil
+	}
+
+	ip, err := addrIP(addr)
+	if err != nil {
+		return fmt.Errorf("%s: %v: %w", addr, err, ErrGated)
+	}
+	for _, prefix := range rules.DenyCIDRs {
+		if prefix.Contains(ip) {
+			return fmt.Errorf("%s is in the denied range %s: %w", ip, prefix, ErrGated)
+		}
+	}
+	if len(rules.AllowCIDRs) == 0 {
+		return nil
+	}
+	for _, prefix := range rules.AllowCIDRs {
+		if prefix.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not in an allowed range: %w", ip, ErrGated)
+}
+
+func (g *Gate) AllowPeer(p Peer) error {
+	rules := g.rules.Load()
+	id := p.Identity()
+	if slices.Contains(rules.DenyIdentities, id) && id != "" {
+		return fmt.Errorf("identity %.16s is denied: %w", id, ErrGated)
+	}
+	if len(rules.AllowIdentities) > 0 && !slices.Contains(rules.AllowIdentities, id) {
+		if id == "" {
+			return fmt.Errorf("%s did not prove an identity: %w", p.RemoteAddr(), ErrGated)
+		}
+		return fmt.Errorf("identity %.16s is not allowed: %w", id, ErrGated)
+	}
+	return nil
+}
+
+// addrIP 返回地址中的 IP，IPv4 映射的 IPv6 地址转换成 IPv4
+func addrIP(addr net.Addr) (netip.Addr, error) {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.AddrPort().Addr().Unmap(), nil
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return ap.Addr().Unmap(), nil
+}
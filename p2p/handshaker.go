@@ -1,5 +1,13 @@
 package p2p
 
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"distributed_file_storage/crypto"
+	"fmt"
+	"io"
+)
+
 // HandshakeFunc ....
 type HandshakeFunc func(Peer) error
 
@@ -7,3 +15,70 @@ type HandshakeFunc func(Peer) error
 func NOPHandshakeFunc(Peer) error {
 	return nil
 }
+
+// handshakeNonceSize 握手时每一方发送的随机数的字节数
+const handshakeNonceSize = 32
+
+// identitySetter 能记录握手确认的身份的 Peer
+type identitySetter interface {
+	setIdentity(string)
+}
+
+// IdentityHandshake 双方交换签名公钥和随机数，再对对方的随机数签名，证明自己持有身份私钥。
+// 握手成功后 Peer.Identity 返回对方的签名公钥(hex)
+func IdentityHandshake(key ed25519.PrivateKey) HandshakeFunc {
+	return func(p Peer) error {
+		setter, ok := p.(identitySetter)
+		if !ok {
+			return fmt.Errorf("handshake: %T cannot record an identity", p)
+		}
+
+		pub := key.Public().(ed25519.PublicKey)
+		nonce := make([]byte, handshakeNonceSize)
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return err
+		}
+
+		hello := append(append([]byte{}, pub...), nonce...)
+		peerHello, err := swap(p, hello)
+		if err != nil {
+			return fmt.Errorf("handshake: %w", err)
+		}
+		peerPub, peerNonce := peerHello[:ed25519.PublicKeySize], peerHello[ed25519.PublicKeySize:]
+
+		sig := crypto.Sign(key, handshakeDigest(peerNonce, peerPub, pub))
+		peerSig, err := swap(p, sig)
+		if err != nil {
+			return fmt.Errorf("handshake: %w", err)
+		}
+
+		identity := fmt.Sprintf("%x", peerPub)
+		if err := crypto.Verify(identity, handshakeDigest(nonce, pub, peerPub), peerSig); err != nil {
+			return fmt.Errorf("handshake with %s: %w", p.RemoteAddr(), err)
+		}
+		setter.setIdentity(identity)
+		return nil
+	}
+}
+
+// swap 发送 b 并读取对方发送的同样长度的数据。写入放在单独的 goroutine 中，
+// 双方同时写入时不会因为同步的连接(如 net.Pipe)互相等待
+func swap(p Peer, b []byte) ([]byte, error) {
+	errch := make(chan error, 1)
+	go func() {
+		_, err := p.Write(b)
+		errch <- err
+	}()
+	buf := make([]byte, len(b))
+	if _, err := io.ReadFull(p, buf); err != nil {
+		return nil, err
+	}
+	return buf, <-errch
+}
+
+// handshakeDigest 对 nonce 的签名同时绑定双方的公钥，签名不能被转发到其他连接
+func handshakeDigest(nonce, receiver, signer []byte) []byte {
+	b := append([]byte("fs handshake\n"), nonce...)
+	b = append(b, receiver...)
+	return append(b, signer...)
+}
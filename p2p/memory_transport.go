@@ -0,0 +1,289 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// ErrConnRefused 内存网络中没有节点监听目标地址
+var ErrConnRefused = errors.New("connection refused")
+
+// MemoryNetwork 进程内的网络，同一个网络中的 MemoryTransport 可以按地址互相连接
+type MemoryNetwork struct {
+	mu        sync.Mutex
+	listeners map[string]*memoryListener
+	nextPort  int // 主动连接一方的临时端口
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		listeners: make(map[string]*memoryListener),
+		nextPort:  49152,
+	}
+}
+
+func (n *MemoryNetwork) listen(addr string) (*memoryListener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.listeners[addr]; ok {
+		return nil, fmt.Errorf("listen memory %s: address already in use", addr)
+	}
+	l := &memoryListener{
+		network: n,
+		addr:    memoryAddr(addr),
+		connch:  make(chan net.Conn),
+		closech: make(chan struct{}),
+	}
+	n.listeners[addr] = l
+	return l, nil
+}
+
+// dial 连接 addr，返回主动连接一方的 conn。from 是发起方的监听地址，用作对方看到的地址(端口换成临时端口)
+func (n *MemoryNetwork) dial(from, addr string) (net.Conn, error) {
+	n.mu.Lock()
+	l, ok := n.listeners[addr]
+	n.nextPort++
+	port := n.nextPort
+	n.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("dial memory %s: %w", addr, ErrConnRefused)
+	}
+
+	host, _, err := net.SplitHostPort(from)
+	if err != nil {
+		host = from
+	}
+	local := memoryAddr(net.JoinHostPort(host, strconv.Itoa(port)))
+
+	c1, c2 := net.Pipe()
+	client := newMemoryConn(c1, local, l.addr)
+	server := newMemoryConn(c2, l.addr, local)
+	select {
+	case l.connch <- server:
+		return client, nil
+	case <-l.closech:
+		client.Close()
+		server.Close()
+		return nil, fmt.Errorf("dial memory %s: %w", addr, ErrConnRefused)
+	}
+}
+
+// memoryAddr 内存网络中的地址，可以是任意字符串
+type memoryAddr string
+
+func (a memoryAddr) Network() string { return "memory" }
+
+func (a memoryAddr) String() string { return string(a) }
+
+// memoryListener 实现 net.Listener
+type memoryListener struct {
+	network   *MemoryNetwork
+	addr      memoryAddr
+	connch    chan net.Conn
+	closech   chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connch:
+		return conn, nil
+	case <-l.closech:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closech)
+		l.network.mu.Lock()
+		delete(l.network.listeners, string(l.addr))
+		l.network.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.addr
+}
+
+// memoryConn 在 net.Pipe 的基础上缓冲写入：net.Pipe 的写入要等对方读取，
+// 而 TCP 连接有内核缓冲区，双方同时写入时不会互相等待
+type memoryConn struct {
+	net.Conn // 读取和截止时间由 net.Pipe 实现
+	local    net.Addr
+	remote   net.Addr
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  [][]byte
+	closed bool
+	err    error // 写入 net.Pipe 的错误，之后的 Write 返回它
+}
+
+func newMemoryConn(conn net.Conn, local, remote net.Addr) *memoryConn {
+	c := &memoryConn{Conn: conn, local: local, remote: remote}
+	c.cond = sync.NewCond(&c.mu)
+	go c.flush()
+	return c
+}
+
+func (c *memoryConn) LocalAddr() net.Addr { return c.local }
+
+func (c *memoryConn) RemoteAddr() net.Addr { return c.remote }
+
+// Read 与 TCP 连接一样，读取已经关闭的连接返回 net.ErrClosed
+func (c *memoryConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if errors.Is(err, io.ErrClosedPipe) {
+		err = net.ErrClosed
+	}
+	return n, err
+}
+
+func (c *memoryConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.queue = append(c.queue, append([]byte(nil), b...))
+	c.cond.Signal()
+	return len(b), nil
+}
+
+// flush 按顺序把缓冲的数据写入 net.Pipe
+func (c *memoryConn) flush() {
+	for {
+		c.mu.Lock()
+		for len(c.queue) == 0 && !c.closed {
+			c.cond.Wait()
+		}
+		if c.closed {
+			c.mu.Unlock()
+			return
+		}
+		b := c.queue[0]
+		c.queue = c.queue[1:]
+		c.mu.Unlock()
+
+		if _, err := c.Conn.Write(b); err != nil {
+			c.mu.Lock()
+			c.err, c.queue = err, nil
+			c.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Close 关闭连接，还没有被对方读取的数据会被丢弃
+func (c *memoryConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.queue = nil
+	c.cond.Signal()
+	c.mu.Unlock()
+
+	return c.Conn.Close()
+}
+
+// MemoryTransport 不经过操作系统网络的 Transport，用于测试。
+// 握手、Gater、限制、解码和数据流的处理与 TCPTransport 相同，ListenAddr 可以是任意字符串
+type MemoryTransport struct {
+	*TCPTransport
+	network *MemoryNetwork
+
+	lock      sync.Mutex
+	conns     map[net.Conn]struct{} // Close 时关闭所有连接
+	listening chan struct{}
+}
+
+func NewMemoryTransport(network *MemoryNetwork, opts TCPTransportOpts) *MemoryTransport {
+	return &MemoryTransport{
+		TCPTransport: NewTCPTransport(opts),
+		network:      network,
+		conns:        make(map[net.Conn]struct{}),
+		listening:    make(chan struct{}),
+	}
+}
+
+// Listening 返回一个在 ListenAndAccept 成功后关闭的 channel
+func (t *MemoryTransport) Listening() <-chan struct{} {
+	return t.listening
+}
+
+func (t *MemoryTransport) ListenAndAccept() error {
+	l, err := t.network.listen(t.ListenAddr)
+	if err != nil {
+		return err
+	}
+	t.listener = &trackingListener{Listener: l, t: t}
+
+	go t.startAcceptLoop()
+	close(t.listening)
+
+	t.Logger.Info("memory transport listening", "addr", t.ListenAddr)
+
+	return nil
+}
+
+func (t *MemoryTransport) Dial(addr string) error {
+	conn, err := t.network.dial(t.ListenAddr, addr)
+	if err != nil {
+		return err
+	}
+	t.remember(conn)
+
+	t.acquire(conn, true)
+	go t.handleConn(conn, true)
+
+	return nil
+}
+
+// Close 停止监听并关闭所有连接
+func (t *MemoryTransport) Close() error {
+	if t.listener != nil {
+		t.listener.Close()
+	}
+
+	t.lock.Lock()
+	conns := t.conns
+	t.conns = make(map[net.Conn]struct{})
+	t.lock.Unlock()
+
+	for conn := range conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// remember 记录连接，用于 Close
+func (t *MemoryTransport) remember(conn net.Conn) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.conns[conn] = struct{}{}
+}
+
+// trackingListener 记录接受的连接
+type trackingListener struct {
+	net.Listener
+	t *MemoryTransport
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.t.remember(conn)
+	}
+	return conn, err
+}
@@ -0,0 +1,108 @@
+package p2p
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryTransport(t *testing.T) {
+	network := NewMemoryNetwork()
+	peers := make(chan Peer, 2)
+	closed := make(chan Peer, 2)
+	newTransport := func(addr string) *MemoryTransport {
+		return NewMemoryTransport(network, TCPTransportOpts{
+			ListenAddr:    addr,
+			HandshakeFunc: NOPHandshakeFunc,
+			Decoder:       DefaultDecoder{},
+			OnPeer:        func(p Peer) error { peers <- p; return nil },
+			OnPeerClose:   func(p Peer) { closed <- p },
+		})
+	}
+	a, b := newTransport("10.0.0.1:3000"), newTransport("10.0.0.2:3000")
+	assert.Nil(t, a.ListenAndAccept())
+	assert.NotNil(t, newTransport("10.0.0.1:3000").ListenAndAccept())
+	assert.ErrorIs(t, b.Dial("10.0.0.9:3000"), ErrConnRefused)
+
+	assert.Nil(t, b.Dial("10.0.0.1:3000"))
+	var inbound, outbound Peer
+	for i := 0; i < 2; i++ {
+		p := <-peers
+		if p.Outbound() {
+			outbound = p
+		} else {
+			inbound = p
+		}
+	}
+	assert.Equal(t, "10.0.0.1:3000", outbound.RemoteAddr().String())
+	assert.Contains(t, inbound.RemoteAddr().String(), "10.0.0.2:")
+
+	// 双方可以同时写入，不需要等待对方读取
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, outbound.Send(EncodeMessage([]byte("ping"))))
+		assert.Nil(t, inbound.Send(EncodeMessage([]byte("pong"))))
+	}
+	for i := 0; i < 100; i++ {
+		rpc := <-a.Consume()
+		assert.Equal(t, []byte("ping"), rpc.Payload)
+		assert.Equal(t, inbound.RemoteAddr().String(), rpc.From)
+		assert.Equal(t, []byte("pong"), (<-b.Consume()).Payload)
+	}
+
+	// 关闭后双方的连接都断开，地址可以重新使用
+	assert.Nil(t, a.Close())
+	for i := 0; i < 2; i++ {
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatal("connection not closed")
+		}
+	}
+	assert.Nil(t, newTransport("10.0.0.1:3000").ListenAndAccept())
+}
+
+func TestPeerWaitStream(t *testing.T) {
+	network := NewMemoryNetwork()
+	peers := make(chan Peer, 2)
+	newTransport := func(addr string) *MemoryTransport {
+		return NewMemoryTransport(network, TCPTransportOpts{
+			ListenAddr:    addr,
+			HandshakeFunc: NOPHandshakeFunc,
+			Decoder:       DefaultDecoder{},
+			OnPeer:        func(p Peer) error { peers <- p; return nil },
+		})
+	}
+	a, b := newTransport("10.0.0.1:3000"), newTransport("10.0.0.2:3000")
+	assert.Nil(t, a.ListenAndAccept())
+	defer a.Close()
+	assert.Nil(t, b.Dial("10.0.0.1:3000"))
+	var inbound, outbound Peer
+	for i := 0; i < 2; i++ {
+		if p := <-peers; p.Outbound() {
+			outbound = p
+		} else {
+			inbound = p
+		}
+	}
+
+	assert.ErrorIs(t, inbound.WaitStream(10*time.Millisecond), os.ErrDeadlineExceeded)
+
+	// 读循环停在数据流之前，调用方读完后它继续读取下一条消息
+	outbound.Send([]byte{IncomingStream})
+	outbound.Write([]byte("data"))
+	outbound.Send(EncodeMessage([]byte("next")))
+	assert.Nil(t, inbound.WaitStream(time.Second))
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(inbound, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("data"), buf)
+	inbound.CloseStream()
+	assert.Equal(t, []byte("next"), (<-a.Consume()).Payload)
+
+	assert.Nil(t, b.Close())
+	assert.ErrorIs(t, inbound.WaitStream(time.Second), net.ErrClosed)
+}
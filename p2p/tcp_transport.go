@@ -1,33 +1,96 @@
 package p2p
 
 import (
+	"distributed_file_storage/metrics"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
+	"os"
 	"sync"
+	"time"
 )
 
+// ErrTooManyConns 入站连接超过 MaxConns 或 MaxConnsPerIP
+var ErrTooManyConns = errors.New("too many connections")
+
 // TCPPeer 通过TCP建立的远程节点
 type TCPPeer struct {
 	net.Conn
 	// outbound == true：表示这个连接是由本地节点主动发起（dial）的（出站连接）
 	// outbound == false：表示这个连接是由本地节点被动接受（accept）的（入站连接）
 	outbound bool // 出站
+	identity string
 
-	wg *sync.WaitGroup
+	streamch  chan struct{} // 读循环读到 IncomingStream 后通知 WaitStream
+	donech    chan struct{} // CloseStream 通知读循环继续读取消息
+	closech   chan struct{}
+	closeOnce sync.Once
 }
 
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
 	return &TCPPeer{
 		Conn:     conn,
 		outbound: outbound,
-		wg:       &sync.WaitGroup{},
+		streamch: make(chan struct{}, 1),
+		donech:   make(chan struct{}),
+		closech:  make(chan struct{}),
+	}
+}
+
+func (p *TCPPeer) Outbound() bool {
+	return p.outbound
+}
+
+func (p *TCPPeer) Identity() string {
+	return p.identity
+}
+
+func (p *TCPPeer) setIdentity(identity string) {
+	p.identity = identity
+}
+
+// WaitStream 等待对方的数据流到达。读循环读到 IncomingStream 后停下来，由调用方读取数据流，
+// 读完后调用 CloseStream。超时后数据流可能随时到达，调用方应该断开连接
+func (p *TCPPeer) WaitStream(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-p.streamch:
+		return nil
+	case <-p.closech:
+		return net.ErrClosed
+	case <-timer.C:
+		return fmt.Errorf("no stream from %s within %s: %w", p.RemoteAddr(), timeout, os.ErrDeadlineExceeded)
 	}
 }
 
 func (p *TCPPeer) CloseStream() {
-	p.wg.Done()
+	select {
+	case p.donech <- struct{}{}:
+	case <-p.closech:
+	}
+}
+
+// Close 关闭连接，等待中的 WaitStream 和读循环随之返回
+func (p *TCPPeer) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closech)
+	})
+	return p.Conn.Close()
+}
+
+// stream 由读循环调用，等待调用方读完数据流。连接关闭时返回 false
+func (p *TCPPeer) stream() bool {
+	p.streamch <- struct{}{}
+	select {
+	case <-p.donech:
+		return true
+	case <-p.closech:
+		return false
+	}
 }
 
 func (p *TCPPeer) Send(data []byte) error {
@@ -36,22 +99,46 @@ func (p *TCPPeer) Send(data []byte) error {
 }
 
 type TCPTransportOpts struct {
-	ListenAddr    string           // 监听地址
-	HandshakeFunc HandshakeFunc    // 握手处理函数
-	Decoder       Decoder          // 解码器
-	OnPeer        func(Peer) error // 两个节点成功建立连接并完成握手后的一些操作(回调函数)
+	ListenAddr    string            // 监听地址
+	HandshakeFunc HandshakeFunc     // 握手处理函数
+	Decoder       Decoder           // 解码器
+	OnPeer        func(Peer) error  // 两个节点成功建立连接并完成握手后的一些操作(回调函数)
+	OnPeerClose   func(Peer)        // 连接断开后的回调
+	OnMisbehave   func(Peer, error) // 对方握手失败或者违反协议、限制被断开时的回调
+	Gater         Gater             // 按地址和身份过滤连接，为空时接受所有连接
+	Metrics       *metrics.Metrics  // 为空时使用一个不导出的实例
+	Logger        *slog.Logger      // 为空时使用 slog.Default()
+
+	// 以下限制为 0 表示不限制
+	MaxConns         int           // 同时打开的连接数(包括主动发起的)，超过时拒绝新的入站连接
+	MaxConnsPerIP    int           // 来自同一个 IP 的入站连接数
+	HandshakeTimeout time.Duration // 握手的最长时间
+	IdleTimeout      time.Duration // 多久没有收到新消息就断开连接，不限制数据流的传输时间
 }
 
 type TCPTransport struct {
 	TCPTransportOpts
 	listener net.Listener // 监听接口
 	rpcch    chan RPC     // 消息管道
+
+	connLock sync.Mutex
+	conns    int                   // 打开的连接数
+	connsIP  map[string]int        // 每个 IP 的入站连接数
+	peers    map[*TCPPeer]struct{} // 完成握手的连接，用于 Regate
 }
 
 func NewTCPTransport(opts TCPTransportOpts) *TCPTransport {
+	if opts.Metrics == nil {
+		opts.Metrics = metrics.New()
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
 	return &TCPTransport{
 		TCPTransportOpts: opts,
 		rpcch:            make(chan RPC, 1024),
+		connsIP:          make(map[string]int),
+		peers:            make(map[*TCPPeer]struct{}),
 	}
 }
 
@@ -75,6 +162,7 @@ func (t *TCPTransport) Dial(addr string) error {
 		return err
 	}
 
+	t.acquire(conn, true)
 	go t.handleConn(conn, true)
 
 	return nil
@@ -90,7 +178,7 @@ func (t *TCPTransport) ListenAndAccept() error {
 
 	go t.startAcceptLoop()
 
-	log.Println("TCP transport listening on port: ", t.ListenAddr)
+	t.Logger.Info("TCP transport listening", "addr", t.ListenAddr)
 
 	return nil
 }
@@ -102,26 +190,101 @@ func (t *TCPTransport) startAcceptLoop() {
 			return
 		}
 		if err != nil {
-			fmt.Println("Error accepting connection: ", err)
+			t.Logger.Warn("error accepting connection", "err", err)
+			continue
+		}
+		if t.Gater != nil {
+			if err := t.Gater.AllowAddr(conn.RemoteAddr()); err != nil {
+				t.Metrics.ConnectionsGated.Inc()
+				t.Logger.Warn("rejecting connection", "peer", conn.RemoteAddr().String(), "err", err)
+				conn.Close()
+				continue
+			}
+		}
+		if err := t.acquire(conn, false); err != nil {
+			t.Metrics.ConnectionsRejected.Inc()
+			t.Logger.Warn("rejecting connection", "peer", conn.RemoteAddr().String(), "err", err)
+			conn.Close()
+			continue
 		}
 
 		go t.handleConn(conn, false)
 	}
 }
 
+// acquire 记录一个新连接，入站连接超过 MaxConns 或 MaxConnsPerIP 时返回错误
+func (t *TCPTransport) acquire(conn net.Conn, outbound bool) error {
+	t.connLock.Lock()
+	defer t.connLock.Unlock()
+
+	if !outbound {
+		ip := remoteIP(conn)
+		if t.MaxConns > 0 && t.conns >= t.MaxConns {
+			return fmt.Errorf("%d connections open: %w", t.conns, ErrTooManyConns)
+		}
+		if t.MaxConnsPerIP > 0 && t.connsIP[ip] >= t.MaxConnsPerIP {
+			return fmt.Errorf("%d connections open from %s: %w", t.connsIP[ip], ip, ErrTooManyConns)
+		}
+		t.connsIP[ip]++
+	}
+	t.conns++
+	return nil
+}
+
+// release 连接关闭后调用
+func (t *TCPTransport) release(conn net.Conn, outbound bool) {
+	t.connLock.Lock()
+	defer t.connLock.Unlock()
+
+	t.conns--
+	if !outbound {
+		ip := remoteIP(conn)
+		if t.connsIP[ip]--; t.connsIP[ip] <= 0 {
+			delete(t.connsIP, ip)
+		}
+	}
+}
+
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
 func (t *TCPTransport) handleConn(conn net.Conn, outBound bool) {
 	var err error
 
+	peer := NewTCPPeer(conn, outBound)
+
 	defer func() {
-		fmt.Printf("dropping peer connection: %s\n", err)
-		conn.Close()
+		t.Logger.Info("dropping peer connection", "peer", conn.RemoteAddr().String(), "err", err)
+		peer.Close()
+		t.release(conn, outBound)
+		if t.OnPeerClose != nil {
+			t.OnPeerClose(peer)
+		}
 	}()
 
-	peer := NewTCPPeer(conn, outBound)
-
+	if t.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(t.HandshakeTimeout))
+	}
 	if err = t.HandshakeFunc(peer); err != nil {
+		t.Metrics.HandshakeFailures.Inc()
+		t.misbehave(peer, err)
 		return
 	}
+	conn.SetDeadline(time.Time{})
+
+	if t.Gater != nil {
+		if err = t.Gater.AllowPeer(peer); err != nil {
+			t.Metrics.ConnectionsGated.Inc()
+			return
+		}
+	}
+	t.track(peer, true)
+	defer t.track(peer, false)
 
 	if t.OnPeer != nil {
 		if err = t.OnPeer(peer); err != nil {
@@ -132,25 +295,97 @@ func (t *TCPTransport) handleConn(conn net.Conn, outBound bool) {
 	// read loop
 	for {
 		rpc := RPC{}
+		if t.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(t.IdleTimeout))
+		}
 		err = t.Decoder.Decode(conn, &rpc)
-		if errors.Is(err, net.ErrClosed) {
+		if t.IdleTimeout > 0 {
+			// 数据流的截止时间由读取它的一方设置
+			conn.SetReadDeadline(time.Time{})
+		}
+		if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
+			return
+		}
+		if offending(err) {
+			// 超过上限的消息、无效的帧或者超时：对方不可信，断开连接
+			t.Metrics.DecodeErrors.Inc()
+			t.Metrics.PeersDisconnected.Inc()
+			t.Logger.Warn("disconnecting peer", "peer", conn.RemoteAddr().String(), "err", err)
+			t.misbehave(peer, err)
 			return
 		}
 		if err != nil {
-			fmt.Printf("TCP read error: %s\n", err)
+			t.Metrics.DecodeErrors.Inc()
+			t.Logger.Warn("TCP read error", "peer", conn.RemoteAddr().String(), "err", err)
 			continue
 		}
 
 		rpc.From = conn.RemoteAddr().String()
 
 		if rpc.Stream {
-			peer.wg.Add(1)
-			fmt.Printf("[%s] incoming stream, waiting...\n", rpc.From)
-			peer.wg.Wait()
-			fmt.Printf("[%s] stream closed, resuming read loop\n", rpc.From)
+			t.Logger.Debug("incoming stream, waiting", "peer", rpc.From)
+			if !peer.stream() {
+				return
+			}
+			// 清除读取数据流时设置的截止时间，没有设置 IdleTimeout 时读循环不会自己重置
+			conn.SetReadDeadline(time.Time{})
+			t.Logger.Debug("stream closed, resuming read loop", "peer", rpc.From)
 			continue
 		}
 
 		t.rpcch <- rpc
 	}
 }
+
+// track 记录或移除完成握手的连接
+func (t *TCPTransport) track(peer *TCPPeer, open bool) {
+	t.connLock.Lock()
+	defer t.connLock.Unlock()
+
+	if open {
+		t.peers[peer] = struct{}{}
+	} else {
+		delete(t.peers, peer)
+	}
+}
+
+// Regate 按 Gater 当前的规则重新检查已经建立的连接，关闭不再允许的连接并返回关闭的数量。
+// 规则更新后调用
+func (t *TCPTransport) Regate() int {
+	if t.Gater == nil {
+		return 0
+	}
+
+	t.connLock.Lock()
+	var denied []*TCPPeer
+	for peer := range t.peers {
+		err := t.Gater.AllowPeer(peer)
+		if err == nil && !peer.outbound {
+			err = t.Gater.AllowAddr(peer.RemoteAddr())
+		}
+		if err != nil {
+			t.Logger.Warn("closing gated connection", "peer", peer.RemoteAddr().String(), "err", err)
+			denied = append(denied, peer)
+		}
+	}
+	t.connLock.Unlock()
+
+	for _, peer := range denied {
+		t.Metrics.ConnectionsGated.Inc()
+		peer.Close()
+	}
+	return len(denied)
+}
+
+func (t *TCPTransport) misbehave(peer Peer, err error) {
+	if t.OnMisbehave != nil {
+		t.OnMisbehave(peer, err)
+	}
+}
+
+// offending 读取错误是否说明对方违反了协议或者限制
+func offending(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, ErrMessageTooLarge) || errors.Is(err, ErrBadFrame) ||
+		errors.As(err, &netErr) && netErr.Timeout()
+}
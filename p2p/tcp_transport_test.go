@@ -1,19 +1,199 @@
 package p2p
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"distributed_file_storage/crypto"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestTCPTransport(t *testing.T) {
 	opts := TCPTransportOpts{
-		ListenAddr:    ":3000",
+		ListenAddr:    "127.0.0.1:0",
 		HandshakeFunc: NOPHandshakeFunc,
 		Decoder:       DefaultDecoder{},
 	}
 	tr := NewTCPTransport(opts)
 
-	assert.Equal(t, tr.ListenAddr, ":3000")
+	assert.Equal(t, tr.ListenAddr, "127.0.0.1:0")
 
 	assert.Nil(t, tr.ListenAndAccept())
+	assert.Nil(t, tr.Close())
+}
+
+func TestDefaultDecoder(t *testing.T) {
+	large := bytes.Repeat([]byte("x"), 4096)
+	var buf bytes.Buffer
+	buf.Write(EncodeMessage(large))
+	buf.Write(EncodeMessage(make([]byte, MaxMessageSize+1)))
+	buf.Write(EncodeMessage([]byte("next")))
+	buf.WriteByte(IncomingStream)
+
+	var dec DefaultDecoder
+	rpc := RPC{}
+	assert.Nil(t, dec.Decode(&buf, &rpc))
+	assert.Equal(t, large, rpc.Payload)
+
+	// 超过上限的消息不会被读取，调用方断开连接
+	assert.ErrorIs(t, dec.Decode(&buf, &RPC{}), ErrMessageTooLarge)
+
+	buf.Reset()
+	buf.Write(EncodeMessage([]byte("next")))
+	buf.WriteByte(IncomingStream)
+	buf.WriteByte(0x7)
+	rpc = RPC{}
+	assert.ErrorIs(t, DefaultDecoder{MaxSize: 2}.Decode(bytes.NewReader(buf.Bytes()), &rpc), ErrMessageTooLarge)
+	assert.Nil(t, dec.Decode(&buf, &rpc))
+	assert.Equal(t, []byte("next"), rpc.Payload)
+
+	rpc = RPC{}
+	assert.Nil(t, dec.Decode(&buf, &rpc))
+	assert.True(t, rpc.Stream)
+	assert.ErrorIs(t, dec.Decode(&buf, &RPC{}), ErrBadFrame)
+}
+
+func TestTCPTransportLimits(t *testing.T) {
+	opened, closed := make(chan struct{}, 1), make(chan struct{}, 2)
+	tr := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:       "127.0.0.1:0",
+		HandshakeFunc:    NOPHandshakeFunc,
+		Decoder:          DefaultDecoder{},
+		MaxConnsPerIP:    1,
+		HandshakeTimeout: time.Second,
+		IdleTimeout:      100 * time.Millisecond,
+		OnPeer:           func(Peer) error { opened <- struct{}{}; return nil },
+		OnPeerClose:      func(Peer) { closed <- struct{}{} },
+	})
+	assert.Nil(t, tr.ListenAndAccept())
+	defer tr.Close()
+	addr := tr.listener.Addr().String()
+
+	first, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer first.Close()
+	<-opened
+
+	// 同一个 IP 的第二个连接被拒绝
+	second, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = second.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, 1.0, tr.Metrics.ConnectionsRejected.Value())
+
+	// 空闲的连接超时后被断开
+	first.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = first.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	// 等读循环退出、释放连接数之后再连接
+	<-closed
+	assert.Equal(t, 1.0, tr.Metrics.PeersDisconnected.Value())
+
+	// 连接关闭后可以再次连接，超过上限的消息断开连接
+	third, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer third.Close()
+	third.Write(EncodeMessage(make([]byte, MaxMessageSize+1)))
+	third.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = third.Read(make([]byte, 1))
+	assert.NotNil(t, err) // EOF 或者因为没有读取的数据而 reset
+	assert.Equal(t, 1.0, tr.Metrics.ConnectionsRejected.Value())
+	assert.Equal(t, 2.0, tr.Metrics.PeersDisconnected.Value())
+}
+
+func TestGate(t *testing.T) {
+	allow, err := ParseCIDRs([]string{"10.0.0.0/8", "192.168.1.7"})
+	assert.Nil(t, err)
+	deny, err := ParseCIDRs([]string{"10.1.0.0/16"})
+	assert.Nil(t, err)
+	_, err = ParseCIDRs([]string{"10.0.0.0/33"})
+	assert.NotNil(t, err)
+
+	g := NewGate(GateRules{AllowCIDRs: allow, DenyCIDRs: deny})
+	tcp := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 4000} }
+	assert.Nil(t, g.AllowAddr(tcp("10.2.3.4")))
+	assert.Nil(t, g.AllowAddr(tcp("::ffff:192.168.1.7")))
+	// 拒绝列表优先
+	assert.ErrorIs(t, g.AllowAddr(tcp("10.1.2.3")), ErrGated)
+	assert.ErrorIs(t, g.AllowAddr(tcp("192.168.1.8")), ErrGated)
+
+	peer := NewTCPPeer(nil, false)
+	peer.setIdentity("aa")
+	assert.Nil(t, g.AllowPeer(peer))
+	g.SetRules(GateRules{DenyIdentities: []string{"aa"}})
+	assert.ErrorIs(t, g.AllowPeer(peer), ErrGated)
+	assert.Nil(t, g.AllowAddr(tcp("10.1.2.3")))
+	g.SetRules(GateRules{AllowIdentities: []string{"bb"}})
+	assert.ErrorIs(t, g.AllowPeer(peer), ErrGated)
+}
+
+func TestTCPTransportGate(t *testing.T) {
+	keyA, keyB := crypto.NewSignKey(), crypto.NewSignKey()
+	gate := NewGate(GateRules{})
+	peers := make(chan Peer, 1)
+	a := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:0",
+		HandshakeFunc: IdentityHandshake(keyA),
+		Decoder:       DefaultDecoder{},
+		Gater:         gate,
+		OnPeer:        func(p Peer) error { peers <- p; return nil },
+	})
+	assert.Nil(t, a.ListenAndAccept())
+	defer a.Close()
+	b := NewTCPTransport(TCPTransportOpts{
+		HandshakeFunc: IdentityHandshake(keyB),
+		Decoder:       DefaultDecoder{},
+	})
+
+	// 握手之后 Identity 是对方的签名公钥
+	assert.Nil(t, b.Dial(a.listener.Addr().String()))
+	select {
+	case p := <-peers:
+		assert.Equal(t, crypto.SignPublicKey(keyB), p.Identity())
+	case <-time.After(time.Second):
+		t.Fatal("no peer")
+	}
+
+	// 更新规则后已经建立的连接被关闭，新的连接在握手之后被拒绝
+	gate.SetRules(GateRules{DenyIdentities: []string{crypto.SignPublicKey(keyB)}})
+	assert.Equal(t, 1, a.Regate())
+	assert.Nil(t, b.Dial(a.listener.Addr().String()))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 0, len(peers))
+	assert.Equal(t, 2.0, a.Metrics.ConnectionsGated.Value())
+
+	// 地址规则在握手之前检查
+	deny, _ := ParseCIDRs([]string{"127.0.0.0/8"})
+	gate.SetRules(GateRules{DenyCIDRs: deny})
+	conn, err := net.Dial("tcp", a.listener.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, 3.0, a.Metrics.ConnectionsGated.Value())
+}
+
+func TestIdentityHandshakeBadSignature(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	// 对方发送别人的公钥，但不能用对应的私钥签名
+	go func() {
+		hello := make([]byte, 64)
+		copy(hello, crypto.NewSignKey().Public().(ed25519.PublicKey))
+		io.ReadFull(c2, make([]byte, 64))
+		c2.Write(hello)
+		io.ReadFull(c2, make([]byte, ed25519.SignatureSize))
+		c2.Write(crypto.Sign(crypto.NewSignKey(), []byte("forged")))
+	}()
+	peer := NewTCPPeer(c1, true)
+	assert.NotNil(t, IdentityHandshake(crypto.NewSignKey())(peer))
+	assert.Equal(t, "", peer.Identity())
 }
@@ -1,12 +1,18 @@
 package p2p
 
-import "net"
+import (
+	"net"
+	"time"
+)
 
 // Peer 一个代表远程节点的接口
 type Peer interface {
-	net.Conn           // TODO 直接嵌入conn的接口
-	Send([]byte) error // 针对节点的发送功能
-	CloseStream()
+	net.Conn                        // TODO 直接嵌入conn的接口
+	Send([]byte) error              // 针对节点的发送功能
+	WaitStream(time.Duration) error // 等待对方的数据流到达，之后直接从连接读取
+	CloseStream()                   // 数据流读完，读循环清除读取截止时间后继续读取消息
+	Outbound() bool                 // 是否由本地节点主动发起连接
+	Identity() string               // 握手确认的对方签名公钥(hex)，没有确认身份时为空
 }
 
 // Transport 处理网络中节点之间通信的任何东西。它可以是以下形式：(TCP, UDP, websockets, ...)
@@ -1,302 +0,0 @@
-package main
-
-import (
-	"bytes"
-	"crypto/aes"
-	"distributed_file_storage/p2p"
-	"encoding/binary"
-	"encoding/gob"
-	"fmt"
-	"io"
-	"log"
-	"sync"
-	"time"
-)
-
-type FileServerOpts struct {
-	ID                string // 公钥
-	EncKey            []byte
-	StorageRoot       string
-	PathTransformFunc PathTransformFunc
-	Transport         p2p.Transport
-	BootstrapNodes    []string // 引导节点
-}
-
-type FileServer struct {
-	FileServerOpts
-
-	peerLock sync.Mutex
-	peers    map[string]p2p.Peer
-
-	store  *Store
-	quitch chan struct{}
-}
-
-func NewFileServer(opts FileServerOpts) *FileServer {
-	storeOpts := StoreOpts{
-		PathTransformFunc: opts.PathTransformFunc,
-		Root:              opts.StorageRoot,
-	}
-	if opts.ID == "" {
-		opts.ID = generateID()
-	}
-	return &FileServer{
-		FileServerOpts: opts,
-		store:          NewStore(storeOpts),
-		quitch:         make(chan struct{}),
-		peers:          make(map[string]p2p.Peer),
-	}
-}
-
-func (s *FileServer) broadcast(msg *Message) error {
-	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
-		return err
-	}
-
-	for _, peer := range s.peers {
-		peer.Send([]byte{p2p.IncomingMessage})
-		if err := peer.Send(buf.Bytes()); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-type Message struct {
-	Payload any
-}
-
-type MessageStoreFile struct {
-	ID   string
-	Key  string
-	Size int64
-}
-
-type MessageGetFile struct {
-	Key string
-	ID  string
-}
-
-func (s *FileServer) Get(key string) (io.Reader, error) {
-	if s.store.Has(s.ID, key) {
-		fmt.Printf("[%s] serving file (%s) from local disk\n", s.Transport.Addr(), key)
-		_, r, err := s.store.Read(s.ID, key)
-		if err != nil {
-			return nil, err
-		}
-		return r, nil
-	}
-
-	fmt.Printf("[%s] dont have file (%s) locally, fetching from network...\n", s.Transport.Addr(), key)
-
-	msg := Message{
-		Payload: MessageGetFile{
-			Key: hashKey(key),
-			ID:  s.ID,
-		},
-	}
-
-	if err := s.broadcast(&msg); err != nil {
-		return nil, err
-	}
-
-	time.Sleep(500 * time.Millisecond)
-
-	for _, peer := range s.peers {
-		// 首先获取发送过来的二进制的文件大小
-		var fileSize int64
-		binary.Read(peer, binary.LittleEndian, &fileSize)
-
-		n, err := s.store.writeDecrypt(s.EncKey, s.ID, key, io.LimitReader(peer, fileSize))
-		if err != nil {
-			return nil, err
-		}
-
-		fmt.Printf("[%s] received (%d) bytes over the network from (%s)\n", s.Transport.Addr(), n, peer.RemoteAddr())
-
-		peer.CloseStream()
-	}
-
-	_, r, err := s.store.Read(s.ID, key)
-	if err != nil {
-		return nil, err
-	}
-	return r, nil
-}
-
-func (s *FileServer) Store(key string, r io.Reader) error {
-	// 1. 存储文件到本地磁盘
-	var (
-		fileBuffer = new(bytes.Buffer)
-		tee        = io.TeeReader(r, fileBuffer)
-	)
-
-	size, err := s.store.Write(s.ID, key, tee)
-	if err != nil {
-		return err
-	}
-
-	// 2. 将文件广播到网络中所有已知节点
-	msg := Message{
-		Payload: MessageStoreFile{
-			Key:  hashKey(key),
-			Size: size + aes.BlockSize,
-			ID:   s.ID,
-		},
-	}
-	// 广播元数据
-	if err := s.broadcast(&msg); err != nil {
-		return err
-	}
-	time.Sleep(5 * time.Millisecond)
-	// 广播实际data
-	var peers []io.Writer
-	for _, peer := range s.peers {
-		peers = append(peers, peer)
-	}
-	// TODO broadcast 方法利用了 io.MultiWriter 的强大功能，实现了高效的“一写多发”。它避免了写一个循环，然后逐个发送数据给每个对等节点的繁琐过程，使代码更加简洁和优雅
-	mw := io.MultiWriter(peers...)
-	mw.Write([]byte{p2p.IncomingStream})
-	_, err = copyEncrypt(s.EncKey, fileBuffer, mw)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (s *FileServer) Stop() {
-	close(s.quitch)
-}
-
-func (s *FileServer) OnPeer(p p2p.Peer) error {
-	s.peerLock.Lock()
-	defer s.peerLock.Unlock()
-
-	s.peers[p.RemoteAddr().String()] = p
-
-	log.Printf("connected with remote %s", p.RemoteAddr())
-
-	return nil
-}
-
-func (s *FileServer) loop() {
-	defer func() {
-		log.Println("file server stopped due to error or user quit action")
-		s.Transport.Close()
-	}()
-
-	for {
-		select {
-		case rpc := <-s.Transport.Consume():
-			var msg Message
-			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
-				log.Println("decoding error: ", err)
-			}
-
-			if err := s.handleMessage(rpc.From, &msg); err != nil {
-				log.Println("handle message error: ", err)
-			}
-
-		case <-s.quitch:
-			return
-		}
-	}
-}
-
-func (s *FileServer) handleMessage(from string, msg *Message) error {
-	switch v := msg.Payload.(type) {
-	case MessageStoreFile:
-		return s.handleMessageStoreFile(from, v)
-	case MessageGetFile:
-		return s.handleMessageGetFile(from, v)
-	}
-
-	return nil
-}
-
-func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error {
-	if !s.store.Has(msg.ID, msg.Key) {
-		return fmt.Errorf("[%s] need to serve file (%s) but it does not exist on disk", s.Transport.Addr(), msg.Key)
-	}
-
-	fmt.Printf("[%s] serving file (%s) over the network\n", s.Transport.Addr(), msg.Key)
-
-	fileSize, r, err := s.store.Read(msg.ID, msg.Key)
-	if err != nil {
-		return err
-	}
-	if rc, ok := r.(io.ReadCloser); ok {
-		fmt.Println("closing readClose")
-		defer rc.Close()
-	}
-
-	peer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("peer %s not in map", from)
-	}
-
-	// 还要发送文件大小
-	peer.Send([]byte{p2p.IncomingStream})
-	binary.Write(peer, binary.LittleEndian, fileSize)
-	n, err := io.Copy(peer, r)
-	if err != nil {
-		return err
-	}
-
-	fmt.Printf("[%s] written (%d) bytes over the network to %s\n", s.Transport.Addr(), n, from)
-
-	return nil
-}
-
-func (s *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) error {
-	peer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("peer (%s) not found", from)
-	}
-
-	_, err := s.store.Write(msg.ID, msg.Key, io.LimitReader(peer, msg.Size))
-	if err != nil {
-		return err
-	}
-
-	peer.CloseStream()
-
-	return nil
-}
-
-func (s *FileServer) bootstrapNetwork() error {
-	for _, addr := range s.BootstrapNodes {
-		if addr == "" {
-			continue
-		}
-		go func(addr string) {
-			fmt.Println("attempting to connect with remote: ", addr)
-			if err := s.Transport.Dial(addr); err != nil {
-				log.Println("dial error: ", err)
-			}
-		}(addr)
-	}
-
-	return nil
-}
-
-func (s *FileServer) Start() error {
-	if err := s.Transport.ListenAndAccept(); err != nil {
-		return err
-	}
-
-	s.bootstrapNetwork()
-
-	s.loop()
-
-	return nil
-}
-
-// Message 中是any，gob 在编码和解码接口类型时，必须提前知道接口可能包含的具体类型
-func init() {
-	gob.Register(MessageStoreFile{})
-	gob.Register(MessageGetFile{})
-}
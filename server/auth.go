@@ -0,0 +1,369 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"distributed_file_storage/crypto"
+	"distributed_file_storage/p2p"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 授权：节点用签名密钥对发出的每个请求签名。开启 AuthOpts.Required 后，节点只处理
+// owner 本人(签名公钥就是 owner ID)、ACL 中授权的请求方或者持有有效授权令牌的请求方的请求，
+// 其他请求回复 MessagePermissionDenied(读取请求在数据流中回复拒绝标记)
+
+// authMaxAge 签名时间与本地时间最多相差多久，超过的请求视为重放。
+// 这段时间内同一个请求方的随机数只接受一次
+const authMaxAge = 5 * time.Minute
+
+// Permission 对一个命名空间或对象的操作权限，可以组合
+type Permission uint8
+
+const (
+	PermRead Permission = 1 << iota
+	PermWrite
+	PermDelete
+
+	PermAll = PermRead | PermWrite | PermDelete
+)
+
+var permissionNames = []struct {
+	perm Permission
+	name string
+}{
+	{PermRead, "read"},
+	{PermWrite, "write"},
+	{PermDelete, "delete"},
+}
+
+// ParsePermissions 解析逗号分隔的权限，如 "read,delete"，"all" 表示全部权限
+func ParsePermissions(s string) (Permission, error) {
+	var perms Permission
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "all" {
+			perms |= PermAll
+			continue
+		}
+		found := false
+		for _, p := range permissionNames {
+			if p.name == name {
+				perms |= p.perm
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown permission %q (want read, write, delete or all)", name)
+		}
+	}
+	return perms, nil
+}
+
+func (p Permission) String() string {
+	var names []string
+	for _, n := range permissionNames {
+		if p&n.perm != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Has 是否包含 other 的所有权限
+func (p Permission) Has(other Permission) bool {
+	return p&other == other
+}
+
+// ACLRule 授权 Principal 对 Owner 命名空间(Object 不为空时只是其中一个对象)的操作
+type ACLRule struct {
+	Principal   string     // 请求方的签名公钥，"*" 表示任何签名有效的请求方
+	Owner       string     // owner ID，"*" 表示所有 owner
+	Object      string     // 对象标识，为空表示整个命名空间
+	Permissions Permission // 允许的操作
+}
+
+func (r ACLRule) allows(principal, owner, object string, op Permission) bool {
+	return (r.Principal == "*" || r.Principal == principal) &&
+		(r.Owner == "*" || r.Owner == owner) &&
+		(r.Object == "" || r.Object == object) &&
+		r.Permissions.Has(op)
+}
+
+// AuthOpts 其他节点请求的授权规则
+type AuthOpts struct {
+	Required bool      // 拒绝没有签名或者没有权限的请求。关闭时只拒绝签名无效的请求
+	ACL      []ACLRule // 除 owner 本人之外允许的请求方
+	// SignedObjects 拒绝没有签名的副本，以及签名者没有写入权限的副本
+	SignedObjects bool
+}
+
+// Auth 随请求发送的签名
+type Auth struct {
+	Signer    string // 签名公钥
+	Recipient string // 接收方握手确认的签名公钥，没有确认身份时为空
+	Time      int64  // 签名时间，UnixNano
+	Nonce     string // 随机数，同一个请求不能重放
+	Token     string // 授权令牌，请求方不是 owner 时使用
+	Sig       []byte
+}
+
+// request 一个需要授权的请求：对 Owner 命名空间中的 Key 进行 Op 操作
+type request struct {
+	Op      Permission
+	Owner   string
+	Key     string
+	Version string
+	Hash    string // 整个消息内容(包括大小、数据密钥等)的 SHA-256
+}
+
+// digest 请求方签名的内容
+func (r request) digest(a *Auth) []byte {
+	return []byte(strings.Join([]string{
+		"fs request", r.Op.String(), r.Owner, r.Key, r.Version, r.Hash,
+		a.Recipient, strconv.FormatInt(a.Time, 10), a.Nonce, a.Token,
+	}, "\n"))
+}
+
+// requestFor 返回消息对应的请求，回复类的消息不需要授权
+func requestFor(payload any) (request, bool) {
+	req, ok := requestOf(payload)
+	if !ok {
+		return request{}, false
+	}
+	req.Hash = payloadHash(payload)
+	return req, true
+}
+
+// payloadHash 消息内容的 SHA-256。JSON 编码与字段顺序无关，gob 解码后得到的结果相同
+func payloadHash(payload any) string {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// shardObject 分片 key(<对象标识>.<序号>)所属的对象标识，不是这个格式时返回 false
+func shardObject(key string, shards int) (string, bool) {
+	i := strings.LastIndexByte(key, '.')
+	if i < 0 {
+		return "", false
+	}
+	index, err := strconv.Atoi(key[i+1:])
+	if err != nil || index < 0 || index >= shards || shardKey(key[:i], index) != key {
+		return "", false
+	}
+	return key[:i], true
+}
+
+func requestOf(payload any) (request, bool) {
+	switch v := payload.(type) {
+	case MessageStoreFile:
+		key := v.Key
+		if v.Erasure != nil {
+			// 分片按所属对象授权
+			if object, ok := shardObject(key, v.Erasure.Shards()); ok {
+				key = object
+			}
+		}
+		return request{Op: PermWrite, Owner: v.ID, Key: key, Version: v.Version}, true
+	case MessageGetFile:
+		return request{Op: PermRead, Owner: v.ID, Key: v.Key, Version: v.Version}, true
+	case MessageGetShards:
+		return request{Op: PermRead, Owner: v.ID, Key: v.Key, Version: v.Version}, true
+	case MessageProbeShards:
+		return request{Op: PermRead, Owner: v.ID, Key: v.Key}, true
+	case MessageDeleteFile:
+		return request{Op: PermDelete, Owner: v.ID, Key: v.Key, Version: v.Version}, true
+	case MessageRewrapKey:
+		return request{Op: PermWrite, Owner: v.ID, Key: v.Key, Version: v.Version}, true
+	case MessageShareKey:
+		return request{Op: PermWrite, Owner: v.ID, Key: v.Key, Version: v.Version}, true
+	case MessageRenameObject:
+		return request{Op: PermWrite, Owner: v.ID, Key: v.From}, true
+	}
+	return request{}, false
+}
+
+// Identity 返回本节点的签名公钥
+func (s *FileServer) Identity() string {
+	return crypto.SignPublicKey(s.SignKey)
+}
+
+type tokenContextKey struct{}
+
+// contextWithToken 让 ctx 中发出的请求带上授权令牌
+func contextWithToken(ctx context.Context, token string) context.Context {
+	if token == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, tokenContextKey{}, token)
+}
+
+func tokenFromContext(ctx context.Context) string {
+	token, _ := ctx.Value(tokenContextKey{}).(string)
+	return token
+}
+
+// sign 为发给 recipient(接收方的签名公钥)的请求消息签名，回复类的消息不变
+func (s *FileServer) sign(msg *Message, token, recipient string) {
+	req, ok := requestFor(msg.Payload)
+	if !ok {
+		return
+	}
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	auth := &Auth{
+		Signer:    s.Identity(),
+		Recipient: recipient,
+		Time:      time.Now().UnixNano(),
+		Nonce:     hex.EncodeToString(nonce),
+		Token:     token,
+	}
+	auth.Sig = crypto.Sign(s.SignKey, req.digest(auth))
+	msg.Auth = auth
+}
+
+// authorize 检查请求的签名和请求方的权限
+func (s *FileServer) authorize(req request, auth *Auth) error {
+	if auth == nil {
+		if !s.Auth.Required {
+			return nil
+		}
+		return fmt.Errorf("unsigned %s request: %w", req.Op, ErrPermissionDenied)
+	}
+
+	if err := crypto.Verify(auth.Signer, req.digest(auth), auth.Sig); err != nil {
+		return fmt.Errorf("%s request from %.16s: %v: %w", req.Op, auth.Signer, err, ErrPermissionDenied)
+	}
+	// 发给其他节点的请求不能转发给本节点
+	if auth.Recipient != s.Identity() && (auth.Recipient != "" || s.Auth.Required) {
+		return fmt.Errorf("%s request from %.16s is addressed to %.16s: %w", req.Op, auth.Signer, auth.Recipient, ErrPermissionDenied)
+	}
+	if age := time.Since(time.Unix(0, auth.Time)); age > authMaxAge || age < -authMaxAge {
+		return fmt.Errorf("%s request from %.16s signed %s ago: %w", req.Op, auth.Signer, age.Round(time.Second), ErrPermissionDenied)
+	}
+	if auth.Nonce == "" || !s.nonces.add(auth.Signer+"/"+auth.Nonce, time.Unix(0, auth.Time).Add(authMaxAge)) {
+		return fmt.Errorf("%s request from %.16s replayed: %w", req.Op, auth.Signer, ErrPermissionDenied)
+	}
+	if !s.Auth.Required || s.allowed(auth.Signer, req.Owner, req.Key, req.Op) {
+		return nil
+	}
+
+	if auth.Token != "" {
+		err := s.verifyToken(auth.Token, auth.Signer, req)
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("%s request from %.16s: %v: %w", req.Op, auth.Signer, err, ErrPermissionDenied)
+	}
+	return fmt.Errorf("%.16s may not %s %.16s/%.16s: %w", auth.Signer, req.Op, req.Owner, req.Key, ErrPermissionDenied)
+}
+
+// nonceCache 签名仍然有效的请求的随机数
+type nonceCache struct {
+	mu     sync.Mutex
+	seen   map[string]time.Time // 随机数 -> 签名过期的时间
+	pruned time.Time
+}
+
+// add 记录一个随机数，已经见过时返回 false。签名过期之后的随机数会被清理
+func (c *nonceCache) add(nonce string, expires time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.pruned) > time.Minute {
+		for n, exp := range c.seen {
+			if now.After(exp) {
+				delete(c.seen, n)
+			}
+		}
+		c.pruned = now
+	}
+
+	if _, ok := c.seen[nonce]; ok {
+		return false
+	}
+	if c.seen == nil {
+		c.seen = make(map[string]time.Time)
+	}
+	c.seen[nonce] = expires
+	return true
+}
+
+// allowed principal 是否是 owner 本人，或者 ACL 允许它对 owner 的对象进行 op 操作
+func (s *FileServer) allowed(principal, owner, object string, op Permission) bool {
+	if principal == owner {
+		return true
+	}
+	for _, rule := range s.Auth.ACL {
+		if rule.allows(principal, owner, object, op) {
+			return true
+		}
+	}
+	return false
+}
+
+// denyRequest 告诉请求方请求被拒绝。读取请求在数据流中回复拒绝标记，否则对方会一直等待数据
+func (s *FileServer) denyRequest(from string, payload any, req request, reason error) {
+	s.Metrics.AuthRejections.Inc()
+
+	peer, ok := s.peer(from)
+	if !ok {
+		return
+	}
+
+	switch v := payload.(type) {
+	case MessageGetFile:
+		peer.Send([]byte{p2p.IncomingStream})
+		fileHeader{Size: filePermissionDenied}.write(peer)
+		return
+	case MessageGetShards:
+		peer.Send([]byte{p2p.IncomingStream})
+		shardHeader{Index: shardsDenied}.write(peer)
+		return
+	case MessageStoreFile:
+		// 丢弃数据流，否则对方节点的读循环会一直阻塞
+		if s.waitStream(peer, v.Key) != nil {
+			return
+		}
+		s.streamDeadline(peer, v.Size)
+		if _, err := io.CopyN(io.Discard, peer, v.Size); err != nil {
+			s.dropStream(peer, v.Key, err)
+			return
+		}
+		peer.CloseStream()
+	}
+	s.replyDenied(peer, req, reason)
+}
+
+// replyDenied 回复 MessagePermissionDenied
+func (s *FileServer) replyDenied(peer p2p.Peer, req request, reason error) {
+	reply := Message{
+		Payload: MessagePermissionDenied{
+			ID:     req.Owner,
+			Key:    req.Key,
+			Op:     req.Op.String(),
+			Reason: reason.Error(),
+		},
+	}
+	if err := s.sendTo([]p2p.Peer{peer}, &reply); err != nil {
+		s.logger.Warn("failed to send permission denied reply", "peer", peer.RemoteAddr().String(), "err", err)
+	}
+}
+
+// handleMessagePermissionDenied 对方拒绝了我们的请求
+func (s *FileServer) handleMessagePermissionDenied(from string, msg MessagePermissionDenied) error {
+	s.logger.Warn("peer denied request", "peer", from, "op", msg.Op, "key", msg.Key, "reason", msg.Reason)
+	return nil
+}
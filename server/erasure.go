@@ -0,0 +1,671 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"distributed_file_storage/crypto"
+	"distributed_file_storage/p2p"
+	"distributed_file_storage/store"
+	"distributed_file_storage/trace"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// MaxShards 数据分片和校验分片加起来的上限(GF(2^8) 的限制)
+const MaxShards = 256
+
+// ErasureOpts 纠删码存储模式：文件切分成 DataShards 个数据分片和 ParityShards 个校验分片，
+// 每个节点最多保存一个分片，任意 DataShards 个分片就能恢复文件。本节点仍然保留完整的副本
+type ErasureOpts struct {
+	DataShards     int
+	ParityShards   int
+	RepairInterval time.Duration // 多久检查一次丢失的分片并重新编码，0 表示不检查
+}
+
+// Enabled 是否使用纠删码代替完整副本
+func (o ErasureOpts) Enabled() bool {
+	return o.DataShards > 0 && o.ParityShards > 0
+}
+
+// shardKey 分片在其他节点上保存时使用的 key
+func shardKey(hashedKey string, index int) string {
+	return fmt.Sprintf("%s.%d", hashedKey, index)
+}
+
+// shardCount 对象的分片数，不是纠删码对象时为 0
+func shardCount(meta store.ObjectMeta) int {
+	if meta.Erasure == nil {
+		return 0
+	}
+	return meta.Erasure.Shards()
+}
+
+func newStripeID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// encodeShards 把数据切分成数据分片并计算校验分片，data 的底层数组可能被用作填充
+func encodeShards(info store.ErasureInfo, data []byte) ([][]byte, error) {
+	enc, err := reedsolomon.New(info.DataShards, info.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	// 空文件也需要分片，Join 时按 Size 截断
+	if len(data) == 0 {
+		data = []byte{0}
+	}
+	shards, err := enc.Split(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(shards); err != nil {
+		return nil, err
+	}
+	return shards, nil
+}
+
+// joinShards 用至少 DataShards 个分片恢复原始数据，缺失的分片为 nil
+func joinShards(info store.ErasureInfo, shards [][]byte) ([]byte, error) {
+	enc, err := reedsolomon.New(info.DataShards, info.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	if err := enc.ReconstructData(shards); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := enc.Join(&buf, shards, int(info.Size)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// shardPeers 返回所有已连接的节点，按地址排序
+func (s *FileServer) shardPeers() []p2p.Peer {
+	s.peerLock.RLock()
+	defer s.peerLock.RUnlock()
+
+	addrs := make([]string, 0, len(s.peers))
+	for addr := range s.peers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	peers := make([]p2p.Peer, len(addrs))
+	for i, addr := range addrs {
+		peers[i] = s.peers[addr]
+	}
+	return peers
+}
+
+// storeShards 把已经写入本地的数据编码成分片，分别发送给不同的节点。
+// 节点不够时剩下的分片由 Repair 在有新节点连接后补上
+func (s *FileServer) storeShards(ctx context.Context, key string, data []byte, opts store.WriteOpts) (int, error) {
+	shards, err := encodeShards(*opts.Erasure, data)
+	if err != nil {
+		return 0, err
+	}
+
+	peers := s.shardPeers()
+	if len(peers) < len(shards) {
+		s.logger.Warn("not enough peers to place every shard",
+			"key", key, "shards", len(shards), "peers", len(peers))
+	}
+
+	hashedKey := s.objectID(key)
+	placed := 0
+	for i, peer := range peers {
+		if i == len(shards) {
+			break
+		}
+		if err := s.sendShard(ctx, peer, hashedKey, i, shards[i], opts); err != nil {
+			return placed, err
+		}
+		placed++
+	}
+
+	return placed, nil
+}
+
+// sendShard 把一个分片加密后发送给 peer
+func (s *FileServer) sendShard(ctx context.Context, peer p2p.Peer, hashedKey string, index int, shard []byte, opts store.WriteOpts) error {
+	dataKey, err := s.dataKey(opts.DataKey)
+	if err != nil {
+		return err
+	}
+	encrypted := new(bytes.Buffer)
+	if _, err := crypto.CopyEncrypt(dataKey, bytes.NewReader(shard), encrypted); err != nil {
+		return err
+	}
+	payload := MessageStoreFile{
+		Key:       shardKey(hashedKey, index),
+		Size:      int64(encrypted.Len()),
+		ID:        s.ID,
+		ExpiresAt: opts.ExpiresAt,
+		Version:   opts.Version,
+		Codec:     opts.Codec,
+		RawSize:   peerRawSize(opts),
+		Erasure:   opts.Erasure,
+		DataKey:   opts.DataKey,
+		Padding:   opts.Padding,
+	}
+	s.signObject(&payload, encrypted.Bytes())
+	msg := Message{
+		Payload: payload,
+		Trace:   trace.SpanContextFromContext(ctx),
+	}
+	if err := s.sendTo([]p2p.Peer{peer}, &msg); err != nil {
+		return err
+	}
+
+	if err := peer.Send([]byte{p2p.IncomingStream}); err != nil {
+		return err
+	}
+	_, err = peer.Write(encrypted.Bytes())
+	return err
+}
+
+// stripe 从节点收集到的同一次切分的分片
+type stripe struct {
+	info   store.ErasureInfo
+	header fileHeader
+	shards [][]byte
+	count  int
+}
+
+// fetchShards 向所有节点请求 key 的分片(version 为空时是最新版本)，并恢复出存储时的数据
+func (s *FileServer) fetchShards(ctx context.Context, key, version string) (shardHeader, []byte, error) {
+	req := MessageGetShards{
+		Key:     s.objectID(key),
+		ID:      s.ID,
+		Version: version,
+		Shards:  s.Erasure.DataShards + s.Erasure.ParityShards,
+	}
+	return s.fetchShardsFrom(ctx, req, key, s.dataKey)
+}
+
+// fetchShardsFrom 向所有节点发送 req 并恢复出数据，label 是日志和传输状态中的名字，unwrap 解开分片中的数据密钥
+func (s *FileServer) fetchShardsFrom(ctx context.Context, req MessageGetShards, label string, unwrap func(string) ([]byte, error)) (shardHeader, []byte, error) {
+	msg := Message{
+		Payload: req,
+		Trace:   trace.SpanContextFromContext(ctx),
+	}
+	// 分数高的节点的分片先被使用
+	peers := s.rankedPeers()
+	if err := s.sendWithToken(peers, &msg, tokenFromContext(ctx)); err != nil {
+		return shardHeader{}, nil, err
+	}
+
+	stripes := make(map[string]*stripe)
+	denied := 0
+	for _, peer := range peers {
+		if err := s.waitStream(peer, label); err != nil {
+			continue
+		}
+		addr := peer.RemoteAddr().String()
+		done := s.transfers.begin(transferGet, label, addr)
+		end, err := s.readShards(peer, req, label, unwrap, stripes)
+		done()
+		if err != nil {
+			s.dropStream(peer, label, err)
+			continue
+		}
+		if end == shardsDenied {
+			denied++
+		}
+		peer.CloseStream()
+	}
+
+	// 有多次写入的分片时选择最新的版本
+	var best *stripe
+	for _, st := range stripes {
+		if st.count < st.info.DataShards {
+			s.logger.Warn("not enough shards to reconstruct file",
+				"key", label, "stripe", st.info.Stripe, "have", st.count, "need", st.info.DataShards)
+			continue
+		}
+		if best == nil || st.header.Version > best.header.Version ||
+			st.header.Version == best.header.Version && st.count > best.count {
+			best = st
+		}
+	}
+	if best == nil && len(stripes) == 0 && denied > 0 {
+		return shardHeader{}, nil, fmt.Errorf("get %s: denied by %d peers: %w", label, denied, ErrPermissionDenied)
+	}
+	if best == nil {
+		return shardHeader{}, nil, fmt.Errorf("get %s: no complete set of shards: %w", label, ErrNotFound)
+	}
+
+	data, err := joinShards(best.info, best.shards)
+	if err != nil {
+		return shardHeader{}, nil, err
+	}
+	if best.header.Padding != crypto.PaddingNone {
+		if data, best.header.RawSize, err = unpadData(best.header.Padding, data); err != nil {
+			return shardHeader{}, nil, err
+		}
+	}
+	s.logger.Info("reconstructed file from shards", "key", label, "shards", best.count, "bytes", len(data))
+
+	return shardHeader{Erasure: best.info, fileHeader: best.header}, data, nil
+}
+
+// readShards 读取 peer 数据流中的分片直到结束标记，返回结束标记。
+// 返回错误时数据流没有读完，调用方应该断开连接
+func (s *FileServer) readShards(peer p2p.Peer, req MessageGetShards, label string, unwrap func(string) ([]byte, error), stripes map[string]*stripe) (int, error) {
+	addr := peer.RemoteAddr().String()
+	for {
+		s.streamDeadline(peer, 0)
+		h, err := readShardHeader(peer)
+		if err != nil {
+			return 0, err
+		}
+		if h.Index < 0 {
+			return h.Index, nil
+		}
+		if h.Size < 0 {
+			return 0, fmt.Errorf("get %s: shard of %d bytes", label, h.Size)
+		}
+		if limit := s.maxReplicaSize(h.Padding); limit > 0 && h.Size > limit {
+			err := fmt.Errorf("get %s: shard of %d bytes: %w", label, h.Size, ErrObjectTooLarge)
+			s.misbehaved(addr, misbehaveOversized, err)
+			return 0, err
+		}
+
+		s.streamDeadline(peer, h.Size)
+		data, err := io.ReadAll(io.LimitReader(peer, h.Size))
+		if err == nil && int64(len(data)) < h.Size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		if h.Index >= h.Erasure.Shards() || h.Erasure.Shards() > MaxShards {
+			continue
+		}
+		// 同一次切分的分片参数必须相同，否则 Index 可能超出第一个分片确定的范围
+		if st, ok := stripes[h.Erasure.Stripe]; ok && (st.info != h.Erasure || h.Index >= len(st.shards)) {
+			s.misbehaved(addr, misbehaveCorrupt, fmt.Errorf("get %s: shard %d of stripe %.16s has conflicting parameters", label, h.Index, h.Erasure.Stripe))
+			continue
+		}
+		claim := headerClaim(req.ID, shardKey(req.Key, h.Index), h.fileHeader, &h.Erasure).withHash(data)
+		if err := s.verifyObject(claim, h.Signer, h.Signature); err != nil {
+			s.Metrics.SignatureRejections.Inc()
+			s.misbehaved(addr, misbehaveCorrupt, err)
+			continue
+		}
+		var buf bytes.Buffer
+		dataKey, err := unwrap(h.DataKey)
+		if err == nil {
+			_, err = crypto.CopyDecrypt(dataKey, bytes.NewReader(data), &buf)
+		}
+		if err != nil {
+			continue
+		}
+		s.served(addr)
+
+		st, ok := stripes[h.Erasure.Stripe]
+		if !ok {
+			st = &stripe{info: h.Erasure, header: h.fileHeader, shards: make([][]byte, h.Erasure.Shards())}
+			stripes[h.Erasure.Stripe] = st
+		}
+		if st.shards[h.Index] == nil {
+			st.shards[h.Index] = buf.Bytes()
+			st.count++
+		}
+	}
+}
+
+func (s *FileServer) handleMessageGetShards(ctx context.Context, from string, msg MessageGetShards) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	defer s.transfers.begin(transferServe, msg.Key, from)()
+
+	peer.Send([]byte{p2p.IncomingStream})
+	for i := 0; i < msg.Shards && i < MaxShards; i++ {
+		key := shardKey(msg.Key, i)
+		meta, err := s.statVersion(msg.ID, key, msg.Version)
+		if err == nil && msg.Recipient != "" {
+			meta.DataKey, err = sharedKey(meta, msg.Recipient)
+		}
+		if err != nil || meta.Erasure == nil {
+			continue
+		}
+
+		var (
+			size int64
+			r    io.ReadCloser
+		)
+		if msg.Version == "" {
+			size, r, err = s.readStore(ctx, msg.ID, key)
+		} else {
+			size, r, err = s.store.ReadVersion(msg.ID, key, msg.Version)
+		}
+		if err != nil {
+			continue
+		}
+
+		h := shardHeader{Index: i, Erasure: *meta.Erasure, fileHeader: newFileHeader(size, meta)}
+		if err := h.write(peer); err != nil {
+			r.Close()
+			return err
+		}
+		n, err := io.Copy(peer, r)
+		r.Close()
+		s.Metrics.BytesServed.Add(float64(n))
+		if err != nil {
+			return err
+		}
+		s.logger.Info("served shard over the network", "key", key, "peer", from, "bytes", n)
+	}
+
+	// 结束标记，请求方读到后关闭数据流
+	return shardHeader{Index: shardsEnd}.write(peer)
+}
+
+func (s *FileServer) handleMessageProbeShards(from string, msg MessageProbeShards) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	reply := MessageShardsHeld{Key: msg.Key, Stripe: msg.Stripe}
+	for i := 0; i < msg.Shards && i < MaxShards; i++ {
+		meta, err := s.store.Stat(msg.ID, shardKey(msg.Key, i))
+		if err == nil && meta.Erasure != nil && meta.Erasure.Stripe == msg.Stripe {
+			reply.Indexes = append(reply.Indexes, i)
+		}
+	}
+
+	return s.sendTo([]p2p.Peer{peer}, &Message{Payload: reply})
+}
+
+func (s *FileServer) handleMessageShardsHeld(from string, msg MessageShardsHeld) error {
+	s.repair.record(msg.Key+"/"+msg.Stripe, from, msg.Indexes)
+	return nil
+}
+
+// repairState 记录正在检查的对象在各个节点上的分片
+type repairState struct {
+	run      sync.Mutex
+	mu       sync.Mutex
+	held     map[string]map[string][]int // hash key/stripe -> 节点地址 -> 分片序号
+	pending  map[string]map[string]bool  // hash key/stripe -> 收到探测、还没有回复的节点
+	waiting  int                         // 所有对象还没有收到的回复数
+	answered chan struct{}               // waiting 降到 0 时关闭
+}
+
+// start 开始一轮检查，丢弃上一轮的状态
+func (r *repairState) start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.held = make(map[string]map[string][]int)
+	r.pending = make(map[string]map[string]bool)
+	r.waiting = 0
+	r.answered = make(chan struct{})
+}
+
+// begin 登记一个对象的探测，peers 是收到探测的节点
+func (r *repairState) begin(id string, peers []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.held[id] = make(map[string][]int)
+	r.pending[id] = make(map[string]bool)
+	for _, peer := range peers {
+		r.pending[id][peer] = true
+	}
+	r.waiting += len(peers)
+}
+
+// record 只记录收到探测的节点对正在检查的对象的回复，迟到或者重复的回复直接丢弃
+func (r *repairState) record(id, peer string, indexes []int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.pending[id][peer] {
+		return
+	}
+	delete(r.pending[id], peer)
+	r.held[id][peer] = indexes
+	if r.waiting--; r.waiting == 0 {
+		close(r.answered)
+	}
+}
+
+// wait 返回的 channel 在所有探测都收到回复时关闭
+func (r *repairState) wait() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.waiting == 0 {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	return r.answered
+}
+
+// end 返回回复了探测的节点持有的分片和没有回复的节点数
+func (r *repairState) end(id string) (map[string][]int, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	held, silent := r.held[id], len(r.pending[id])
+	delete(r.held, id)
+	delete(r.pending, id)
+	return held, silent
+}
+
+// RepairReport 一次分片检查和修复的结果
+type RepairReport struct {
+	StartedAt      time.Time     `json:"started_at"`
+	Duration       time.Duration `json:"duration"`
+	Objects        int64         `json:"objects"`         // 检查的纠删码对象数
+	Degraded       int64         `json:"degraded"`        // 缺少分片的对象数
+	ShardsRestored int64         `json:"shards_restored"` // 重新编码并发送的分片数
+	ShardsMissing  int64         `json:"shards_missing"`  // 没有空闲节点可以放置，仍然缺少的分片数
+	Unverified     int64         `json:"unverified"`      // 有节点没有回复探测，无法判断是否缺少分片的对象数
+}
+
+// Repair 检查本节点纠删码对象的分片，把丢失的分片用本地副本重新编码，发送给还没有该对象分片的节点
+func (s *FileServer) Repair(ctx context.Context) (RepairReport, error) {
+	s.repair.run.Lock()
+	defer s.repair.run.Unlock()
+
+	report := RepairReport{StartedAt: time.Now().UTC()}
+	defer func() {
+		report.Duration = time.Since(report.StartedAt)
+	}()
+
+	metas, err := s.store.List(s.ID)
+	if err != nil {
+		return report, err
+	}
+
+	// 只有收到探测的节点的回复会被记录，之后连接的节点不会作为放置分片的目标
+	s.repair.start()
+	peers := s.shardPeers()
+	addrs := make([]string, len(peers))
+	for i, peer := range peers {
+		addrs[i] = peer.RemoteAddr().String()
+	}
+
+	var objects []store.ObjectMeta
+	for _, meta := range metas {
+		if meta.Erasure == nil {
+			continue
+		}
+		objects = append(objects, meta)
+
+		probe := MessageProbeShards{
+			ID:     s.ID,
+			Key:    s.objectIDFor(meta),
+			Stripe: meta.Erasure.Stripe,
+			Shards: meta.Erasure.Shards(),
+		}
+		s.repair.begin(probe.Key+"/"+probe.Stripe, addrs)
+		if err := s.sendTo(peers, &Message{Payload: probe}); err != nil {
+			return report, err
+		}
+	}
+	if len(objects) == 0 {
+		return report, nil
+	}
+
+	// 等所有节点回复，最多等待与数据流相同的时间，没有回复的节点在 repairObject 中跳过
+	probeCtx, cancel := context.WithTimeout(ctx, s.streamTimeout)
+	defer cancel()
+	select {
+	case <-s.repair.wait():
+	case <-probeCtx.Done():
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+	}
+
+	for _, meta := range objects {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		report.Objects++
+
+		restored, missing, err := s.repairObject(ctx, meta)
+		if errors.Is(err, errProbeUnanswered) {
+			report.Unverified++
+		} else if restored+missing > 0 {
+			report.Degraded++
+		}
+		report.ShardsRestored += int64(restored)
+		report.ShardsMissing += int64(missing)
+		if err != nil {
+			s.logger.Warn("failed to repair shards", "key", meta.Key, "err", err)
+		}
+	}
+
+	s.Metrics.ShardsRestored.Add(float64(report.ShardsRestored))
+	if report.Degraded > 0 {
+		s.logger.Info("repair finished",
+			"objects", report.Objects,
+			"degraded", report.Degraded,
+			"restored", report.ShardsRestored,
+			"missing", report.ShardsMissing,
+			"duration", time.Since(report.StartedAt))
+	}
+
+	return report, nil
+}
+
+// errProbeUnanswered 有节点没有回复分片探测
+var errProbeUnanswered = errors.New("shard probe unanswered")
+
+// repairObject 根据探测结果补发一个对象丢失的分片
+func (s *FileServer) repairObject(ctx context.Context, meta store.ObjectMeta) (restored, missing int, err error) {
+	info := *meta.Erasure
+	hashedKey := s.objectIDFor(meta)
+	held, silent := s.repair.end(hashedKey + "/" + info.Stripe)
+	if silent > 0 {
+		// 没有回复的节点可能持有任何一个分片，无法判断哪些分片丢失，等下一轮再检查
+		return 0, 0, fmt.Errorf("%d peers: %w", silent, errProbeUnanswered)
+	}
+
+	present := make([]bool, info.Shards())
+	var free []p2p.Peer
+	for _, peer := range s.shardPeers() {
+		indexes, ok := held[peer.RemoteAddr().String()]
+		if !ok {
+			// 探测之后才连接的节点
+			continue
+		}
+		if len(indexes) == 0 {
+			free = append(free, peer)
+			continue
+		}
+		for _, i := range indexes {
+			if i >= 0 && i < len(present) {
+				present[i] = true
+			}
+		}
+	}
+
+	var lost []int
+	for i, ok := range present {
+		if !ok {
+			lost = append(lost, i)
+		}
+	}
+	if len(lost) == 0 {
+		return 0, 0, nil
+	}
+
+	_, r, err := s.openStored(ctx, meta.Key, "")
+	if err != nil {
+		return 0, len(lost), err
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return 0, len(lost), err
+	}
+	// 填充是确定的，重新编码的分片与原来的相同
+	data = padData(meta.Padding, data, meta.Size)
+	if int64(len(data)) != info.Size {
+		return 0, len(lost), fmt.Errorf("local copy has %d bytes, shards were cut from %d", len(data), info.Size)
+	}
+
+	shards, err := encodeShards(info, data)
+	if err != nil {
+		return 0, len(lost), err
+	}
+
+	opts := store.WriteOpts{Version: meta.Version, Codec: meta.Codec, Size: meta.Size, Erasure: &info, DataKey: meta.DataKey, Padding: meta.Padding}
+	if meta.ExpiresAt != nil {
+		opts.ExpiresAt = *meta.ExpiresAt
+	}
+	for _, i := range lost {
+		if len(free) == 0 {
+			break
+		}
+		peer := free[0]
+		free = free[1:]
+		if err := s.sendShard(ctx, peer, hashedKey, i, shards[i], opts); err != nil {
+			return restored, len(lost) - restored, err
+		}
+		s.logger.Info("restored lost shard", "key", meta.Key, "shard", i, "peer", peer.RemoteAddr().String())
+		restored++
+	}
+
+	return restored, len(lost) - restored, nil
+}
+
+// repairLoop 每隔 RepairInterval 检查一次分片，直到 Stop 被调用
+func (s *FileServer) repairLoop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-s.quitch
+		cancel()
+	}()
+
+	ticker := time.NewTicker(s.Erasure.RepairInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.Repair(ctx)
+		case <-s.quitch:
+			return
+		}
+	}
+}
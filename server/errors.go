@@ -0,0 +1,21 @@
+package server
+
+import (
+	"distributed_file_storage/store"
+	"errors"
+)
+
+var (
+	// ErrNotFound 本地和网络中都找不到文件
+	ErrNotFound = store.ErrNotFound
+	// ErrObjectTooLarge 文件超过 FileServerOpts.MaxObjectSize
+	ErrObjectTooLarge = errors.New("object too large")
+	// ErrTooManyPeers 已连接节点数达到 FileServerOpts.MaxPeers
+	ErrTooManyPeers = errors.New("too many peers")
+	// ErrPeerBanned 节点因为不当行为被暂时封禁
+	ErrPeerBanned = errors.New("peer banned")
+	// ErrQuotaExceeded 写入会超过 owner 的配额或节点的总容量
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrPermissionDenied 请求没有签名、签名无效，或者请求方没有对应的权限
+	ErrPermissionDenied = errors.New("permission denied")
+)
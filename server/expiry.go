@@ -0,0 +1,35 @@
+package server
+
+import "time"
+
+// ExpireObjects 删除本节点上所有已过期的对象，包括替其他节点保存的副本
+func (s *FileServer) ExpireObjects() error {
+	usage, err := s.store.Expire(time.Now())
+	if err != nil {
+		s.logger.Warn("failed to remove expired objects", "err", err)
+		return err
+	}
+	if usage.Objects == 0 {
+		return nil
+	}
+
+	s.Metrics.ExpiredObjects.Add(float64(usage.Objects))
+	s.logger.Info("removed expired objects", "objects", usage.Objects, "bytes", usage.Bytes)
+
+	return nil
+}
+
+// expiryLoop 每隔 ExpiryInterval 清理一次过期对象，直到 Stop 被调用
+func (s *FileServer) expiryLoop() {
+	ticker := time.NewTicker(s.ExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.ExpireObjects()
+		case <-s.quitch:
+			return
+		}
+	}
+}
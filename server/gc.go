@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"distributed_file_storage/store"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrGCUnsupported Store 没有实现 store.Collector
+var ErrGCUnsupported = errors.New("store does not support garbage collection")
+
+// gcState 保存最近一次垃圾回收的结果，并保证同一时间只有一次回收在运行
+type gcState struct {
+	run  sync.Mutex
+	mu   sync.Mutex
+	last *store.GCReport
+}
+
+func (g *gcState) lastReport() *store.GCReport {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.last
+}
+
+// GC 立即运行一次垃圾回收，返回清理掉的内容
+func (s *FileServer) GC(ctx context.Context) (store.GCReport, error) {
+	collector, ok := s.store.(store.Collector)
+	if !ok {
+		return store.GCReport{}, ErrGCUnsupported
+	}
+
+	s.gc.run.Lock()
+	defer s.gc.run.Unlock()
+
+	report, err := collector.GC(ctx, s.GCOpts)
+	if err != nil {
+		s.logger.Warn("gc failed", "err", err)
+		return report, err
+	}
+
+	s.gc.mu.Lock()
+	s.gc.last = &report
+	s.gc.mu.Unlock()
+
+	s.Metrics.GCRuns.Inc()
+	s.Metrics.GCReclaimedBytes.Add(float64(report.BytesReclaimed))
+	s.Metrics.GCReclaimedFiles.Add(float64(report.IncompleteFiles + report.UnreferencedFiles))
+
+	s.logger.Info("gc finished",
+		"scanned", report.Scanned,
+		"incomplete", report.IncompleteFiles,
+		"unreferenced", report.UnreferencedFiles,
+		"empty_dirs", report.EmptyDirs,
+		"bytes", report.BytesReclaimed,
+		"duration", report.Duration)
+
+	return report, nil
+}
+
+// gcLoop 每隔 GCInterval 运行一次垃圾回收，直到 Stop 被调用
+func (s *FileServer) gcLoop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-s.quitch
+		cancel()
+	}()
+
+	ticker := time.NewTicker(s.GCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.GC(ctx)
+		case <-s.quitch:
+			return
+		}
+	}
+}
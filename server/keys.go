@@ -0,0 +1,191 @@
+package server
+
+import (
+	"distributed_file_storage/crypto"
+	"distributed_file_storage/store"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrUnknownMasterKey 数据密钥是用一个已经停用的主密钥包装的，对象无法再解密
+var ErrUnknownMasterKey = errors.New("data key was wrapped with an unknown or retired master key")
+
+// keyring 当前的主密钥和轮换前的主密钥
+type keyring struct {
+	rotate   sync.Mutex // 同一时间只有一次轮换
+	mu       sync.RWMutex
+	current  []byte
+	previous [][]byte
+}
+
+func (k *keyring) masters() ([]byte, [][]byte) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current, k.previous
+}
+
+// masterKey 返回当前的主密钥
+func (s *FileServer) masterKey() []byte {
+	current, _ := s.keys.masters()
+	return current
+}
+
+// PreviousKeys 返回轮换前还没有停用的主密钥
+func (s *FileServer) PreviousKeys() [][]byte {
+	_, previous := s.keys.masters()
+	return previous
+}
+
+// newDataKey 为一个新对象生成数据密钥，返回明文和用当前主密钥包装后的结果
+func (s *FileServer) newDataKey() ([]byte, string, error) {
+	dataKey := crypto.NewEncryptionKey()
+	wrapped, err := crypto.WrapKey(s.masterKey(), dataKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return dataKey, wrapped, nil
+}
+
+// dataKey 解开对象的数据密钥。没有数据密钥的旧对象直接用主密钥加密
+func (s *FileServer) dataKey(wrapped string) ([]byte, error) {
+	current, previous := s.keys.masters()
+	if wrapped == "" {
+		return current, nil
+	}
+
+	id := crypto.WrappedKeyID(wrapped)
+	for _, master := range append([][]byte{current}, previous...) {
+		if crypto.KeyID(master) == id {
+			return crypto.UnwrapKey(master, wrapped)
+		}
+	}
+	return nil, fmt.Errorf("master key %s: %w", id, ErrUnknownMasterKey)
+}
+
+// RotateReport 一次主密钥轮换的结果
+type RotateReport struct {
+	KeyID     string `json:"key_id"`    // 新主密钥的 ID
+	Rewrapped int64  `json:"rewrapped"` // 重新包装的数据密钥数，包括历史版本
+	Adopted   int64  `json:"adopted"`   // 没有数据密钥的旧对象，旧主密钥成为它们的数据密钥
+	Failed    int64  `json:"failed"`
+}
+
+// RotateKey 把主密钥换成 newKey：本地对象(包括历史版本)的数据密钥用新主密钥重新包装，
+// 并通知其他节点更新副本中的数据密钥，对象内容不需要重新加密。
+// 旧主密钥保留在 PreviousKeys 中，用来读取没有更新到的副本，直到 RetireKeys
+func (s *FileServer) RotateKey(newKey []byte) (RotateReport, error) {
+	s.keys.rotate.Lock()
+	defer s.keys.rotate.Unlock()
+
+	report := RotateReport{KeyID: crypto.KeyID(newKey)}
+	old, previous := s.keys.masters()
+	if crypto.KeyID(old) == report.KeyID {
+		return report, fmt.Errorf("rotate: the new master key is the current one")
+	}
+
+	// 先切换主密钥，轮换期间写入的对象直接使用新主密钥
+	s.keys.mu.Lock()
+	s.keys.current = newKey
+	s.keys.previous = append([][]byte{old}, previous...)
+	s.keys.mu.Unlock()
+
+	metas, err := s.store.List(s.ID)
+	if err != nil {
+		return report, err
+	}
+	for _, meta := range metas {
+		versions, err := s.store.ListVersions(s.ID, meta.Key)
+		if err != nil {
+			versions = []store.ObjectMeta{meta}
+		}
+
+		for _, v := range versions {
+			if v.DataKey != "" && crypto.WrappedKeyID(v.DataKey) == report.KeyID {
+				continue
+			}
+
+			dataKey := old
+			if v.DataKey != "" {
+				if dataKey, err = s.dataKey(v.DataKey); err != nil {
+					s.logger.Warn("rotate: cannot unwrap data key", "key", meta.Key, "version", v.Version, "err", err)
+					report.Failed++
+					continue
+				}
+			}
+			wrapped, err := crypto.WrapKey(newKey, dataKey)
+			if err == nil {
+				err = s.store.UpdateMeta(s.ID, meta.Key, v.Version, func(m *store.ObjectMeta) {
+					m.DataKey = wrapped
+				})
+			}
+			if err != nil {
+				s.logger.Warn("rotate: cannot update data key", "key", meta.Key, "version", v.Version, "err", err)
+				report.Failed++
+				continue
+			}
+			if v.DataKey == "" {
+				report.Adopted++
+			} else {
+				report.Rewrapped++
+			}
+
+			msg := Message{
+				Payload: MessageRewrapKey{
+					ID:      s.ID,
+					Key:     s.objectIDFor(meta),
+					Version: v.Version,
+					DataKey: wrapped,
+					Shards:  shardCount(v),
+				},
+			}
+			if err := s.broadcast(&msg); err != nil {
+				s.logger.Warn("rotate: failed to notify peers", "key", meta.Key, "err", err)
+			}
+		}
+	}
+
+	s.logger.Info("rotated master key",
+		"key_id", report.KeyID, "rewrapped", report.Rewrapped, "adopted", report.Adopted, "failed", report.Failed)
+
+	return report, nil
+}
+
+// RetireKeys 停用轮换前的主密钥，返回停用的个数。
+// 仍然由它们包装的数据密钥(例如删除时不在线的节点上残留的副本)从此无法解开
+func (s *FileServer) RetireKeys() int {
+	s.keys.rotate.Lock()
+	defer s.keys.rotate.Unlock()
+
+	s.keys.mu.Lock()
+	defer s.keys.mu.Unlock()
+
+	n := len(s.keys.previous)
+	s.keys.previous = nil
+	if n > 0 {
+		s.logger.Info("retired previous master keys", "keys", n)
+	}
+	return n
+}
+
+func (s *FileServer) handleMessageRewrapKey(from string, msg MessageRewrapKey) error {
+	keys := []string{msg.Key}
+	for i := 0; i < msg.Shards && i < MaxShards; i++ {
+		keys = append(keys, shardKey(msg.Key, i))
+	}
+
+	for _, key := range keys {
+		err := s.store.UpdateMeta(msg.ID, key, msg.Version, func(m *store.ObjectMeta) {
+			m.DataKey = msg.DataKey
+		})
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		s.logger.Debug("updated data key on request of peer", "key", key, "version", msg.Version, "peer", from)
+	}
+
+	return nil
+}
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"distributed_file_storage/store"
+	"distributed_file_storage/trace"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"time"
+)
+
+// fileNotFoundSize 节点没有请求的文件时，用它代替文件大小回复
+const fileNotFoundSize int64 = -1
+
+// filePermissionDenied 请求方没有读取权限时，用它代替文件大小回复
+const filePermissionDenied int64 = -2
+
+// fileHeader 回复 MessageGetFile 时在加密数据之前发送。
+// Size 为 fileNotFoundSize 或 filePermissionDenied 时后面没有其他字段
+type fileHeader struct {
+	Size      int64
+	ExpiresAt int64 // UnixNano，0 表示永不过期
+	Version   string
+	Codec     string
+	RawSize   int64 // 压缩前的字节数，没有压缩或者有填充时为 0
+	DataKey   string
+	Padding   string // 密文使用的填充方案，真实长度在密文中
+	Signer    string // 上传者的签名公钥，为空表示没有签名
+	Signature string
+}
+
+func newFileHeader(size int64, meta store.ObjectMeta) fileHeader {
+	h := fileHeader{Size: size, Version: meta.Version, Codec: meta.Codec, DataKey: meta.DataKey, Padding: meta.Padding,
+		Signer: meta.Signer, Signature: meta.Signature}
+	if meta.ExpiresAt != nil {
+		h.ExpiresAt = meta.ExpiresAt.UnixNano()
+	}
+	if meta.Codec != "" && meta.Padding == "" {
+		h.RawSize = meta.Size
+	}
+	return h
+}
+
+func (h fileHeader) write(w io.Writer) error {
+	if err := binary.Write(w, binary.LittleEndian, h.Size); err != nil || h.Size < 0 {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, h.ExpiresAt); err != nil {
+		return err
+	}
+	if err := writeString(w, h.Version); err != nil {
+		return err
+	}
+	if err := writeString(w, h.Codec); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, h.RawSize); err != nil {
+		return err
+	}
+	if err := writeString(w, h.DataKey); err != nil {
+		return err
+	}
+	if err := writeString(w, h.Padding); err != nil {
+		return err
+	}
+	if err := writeString(w, h.Signer); err != nil {
+		return err
+	}
+	return writeString(w, h.Signature)
+}
+
+func readFileHeader(r io.Reader) (fileHeader, error) {
+	var h fileHeader
+	if err := binary.Read(r, binary.LittleEndian, &h.Size); err != nil || h.Size < 0 {
+		return h, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &h.ExpiresAt); err != nil {
+		return h, err
+	}
+	var err error
+	if h.Version, err = readString(r); err != nil {
+		return h, err
+	}
+	if h.Codec, err = readString(r); err != nil {
+		return h, err
+	}
+	if err = binary.Read(r, binary.LittleEndian, &h.RawSize); err != nil {
+		return h, err
+	}
+	if h.DataKey, err = readString(r); err != nil {
+		return h, err
+	}
+	if h.Padding, err = readString(r); err != nil {
+		return h, err
+	}
+	if h.Signer, err = readString(r); err != nil {
+		return h, err
+	}
+	h.Signature, err = readString(r)
+	return h, err
+}
+
+// writeString 写入 uint16 长度和字符串内容
+func writeString(w io.Writer, s string) error {
+	if err := binary.Write(w, binary.LittleEndian, uint16(len(s))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+func readString(r io.Reader) (string, error) {
+	var n uint16
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// writeOpts 本地保存收到的文件时沿用发送方的过期时间、版本和压缩算法
+func (h fileHeader) writeOpts() store.WriteOpts {
+	opts := store.WriteOpts{Version: h.Version, Codec: h.Codec, Size: h.RawSize, DataKey: h.DataKey, Padding: h.Padding}
+	if h.ExpiresAt != 0 {
+		opts.ExpiresAt = time.Unix(0, h.ExpiresAt)
+	}
+	return opts
+}
+
+// shardsEnd 回复 MessageGetShards 时表示后面没有更多分片，shardsDenied 表示请求方没有读取权限
+const (
+	shardsEnd    = -1
+	shardsDenied = -2
+)
+
+// shardHeader 回复 MessageGetShards 时在每个分片的加密数据之前发送。
+// Index 为 shardsEnd 或 shardsDenied 时后面没有其他字段
+type shardHeader struct {
+	Index   int
+	Erasure store.ErasureInfo
+	fileHeader
+}
+
+func (h shardHeader) write(w io.Writer) error {
+	if err := binary.Write(w, binary.LittleEndian, int32(h.Index)); err != nil || h.Index < 0 {
+		return err
+	}
+	if err := writeString(w, h.Erasure.Stripe); err != nil {
+		return err
+	}
+	sizes := []int64{int64(h.Erasure.DataShards), int64(h.Erasure.ParityShards), h.Erasure.Size}
+	if err := binary.Write(w, binary.LittleEndian, sizes); err != nil {
+		return err
+	}
+	return h.fileHeader.write(w)
+}
+
+func readShardHeader(r io.Reader) (shardHeader, error) {
+	var (
+		h     shardHeader
+		index int32
+		err   error
+	)
+	if err = binary.Read(r, binary.LittleEndian, &index); err != nil {
+		return shardHeader{Index: shardsEnd}, err
+	}
+	if index < 0 {
+		return shardHeader{Index: int(index)}, nil
+	}
+	h.Index = int(index)
+	if h.Erasure.Stripe, err = readString(r); err != nil {
+		return h, err
+	}
+	sizes := make([]int64, 3)
+	if err = binary.Read(r, binary.LittleEndian, sizes); err != nil {
+		return h, err
+	}
+	h.Erasure.DataShards, h.Erasure.ParityShards, h.Erasure.Size = int(sizes[0]), int(sizes[1]), sizes[2]
+	h.fileHeader, err = readFileHeader(r)
+	return h, err
+}
+
+type Message struct {
+	Payload any
+	Trace   trace.SpanContext // 发送方的追踪上下文
+	Auth    *Auth             // 请求方的签名，回复类的消息为空
+}
+
+type MessageStoreFile struct {
+	ID        string
+	Key       string
+	Size      int64
+	ExpiresAt time.Time          // 零值表示永不过期
+	Version   string             // 为空表示没有开启版本
+	Codec     string             // 加密前使用的压缩算法
+	RawSize   int64              // 压缩前的字节数
+	Erasure   *store.ErasureInfo // 不为空时 Key 是一个纠删码分片
+	DataKey   string             // 用 owner 主密钥包装的数据密钥，接收方无法解开
+	Padding   string             // 密文使用的填充方案，此时 RawSize 为 0
+	Signer    string             // 上传者的签名公钥，为空表示没有签名
+	Signature string             // 上传者对 objectClaim 的签名(base64)
+}
+
+type MessageGetFile struct {
+	Key       string
+	ID        string
+	Version   string // 为空表示最新版本
+	Recipient string // 不为空时请求共享给该公钥的文件，回复中的数据密钥是共享的数据密钥
+}
+
+type MessageDeleteFile struct {
+	Key     string
+	ID      string
+	Version string // 为空表示删除所有版本
+	Shards  int    // 纠删码对象的分片数，同时删除对应的分片
+}
+
+// MessageRewrapKey 主密钥轮换后更新副本(和分片)元数据中的数据密钥
+type MessageRewrapKey struct {
+	ID      string
+	Key     string
+	Version string
+	DataKey string
+	Shards  int
+}
+
+// MessageShareKey 把用接收方公钥加密的数据密钥保存到副本(和分片)的元数据中
+type MessageShareKey struct {
+	ID        string
+	Key       string
+	Version   string
+	Recipient string
+	DataKey   string
+	Shards    int
+}
+
+// MessageRenameObject 把 owner 的一个副本(包括历史版本和分片)从 From 改名为 To
+type MessageRenameObject struct {
+	ID     string
+	From   string
+	To     string
+	Shards int
+}
+
+// MessageGetShards 请求纠删码对象的分片，节点依次发送自己保存的分片
+type MessageGetShards struct {
+	Key       string
+	ID        string
+	Version   string // 为空表示最新版本
+	Shards    int    // 分片总数，节点只查找序号小于它的分片
+	Recipient string // 同 MessageGetFile.Recipient
+}
+
+// MessageProbeShards 询问节点保存了某次切分的哪些分片，节点回复 MessageShardsHeld
+type MessageProbeShards struct {
+	ID     string
+	Key    string
+	Stripe string
+	Shards int
+}
+
+type MessageShardsHeld struct {
+	Key     string
+	Stripe  string
+	Indexes []int
+}
+
+// MessageQuotaExceeded 接收方因配额不足拒绝了 MessageStoreFile
+type MessageQuotaExceeded struct {
+	ID    string
+	Key   string
+	Size  int64
+	Limit int64 // 触发拒绝的上限
+	Used  int64 // 写入前已使用的字节数
+}
+
+// MessagePermissionDenied 接收方拒绝了请求(签名无效或者没有权限)
+type MessagePermissionDenied struct {
+	ID     string
+	Key    string
+	Op     string
+	Reason string
+}
+
+// Message 中是any，gob 在编码和解码接口类型时，必须提前知道接口可能包含的具体类型
+func init() {
+	gob.Register(MessageStoreFile{})
+	gob.Register(MessageGetFile{})
+	gob.Register(MessageDeleteFile{})
+	gob.Register(MessageQuotaExceeded{})
+	gob.Register(MessagePermissionDenied{})
+	gob.Register(MessageRewrapKey{})
+	gob.Register(MessageRenameObject{})
+	gob.Register(MessageShareKey{})
+	gob.Register(MessageGetShards{})
+	gob.Register(MessageProbeShards{})
+	gob.Register(MessageShardsHeld{})
+}
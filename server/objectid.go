@@ -0,0 +1,113 @@
+package server
+
+import (
+	"distributed_file_storage/crypto"
+	"distributed_file_storage/store"
+	"errors"
+)
+
+// 其他节点只看到对象标识而不是文件名。标识是以 owner 的 NameKey 为密钥的 HMAC-SHA256，
+// 节点无法通过对常见文件名做哈希来猜测副本的内容。之前的版本使用文件名的 md5，
+// 这些对象在迁移(MigrateObjectIDs 或者下一次写入)之前仍然使用 md5 标识
+
+// objectID 返回 key 在其他节点上的标识
+func (s *FileServer) objectID(key string) string {
+	meta, err := s.store.Stat(s.ID, key)
+	if err != nil {
+		meta = store.ObjectMeta{Key: key, KeyedID: true}
+	}
+	return s.objectIDFor(meta)
+}
+
+// objectIDFor 根据本地元数据返回对象在其他节点上的标识
+func (s *FileServer) objectIDFor(meta store.ObjectMeta) string {
+	if !meta.KeyedID {
+		return crypto.HashKey(meta.Key)
+	}
+	return crypto.ObjectID(s.NameKey, meta.Key)
+}
+
+// MigrateReport 把旧的 md5 标识迁移到 HMAC 标识的结果
+type MigrateReport struct {
+	Migrated int64 `json:"migrated"`
+	Failed   int64 `json:"failed"`
+}
+
+// MigrateObjectIDs 通知其他节点把本节点旧对象的副本(包括历史版本和分片)从 md5 标识改名为 HMAC 标识。
+// 迁移时不在线的节点上的旧副本之后不会再被读取
+func (s *FileServer) MigrateObjectIDs() (MigrateReport, error) {
+	var report MigrateReport
+
+	metas, err := s.store.List(s.ID)
+	if err != nil {
+		return report, err
+	}
+	for _, meta := range metas {
+		if meta.KeyedID {
+			continue
+		}
+		if err := s.migrateObjectID(meta); err != nil {
+			s.logger.Warn("migrate: cannot rename replicas", "key", meta.Key, "err", err)
+			report.Failed++
+			continue
+		}
+		report.Migrated++
+	}
+
+	s.logger.Info("migrated object ids", "migrated", report.Migrated, "failed", report.Failed)
+	return report, nil
+}
+
+// migrateObjectID 通知其他节点改名，再在本地所有版本的元数据中标记为 HMAC 标识
+func (s *FileServer) migrateObjectID(meta store.ObjectMeta) error {
+	versions, err := s.store.ListVersions(s.ID, meta.Key)
+	if err != nil {
+		versions = []store.ObjectMeta{meta}
+	}
+	shards := 0
+	for _, v := range versions {
+		shards = max(shards, shardCount(v))
+	}
+
+	msg := Message{
+		Payload: MessageRenameObject{
+			ID:     s.ID,
+			From:   crypto.HashKey(meta.Key),
+			To:     crypto.ObjectID(s.NameKey, meta.Key),
+			Shards: shards,
+		},
+	}
+	if err := s.broadcast(&msg); err != nil {
+		return err
+	}
+
+	for _, v := range versions {
+		err := s.store.UpdateMeta(s.ID, meta.Key, v.Version, func(m *store.ObjectMeta) {
+			m.KeyedID = true
+		})
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileServer) handleMessageRenameObject(from string, msg MessageRenameObject) error {
+	renames := [][2]string{{msg.From, msg.To}}
+	for i := 0; i < msg.Shards && i < MaxShards; i++ {
+		renames = append(renames, [2]string{shardKey(msg.From, i), shardKey(msg.To, i)})
+	}
+
+	for _, r := range renames {
+		err := s.store.Rename(msg.ID, r[0], r[1])
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		s.logger.Debug("renamed replica on request of peer", "from", r[0], "to", r[1], "peer", from)
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"crypto/sha256"
+	"distributed_file_storage/crypto"
+	"distributed_file_storage/store"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// 对象签名：上传者用签名密钥对副本(或分片)的密文哈希和元数据签名，签名随副本保存在其他节点上。
+// 接收副本的节点和取回副本的节点都会校验签名，篡改过内容或元数据的副本被丢弃。
+// 开启 AuthOpts.SignedObjects 后没有签名的副本也被拒绝，签名者必须有写入 owner 命名空间的权限。
+// 本节点命名空间中的副本总是必须由本节点签名。本节点自己保存的文件不校验
+
+// objectClaim 签名覆盖的内容。数据密钥不在其中，轮换主密钥重新包装数据密钥后签名仍然有效
+type objectClaim struct {
+	Owner     string             `json:"owner"`
+	Key       string             `json:"key"` // 对象标识或分片标识
+	Version   string             `json:"version,omitempty"`
+	ExpiresAt int64              `json:"expires_at,omitempty"` // UnixNano
+	Codec     string             `json:"codec,omitempty"`
+	Padding   string             `json:"padding,omitempty"`
+	Erasure   *store.ErasureInfo `json:"erasure,omitempty"`
+	Hash      []byte             `json:"hash"` // 节点之间传输的密文(包括 IV)的 SHA-256
+}
+
+func (c objectClaim) digest() []byte {
+	b, _ := json.Marshal(c)
+	return append([]byte("fs object\n"), b...)
+}
+
+// withHash 填写 data 的哈希
+func (c objectClaim) withHash(data []byte) objectClaim {
+	sum := sha256.Sum256(data)
+	c.Hash = sum[:]
+	return c
+}
+
+// storeClaim 发送给其他节点的副本的签名内容，hash 在发送数据时计算
+func storeClaim(msg MessageStoreFile) objectClaim {
+	c := objectClaim{
+		Owner:   msg.ID,
+		Key:     msg.Key,
+		Version: msg.Version,
+		Codec:   msg.Codec,
+		Padding: msg.Padding,
+		Erasure: msg.Erasure,
+	}
+	if !msg.ExpiresAt.IsZero() {
+		c.ExpiresAt = msg.ExpiresAt.UnixNano()
+	}
+	return c
+}
+
+// headerClaim 取回的副本的签名内容
+func headerClaim(owner, key string, h fileHeader, erasure *store.ErasureInfo) objectClaim {
+	return objectClaim{
+		Owner:     owner,
+		Key:       key,
+		Version:   h.Version,
+		ExpiresAt: h.ExpiresAt,
+		Codec:     h.Codec,
+		Padding:   h.Padding,
+		Erasure:   erasure,
+	}
+}
+
+// signObject 对 data(发送的密文)签名，填写 msg 的 Signer 和 Signature
+func (s *FileServer) signObject(msg *MessageStoreFile, data []byte) {
+	c := storeClaim(*msg).withHash(data)
+	msg.Signer = s.Identity()
+	msg.Signature = base64.StdEncoding.EncodeToString(crypto.Sign(s.SignKey, c.digest()))
+}
+
+// checkSigner 在接收数据之前检查副本的签名者：本节点命名空间中的副本必须由本节点签名，
+// 其他副本在 strict 模式下必须有签名，且签名者有写入权限
+func (s *FileServer) checkSigner(owner, key, signer, sig string) error {
+	if owner == s.ID && (signer != s.Identity() || sig == "") {
+		return fmt.Errorf("object %.16s/%.16s is not signed by this node: %w", owner, key, ErrPermissionDenied)
+	}
+	if signer == "" || sig == "" {
+		if s.Auth.SignedObjects {
+			return fmt.Errorf("object %.16s/%.16s is not signed: %w", owner, key, ErrPermissionDenied)
+		}
+		return nil
+	}
+	if s.Auth.SignedObjects && signer != s.Identity() && !s.allowed(signer, owner, key, PermWrite) {
+		return fmt.Errorf("object %.16s/%.16s signed by %.16s, who may not write it: %w", owner, key, signer, ErrPermissionDenied)
+	}
+	return nil
+}
+
+// checkIncoming 在接收副本之前检查签名者。已经有签名的副本不能被没有签名的写入，
+// 或者没有写入权限的其他签名者覆盖
+func (s *FileServer) checkIncoming(msg MessageStoreFile) error {
+	if err := s.checkSigner(msg.ID, msg.Key, msg.Signer, msg.Signature); err != nil {
+		return err
+	}
+	meta, err := s.store.Stat(msg.ID, msg.Key)
+	if err != nil || meta.Signer == "" || meta.Signer == msg.Signer {
+		return nil
+	}
+	if msg.Signer == "" {
+		return fmt.Errorf("unsigned write over object %.16s/%.16s signed by %.16s: %w", msg.ID, msg.Key, meta.Signer, ErrPermissionDenied)
+	}
+	if !s.allowed(msg.Signer, msg.ID, msg.Key, PermWrite) {
+		return fmt.Errorf("%.16s may not overwrite object %.16s/%.16s signed by %.16s: %w", msg.Signer, msg.ID, msg.Key, meta.Signer, ErrPermissionDenied)
+	}
+	return nil
+}
+
+// verifyObject 检查 claim(已经填写 Hash)的签名，没有签名的其他 owner 的对象只在非 strict 模式下通过
+func (s *FileServer) verifyObject(c objectClaim, signer, sig string) error {
+	if err := s.checkSigner(c.Owner, c.Key, signer, sig); err != nil || signer == "" || sig == "" {
+		return err
+	}
+	b, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("object %.16s/%.16s: malformed signature: %w", c.Owner, c.Key, crypto.ErrBadSignature)
+	}
+	if err := crypto.Verify(signer, c.digest(), b); err != nil {
+		return fmt.Errorf("object %.16s/%.16s signed by %.16s: %w", c.Owner, c.Key, signer, err)
+	}
+	return nil
+}
+
+// verifyingReader 计算读到的数据的哈希，读到结尾时校验签名。
+// 校验失败时用错误代替 io.EOF，Store 会丢弃写了一半的文件
+type verifyingReader struct {
+	r      io.Reader
+	h      hash.Hash
+	verify func(sum []byte) error
+}
+
+func (s *FileServer) newVerifyingReader(r io.Reader, c objectClaim, signer, sig string) *verifyingReader {
+	return &verifyingReader{
+		r: r,
+		h: sha256.New(),
+		verify: func(sum []byte) error {
+			c.Hash = sum
+			return s.verifyObject(c, signer, sig)
+		},
+	}
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF && v.verify != nil {
+		verify := v.verify
+		v.verify = nil
+		if verr := verify(v.h.Sum(nil)); verr != nil {
+			return n, verr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"bytes"
+	"distributed_file_storage/crypto"
+	"distributed_file_storage/store"
+	"fmt"
+	"io"
+)
+
+// padData 在加密之前按 scheme 填充发送给其他节点的数据。
+// rawSize 为 0 时与 data 的长度相同，和本地元数据中的 Size 一致，修复分片时能得到相同的结果
+func padData(scheme string, data []byte, rawSize int64) []byte {
+	if scheme == crypto.PaddingNone {
+		return data
+	}
+	if rawSize == 0 {
+		rawSize = int64(len(data))
+	}
+
+	var buf bytes.Buffer
+	io.Copy(&buf, crypto.PadReader(scheme, bytes.NewReader(data), crypto.PadHeader{Size: int64(len(data)), RawSize: rawSize}))
+	return buf.Bytes()
+}
+
+// unpadData 去掉 padData 的填充，返回原始数据和压缩前的字节数
+func unpadData(scheme string, data []byte) ([]byte, int64, error) {
+	if scheme == crypto.PaddingNone {
+		return data, 0, nil
+	}
+
+	_, h, err := crypto.UnpadReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, err
+	}
+	if h.Size > int64(len(data))-crypto.PadHeaderSize {
+		return nil, 0, fmt.Errorf("padding header: size %d exceeds the %d bytes received", h.Size, len(data))
+	}
+	return data[crypto.PadHeaderSize : crypto.PadHeaderSize+h.Size], h.RawSize, nil
+}
+
+// peerRawSize 发送给其他节点的压缩前字节数，有填充时不发送
+func peerRawSize(opts store.WriteOpts) int64 {
+	if opts.Padding != crypto.PaddingNone {
+		return 0
+	}
+	return opts.Size
+}
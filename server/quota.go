@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+)
+
+// QuotaOpts 限制其他节点可以写入本节点的数据量，值为 0 表示不限制
+type QuotaOpts struct {
+	Capacity     int64            // 节点总容量(所有 owner 加起来)
+	DefaultOwner int64            // 每个 owner 默认的配额
+	Owners       map[string]int64 // 按 owner id 单独设置的配额，覆盖 DefaultOwner
+}
+
+// ownerLimit 返回某个 owner 的配额，0 表示不限制
+func (q QuotaOpts) ownerLimit(id string) int64 {
+	if limit, ok := q.Owners[id]; ok {
+		return limit
+	}
+	return q.DefaultOwner
+}
+
+// QuotaError 说明是哪个上限拒绝了写入
+type QuotaError struct {
+	Owner string
+	Size  int64
+	Used  int64
+	Limit int64
+	Node  bool // true 表示超过节点总容量，false 表示超过 owner 配额
+}
+
+func (e *QuotaError) Error() string {
+	if e.Node {
+		return fmt.Sprintf("node capacity exceeded: %d bytes used, %d more requested, capacity %d", e.Used, e.Size, e.Limit)
+	}
+	return fmt.Sprintf("owner %s quota exceeded: %d bytes used, %d more requested, quota %d", e.Owner, e.Used, e.Size, e.Limit)
+}
+
+func (e *QuotaError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+// checkQuota 在接受其他节点的数据流之前检查 owner 配额和节点总容量
+func (s *FileServer) checkQuota(id, key string, size int64) error {
+	limit := s.Quota.ownerLimit(id)
+	if limit == 0 && s.Quota.Capacity == 0 {
+		return nil
+	}
+
+	// 覆盖已有的对象时，旧数据会被释放
+	var existing int64
+	if meta, err := s.store.Stat(id, key); err == nil {
+		existing = meta.DiskSize()
+	}
+
+	if limit > 0 {
+		usage, err := s.store.Usage(id)
+		if err != nil {
+			return err
+		}
+		if usage.Bytes-existing+size > limit {
+			return &QuotaError{Owner: id, Size: size, Used: usage.Bytes, Limit: limit}
+		}
+	}
+
+	if s.Quota.Capacity > 0 {
+		usage, err := s.store.Usage("")
+		if err != nil {
+			return err
+		}
+		if usage.Bytes-existing+size > s.Quota.Capacity {
+			return &QuotaError{Owner: id, Size: size, Used: usage.Bytes, Limit: s.Quota.Capacity, Node: true}
+		}
+	}
+
+	return nil
+}
+
+// QuotaStatus 节点容量和每个 owner 的使用情况
+type QuotaStatus struct {
+	Capacity int64        `json:"capacity"`
+	Used     int64        `json:"used"`
+	Owners   []OwnerUsage `json:"owners"`
+}
+
+type OwnerUsage struct {
+	ID      string `json:"id"`
+	Objects int64  `json:"objects"`
+	Bytes   int64  `json:"bytes"`
+	Quota   int64  `json:"quota"` // 0 表示不限制
+}
+
+// QuotaStatus 统计每个 owner 的占用
+func (s *FileServer) QuotaStatus() (QuotaStatus, error) {
+	ids, err := s.store.Owners()
+	if err != nil {
+		return QuotaStatus{}, err
+	}
+	sort.Strings(ids)
+
+	status := QuotaStatus{
+		Capacity: s.Quota.Capacity,
+		Owners:   make([]OwnerUsage, 0, len(ids)),
+	}
+	for _, id := range ids {
+		usage, err := s.store.Usage(id)
+		if err != nil {
+			return QuotaStatus{}, err
+		}
+		status.Used += usage.Bytes
+		status.Owners = append(status.Owners, OwnerUsage{
+			ID:      id,
+			Objects: usage.Objects,
+			Bytes:   usage.Bytes,
+			Quota:   s.Quota.ownerLimit(id),
+		})
+	}
+
+	return status, nil
+}
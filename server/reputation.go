@@ -0,0 +1,343 @@
+package server
+
+import (
+	"distributed_file_storage/p2p"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 节点信誉：按握手确认的身份(没有确认身份时按 IP)记录其他节点的不当行为(无法解码的消息、谎报大小、
+// 损坏的数据、超时)，每次扣分，分数随时间向 0 衰减。分数低于 BanScore 时封禁该身份一段时间，
+// 没有确认身份或者开启 BanIP 时同时封禁它的 IP。封禁时断开它的所有连接；FileServer 作为 Transport 的 Gater，
+// 被封禁的 IP 在握手之前、被封禁的身份在握手之后被拒绝。封禁列表保存在 BanFile 中，重启后仍然有效。
+// 正确提供副本的节点加分，Get 优先从分数高的节点读取
+
+// 不当行为的种类和扣分
+const (
+	misbehaveBadMessage = "bad_message" // 无法解码的消息或者无效的帧
+	misbehaveOversized  = "oversized"   // 超过上限的消息或文件
+	misbehaveCorrupt    = "corrupt"     // 签名校验失败或者无法解密的数据
+	misbehaveTimeout    = "timeout"     // 握手或读取超时
+)
+
+var misbehavePenalty = map[string]float64{
+	misbehaveBadMessage: 50,
+	misbehaveOversized:  50,
+	misbehaveCorrupt:    40,
+	misbehaveTimeout:    20,
+}
+
+const (
+	// servedReward 节点提供了一个校验通过的副本
+	servedReward = 5
+	// maxScore 分数的上限，好节点也不能无限积累信用
+	maxScore = 100
+)
+
+// ReputationOpts 信誉和封禁的参数，零值使用默认值
+type ReputationOpts struct {
+	BanScore    float64       // 分数低于它时封禁，0 表示 -100
+	BanDuration time.Duration // 封禁多久，0 表示 1 小时
+	HalfLife    time.Duration // 分数衰减一半的时间，0 表示 10 分钟
+	BanFile     string        // 封禁列表的路径，为空时不保存
+	BanIP       bool          // 封禁身份时同时封禁它的 IP
+}
+
+// BanInfo 一个被封禁的身份或 IP
+type BanInfo struct {
+	Identity string    `json:"identity,omitempty"` // 握手确认的签名公钥，没有确认身份时为空
+	IP       string    `json:"ip,omitempty"`       // 同时被封禁的 IP
+	Until    time.Time `json:"until"`
+	Reason   string    `json:"reason"`
+}
+
+// matches 节点是否被这个封禁拒绝
+func (b BanInfo) matches(p subject) bool {
+	return b.Identity != "" && b.Identity == p.identity || b.IP != "" && b.IP == p.ip
+}
+
+// subject 信誉和封禁的对象，同一个节点重新连接时端口会变化，IP 也可能变化
+type subject struct {
+	identity string
+	ip       string
+}
+
+// key 分数和封禁按身份记录，没有确认身份时按 IP
+func (p subject) key() string {
+	if p.identity != "" {
+		return p.identity
+	}
+	return p.ip
+}
+
+// peerScore 一个节点的分数，updated 之后的衰减在读取时计算
+type peerScore struct {
+	score   float64
+	updated time.Time
+}
+
+type reputation struct {
+	ReputationOpts
+
+	mu     sync.Mutex
+	scores map[string]*peerScore
+	bans   map[string]BanInfo
+	now    func() time.Time
+}
+
+func newReputation(opts ReputationOpts) *reputation {
+	if opts.BanScore == 0 {
+		opts.BanScore = -100
+	}
+	if opts.BanDuration <= 0 {
+		opts.BanDuration = time.Hour
+	}
+	if opts.HalfLife <= 0 {
+		opts.HalfLife = 10 * time.Minute
+	}
+	return &reputation{
+		ReputationOpts: opts,
+		scores:         make(map[string]*peerScore),
+		bans:           make(map[string]BanInfo),
+		now:            time.Now,
+	}
+}
+
+// load 读取 BanFile 中还没有到期的封禁
+func (r *reputation) load() error {
+	if r.BanFile == "" {
+		return nil
+	}
+	b, err := os.ReadFile(r.BanFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var bans []struct {
+		BanInfo
+		Peer string `json:"peer"` // 旧版本按 IP 封禁
+	}
+	if err := json.Unmarshal(b, &bans); err != nil {
+		return fmt.Errorf("ban file %s: %w", r.BanFile, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	for _, ban := range bans {
+		if ban.Identity == "" && ban.IP == "" {
+			ban.IP = ban.Peer
+		}
+		if ban.Until.After(now) {
+			r.bans[subject{identity: ban.Identity, ip: ban.IP}.key()] = ban.BanInfo
+		}
+	}
+	return nil
+}
+
+// save 把封禁列表写入 BanFile，调用方持有 mu
+func (r *reputation) save() error {
+	if r.BanFile == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(r.listLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(r.BanFile+".tmp", b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(r.BanFile+".tmp", r.BanFile)
+}
+
+// scoreLocked 返回衰减后的分数
+func (r *reputation) scoreLocked(p subject) float64 {
+	ps, ok := r.scores[p.key()]
+	if !ok {
+		return 0
+	}
+	elapsed := r.now().Sub(ps.updated)
+	return ps.score * math.Pow(0.5, float64(elapsed)/float64(r.HalfLife))
+}
+
+func (r *reputation) score(p subject) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.scoreLocked(p)
+}
+
+// add 调整分数，返回调整后的分数。分数低于 BanScore 时封禁，ban 不为空
+func (r *reputation) add(p subject, delta float64, reason string) (score float64, ban *BanInfo, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	score = min(r.scoreLocked(p)+delta, maxScore)
+	if score > r.BanScore {
+		r.scores[p.key()] = &peerScore{score: score, updated: r.now()}
+		return score, nil, nil
+	}
+
+	// 封禁期间的分数没有意义，解封后从 0 开始
+	delete(r.scores, p.key())
+	b := BanInfo{Identity: p.identity, Until: r.now().Add(r.BanDuration).UTC(), Reason: reason}
+	if p.identity == "" || r.BanIP {
+		b.IP = p.ip
+	}
+	r.bans[p.key()] = b
+	return score, &b, r.save()
+}
+
+// banned 返回拒绝 p 的封禁，已经到期的封禁被移除
+func (r *reputation) banned(p subject) (BanInfo, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	for key, ban := range r.bans {
+		if !ban.matches(p) {
+			continue
+		}
+		if ban.Until.After(now) {
+			return ban, true
+		}
+		delete(r.bans, key)
+		r.save()
+	}
+	return BanInfo{}, false
+}
+
+func (r *reputation) list() []BanInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.listLocked()
+}
+
+// listLocked 返回还没有到期的封禁，按身份和 IP 排序
+func (r *reputation) listLocked() []BanInfo {
+	now := r.now()
+	bans := make([]BanInfo, 0, len(r.bans))
+	for _, ban := range r.bans {
+		if ban.Until.After(now) {
+			bans = append(bans, ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		if bans[i].Identity != bans[j].Identity {
+			return bans[i].Identity < bans[j].Identity
+		}
+		return bans[i].IP < bans[j].IP
+	})
+	return bans
+}
+
+// peerIP 节点地址中的 IP
+func peerIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// peerSubject 连接对应的信誉对象
+func peerSubject(p p2p.Peer) subject {
+	return subject{identity: p.Identity(), ip: peerIP(p.RemoteAddr().String())}
+}
+
+// subjectOf 地址为 addr 的已连接节点的信誉对象，已经断开时只有 IP
+func (s *FileServer) subjectOf(addr string) subject {
+	if peer, ok := s.peer(addr); ok {
+		return peerSubject(peer)
+	}
+	return subject{ip: peerIP(addr)}
+}
+
+// misbehaved 记录 addr 的一次不当行为，分数过低时封禁并断开它的所有连接
+func (s *FileServer) misbehaved(addr, kind string, reason error) {
+	s.penalize(addr, s.subjectOf(addr), kind, reason)
+}
+
+func (s *FileServer) penalize(addr string, p subject, kind string, reason error) {
+	score, ban, err := s.reputation.add(p, -misbehavePenalty[kind], fmt.Sprintf("%s: %v", kind, reason))
+	if err != nil {
+		s.logger.Warn("failed to save ban list", "err", err)
+	}
+	s.logger.Warn("peer misbehaved", "peer", addr, "identity", p.identity, "kind", kind, "score", score, "err", reason)
+	if ban == nil {
+		return
+	}
+
+	s.Metrics.PeersBanned.Inc()
+	s.logger.Warn("banning peer", "identity", ban.Identity, "ip", ban.IP, "duration", s.reputation.BanDuration)
+
+	for _, peer := range s.snapshotPeers() {
+		if ban.matches(peerSubject(peer)) {
+			peer.Close()
+		}
+	}
+}
+
+// served 节点提供了一个校验通过的副本
+func (s *FileServer) served(addr string) {
+	s.reputation.add(s.subjectOf(addr), servedReward, "")
+}
+
+// OnMisbehave 作为 Transport 的回调，记录传输层断开的节点
+func (s *FileServer) OnMisbehave(p p2p.Peer, err error) {
+	kind := misbehaveBadMessage
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		kind = misbehaveTimeout
+	case errors.Is(err, p2p.ErrMessageTooLarge):
+		kind = misbehaveOversized
+	}
+	s.penalize(p.RemoteAddr().String(), peerSubject(p), kind, err)
+}
+
+// AllowAddr 作为 Transport 的 Gater，在握手之前拒绝被封禁的 IP
+func (s *FileServer) AllowAddr(addr net.Addr) error {
+	if ban, ok := s.reputation.banned(subject{ip: peerIP(addr.String())}); ok {
+		return fmt.Errorf("%s banned until %s (%s): %w: %w", addr, ban.Until.Format(time.RFC3339), ban.Reason, ErrPeerBanned, p2p.ErrGated)
+	}
+	return nil
+}
+
+// AllowPeer 作为 Transport 的 Gater，在握手之后拒绝被封禁的身份或 IP
+func (s *FileServer) AllowPeer(p p2p.Peer) error {
+	if ban, ok := s.reputation.banned(peerSubject(p)); ok {
+		return fmt.Errorf("%s banned until %s (%s): %w: %w", p.RemoteAddr(), ban.Until.Format(time.RFC3339), ban.Reason, ErrPeerBanned, p2p.ErrGated)
+	}
+	return nil
+}
+
+// rankedPeers 返回已连接的节点，分数高的在前
+func (s *FileServer) rankedPeers() []p2p.Peer {
+	peers := s.snapshotPeers()
+
+	scores := make(map[p2p.Peer]float64, len(peers))
+	for _, peer := range peers {
+		scores[peer] = s.reputation.score(peerSubject(peer))
+	}
+	sort.SliceStable(peers, func(i, j int) bool {
+		if scores[peers[i]] != scores[peers[j]] {
+			return scores[peers[i]] > scores[peers[j]]
+		}
+		return peers[i].RemoteAddr().String() < peers[j].RemoteAddr().String()
+	})
+	return peers
+}
+
+// Bans 返回当前的封禁列表
+func (s *FileServer) Bans() []BanInfo {
+	return s.reputation.list()
+}
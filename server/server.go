@@ -0,0 +1,1134 @@
+// Package server 实现分布式文件存储节点 FileServer
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/ed25519"
+	"distributed_file_storage/audit"
+	"distributed_file_storage/codec"
+	"distributed_file_storage/crypto"
+	"distributed_file_storage/metrics"
+	"distributed_file_storage/p2p"
+	"distributed_file_storage/store"
+	"distributed_file_storage/trace"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+type FileServerOpts struct {
+	ID                string             // 公钥
+	EncKey            []byte             // 主密钥，只用来包装每个对象的数据密钥
+	PreviousKeys      [][]byte           // 轮换前的主密钥，用来解开还没有重新包装的数据密钥
+	NameKey           []byte             // 计算其他节点上的对象标识的密钥，为空时由 EncKey 派生，轮换主密钥后必须保持不变
+	ShareKey          []byte             // 接收其他 owner 共享文件的 X25519 私钥，为空时由 EncKey 派生
+	SignKey           ed25519.PrivateKey // 对请求和授权令牌签名的身份密钥，为空时由 EncKey 派生
+	StorageRoot       string
+	PathTransformFunc store.PathTransformFunc
+	Store             store.Store // 为空时使用 StorageRoot 和 PathTransformFunc 创建 DiskStore
+	Transport         p2p.Transport
+	BootstrapNodes    []string         // 引导节点
+	ReplicationFactor int              // 每个文件复制到多少个节点，0 表示所有已连接节点
+	MaxObjectSize     int64            // 单个文件的最大字节数，0 表示不限制
+	MaxPeers          int              // 最多连接的节点数，0 表示不限制
+	MinStreamRate     int64            // 读取数据流的最低速率(字节/秒)，0 表示 64 KiB/s，更慢的节点会被断开
+	Quota             QuotaOpts        // 其他节点写入的配额
+	Auth              AuthOpts         // 其他节点请求的授权规则
+	Versioning        bool             // 为本节点的文件保留历史版本
+	Compression       string           // 默认的压缩算法：空、gzip、zstd 或 auto(按内容采样选择)
+	Reputation        ReputationOpts   // 不当行为的扣分和封禁
+	Erasure           ErasureOpts      // 开启后其他节点保存纠删码分片而不是完整副本
+	EncryptAtRest     bool             // 本节点的文件在本地磁盘上也用 EncKey 加密保存
+	Padding           string           // 发送给其他节点的密文的填充方案：空、padme 或 buckets
+	GCInterval        time.Duration    // 自动垃圾回收的间隔，0 表示只能手动调用 GC
+	GCOpts            store.GCOpts     // 垃圾回收的宽限期和限速
+	ExpiryInterval    time.Duration    // 多久清理一次过期对象，0 表示不清理(过期对象仍然读不到)
+	AuditLog          *audit.Log       // 记录 Put、Get、Delete 和远端请求，为空时不记录
+	Metrics           *metrics.Metrics // 为空时使用一个不导出的实例
+	Logger            *slog.Logger     // 为空时使用 slog.Default()
+	Tracer            *trace.Tracer    // 为空时不导出 span
+}
+
+type FileServer struct {
+	FileServerOpts
+
+	peerLock  sync.RWMutex
+	peers     map[string]p2p.Peer
+	peerSince map[string]time.Time // 节点的连接时间
+
+	transfers transfers
+	startedAt time.Time
+	gc        gcState
+	repair    repairState
+	keys      keyring
+
+	reputation *reputation
+	nonces     nonceCache
+
+	store         store.Store
+	logger        *slog.Logger
+	streamTimeout time.Duration // 等待其他节点的数据流或回复的基础时间，测试中会缩短
+	quitch        chan struct{}
+	stopOnce      sync.Once
+}
+
+func NewFileServer(opts FileServerOpts) *FileServer {
+	if opts.SignKey == nil {
+		opts.SignKey, _ = crypto.SignKeyFromSeed(crypto.DeriveKey(opts.EncKey, "sign key"))
+	}
+	if opts.ID == "" {
+		opts.ID = crypto.SignPublicKey(opts.SignKey)
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	logger := opts.Logger.With("node_id", opts.ID, "addr", opts.Transport.Addr())
+	if opts.Store == nil {
+		opts.Store = store.NewDiskStore(store.StoreOpts{
+			PathTransformFunc: opts.PathTransformFunc,
+			Root:              opts.StorageRoot,
+			Logger:            logger,
+		})
+	}
+	if opts.Metrics == nil {
+		opts.Metrics = metrics.New()
+	}
+	if opts.Tracer == nil {
+		opts.Tracer = trace.NewTracer(nil)
+	}
+	if opts.NameKey == nil {
+		opts.NameKey = crypto.DeriveKey(opts.EncKey, "object id")
+	}
+	if opts.ShareKey == nil {
+		opts.ShareKey = crypto.DeriveKey(opts.EncKey, "share key")
+	}
+	s := &FileServer{
+		FileServerOpts: opts,
+		store:          opts.Store,
+		logger:         logger,
+		streamTimeout:  streamTimeout,
+		quitch:         make(chan struct{}),
+		peers:          make(map[string]p2p.Peer),
+		peerSince:      make(map[string]time.Time),
+		startedAt:      time.Now().UTC(),
+	}
+	s.keys.current, s.keys.previous = opts.EncKey, opts.PreviousKeys
+	s.reputation = newReputation(opts.Reputation)
+	s.registerMetrics()
+
+	return s
+}
+
+// registerMetrics 注册在导出时才计算的指标
+func (s *FileServer) registerMetrics() {
+	s.Metrics.NewGaugeFunc("fs_peers", "Number of connected peers.", func() float64 {
+		s.peerLock.RLock()
+		defer s.peerLock.RUnlock()
+		return float64(len(s.peers))
+	})
+	s.Metrics.NewGaugeFunc("fs_rpc_queue_depth", "Messages waiting in the transport queue.", func() float64 {
+		return float64(len(s.Transport.Consume()))
+	})
+	s.Metrics.NewGaugeFunc("fs_disk_usage_bytes", "Bytes used by all objects in the storage root.", func() float64 {
+		usage, _ := s.store.Usage("")
+		return float64(usage.Bytes)
+	})
+}
+
+func (s *FileServer) broadcast(msg *Message) error {
+	return s.sendTo(s.snapshotPeers(), msg)
+}
+
+// sendTo 只把消息发送给指定的节点，请求消息在发送前签名
+func (s *FileServer) sendTo(peers []p2p.Peer, msg *Message) error {
+	return s.sendWithToken(peers, msg, "")
+}
+
+// sendWithToken 同 sendTo，请求消息带上授权令牌。签名绑定接收方，每个节点收到的签名不同
+func (s *FileServer) sendWithToken(peers []p2p.Peer, msg *Message, token string) error {
+	for _, peer := range peers {
+		s.sign(msg, token, peer.Identity())
+
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+			return err
+		}
+		if err := peer.Send(p2p.EncodeMessage(buf.Bytes())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get 读取文件，本地没有时从网络中的节点获取。调用方负责关闭返回的 ReadCloser
+func (s *FileServer) Get(key string) (io.ReadCloser, error) {
+	defer observeDuration(s.Metrics.GetDuration, time.Now())
+
+	ctx, span := s.Tracer.Start(context.Background(), "FileServer.Get")
+	defer span.End()
+	span.SetAttr("node_id", s.ID)
+	span.SetAttr("key", key)
+
+	r, err := s.get(ctx, span, key)
+	span.SetError(err)
+	s.auditLocal("get", key, "", 0, err)
+
+	return r, err
+}
+
+func (s *FileServer) get(ctx context.Context, span *trace.Span, key string) (io.ReadCloser, error) {
+	if s.store.Has(s.ID, key) {
+		s.logger.Debug("serving file from local disk", "key", key)
+		span.SetAttr("served_by", "local")
+		return s.openLocal(ctx, key, "")
+	}
+
+	s.logger.Info("file not found locally, fetching from network", "key", key)
+
+	if s.Erasure.Enabled() {
+		h, data, err := s.fetchShards(ctx, key, "")
+		if err == nil {
+			opts := h.writeOpts()
+			opts.Erasure = &h.Erasure
+			opts.KeyedID = true
+			if _, err := s.writeLocal(ctx, key, bytes.NewReader(data), int64(len(data)), opts); err != nil {
+				return nil, err
+			}
+			s.Metrics.BytesStored.Add(float64(len(data)))
+			span.SetAttr("served_by", "shards")
+			return s.openLocal(ctx, key, "")
+		}
+		// 开启纠删码之前写入的文件只有完整副本
+		s.logger.Info("could not reconstruct file from shards, asking for a full copy", "key", key, "err", err)
+	}
+
+	// 只保存第一个(分数最高的)节点的副本
+	received := false
+	err := s.fetch(ctx, key, "", func(peer string, h fileHeader, r io.Reader) error {
+		if received {
+			return nil
+		}
+		opts := h.writeOpts()
+		opts.KeyedID = true
+		n, err := s.writeDecrypt(ctx, key, r, h.Size, opts)
+		if err != nil {
+			return err
+		}
+
+		s.logger.Info("received file over the network", "key", key, "peer", peer, "bytes", n)
+		span.SetAttr("served_by", peer)
+		received = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.openLocal(ctx, key, "")
+}
+
+// fetch 向所有节点请求 key 的某个版本(为空时是最新版本)，对每个有该文件的节点调用 handle。
+// handle 没有读完的数据会被丢弃
+func (s *FileServer) fetch(ctx context.Context, key, version string, handle func(peer string, h fileHeader, r io.Reader) error) error {
+	return s.fetchFrom(ctx, MessageGetFile{Key: s.objectID(key), ID: s.ID, Version: version}, key, handle)
+}
+
+// fetchFrom 向所有节点发送 req，label 是传输状态中显示的名字。每个节点都会回复一个数据流，
+// handle 返回错误后仍然读完其他节点的回复，否则它们的读循环会停在没有读取的数据流上
+func (s *FileServer) fetchFrom(ctx context.Context, req MessageGetFile, label string, handle func(peer string, h fileHeader, r io.Reader) error) error {
+	msg := Message{
+		Payload: req,
+		Trace:   trace.SpanContextFromContext(ctx),
+	}
+
+	// 分数高的节点先交给 handle
+	peers := s.rankedPeers()
+	if err := s.sendWithToken(peers, &msg, tokenFromContext(ctx)); err != nil {
+		return err
+	}
+
+	served, denied, rejected := 0, 0, 0
+	var rejectErr, handleErr error
+	for _, peer := range peers {
+		if err := s.waitStream(peer, label); err != nil {
+			continue
+		}
+		s.streamDeadline(peer, 0)
+		h, err := readFileHeader(peer)
+		if err != nil {
+			s.dropStream(peer, label, err)
+			continue
+		}
+		if h.Size < 0 {
+			if h.Size == filePermissionDenied {
+				denied++
+			}
+			peer.CloseStream()
+			continue
+		}
+		if limit := s.maxReplicaSize(h.Padding); limit > 0 && h.Size > limit {
+			s.disconnect(peer.RemoteAddr().String(), misbehaveOversized, fmt.Errorf("get %s: copy of %d bytes: %w", label, h.Size, ErrObjectTooLarge))
+			peer.CloseStream()
+			continue
+		}
+
+		// 先读完整个副本，校验上传者的签名之后才交给 handle
+		addr := peer.RemoteAddr().String()
+		done := s.transfers.begin(transferGet, label, addr)
+		s.streamDeadline(peer, h.Size)
+		data, err := io.ReadAll(io.LimitReader(peer, h.Size))
+		if err == nil && int64(len(data)) < h.Size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			done()
+			s.dropStream(peer, label, err)
+			continue
+		}
+		peer.CloseStream()
+		if err := s.verifyObject(headerClaim(req.ID, req.Key, h, nil).withHash(data), h.Signer, h.Signature); err != nil {
+			s.Metrics.SignatureRejections.Inc()
+			s.misbehaved(addr, misbehaveCorrupt, fmt.Errorf("get %s: %w", label, err))
+			rejected, rejectErr = rejected+1, err
+			done()
+			continue
+		}
+		served++
+		s.served(addr)
+
+		if handleErr == nil {
+			handleErr = handle(addr, h, bytes.NewReader(data))
+		}
+		done()
+	}
+	if handleErr != nil {
+		return handleErr
+	}
+	if served == 0 && rejected > 0 {
+		return fmt.Errorf("get %s: rejected copies from %d peers: %w", label, rejected, rejectErr)
+	}
+	if served == 0 && denied > 0 {
+		return fmt.Errorf("get %s: denied by %d peers: %w", label, denied, ErrPermissionDenied)
+	}
+
+	return nil
+}
+
+// readStore 和 writeStore 包装本地 Store 的读写，并记录磁盘 I/O 的 span
+func (s *FileServer) readStore(ctx context.Context, id, key string) (int64, io.ReadCloser, error) {
+	_, span := s.Tracer.Start(ctx, "store.read")
+	defer span.End()
+	span.SetAttr("key", key)
+
+	n, r, err := s.store.Read(id, key)
+	span.SetAttr("bytes", n)
+	span.SetError(err)
+
+	return n, r, err
+}
+
+// openLocal 打开本节点保存的文件(version 为空时是最新版本)，解密并按元数据中的压缩算法解压
+func (s *FileServer) openLocal(ctx context.Context, key, version string) (io.ReadCloser, error) {
+	meta, r, err := s.openStored(ctx, key, version)
+	if err != nil {
+		return nil, err
+	}
+
+	return codec.NewReader(meta.Codec, r)
+}
+
+// openStored 打开本节点保存的文件，返回解密后、解压前的数据
+func (s *FileServer) openStored(ctx context.Context, key, version string) (store.ObjectMeta, io.ReadCloser, error) {
+	meta, err := s.statVersion(s.ID, key, version)
+	if err != nil {
+		return meta, nil, err
+	}
+
+	var r io.ReadCloser
+	if version == "" {
+		_, r, err = s.readStore(ctx, s.ID, key)
+	} else {
+		_, r, err = s.store.ReadVersion(s.ID, key, version)
+	}
+	if err != nil || !meta.Encrypted {
+		return meta, r, err
+	}
+
+	dataKey, err := s.dataKey(meta.DataKey)
+	if err != nil {
+		r.Close()
+		return meta, nil, err
+	}
+	dr, err := crypto.DecryptReader(dataKey, r)
+	if err != nil {
+		r.Close()
+		return meta, nil, err
+	}
+	return meta, struct {
+		io.Reader
+		io.Closer
+	}{dr, r}, nil
+}
+
+// writeLocal 把压缩后的数据写入本节点的命名空间，EncryptAtRest 时先加密。size 是 r 的字节数
+func (s *FileServer) writeLocal(ctx context.Context, key string, r io.Reader, size int64, opts store.WriteOpts) (int64, error) {
+	if s.EncryptAtRest {
+		dataKey, err := s.dataKey(opts.DataKey)
+		if err != nil {
+			return 0, err
+		}
+		er, err := crypto.EncryptReader(dataKey, r)
+		if err != nil {
+			return 0, err
+		}
+		r = er
+		opts.Encrypted = true
+		if opts.Size == 0 {
+			opts.Size = size
+		}
+	}
+
+	return s.writeStore(ctx, s.ID, key, r, opts)
+}
+
+func (s *FileServer) writeStore(ctx context.Context, id, key string, r io.Reader, opts store.WriteOpts) (int64, error) {
+	_, span := s.Tracer.Start(ctx, "store.write")
+	defer span.End()
+	span.SetAttr("key", key)
+
+	n, err := s.store.Write(id, key, r, opts)
+	span.SetAttr("bytes", n)
+	span.SetError(err)
+
+	return n, err
+}
+
+// writeDecrypt 解密从节点收到的 size 字节的数据流并写入本地 Store。
+// EncryptAtRest 时数据流已经是用对象的数据密钥加密的格式，没有填充时直接保存
+func (s *FileServer) writeDecrypt(ctx context.Context, key string, r io.Reader, size int64, opts store.WriteOpts) (int64, error) {
+	if s.EncryptAtRest && opts.Padding == crypto.PaddingNone {
+		opts.Encrypted = true
+		if opts.Size == 0 {
+			opts.Size = size - aes.BlockSize
+		}
+		n, err := s.writeStore(ctx, s.ID, key, r, opts)
+		s.Metrics.BytesStored.Add(float64(n))
+		return n, err
+	}
+
+	dataKey, err := s.dataKey(opts.DataKey)
+	if err != nil {
+		return 0, err
+	}
+
+	if opts.Padding != crypto.PaddingNone {
+		dr, err := crypto.DecryptReader(dataKey, r)
+		if err != nil {
+			return 0, err
+		}
+		ur, h, err := crypto.UnpadReader(dr)
+		if err != nil {
+			return 0, err
+		}
+		opts.Size = h.RawSize
+		n, err := s.writeLocal(ctx, key, ur, h.Size, opts)
+		s.Metrics.BytesStored.Add(float64(n))
+		return n, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := crypto.CopyDecrypt(dataKey, r, pw)
+		pw.CloseWithError(err)
+	}()
+
+	n, err := s.writeStore(ctx, s.ID, key, pr, opts)
+	pr.CloseWithError(err)
+	s.Metrics.BytesStored.Add(float64(n))
+
+	return n, err
+}
+
+// PutOpts Put 的可选参数
+type PutOpts struct {
+	TTL       time.Duration // 存活时间，ExpiresAt 为空时使用
+	ExpiresAt time.Time     // 过期时间，到期后 Get 返回 ErrNotFound，各节点的副本会被清理
+	Codec     string        // 压缩算法：none、gzip、zstd 或 auto，为空时使用 FileServerOpts.Compression
+}
+
+func (o PutOpts) writeOpts(version, defaultCodec string) store.WriteOpts {
+	opts := store.WriteOpts{ExpiresAt: o.ExpiresAt, Version: version, Codec: o.Codec}
+	if opts.Codec == "" {
+		opts.Codec = defaultCodec
+	}
+	if opts.Codec == "none" {
+		opts.Codec = codec.None
+	}
+	if opts.ExpiresAt.IsZero() && o.TTL > 0 {
+		opts.ExpiresAt = time.Now().Add(o.TTL)
+	}
+	return opts
+}
+
+// Store 把文件写入本地磁盘，再把加密后的副本发送给网络中的节点
+func (s *FileServer) Store(key string, r io.Reader) error {
+	return s.Put(key, r, PutOpts{})
+}
+
+// Put 与 Store 相同，但可以设置过期时间等选项
+func (s *FileServer) Put(key string, r io.Reader, opts PutOpts) error {
+	start := time.Now()
+	defer observeDuration(s.Metrics.StoreDuration, start)
+
+	ctx, span := s.Tracer.Start(context.Background(), "FileServer.Store")
+	defer span.End()
+	span.SetAttr("node_id", s.ID)
+	span.SetAttr("key", key)
+
+	done := s.transfers.begin(transferStore, key, "")
+	var version string
+	if s.Versioning {
+		version = newVersionID()
+		span.SetAttr("version", version)
+	}
+
+	size, err := s.storeFile(ctx, span, key, r, opts.writeOpts(version, s.Compression))
+	done()
+	span.SetError(err)
+	s.auditLocal("put", key, version, size, err)
+	if err == nil {
+		s.logger.Info("stored file", "key", key, "bytes", size, "duration", time.Since(start))
+	}
+
+	return err
+}
+
+func (s *FileServer) storeFile(ctx context.Context, span *trace.Span, key string, r io.Reader, opts store.WriteOpts) (int64, error) {
+	// 1. 压缩，auto 时先采样选择算法。压缩后的数据同时用于本地存储和加密发送
+	br := bufio.NewReaderSize(r, codec.SampleSize)
+	if opts.Codec == codec.Auto {
+		sample, _ := br.Peek(codec.SampleSize)
+		opts.Codec = codec.Detect(sample)
+	}
+	if opts.Codec != codec.None {
+		span.SetAttr("codec", opts.Codec)
+	}
+
+	fileBuffer := new(bytes.Buffer)
+	cw, err := codec.NewWriter(opts.Codec, fileBuffer)
+	if err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(cw, br)
+	if cerr := cw.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if s.MaxObjectSize > 0 && size > s.MaxObjectSize {
+		return 0, fmt.Errorf("store %s: %d bytes: %w", key, size, ErrObjectTooLarge)
+	}
+	opts.Size = size
+	dataKey, wrapped, err := s.newDataKey()
+	if err != nil {
+		return 0, err
+	}
+	opts.DataKey = wrapped
+	// 旧对象的副本先改用 HMAC 标识，新写入的版本和历史版本在其他节点上使用同一个标识
+	if meta, err := s.store.Stat(s.ID, key); err == nil && !meta.KeyedID {
+		if err := s.migrateObjectID(meta); err != nil {
+			return 0, err
+		}
+	}
+	opts.KeyedID = true
+	opts.Padding = s.Padding
+	// 发送给其他节点的数据带有填充，本地保存的数据没有
+	peerData := padData(opts.Padding, fileBuffer.Bytes(), opts.Size)
+	if s.Erasure.Enabled() {
+		opts.Erasure = &store.ErasureInfo{
+			Stripe:       newStripeID(),
+			DataShards:   s.Erasure.DataShards,
+			ParityShards: s.Erasure.ParityShards,
+			Size:         int64(len(peerData)),
+		}
+	}
+
+	// 2. 存储文件到本地磁盘
+	stored, err := s.writeLocal(ctx, key, bytes.NewReader(fileBuffer.Bytes()), int64(fileBuffer.Len()), opts)
+	if err != nil {
+		return 0, err
+	}
+	s.Metrics.BytesStored.Add(float64(stored))
+	span.SetAttr("bytes", size)
+	span.SetAttr("stored_bytes", stored)
+
+	// 3. 纠删码模式下每个节点只保存一个分片
+	if opts.Erasure != nil {
+		placed, err := s.storeShards(ctx, key, peerData, opts)
+		span.SetAttr("shards", placed)
+		return size, err
+	}
+
+	// 否则将文件广播到网络中所有已知节点。先加密，签名覆盖发送的密文
+	encrypted := new(bytes.Buffer)
+	if _, err := crypto.CopyEncrypt(dataKey, bytes.NewReader(peerData), encrypted); err != nil {
+		return 0, err
+	}
+	payload := MessageStoreFile{
+		Key:       s.objectID(key),
+		Size:      int64(encrypted.Len()),
+		ID:        s.ID,
+		ExpiresAt: opts.ExpiresAt,
+		Version:   opts.Version,
+		Codec:     opts.Codec,
+		RawSize:   peerRawSize(opts),
+		DataKey:   opts.DataKey,
+		Padding:   opts.Padding,
+	}
+	s.signObject(&payload, encrypted.Bytes())
+	msg := Message{
+		Payload: payload,
+		Trace:   trace.SpanContextFromContext(ctx),
+	}
+	// 广播元数据
+	replicas := s.replicaPeers()
+	span.SetAttr("replicas", len(replicas))
+	if err := s.sendTo(replicas, &msg); err != nil {
+		return 0, err
+	}
+	// 广播实际data
+	var peers []io.Writer
+	for _, peer := range replicas {
+		peers = append(peers, peer)
+	}
+	// TODO broadcast 方法利用了 io.MultiWriter 的强大功能，实现了高效的“一写多发”。它避免了写一个循环，然后逐个发送数据给每个对等节点的繁琐过程，使代码更加简洁和优雅
+	mw := io.MultiWriter(peers...)
+	mw.Write([]byte{p2p.IncomingStream})
+	_, err = mw.Write(encrypted.Bytes())
+
+	return size, err
+}
+
+// Delete 删除本地文件，并通知网络中的节点删除各自的副本
+func (s *FileServer) Delete(key string) error {
+	meta, _ := s.store.Stat(s.ID, key)
+	objectID := s.objectID(key)
+	err := s.store.Delete(s.ID, key)
+	s.auditLocal("delete", key, "", 0, err)
+	if err != nil {
+		return err
+	}
+
+	msg := Message{
+		Payload: MessageDeleteFile{
+			Key:    objectID,
+			ID:     s.ID,
+			Shards: shardCount(meta),
+		},
+	}
+
+	return s.broadcast(&msg)
+}
+
+// Stat 返回本地文件的元数据
+func (s *FileServer) Stat(key string) (store.ObjectMeta, error) {
+	return s.store.Stat(s.ID, key)
+}
+
+// List 列出本节点名下的所有文件
+func (s *FileServer) List() ([]store.ObjectMeta, error) {
+	return s.store.List(s.ID)
+}
+
+// Peers 返回当前已连接节点的地址
+func (s *FileServer) Peers() []string {
+	s.peerLock.RLock()
+	defer s.peerLock.RUnlock()
+
+	addrs := make([]string, 0, len(s.peers))
+	for addr := range s.peers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	return addrs
+}
+
+// peer 返回地址对应的已连接节点。节点随时可能断开，不要直接读取 s.peers
+func (s *FileServer) peer(addr string) (p2p.Peer, bool) {
+	s.peerLock.RLock()
+	defer s.peerLock.RUnlock()
+
+	peer, ok := s.peers[addr]
+	return peer, ok
+}
+
+// snapshotPeers 返回当前已连接的所有节点
+func (s *FileServer) snapshotPeers() []p2p.Peer {
+	s.peerLock.RLock()
+	defer s.peerLock.RUnlock()
+
+	peers := make([]p2p.Peer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// replicaPeers 按 ReplicationFactor 选出存放副本的节点
+func (s *FileServer) replicaPeers() []p2p.Peer {
+	s.peerLock.RLock()
+	defer s.peerLock.RUnlock()
+
+	addrs := make([]string, 0, len(s.peers))
+	for addr := range s.peers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	if s.ReplicationFactor > 0 && len(addrs) > s.ReplicationFactor {
+		addrs = addrs[:s.ReplicationFactor]
+	}
+
+	peers := make([]p2p.Peer, len(addrs))
+	for i, addr := range addrs {
+		peers[i] = s.peers[addr]
+	}
+
+	return peers
+}
+
+// Stop 停止消息循环并关闭 Transport，可以重复调用
+func (s *FileServer) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.quitch)
+	})
+}
+
+// OnPeer 作为 Transport 的回调，记录新建立连接的节点
+func (s *FileServer) OnPeer(p p2p.Peer) error {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	if s.MaxPeers > 0 && len(s.peers) >= s.MaxPeers {
+		return fmt.Errorf("refusing peer %s: %w", p.RemoteAddr(), ErrTooManyPeers)
+	}
+	if ban, ok := s.reputation.banned(peerSubject(p)); ok {
+		return fmt.Errorf("refusing peer %s until %s (%s): %w", p.RemoteAddr(), ban.Until.Format(time.RFC3339), ban.Reason, ErrPeerBanned)
+	}
+
+	s.peers[p.RemoteAddr().String()] = p
+	s.peerSince[p.RemoteAddr().String()] = time.Now().UTC()
+
+	s.logger.Info("connected with remote", "peer", p.RemoteAddr().String())
+
+	return nil
+}
+
+// OnPeerClose 作为 Transport 的回调，移除已断开的节点
+func (s *FileServer) OnPeerClose(p p2p.Peer) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	addr := p.RemoteAddr().String()
+	if s.peers[addr] == p {
+		delete(s.peers, addr)
+		delete(s.peerSince, addr)
+		s.logger.Info("disconnected from remote", "peer", addr)
+	}
+}
+
+// maxReplicaSize 其他节点发来的一个副本(密文)最多有多少字节，0 表示不限制
+func (s *FileServer) maxReplicaSize(padding string) int64 {
+	if s.MaxObjectSize <= 0 {
+		return 0
+	}
+	size := s.MaxObjectSize
+	if padding != crypto.PaddingNone {
+		size = crypto.PaddedSize(padding, size+crypto.PadHeaderSize)
+	}
+	return size + aes.BlockSize
+}
+
+// disconnect 断开违反限制的节点，kind 计入它的信誉
+func (s *FileServer) disconnect(addr, kind string, reason error) {
+	s.misbehaved(addr, kind, reason)
+
+	peer, ok := s.peer(addr)
+	if !ok {
+		return
+	}
+
+	s.Metrics.PeersDisconnected.Inc()
+	s.logger.Warn("disconnecting peer", "peer", addr, "err", reason)
+	peer.Close()
+}
+
+// streamTimeout 请求发出后等待对方数据流的最长时间
+const streamTimeout = 10 * time.Second
+
+// waitStream 等待 peer 的数据流。超时或连接已经断开时返回错误，超时的连接会被断开：
+// 之后才到达的数据流没有人读取，读循环会一直停在那里
+func (s *FileServer) waitStream(peer p2p.Peer, label string) error {
+	err := peer.WaitStream(s.streamTimeout)
+	if err != nil {
+		s.Metrics.PeersDisconnected.Inc()
+		s.logger.Warn("no stream from peer", "peer", peer.RemoteAddr().String(), "key", label, "err", err)
+		peer.Close()
+	}
+	return err
+}
+
+// defaultMinStreamRate MinStreamRate 为 0 时读取数据流的最低速率
+const defaultMinStreamRate = 64 << 10
+
+// streamDeadline 设置读取 size 字节数据流的截止时间：streamTimeout 加上按 MinStreamRate 传完的时间。
+// 对方中途停下时读取返回超时错误，不会一直占着读取数据流的 goroutine。CloseStream 之后传输层会清除截止时间
+func (s *FileServer) streamDeadline(peer p2p.Peer, size int64) {
+	rate := s.MinStreamRate
+	if rate <= 0 {
+		rate = defaultMinStreamRate
+	}
+	peer.SetReadDeadline(time.Now().Add(s.streamTimeout + time.Duration(size/rate)*time.Second))
+}
+
+// dropStream 数据流读到一半出错，连接上剩下的字节无法再解析成消息，只能断开连接。
+// 没有在截止时间内发完数据流的节点还会被扣分
+func (s *FileServer) dropStream(peer p2p.Peer, label string, err error) {
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		s.misbehaved(peer.RemoteAddr().String(), misbehaveTimeout, fmt.Errorf("stream %s: %w", label, err))
+	}
+	s.Metrics.PeersDisconnected.Inc()
+	s.logger.Warn("dropping peer after a failed stream read", "peer", peer.RemoteAddr().String(), "key", label, "err", err)
+	peer.Close()
+	peer.CloseStream()
+}
+
+func observeDuration(h *metrics.Histogram, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (s *FileServer) loop() {
+	defer func() {
+		s.logger.Info("file server stopped due to error or user quit action")
+		s.Transport.Close()
+	}()
+
+	for {
+		select {
+		case rpc := <-s.Transport.Consume():
+			var msg Message
+			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
+				s.Metrics.DecodeErrors.Inc()
+				s.disconnect(rpc.From, misbehaveBadMessage, fmt.Errorf("undecodable message: %w", err))
+				continue
+			}
+
+			if err := s.handleMessage(rpc.From, &msg); err != nil {
+				s.logger.Warn("handle message error", "peer", rpc.From, "err", err)
+			}
+
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+func (s *FileServer) handleMessage(from string, msg *Message) (err error) {
+	// 以发送方传来的追踪上下文作为父 span
+	ctx := trace.ContextWithRemote(context.Background(), msg.Trace)
+
+	if req, ok := requestFor(msg.Payload); ok {
+		defer func() { s.auditRequest(from, msg, req, err) }()
+		if err := s.authorize(req, msg.Auth); err != nil {
+			s.denyRequest(from, msg.Payload, req, err)
+			return err
+		}
+	}
+
+	switch v := msg.Payload.(type) {
+	case MessageStoreFile:
+		return s.traceHandler(ctx, "handleMessageStoreFile", from, v.Key, func(ctx context.Context) error {
+			return s.handleMessageStoreFile(ctx, from, v)
+		})
+	case MessageGetFile:
+		return s.traceHandler(ctx, "handleMessageGetFile", from, v.Key, func(ctx context.Context) error {
+			return s.handleMessageGetFile(ctx, from, v)
+		})
+	case MessageDeleteFile:
+		return s.handleMessageDeleteFile(from, v)
+	case MessageQuotaExceeded:
+		return s.handleMessageQuotaExceeded(from, v)
+	case MessagePermissionDenied:
+		return s.handleMessagePermissionDenied(from, v)
+	case MessageRewrapKey:
+		return s.handleMessageRewrapKey(from, v)
+	case MessageRenameObject:
+		return s.handleMessageRenameObject(from, v)
+	case MessageShareKey:
+		return s.handleMessageShareKey(from, v)
+	case MessageGetShards:
+		return s.traceHandler(ctx, "handleMessageGetShards", from, v.Key, func(ctx context.Context) error {
+			return s.handleMessageGetShards(ctx, from, v)
+		})
+	case MessageProbeShards:
+		return s.handleMessageProbeShards(from, v)
+	case MessageShardsHeld:
+		return s.handleMessageShardsHeld(from, v)
+	}
+
+	return nil
+}
+
+// traceHandler 为处理远端请求的 handler 记录一个 span
+func (s *FileServer) traceHandler(ctx context.Context, name, from, key string, handler func(context.Context) error) error {
+	ctx, span := s.Tracer.Start(ctx, name)
+	defer span.End()
+	span.SetAttr("node_id", s.ID)
+	span.SetAttr("peer", from)
+	span.SetAttr("key", key)
+
+	err := handler(ctx)
+	span.SetError(err)
+
+	return err
+}
+
+func (s *FileServer) handleMessageGetFile(ctx context.Context, from string, msg MessageGetFile) error {
+	// 告诉请求方本节点没有该文件，避免对方一直等待数据流
+	notFound := func() {
+		if peer, ok := s.peer(from); ok {
+			peer.Send([]byte{p2p.IncomingStream})
+			fileHeader{Size: fileNotFoundSize}.write(peer)
+		}
+	}
+
+	meta, err := s.statVersion(msg.ID, msg.Key, msg.Version)
+	if err == nil && msg.Recipient != "" {
+		meta.DataKey, err = sharedKey(meta, msg.Recipient)
+	}
+	if err != nil {
+		notFound()
+		return fmt.Errorf("[%s] need to serve file (%s) but it does not exist on disk", s.Transport.Addr(), msg.Key)
+	}
+
+	var (
+		fileSize int64
+		r        io.ReadCloser
+	)
+	if msg.Version == "" {
+		fileSize, r, err = s.readStore(ctx, msg.ID, msg.Key)
+	} else {
+		fileSize, r, err = s.store.ReadVersion(msg.ID, msg.Key, msg.Version)
+	}
+	if err != nil {
+		notFound()
+		return err
+	}
+	defer r.Close()
+
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	defer s.transfers.begin(transferServe, msg.Key, from)()
+
+	// 先发送文件大小、过期时间和版本
+	peer.Send([]byte{p2p.IncomingStream})
+	newFileHeader(fileSize, meta).write(peer)
+	n, err := io.Copy(peer, r)
+	s.Metrics.BytesServed.Add(float64(n))
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("served file over the network", "key", msg.Key, "peer", from, "bytes", n)
+
+	return nil
+}
+
+func (s *FileServer) handleMessageStoreFile(ctx context.Context, from string, msg MessageStoreFile) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+
+	if limit := s.maxReplicaSize(msg.Padding); msg.Size < 0 || limit > 0 && msg.Size > limit {
+		// 不接收数据流，直接断开连接
+		err := fmt.Errorf("rejecting file (%s) from %s: %d bytes: %w", msg.Key, from, msg.Size, ErrObjectTooLarge)
+		s.disconnect(from, misbehaveOversized, err)
+		return err
+	}
+	if err := s.waitStream(peer, msg.Key); err != nil {
+		return err
+	}
+	defer peer.CloseStream()
+	s.streamDeadline(peer, msg.Size)
+
+	if err := s.checkQuota(msg.ID, msg.Key, msg.Size); err != nil {
+		if _, err := io.CopyN(io.Discard, peer, msg.Size); err != nil {
+			s.dropStream(peer, msg.Key, err)
+			return err
+		}
+		s.Metrics.QuotaRejections.Inc()
+
+		var qerr *QuotaError
+		if errors.As(err, &qerr) {
+			reply := Message{
+				Payload: MessageQuotaExceeded{
+					ID:    msg.ID,
+					Key:   msg.Key,
+					Size:  msg.Size,
+					Limit: qerr.Limit,
+					Used:  qerr.Used,
+				},
+				Trace: trace.SpanContextFromContext(ctx),
+			}
+			if err := s.sendTo([]p2p.Peer{peer}, &reply); err != nil {
+				s.logger.Warn("failed to send quota reply", "peer", from, "err", err)
+			}
+		}
+		return fmt.Errorf("rejecting file (%s) from %s: %w", msg.Key, from, err)
+	}
+
+	req := request{Op: PermWrite, Owner: msg.ID, Key: msg.Key, Version: msg.Version}
+	if err := s.checkIncoming(msg); err != nil {
+		if _, err := io.CopyN(io.Discard, peer, msg.Size); err != nil {
+			s.dropStream(peer, msg.Key, err)
+			return err
+		}
+		s.Metrics.SignatureRejections.Inc()
+		s.replyDenied(peer, req, err)
+		return fmt.Errorf("rejecting file (%s) from %s: %w", msg.Key, from, err)
+	}
+
+	done := s.transfers.begin(transferReceive, msg.Key, from)
+	opts := store.WriteOpts{
+		ExpiresAt: msg.ExpiresAt,
+		Version:   msg.Version,
+		Codec:     msg.Codec,
+		Size:      msg.RawSize,
+		Erasure:   msg.Erasure,
+		DataKey:   msg.DataKey,
+		Padding:   msg.Padding,
+		Signer:    msg.Signer,
+		Signature: msg.Signature,
+	}
+	// 读到结尾时校验签名，校验失败的数据不会保存
+	stream := io.LimitReader(peer, msg.Size)
+	r := s.newVerifyingReader(stream, storeClaim(msg), msg.Signer, msg.Signature)
+	n, err := s.writeStore(ctx, msg.ID, msg.Key, r, opts)
+	done()
+	if err != nil {
+		// 写入失败时数据流可能还没有读完
+		if _, derr := io.Copy(io.Discard, stream); derr != nil {
+			s.dropStream(peer, msg.Key, derr)
+		}
+	}
+	if errors.Is(err, crypto.ErrBadSignature) {
+		s.Metrics.SignatureRejections.Inc()
+		s.misbehaved(from, misbehaveCorrupt, err)
+		s.replyDenied(peer, req, err)
+	}
+	if err != nil {
+		return err
+	}
+	s.Metrics.BytesStored.Add(float64(n))
+
+	return nil
+}
+
+func (s *FileServer) handleMessageDeleteFile(from string, msg MessageDeleteFile) error {
+	keys := []string{msg.Key}
+	for i := 0; i < msg.Shards && i < MaxShards; i++ {
+		keys = append(keys, shardKey(msg.Key, i))
+	}
+
+	for _, key := range keys {
+		if msg.Version != "" {
+			err := s.store.DeleteVersion(msg.ID, key, msg.Version)
+			if errors.Is(err, store.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			s.logger.Info("deleting version on request of peer", "key", key, "version", msg.Version, "peer", from)
+			continue
+		}
+
+		if !s.store.Has(msg.ID, key) {
+			continue
+		}
+
+		s.logger.Info("deleting file on request of peer", "key", key, "peer", from)
+		if err := s.store.Delete(msg.ID, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handleMessageQuotaExceeded 对方因为配额拒绝了我们发送的副本
+func (s *FileServer) handleMessageQuotaExceeded(from string, msg MessageQuotaExceeded) error {
+	s.logger.Warn("peer rejected replica: quota exceeded",
+		"peer", from, "key", msg.Key, "bytes", msg.Size, "used", msg.Used, "limit", msg.Limit)
+
+	return nil
+}
+
+func (s *FileServer) bootstrapNetwork() error {
+	for _, addr := range s.BootstrapNodes {
+		if addr == "" {
+			continue
+		}
+		go func(addr string) {
+			s.logger.Info("attempting to connect with remote", "peer", addr)
+			if err := s.Transport.Dial(addr); err != nil {
+				s.logger.Warn("dial error", "peer", addr, "err", err)
+			}
+		}(addr)
+	}
+
+	return nil
+}
+
+// Start 开始监听、连接引导节点并运行消息循环，直到 Stop 被调用
+func (s *FileServer) Start() error {
+	if err := s.reputation.load(); err != nil {
+		return err
+	}
+	if err := s.Transport.ListenAndAccept(); err != nil {
+		return err
+	}
+
+	s.bootstrapNetwork()
+
+	if s.GCInterval > 0 {
+		go s.gcLoop()
+	}
+	if s.ExpiryInterval > 0 {
+		go s.expiryLoop()
+	}
+	if s.Erasure.Enabled() && s.Erasure.RepairInterval > 0 {
+		go s.repairLoop()
+	}
+
+	s.loop()
+
+	return nil
+}
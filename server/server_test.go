@@ -0,0 +1,1308 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"distributed_file_storage/audit"
+	"distributed_file_storage/codec"
+	"distributed_file_storage/crypto"
+	"distributed_file_storage/p2p"
+	"distributed_file_storage/store"
+	"distributed_file_storage/trace"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T) *FileServer {
+	return NewFileServer(FileServerOpts{
+		EncKey:            crypto.NewEncryptionKey(),
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: store.CASPathTransformFunc,
+		Transport:         p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddr: ":0"}),
+	})
+}
+
+func TestFileServerLocal(t *testing.T) {
+	s := newTestServer(t)
+	data := []byte("my big data file here!")
+
+	if err := s.Store("picture.png", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := s.Get("picture.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(b, data) {
+		t.Errorf("have %s, want %s", b, data)
+	}
+
+	if err := s.Delete("picture.png"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("picture.png"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("have %v, want ErrNotFound", err)
+	}
+}
+
+func TestFileServerMaxObjectSize(t *testing.T) {
+	s := newTestServer(t)
+	s.MaxObjectSize = 4
+
+	err := s.Store("big", bytes.NewReader([]byte("more than four bytes")))
+	if !errors.Is(err, ErrObjectTooLarge) {
+		t.Errorf("have %v, want ErrObjectTooLarge", err)
+	}
+	if have := s.maxReplicaSize(crypto.PaddingNone); have != 4+16 {
+		t.Errorf("have replica limit %d, want %d", have, 4+16)
+	}
+	if have := s.maxReplicaSize(crypto.PaddingBuckets); have != crypto.MinBucket+16 {
+		t.Errorf("have padded replica limit %d, want %d", have, crypto.MinBucket+16)
+	}
+	if s.store.Has(s.ID, "big") {
+		t.Errorf("expected oversized file to be removed")
+	}
+}
+
+func TestFileServerTracing(t *testing.T) {
+	exp := trace.NewInMemoryExporter()
+	s := newTestServer(t)
+	s.Tracer = trace.NewTracer(exp)
+
+	if err := s.Store("picture.png", bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.Get("picture.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	get := exp.Find("FileServer.Get")
+	if len(get) != 1 || get[0].Attributes["served_by"] != "local" {
+		t.Fatalf("unexpected FileServer.Get spans: %+v", get)
+	}
+	read := exp.Find("store.read")
+	if len(read) != 1 || read[0].ParentID != get[0].SpanID {
+		t.Errorf("expected store.read to be a child of FileServer.Get: %+v", read)
+	}
+	if len(exp.Find("store.write")) != 1 {
+		t.Errorf("expected one store.write span")
+	}
+}
+
+func TestFileServerExpiry(t *testing.T) {
+	s := newTestServer(t)
+
+	err := s.Put("artifact.tar", bytes.NewReader([]byte("build output")), PutOpts{TTL: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := s.Stat("artifact.tar")
+	if err != nil || meta.ExpiresAt == nil {
+		t.Fatalf("expected expiry in metadata: %+v %v", meta, err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, err := s.Get("artifact.tar"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("have %v, want ErrNotFound", err)
+	}
+
+	if err := s.ExpireObjects(); err != nil {
+		t.Fatal(err)
+	}
+	if usage, _ := s.store.Usage(s.ID); usage.Objects != 0 {
+		t.Errorf("expected expired object to be removed, have %d objects", usage.Objects)
+	}
+	if s.Metrics.ExpiredObjects.Value() != 1 {
+		t.Errorf("have %v expired objects counted, want 1", s.Metrics.ExpiredObjects.Value())
+	}
+}
+
+func TestFileServerVersioning(t *testing.T) {
+	s := newTestServer(t)
+	s.Versioning = true
+
+	for _, data := range []string{"first", "second"} {
+		if err := s.Store("notes.txt", bytes.NewReader([]byte(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	versions, err := s.ListVersions("notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Version <= versions[1].Version {
+		t.Fatalf("unexpected versions: %+v", versions)
+	}
+
+	r, err := s.GetVersion("notes.txt", versions[1].Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	r.Close()
+	if string(b) != "first" {
+		t.Errorf("have %q, want %q", b, "first")
+	}
+
+	if err := s.Rollback("notes.txt", versions[1].Version); err != nil {
+		t.Fatal(err)
+	}
+	r, err = s.Get("notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = io.ReadAll(r)
+	r.Close()
+	if string(b) != "first" {
+		t.Errorf("after rollback have %q, want %q", b, "first")
+	}
+	if versions, _ := s.ListVersions("notes.txt"); len(versions) != 3 {
+		t.Errorf("expected rollback to add a version, have %d", len(versions))
+	}
+}
+
+func TestFileServerCompression(t *testing.T) {
+	s := newTestServer(t)
+	s.Compression = codec.Auto
+	logs := []byte(strings.Repeat("GET /objects/report.pdf 200 3ms\n", 500))
+
+	if err := s.Store("access.log", bytes.NewReader(logs)); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := s.Stat("access.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Codec != codec.Zstd || meta.Size != int64(len(logs)) || meta.DiskSize() >= meta.Size {
+		t.Errorf("unexpected metadata: %+v", meta)
+	}
+
+	r, err := s.Get("access.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(b, logs) {
+		t.Errorf("decompressed data does not match")
+	}
+
+	// 单个对象可以关闭压缩
+	if err := s.Put("raw.log", bytes.NewReader(logs), PutOpts{Codec: "none"}); err != nil {
+		t.Fatal(err)
+	}
+	if meta, _ := s.Stat("raw.log"); meta.Codec != codec.None || meta.DiskSize() != int64(len(logs)) {
+		t.Errorf("expected raw.log to be stored uncompressed: %+v", meta)
+	}
+}
+
+func TestFileHeader(t *testing.T) {
+	var buf bytes.Buffer
+	want := fileHeader{Size: 42, ExpiresAt: time.Now().UnixNano(), Version: newVersionID(), Codec: codec.Zstd, RawSize: 1024, DataKey: "key", Padding: crypto.PaddingPadme,
+		Signer: "5289355c", Signature: "c2ln"}
+	if err := want.write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	fileHeader{Size: fileNotFoundSize}.write(&buf)
+	fileHeader{Size: filePermissionDenied}.write(&buf)
+
+	if have, err := readFileHeader(&buf); err != nil || have != want {
+		t.Errorf("have %+v (%v), want %+v", have, err, want)
+	}
+	if have, err := readFileHeader(&buf); err != nil || have.Size != fileNotFoundSize {
+		t.Errorf("have %+v (%v), want not found", have, err)
+	}
+	if have, err := readFileHeader(&buf); err != nil || have.Size != filePermissionDenied {
+		t.Errorf("have %+v (%v), want permission denied", have, err)
+	}
+}
+
+func TestFileServerQuota(t *testing.T) {
+	s := newTestServer(t)
+	s.Quota = QuotaOpts{
+		Capacity:     100,
+		DefaultOwner: 50,
+		Owners:       map[string]int64{"big": 80},
+	}
+
+	if _, err := s.store.Write("peer", "a", bytes.NewReader(make([]byte, 40)), store.WriteOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var qerr *QuotaError
+	err := s.checkQuota("peer", "b", 20)
+	if !errors.As(err, &qerr) || qerr.Node || qerr.Limit != 50 || qerr.Used != 40 {
+		t.Fatalf("have %v, want owner quota error", err)
+	}
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("have %v, want ErrQuotaExceeded", err)
+	}
+
+	// 覆盖已有对象时只计算增加的部分
+	if err := s.checkQuota("peer", "a", 45); err != nil {
+		t.Errorf("overwrite: %v", err)
+	}
+
+	if _, err := s.store.Write("big", "c", bytes.NewReader(make([]byte, 50)), store.WriteOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	err = s.checkQuota("big", "d", 20)
+	if !errors.As(err, &qerr) || !qerr.Node || qerr.Limit != 100 {
+		t.Fatalf("have %v, want node capacity error", err)
+	}
+
+	status, err := s.QuotaStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Used != 90 || len(status.Owners) != 2 || status.Owners[0].Quota != 80 {
+		t.Errorf("unexpected quota status: %+v", status)
+	}
+}
+
+func TestErasureShards(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("a"), bytes.Repeat([]byte("erasure coded archive "), 1000)} {
+		info := store.ErasureInfo{Stripe: newStripeID(), DataShards: 4, ParityShards: 2, Size: int64(len(data))}
+		shards, err := encodeShards(info, append([]byte(nil), data...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(shards) != info.Shards() {
+			t.Fatalf("have %d shards, want %d", len(shards), info.Shards())
+		}
+
+		// 丢掉 ParityShards 个分片后仍然可以恢复
+		shards[0], shards[3] = nil, nil
+		have, err := joinShards(info, shards)
+		if err != nil || !bytes.Equal(have, data) {
+			t.Errorf("%d bytes: join failed: %v", len(data), err)
+		}
+
+		// ReconstructData 会填回缺失的分片
+		shards[0], shards[1], shards[3] = nil, nil, nil
+		if _, err := joinShards(info, shards); err == nil {
+			t.Errorf("%d bytes: expected an error with too few shards", len(data))
+		}
+	}
+}
+
+func TestShardHeader(t *testing.T) {
+	var buf bytes.Buffer
+	want := shardHeader{
+		Index:      5,
+		Erasure:    store.ErasureInfo{Stripe: newStripeID(), DataShards: 4, ParityShards: 2, Size: 4096},
+		fileHeader: fileHeader{Size: 1040, Version: newVersionID(), Codec: codec.Gzip, RawSize: 8192},
+	}
+	if err := want.write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	shardHeader{Index: shardsEnd}.write(&buf)
+
+	if have, err := readShardHeader(&buf); err != nil || have != want {
+		t.Errorf("have %+v (%v), want %+v", have, err, want)
+	}
+	if have, err := readShardHeader(&buf); err != nil || have.Index != shardsEnd {
+		t.Errorf("have %+v (%v), want end of shards", have, err)
+	}
+}
+
+func TestShardRequestKey(t *testing.T) {
+	erasure := &store.ErasureInfo{DataShards: 4, ParityShards: 2}
+	tests := []struct{ key, want string }{
+		{"9c1e.0", "9c1e"},
+		{"9c1e.5", "9c1e"},
+		{"a.b.3", "a.b"},
+		{"9c1e.6", "9c1e.6"},
+		{"9c1e.05", "9c1e.05"},
+		{"9c1e.+1", "9c1e.+1"},
+		{"9c1e.x", "9c1e.x"},
+		{"9c1e", "9c1e"},
+	}
+	for _, tt := range tests {
+		req, _ := requestFor(MessageStoreFile{Key: tt.key, Erasure: erasure})
+		if req.Key != tt.want {
+			t.Errorf("%s: have %q, want %q", tt.key, req.Key, tt.want)
+		}
+	}
+}
+
+func TestFileServerEncryptAtRest(t *testing.T) {
+	s := newTestServer(t)
+	secret := []byte(strings.Repeat("the launch code is 0000\n", 100))
+
+	// 开启之前写入的明文文件仍然可以读取
+	if err := s.Store("old.txt", bytes.NewReader(secret)); err != nil {
+		t.Fatal(err)
+	}
+	s.EncryptAtRest = true
+
+	for _, c := range []string{codec.None, codec.Zstd} {
+		key := "secret-" + c
+		if err := s.Put(key, bytes.NewReader(secret), PutOpts{Codec: c}); err != nil {
+			t.Fatal(err)
+		}
+
+		_, r, err := s.store.Read(s.ID, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := io.ReadAll(r)
+		r.Close()
+		if bytes.Contains(raw, []byte("launch code")) {
+			t.Errorf("%s: plaintext found on disk", key)
+		}
+
+		meta, err := s.Stat(key)
+		if err != nil || !meta.Encrypted || meta.Size != int64(len(secret)) || meta.DiskSize() != int64(len(raw)) {
+			t.Errorf("%s: unexpected meta %+v (%v)", key, meta, err)
+		}
+	}
+
+	// 从其他节点收到的密文直接保存
+	var replica bytes.Buffer
+	crypto.CopyEncrypt(s.EncKey, bytes.NewReader(secret), &replica)
+	if _, err := s.writeDecrypt(context.Background(), "fetched.txt", &replica, int64(replica.Len()), store.WriteOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"old.txt", "secret-", "secret-zstd", "fetched.txt"} {
+		r, err := s.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(r)
+		r.Close()
+		if !bytes.Equal(b, secret) {
+			t.Errorf("%s: have %d bytes, want the original content", key, len(b))
+		}
+	}
+}
+
+func TestFileServerRotateKey(t *testing.T) {
+	s := newTestServer(t)
+	payload := []byte("envelope encrypted content")
+
+	// 没有数据密钥的旧副本直接用主密钥加密
+	var legacy bytes.Buffer
+	crypto.CopyEncrypt(s.EncKey, bytes.NewReader(payload), &legacy)
+	if _, err := s.writeDecrypt(context.Background(), "legacy.txt", &legacy, int64(legacy.Len()), store.WriteOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Store("plain.txt", bytes.NewReader(payload)); err != nil {
+		t.Fatal(err)
+	}
+	s.EncryptAtRest = true
+	if err := s.Store("at-rest.txt", bytes.NewReader(payload)); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := s.Stat("at-rest.txt")
+	if err != nil || crypto.WrappedKeyID(meta.DataKey) != crypto.KeyID(s.EncKey) {
+		t.Fatalf("expected a data key wrapped by the master key, have %+v (%v)", meta, err)
+	}
+	oldWrapped := meta.DataKey
+
+	report, err := s.RotateKey(crypto.NewEncryptionKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Rewrapped != 2 || report.Adopted != 1 || report.Failed != 0 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if _, err := s.RotateKey(s.masterKey()); err == nil {
+		t.Errorf("expected an error when rotating to the current key")
+	}
+
+	for _, key := range []string{"legacy.txt", "plain.txt", "at-rest.txt"} {
+		meta, err := s.Stat(key)
+		if err != nil || crypto.WrappedKeyID(meta.DataKey) != report.KeyID {
+			t.Errorf("%s: data key not rewrapped: %+v (%v)", key, meta, err)
+		}
+	}
+
+	// 停用旧主密钥之后，仍然由它包装的数据密钥无法解开
+	if n := s.RetireKeys(); n != 1 {
+		t.Errorf("retired %d keys, want 1", n)
+	}
+	if _, err := s.dataKey(oldWrapped); !errors.Is(err, ErrUnknownMasterKey) {
+		t.Errorf("have %v, want ErrUnknownMasterKey", err)
+	}
+
+	for _, key := range []string{"legacy.txt", "plain.txt", "at-rest.txt"} {
+		r, err := s.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(r)
+		r.Close()
+		if !bytes.Equal(b, payload) {
+			t.Errorf("%s: have %q after rotation", key, b)
+		}
+	}
+}
+
+func TestFileServerObjectID(t *testing.T) {
+	s, other := newTestServer(t), newTestServer(t)
+	name := "picture_1.png"
+
+	if err := s.Store(name, bytes.NewReader([]byte("cat"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Store(name, bytes.NewReader([]byte("dog"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// 其他节点看到的标识既不是文件名的哈希，不同 owner 的同名文件也无法关联
+	id := s.objectID(name)
+	if id == crypto.HashKey(name) || id == other.objectID(name) || id != crypto.ObjectID(s.NameKey, name) {
+		t.Errorf("object id %q can be linked to the name", id)
+	}
+
+	// 轮换主密钥后标识不变
+	if _, err := s.RotateKey(crypto.NewEncryptionKey()); err != nil {
+		t.Fatal(err)
+	}
+	if s.objectID(name) != id {
+		t.Errorf("object id changed after key rotation")
+	}
+}
+
+func TestFileServerMigrateObjectIDs(t *testing.T) {
+	s, peer := newTestServer(t), newTestServer(t)
+	s.Versioning = true
+
+	// 旧版本写入的对象：owner 的元数据没有 KeyedID，副本以 md5 命名
+	legacy := crypto.HashKey("old.txt")
+	for _, v := range []string{"v1", "v2"} {
+		if _, err := s.store.Write(s.ID, "old.txt", bytes.NewReader([]byte(v)), store.WriteOpts{Version: v}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := peer.store.Write(s.ID, legacy, bytes.NewReader([]byte(v)), store.WriteOpts{Version: v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.objectID("old.txt") != legacy {
+		t.Fatalf("expected the legacy md5 id before migration")
+	}
+
+	report, err := s.MigrateObjectIDs()
+	if err != nil || report.Migrated != 1 {
+		t.Fatalf("unexpected report %+v (%v)", report, err)
+	}
+	id := s.objectID("old.txt")
+	if id != crypto.ObjectID(s.NameKey, "old.txt") {
+		t.Errorf("object still uses the legacy id after migration")
+	}
+	// 历史版本也已经标记，删除最新版本之后不会回到 md5
+	if err := s.store.DeleteVersion(s.ID, "old.txt", "v2"); err != nil || s.objectID("old.txt") != id {
+		t.Errorf("older version still uses the legacy id (%v)", err)
+	}
+
+	// 节点收到改名消息后，副本和历史版本都使用新的标识
+	if err := peer.handleMessageRenameObject("owner", MessageRenameObject{ID: s.ID, From: legacy, To: id}); err != nil {
+		t.Fatal(err)
+	}
+	versions, err := peer.store.ListVersions(s.ID, id)
+	if err != nil || len(versions) != 2 || peer.store.Has(s.ID, legacy) {
+		t.Errorf("replica not renamed: %+v (%v)", versions, err)
+	}
+
+	if report, _ := s.MigrateObjectIDs(); report.Migrated != 0 {
+		t.Errorf("migrated %d objects twice", report.Migrated)
+	}
+}
+
+func TestFileServerPadding(t *testing.T) {
+	s := newTestServer(t)
+	payload := []byte(strings.Repeat("padded ", 100))
+
+	for _, scheme := range []string{crypto.PaddingPadme, crypto.PaddingBuckets} {
+		peerData := padData(scheme, payload, 0)
+		if int64(len(peerData)) != crypto.PaddedSize(scheme, crypto.PadHeaderSize+int64(len(payload))) {
+			t.Errorf("%s: have %d bytes of padded data", scheme, len(peerData))
+		}
+		// 填充是确定的，修复分片时重新编码得到相同的数据
+		if !bytes.Equal(peerData, padData(scheme, payload, 0)) {
+			t.Errorf("%s: padding is not deterministic", scheme)
+		}
+		if data, rawSize, err := unpadData(scheme, peerData); err != nil || !bytes.Equal(data, payload) || rawSize != int64(len(payload)) {
+			t.Errorf("%s: unpad failed: %v", scheme, err)
+		}
+		if _, _, err := unpadData(scheme, peerData[:20]); err == nil {
+			t.Errorf("%s: expected an error for truncated data", scheme)
+		}
+
+		// 从其他节点取回带填充的副本，本地保存去掉填充后的数据
+		for _, atRest := range []bool{false, true} {
+			s.EncryptAtRest = atRest
+			key := fmt.Sprintf("%s-%v", scheme, atRest)
+			dataKey, wrapped, _ := s.newDataKey()
+			var replica bytes.Buffer
+			crypto.CopyEncrypt(dataKey, bytes.NewReader(peerData), &replica)
+			opts := store.WriteOpts{DataKey: wrapped, Padding: scheme}
+			if _, err := s.writeDecrypt(context.Background(), key, &replica, int64(replica.Len()), opts); err != nil {
+				t.Fatal(err)
+			}
+
+			meta, err := s.Stat(key)
+			if err != nil || meta.Size != int64(len(payload)) || meta.Padding != scheme {
+				t.Errorf("%s: unexpected meta %+v (%v)", key, meta, err)
+			}
+			r, err := s.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(r)
+			r.Close()
+			if !bytes.Equal(b, payload) {
+				t.Errorf("%s: have %d bytes, want the original content", key, len(b))
+			}
+		}
+	}
+}
+
+func TestFileServerShare(t *testing.T) {
+	owner, peer, recipient := newTestServer(t), newTestServer(t), newTestServer(t)
+	payload := []byte("shared content")
+
+	if err := owner.Store("doc", bytes.NewReader(payload)); err != nil {
+		t.Fatal(err)
+	}
+	share, err := owner.Share("doc", recipient.SharePublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed, err := ParseShare(share.String()); err != nil || parsed != share || share.Owner != owner.ID {
+		t.Errorf("have %+v (%v), want %+v", parsed, err, share)
+	}
+	if _, err := ParseShare("no-object-id"); err == nil {
+		t.Errorf("expected an error for a malformed share")
+	}
+
+	// 节点上的副本保存共享的数据密钥
+	meta, _ := owner.Stat("doc")
+	dataKey, _ := owner.dataKey(meta.DataKey)
+	var replica bytes.Buffer
+	crypto.CopyEncrypt(dataKey, bytes.NewReader(payload), &replica)
+	if _, err := peer.store.Write(owner.ID, share.ObjectID, &replica, store.WriteOpts{DataKey: meta.DataKey}); err != nil {
+		t.Fatal(err)
+	}
+	sealed := meta.Shares[recipient.SharePublicKey()]
+	msg := MessageShareKey{ID: owner.ID, Key: share.ObjectID, Recipient: recipient.SharePublicKey(), DataKey: sealed}
+	if err := peer.handleMessageShareKey("owner", msg); err != nil {
+		t.Fatal(err)
+	}
+
+	replicaMeta, err := peer.store.Stat(owner.ID, share.ObjectID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err := sharedKey(replicaMeta, recipient.SharePublicKey())
+	if err != nil || have != sealed {
+		t.Fatalf("replica does not hold the shared key: %v", err)
+	}
+	if _, err := sharedKey(replicaMeta, peer.SharePublicKey()); !errors.Is(err, ErrNotShared) {
+		t.Errorf("have %v, want ErrNotShared", err)
+	}
+
+	// 只有接收方能解开数据密钥，节点和其他 owner 都不能
+	if key, err := crypto.OpenKey(recipient.ShareKey, have); err != nil || !bytes.Equal(key, dataKey) {
+		t.Errorf("recipient cannot open the shared key: %v", err)
+	}
+	if _, err := crypto.OpenKey(peer.ShareKey, have); err == nil {
+		t.Errorf("peer opened a key shared with someone else")
+	}
+
+	// 没有数据密钥的旧对象不能共享
+	var legacy bytes.Buffer
+	crypto.CopyEncrypt(owner.EncKey, bytes.NewReader(payload), &legacy)
+	if _, err := owner.writeDecrypt(context.Background(), "legacy", &legacy, int64(legacy.Len()), store.WriteOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := owner.Share("legacy", recipient.SharePublicKey()); err == nil {
+		t.Errorf("expected an error when sharing an object encrypted with the master key")
+	}
+}
+
+func TestFileServerAuth(t *testing.T) {
+	owner, peer, other, third := newTestServer(t), newTestServer(t), newTestServer(t), newTestServer(t)
+	if owner.ID != owner.Identity() {
+		t.Fatalf("expected the node id to be the signing public key")
+	}
+
+	signed := func(s *FileServer, payload any, token string) (request, *Auth) {
+		msg := Message{Payload: payload}
+		s.sign(&msg, token, peer.Identity())
+		req, _ := requestFor(payload)
+		return req, msg.Auth
+	}
+	get := MessageGetFile{ID: owner.ID, Key: "9c1e"}
+	del := MessageDeleteFile{ID: owner.ID, Key: "9c1e"}
+
+	// 没有开启 Required 时只拒绝签名无效的请求
+	req, _ := requestFor(get)
+	if err := peer.authorize(req, nil); err != nil {
+		t.Errorf("unsigned request denied without Required: %v", err)
+	}
+	req, auth := signed(owner, get, "")
+	req.Key = "ffff"
+	if err := peer.authorize(req, auth); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("have %v, want ErrPermissionDenied for a tampered request", err)
+	}
+
+	peer.Auth.Required = true
+	if err := peer.authorize(req, nil); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("have %v, want ErrPermissionDenied for an unsigned request", err)
+	}
+	if err := peer.authorize(signed(owner, del, "")); err != nil {
+		t.Errorf("owner denied: %v", err)
+	}
+	if err := peer.authorize(signed(other, get, "")); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("have %v, want ErrPermissionDenied for another node", err)
+	}
+	req, auth = signed(owner, get, "")
+	auth.Time = time.Now().Add(-time.Hour).UnixNano()
+	auth.Sig = crypto.Sign(owner.SignKey, req.digest(auth))
+	if err := peer.authorize(req, auth); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("have %v, want ErrPermissionDenied for an old signature", err)
+	}
+
+	// 同一个请求只接受一次，发给其他节点的请求不能转发过来
+	req, auth = signed(owner, get, "")
+	if err := peer.authorize(req, auth); err != nil {
+		t.Errorf("owner denied: %v", err)
+	}
+	if err := peer.authorize(req, auth); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("have %v, want ErrPermissionDenied for a replayed request", err)
+	}
+	msg := Message{Payload: get}
+	owner.sign(&msg, "", other.Identity())
+	if err := peer.authorize(req, msg.Auth); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("have %v, want ErrPermissionDenied for a request addressed to another node", err)
+	}
+
+	// 签名覆盖消息的全部内容，包括数据大小
+	put := MessageStoreFile{ID: owner.ID, Key: "9c1e", Size: 10}
+	_, auth = signed(owner, put, "")
+	put.Size = 1 << 30
+	req, _ = requestFor(put)
+	if err := peer.authorize(req, auth); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("have %v, want ErrPermissionDenied for a resized request", err)
+	}
+
+	// ACL 授权另一个节点读取 owner 的文件
+	peer.Auth.ACL = []ACLRule{{Principal: other.Identity(), Owner: owner.ID, Permissions: PermRead}}
+	if err := peer.authorize(signed(other, get, "")); err != nil {
+		t.Errorf("ACL read denied: %v", err)
+	}
+	if err := peer.authorize(signed(other, del, "")); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("have %v, want ErrPermissionDenied for a delete not in the ACL", err)
+	}
+	peer.Auth.ACL = nil
+
+	// owner 签发的令牌，可以委托但不能扩大权限
+	token, err := owner.IssueToken(TokenOpts{Subject: other.Identity(), Permissions: PermRead | PermDelete})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.authorize(signed(other, del, token)); err != nil {
+		t.Errorf("token denied: %v", err)
+	}
+	if err := peer.authorize(signed(third, get, token)); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("have %v, want ErrPermissionDenied for a token issued to someone else", err)
+	}
+
+	delegated, err := other.DelegateToken(token, TokenOpts{Subject: third.Identity(), Permissions: PermRead, TTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.authorize(signed(third, get, delegated)); err != nil {
+		t.Errorf("delegated token denied: %v", err)
+	}
+	if err := peer.authorize(signed(third, del, delegated)); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("have %v, want ErrPermissionDenied beyond the delegated permissions", err)
+	}
+	if _, err := other.DelegateToken(token, TokenOpts{Subject: third.Identity(), Permissions: PermWrite}); err == nil {
+		t.Errorf("expected an error when delegating more than the token grants")
+	}
+	if _, err := third.DelegateToken(token, TokenOpts{Subject: third.Identity()}); err == nil {
+		t.Errorf("expected an error when delegating a token issued to another node")
+	}
+
+	// 篡改、过期和不是 owner 签发的令牌
+	chain, _ := ParseToken(delegated)
+	chain[1].Perms = PermAll
+	if err := peer.authorize(signed(third, del, encodeToken(chain))); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("have %v, want ErrPermissionDenied for a tampered token", err)
+	}
+	expired := Capability{Issuer: owner.Identity(), Subject: other.Identity(), Owner: owner.ID, Perms: PermRead, Expires: time.Now().Add(-time.Minute).Unix()}
+	expired.Sig = crypto.Sign(owner.SignKey, expired.digest(nil))
+	if err := peer.authorize(signed(other, get, encodeToken([]Capability{expired}))); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("have %v, want ErrPermissionDenied for an expired token", err)
+	}
+	forged, _ := third.IssueToken(TokenOpts{Subject: other.Identity(), Permissions: PermRead})
+	if err := peer.authorize(signed(other, MessageGetFile{ID: owner.ID, Key: "9c1e"}, forged)); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("have %v, want ErrPermissionDenied for a token issued by another owner", err)
+	}
+}
+
+func TestFileServerSignedObjects(t *testing.T) {
+	owner, peer, other := newTestServer(t), newTestServer(t), newTestServer(t)
+
+	data := []byte("ciphertext of report.pdf")
+	msg := MessageStoreFile{
+		ID:        owner.ID,
+		Key:       "9c1e",
+		Size:      int64(len(data)),
+		ExpiresAt: time.Now().Add(time.Hour),
+		Version:   newVersionID(),
+		Codec:     codec.Zstd,
+		Padding:   crypto.PaddingPadme,
+		Erasure:   &store.ErasureInfo{Stripe: newStripeID(), DataShards: 2, ParityShards: 1, Size: 100},
+	}
+	owner.signObject(&msg, data)
+
+	// 接收方按签名保存，取回时由元数据得到的签名内容与发送时相同
+	receive := func(msg MessageStoreFile, data []byte) error {
+		if err := peer.checkIncoming(msg); err != nil {
+			return err
+		}
+		opts := store.WriteOpts{ExpiresAt: msg.ExpiresAt, Version: msg.Version, Codec: msg.Codec, Erasure: msg.Erasure,
+			Padding: msg.Padding, Signer: msg.Signer, Signature: msg.Signature}
+		r := peer.newVerifyingReader(bytes.NewReader(data), storeClaim(msg), msg.Signer, msg.Signature)
+		_, err := peer.store.Write(msg.ID, msg.Key, r, opts)
+		return err
+	}
+	if err := receive(msg, data); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := peer.store.Stat(owner.ID, "9c1e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newFileHeader(meta.Size, meta)
+	if err := peer.verifyObject(headerClaim(owner.ID, "9c1e", h, meta.Erasure).withHash(data), h.Signer, h.Signature); err != nil {
+		t.Errorf("stored replica does not verify: %v", err)
+	}
+	h.Version = newVersionID()
+	if err := peer.verifyObject(headerClaim(owner.ID, "9c1e", h, meta.Erasure).withHash(data), h.Signer, h.Signature); !errors.Is(err, crypto.ErrBadSignature) {
+		t.Errorf("have %v, want ErrBadSignature for changed metadata", err)
+	}
+
+	// 篡改过的内容在写入结束时被拒绝，不会留下文件
+	tampered := msg
+	tampered.Key = "7a0b"
+	owner.signObject(&tampered, data)
+	if err := receive(tampered, []byte("something else entirely!")); !errors.Is(err, crypto.ErrBadSignature) {
+		t.Errorf("have %v, want ErrBadSignature for tampered data", err)
+	}
+	if peer.store.Has(owner.ID, "7a0b") {
+		t.Errorf("tampered replica was stored")
+	}
+
+	// 已经有签名的副本不能被没有签名或其他节点签名的写入覆盖
+	unsigned := msg
+	unsigned.Signer, unsigned.Signature = "", ""
+	if err := receive(unsigned, data); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("have %v, want ErrPermissionDenied for an unsigned overwrite", err)
+	}
+	forged := msg
+	other.signObject(&forged, data)
+	if err := receive(forged, data); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("have %v, want ErrPermissionDenied for an overwrite by another node", err)
+	}
+
+	// strict 模式拒绝没有签名的副本和没有写入权限的签名者
+	unsigned.Key = "4d3c"
+	if err := receive(unsigned, data); err != nil {
+		t.Errorf("unsigned replica rejected without SignedObjects: %v", err)
+	}
+	peer.Auth.SignedObjects = true
+	unsigned.Key = "5e6f"
+	if err := receive(unsigned, data); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("have %v, want ErrPermissionDenied for an unsigned replica", err)
+	}
+	forged.Key = "5e6f"
+	other.signObject(&forged, data)
+	if err := receive(forged, data); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("have %v, want ErrPermissionDenied for an untrusted signer", err)
+	}
+	peer.Auth.ACL = []ACLRule{{Principal: other.Identity(), Owner: owner.ID, Permissions: PermWrite}}
+	if err := receive(forged, data); err != nil {
+		t.Errorf("signer with write permission rejected: %v", err)
+	}
+
+	// 即使没有开启 strict 模式，owner 取回自己的对象时也只接受自己的签名：
+	// 节点替换了内容并重新签名的副本，以及去掉签名的副本都被拒绝
+	replaced := []byte("replaced by the peer")
+	resigned := msg
+	peer.signObject(&resigned, replaced)
+	h = newFileHeader(meta.Size, meta)
+	claim := headerClaim(owner.ID, "9c1e", h, meta.Erasure)
+	if err := owner.verifyObject(claim.withHash(replaced), resigned.Signer, resigned.Signature); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("have %v, want ErrPermissionDenied for a copy re-signed by a peer", err)
+	}
+	if err := owner.verifyObject(claim.withHash(data), "", ""); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("have %v, want ErrPermissionDenied for an unsigned copy", err)
+	}
+	if err := owner.verifyObject(claim.withHash(data), h.Signer, h.Signature); err != nil {
+		t.Errorf("owner rejected its own signature: %v", err)
+	}
+}
+
+func TestReputation(t *testing.T) {
+	banFile := t.TempDir() + "/bans.json"
+	now := time.Now()
+	r := newReputation(ReputationOpts{BanFile: banFile, HalfLife: time.Minute})
+	r.now = func() time.Time { return now }
+	bad, good := subject{ip: "10.0.0.1"}, subject{ip: "10.0.0.2"}
+
+	// 分数随时间衰减
+	if _, ban, _ := r.add(bad, -misbehavePenalty[misbehaveCorrupt], "corrupt"); ban != nil {
+		t.Fatalf("banned after one event")
+	}
+	now = now.Add(time.Minute)
+	if have := r.score(bad); have != -20 {
+		t.Errorf("have score %v after one half life, want -20", have)
+	}
+	r.add(good, servedReward, "")
+	if r.score(good) <= r.score(bad) {
+		t.Errorf("expected a peer that served data to rank higher")
+	}
+
+	// 分数低于 BanScore 时封禁，封禁列表重启后仍然有效
+	r.add(bad, -misbehavePenalty[misbehaveBadMessage], "bad message")
+	if _, ban, err := r.add(bad, -misbehavePenalty[misbehaveOversized], "oversized"); ban == nil || err != nil {
+		t.Fatalf("expected a ban (%v)", err)
+	}
+	loaded := newReputation(ReputationOpts{BanFile: banFile})
+	if err := loaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	ban, ok := loaded.banned(bad)
+	if !ok || ban.Reason != "oversized" {
+		t.Errorf("have %+v, want the ban to survive a restart", ban)
+	}
+	if _, ok := loaded.banned(good); ok {
+		t.Errorf("good peer was banned")
+	}
+
+	loaded.now = func() time.Time { return now.Add(2 * time.Hour) }
+	if _, ok := loaded.banned(bad); ok {
+		t.Errorf("expected the ban to expire")
+	}
+
+	// 确认了身份的节点按身份封禁，换了 IP 也被拒绝，同一个 IP 后面的其他节点不受影响
+	mallory := subject{identity: "a1b2", ip: "10.0.0.3"}
+	r.add(mallory, -1000, "corrupt")
+	if _, ok := r.banned(subject{identity: "a1b2", ip: "10.0.0.9"}); !ok {
+		t.Errorf("expected the identity to stay banned from another IP")
+	}
+	if _, ok := r.banned(subject{identity: "c3d4", ip: "10.0.0.3"}); ok {
+		t.Errorf("another identity behind the same IP was banned")
+	}
+	if _, ok := r.banned(subject{ip: "10.0.0.3"}); ok {
+		t.Errorf("IP banned without BanIP")
+	}
+	r.BanIP = true
+	r.add(subject{identity: "e5f6", ip: "10.0.0.4"}, -1000, "corrupt")
+	if _, ok := r.banned(subject{ip: "10.0.0.4"}); !ok {
+		t.Errorf("expected BanIP to ban the IP too")
+	}
+
+	// 旧版本按 IP 保存的封禁
+	legacy := t.TempDir() + "/bans.json"
+	os.WriteFile(legacy, []byte(`[{"peer":"10.0.0.5","until":"`+now.Add(time.Hour).Format(time.RFC3339)+`","reason":"old"}]`), 0o600)
+	old := newReputation(ReputationOpts{BanFile: legacy})
+	if err := old.load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := old.banned(subject{identity: "a1b2", ip: "10.0.0.5"}); !ok {
+		t.Errorf("expected a legacy ban to apply to the IP")
+	}
+
+	// 被封禁的节点不能连接
+	s := newTestServer(t)
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	peer := p2p.NewTCPPeer(local, false)
+	s.reputation.add(peerSubject(peer), -1000, "test")
+	if err := s.OnPeer(peer); !errors.Is(err, ErrPeerBanned) {
+		t.Errorf("have %v, want ErrPeerBanned", err)
+	}
+}
+
+func TestBannedAddrRejectedBeforeHandshake(t *testing.T) {
+	network := p2p.NewMemoryNetwork()
+	var handshakes atomic.Int32
+	tr := p2p.NewMemoryTransport(network, p2p.TCPTransportOpts{
+		ListenAddr: "10.0.0.1:3000",
+		HandshakeFunc: func(p p2p.Peer) error {
+			handshakes.Add(1)
+			return nil
+		},
+		Decoder: p2p.DefaultDecoder{},
+	})
+	s := NewFileServer(FileServerOpts{
+		EncKey:            crypto.NewEncryptionKey(),
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: store.CASPathTransformFunc,
+		Transport:         tr,
+	})
+	tr.Gater = s
+	tr.OnPeer = s.OnPeer
+	tr.OnPeerClose = s.OnPeerClose
+	if err := tr.ListenAndAccept(); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	s.reputation.add(subject{ip: "10.0.0.2"}, -1000, "test")
+
+	closed := make(chan struct{})
+	banned := p2p.NewMemoryTransport(network, p2p.TCPTransportOpts{
+		ListenAddr:    "10.0.0.2:3000",
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+		OnPeerClose:   func(p2p.Peer) { close(closed) },
+	})
+	defer banned.Close()
+	if err := banned.Dial("10.0.0.1:3000"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("expected the banned peer to be disconnected")
+	}
+	if have := handshakes.Load(); have != 0 {
+		t.Errorf("have %d handshakes with a banned address, want 0", have)
+	}
+	if have := tr.Metrics.ConnectionsGated.Value(); have != 1 {
+		t.Errorf("have %v gated connections, want 1", have)
+	}
+}
+
+// shardResponder 返回连接到一个假节点的 FileServer，假节点收到请求后调用 reply 回复；
+// closed 在假节点的连接断开时关闭
+func shardResponder(t *testing.T, reply func(peer p2p.Peer)) (s *FileServer, closed <-chan struct{}) {
+	network := p2p.NewMemoryNetwork()
+	tr := p2p.NewMemoryTransport(network, p2p.TCPTransportOpts{
+		ListenAddr:    "10.0.0.1:3000",
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	s = NewFileServer(FileServerOpts{
+		EncKey:            crypto.NewEncryptionKey(),
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: store.CASPathTransformFunc,
+		Transport:         tr,
+	})
+	connected := make(chan struct{}, 1)
+	tr.OnPeer = func(p p2p.Peer) error {
+		defer func() { connected <- struct{}{} }()
+		return s.OnPeer(p)
+	}
+	tr.OnPeerClose = s.OnPeerClose
+	if err := tr.ListenAndAccept(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tr.Close() })
+
+	peers, done := make(chan p2p.Peer, 1), make(chan struct{})
+	fake := p2p.NewMemoryTransport(network, p2p.TCPTransportOpts{
+		ListenAddr:    "10.0.0.2:3000",
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+		OnPeer:        func(p p2p.Peer) error { peers <- p; return nil },
+		OnPeerClose:   func(p2p.Peer) { close(done) },
+	})
+	t.Cleanup(func() { fake.Close() })
+	if err := fake.Dial("10.0.0.1:3000"); err != nil {
+		t.Fatal(err)
+	}
+	<-connected
+	go func() {
+		peer := <-peers
+		<-fake.Consume()
+		reply(peer)
+	}()
+	return s, done
+}
+
+func TestFetchShardsBrokenStream(t *testing.T) {
+	// 对方回复一个无法解析的分片，后面跟着不属于任何分片的数据
+	s, closed := shardResponder(t, func(peer p2p.Peer) {
+		peer.Send([]byte{p2p.IncomingStream})
+		shardHeader{Index: 0, fileHeader: fileHeader{Size: -5}}.write(peer)
+		peer.Write([]byte("garbage"))
+	})
+
+	_, _, err := s.fetchShardsFrom(context.Background(), MessageGetShards{ID: s.ID, Key: "k", Shards: 3}, "k", s.dataKey)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("have %v, want ErrNotFound", err)
+	}
+	// 剩下的数据不会被当作消息解析，连接被断开
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("expected the peer to be dropped")
+	}
+	if have := s.Metrics.PeersDisconnected.Value(); have != 1 {
+		t.Errorf("have %v peers disconnected, want 1", have)
+	}
+}
+
+func TestFetchShardsConflictingStripe(t *testing.T) {
+	// 同一次切分的第二个分片声称有更多分片，序号超出第一个分片确定的范围
+	key := crypto.NewEncryptionKey()
+	shard := func(index int, info store.ErasureInfo) (shardHeader, []byte) {
+		var buf bytes.Buffer
+		crypto.CopyEncrypt(key, bytes.NewReader([]byte("shard data")), &buf)
+		return shardHeader{Index: index, Erasure: info, fileHeader: fileHeader{Size: int64(buf.Len())}}, buf.Bytes()
+	}
+	stripe := newStripeID()
+	s, _ := shardResponder(t, func(peer p2p.Peer) {
+		peer.Send([]byte{p2p.IncomingStream})
+		for _, sh := range []struct {
+			index int
+			info  store.ErasureInfo
+		}{
+			{0, store.ErasureInfo{Stripe: stripe, DataShards: 2, ParityShards: 1, Size: 20}},
+			{5, store.ErasureInfo{Stripe: stripe, DataShards: 4, ParityShards: 2, Size: 20}},
+		} {
+			h, data := shard(sh.index, sh.info)
+			h.write(peer)
+			peer.Write(data)
+		}
+		shardHeader{Index: shardsEnd}.write(peer)
+	})
+
+	unwrap := func(string) ([]byte, error) { return key, nil }
+	req := MessageGetShards{ID: "other-owner", Key: "k", Shards: MaxShards}
+	if _, _, err := s.fetchShardsFrom(context.Background(), req, "k", unwrap); !errors.Is(err, ErrNotFound) {
+		t.Errorf("have %v, want ErrNotFound", err)
+	}
+	if have := s.reputation.score(subject{ip: "10.0.0.2"}); have >= 0 {
+		t.Errorf("have score %v, want a penalty for the conflicting shard", have)
+	}
+}
+
+func TestFetchShardsStalledStream(t *testing.T) {
+	// 对方声明了分片的大小，只发了一部分就停下
+	s, closed := shardResponder(t, func(peer p2p.Peer) {
+		peer.Send([]byte{p2p.IncomingStream})
+		shardHeader{Index: 0, fileHeader: fileHeader{Size: 1 << 20}}.write(peer)
+		peer.Write([]byte("partial"))
+	})
+	s.streamTimeout = 100 * time.Millisecond
+	s.MinStreamRate = 1 << 30
+
+	start := time.Now()
+	_, _, err := s.fetchShardsFrom(context.Background(), MessageGetShards{ID: s.ID, Key: "k", Shards: 3}, "k", s.dataKey)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("have %v, want ErrNotFound", err)
+	}
+	// 截止时间是 100ms 加上按 1 GiB/s 传完 1 MiB 的时间
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("stream read took %v", elapsed)
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("expected the stalled peer to be dropped")
+	}
+	if have := s.reputation.score(subject{ip: "10.0.0.2"}); have >= 0 {
+		t.Errorf("have score %v, want a penalty for the timeout", have)
+	}
+}
+
+func TestFileServerPeersConcurrent(t *testing.T) {
+	s := newTestServer(t)
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	go io.Copy(io.Discard, remote)
+	peer := p2p.NewTCPPeer(local, false)
+	from := peer.RemoteAddr().String()
+
+	// 节点反复断开和重连的同时处理它的请求，没有加锁的读取会被 -race 发现
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			s.OnPeer(peer)
+			s.OnPeerClose(peer)
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		s.handleMessageGetFile(context.Background(), from, MessageGetFile{ID: s.ID, Key: "missing"})
+		s.broadcast(&Message{Payload: MessageDeleteFile{ID: s.ID, Key: "missing"}})
+	}
+	<-done
+}
+
+func TestFileServerAudit(t *testing.T) {
+	path := t.TempDir() + "/audit.log"
+	log, err := audit.NewLog(audit.LogOpts{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, owner := newTestServer(t), newTestServer(t)
+	s.AuditLog = log
+
+	if err := s.Store("report.pdf", strings.NewReader("q3 numbers")); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.Get("report.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if err := s.Delete("report.pdf"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 远端请求：没有签名的请求被拒绝，owner 签名的请求被处理
+	s.Auth.Required = true
+	del := MessageDeleteFile{ID: owner.ID, Key: "9c1e"}
+	s.handleMessage("10.0.0.7:3000", &Message{Payload: del})
+	msg := Message{Payload: del}
+	owner.sign(&msg, "", s.Identity())
+	if err := s.handleMessage("10.0.0.7:3000", &msg); err != nil {
+		t.Fatal(err)
+	}
+	log.Close()
+
+	report, err := audit.Verify(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Entries != 5 {
+		t.Fatalf("have %d entries, want 5", report.Entries)
+	}
+	b, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	want := []string{
+		`"op":"put","actor":"` + s.Identity(),
+		`"op":"get"`,
+		`"op":"delete"`,
+		`"op":"delete_file","actor":"","peer":"10.0.0.7:3000"`,
+		`"op":"delete_file","actor":"` + owner.Identity(),
+	}
+	for i, w := range want {
+		if !strings.Contains(lines[i], w) {
+			t.Errorf("entry %d: have %s, want %s", i+1, lines[i], w)
+		}
+	}
+	if !strings.Contains(lines[3], `"result":"denied"`) || !strings.Contains(lines[4], `"result":"ok"`) {
+		t.Errorf("unexpected results:\n%s\n%s", lines[3], lines[4])
+	}
+}
+
+func TestRepairWaitsForProbes(t *testing.T) {
+	network := p2p.NewMemoryNetwork()
+	tr := p2p.NewMemoryTransport(network, p2p.TCPTransportOpts{
+		ListenAddr:    "10.0.0.1:3000",
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	s := NewFileServer(FileServerOpts{
+		EncKey:            crypto.NewEncryptionKey(),
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: store.CASPathTransformFunc,
+		Transport:         tr,
+		Erasure:           ErasureOpts{DataShards: 2, ParityShards: 1},
+	})
+	if err := s.Put("archive.tar", bytes.NewReader([]byte("erasure coded archive")), PutOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	connected := make(chan struct{}, 2)
+	tr.OnPeer = func(p p2p.Peer) error {
+		defer func() { connected <- struct{}{} }()
+		return s.OnPeer(p)
+	}
+	tr.OnPeerClose = s.OnPeerClose
+	if err := tr.ListenAndAccept(); err != nil {
+		t.Fatal(err)
+	}
+	go s.loop()
+	t.Cleanup(s.Stop)
+
+	// 每个节点持有一个分片，answer 关闭之前 10.0.0.3 不回复探测
+	answer := make(chan struct{})
+	for i, addr := range []string{"10.0.0.2:3000", "10.0.0.3:3000"} {
+		index, peers := i, make(chan p2p.Peer, 1)
+		fake := p2p.NewMemoryTransport(network, p2p.TCPTransportOpts{
+			ListenAddr:    addr,
+			HandshakeFunc: p2p.NOPHandshakeFunc,
+			Decoder:       p2p.DefaultDecoder{},
+			OnPeer:        func(p p2p.Peer) error { peers <- p; return nil },
+		})
+		t.Cleanup(func() { fake.Close() })
+		if err := fake.Dial("10.0.0.1:3000"); err != nil {
+			t.Fatal(err)
+		}
+		<-connected
+		go func() {
+			peer := <-peers
+			for rpc := range fake.Consume() {
+				var msg Message
+				if gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg) != nil {
+					continue
+				}
+				probe, ok := msg.Payload.(MessageProbeShards)
+				if !ok {
+					continue
+				}
+				if index == 1 {
+					<-answer
+				}
+				reply := Message{Payload: MessageShardsHeld{Key: probe.Key, Stripe: probe.Stripe, Indexes: []int{index}}}
+				buf := new(bytes.Buffer)
+				gob.NewEncoder(buf).Encode(reply)
+				peer.Send(p2p.EncodeMessage(buf.Bytes()))
+			}
+		}()
+	}
+
+	// 没有回复的节点可能持有缺少的分片，不能判断对象是否缺少分片
+	s.streamTimeout = 200 * time.Millisecond
+	report, err := s.Repair(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Unverified != 1 || report.Degraded != 0 || report.ShardsRestored != 0 {
+		t.Errorf("unexpected report with a silent peer: %+v", report)
+	}
+
+	// 所有节点都回复后不用等到超时；两个节点都持有分片，第三个分片没有地方放置
+	close(answer)
+	s.streamTimeout = streamTimeout
+	report, err = s.Repair(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Unverified != 0 || report.Degraded != 1 || report.ShardsMissing != 1 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+	if report.Duration >= streamTimeout {
+		t.Errorf("repair waited %v for answered probes", report.Duration)
+	}
+}
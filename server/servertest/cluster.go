@@ -0,0 +1,226 @@
+// Package servertest 在一个进程中启动多个 FileServer，节点之间通过 p2p.MemoryTransport 连接，用于集群测试
+package servertest
+
+import (
+	"distributed_file_storage/crypto"
+	"distributed_file_storage/metrics"
+	"distributed_file_storage/p2p"
+	"distributed_file_storage/server"
+	"distributed_file_storage/store"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Topology 返回 n 个节点之间的连接，{i, j} 表示节点 i 主动连接节点 j
+type Topology func(n int) [][2]int
+
+// FullMesh 每两个节点之间都有连接
+func FullMesh(n int) [][2]int {
+	var edges [][2]int
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			edges = append(edges, [2]int{j, i})
+		}
+	}
+	return edges
+}
+
+// Star 其他节点都连接节点 0
+func Star(n int) [][2]int {
+	var edges [][2]int
+	for i := 1; i < n; i++ {
+		edges = append(edges, [2]int{i, 0})
+	}
+	return edges
+}
+
+// Line 节点 i+1 连接节点 i
+func Line(n int) [][2]int {
+	var edges [][2]int
+	for i := 1; i < n; i++ {
+		edges = append(edges, [2]int{i, i - 1})
+	}
+	return edges
+}
+
+// Ring 在 Line 的基础上节点 0 连接最后一个节点
+func Ring(n int) [][2]int {
+	edges := Line(n)
+	if n > 2 {
+		edges = append(edges, [2]int{0, n - 1})
+	}
+	return edges
+}
+
+type ClusterOpts struct {
+	Nodes     int
+	Topology  Topology                                 // 为空时是 FullMesh
+	Configure func(i int, opts *server.FileServerOpts) // 创建每个节点之前修改选项，Transport 由 Cluster 设置
+	Timeout   time.Duration                            // 等待连接建立或断开的最长时间，默认 5s
+}
+
+// Cluster 一组在同一个 p2p.MemoryNetwork 中的 FileServer
+type Cluster struct {
+	ClusterOpts
+	Network *p2p.MemoryNetwork
+	Nodes   []*server.FileServer
+
+	t          testing.TB
+	transports []*p2p.MemoryTransport
+	done       []chan error // Start 返回后收到它的结果
+	stopped    []bool
+}
+
+// Addr 返回节点 i 的监听地址
+func Addr(i int) string {
+	return fmt.Sprintf("10.0.%d.%d:3000", i/250, i%250+1)
+}
+
+// NewCluster 创建并启动 opts.Nodes 个节点，存储目录在 t.TempDir() 中，按 Topology 连接后返回。
+// 测试结束时自动停止所有节点
+func NewCluster(t testing.TB, opts ClusterOpts) *Cluster {
+	t.Helper()
+	if opts.Topology == nil {
+		opts.Topology = FullMesh
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 5 * time.Second
+	}
+
+	c := &Cluster{
+		ClusterOpts: opts,
+		Network:     p2p.NewMemoryNetwork(),
+		t:           t,
+	}
+	t.Cleanup(c.Close)
+
+	for i := 0; i < opts.Nodes; i++ {
+		c.start(i)
+	}
+	for _, edge := range opts.Topology(opts.Nodes) {
+		c.Connect(edge[0], edge[1])
+	}
+	return c
+}
+
+func (c *Cluster) start(i int) {
+	c.t.Helper()
+
+	fileServerOpts := server.FileServerOpts{
+		EncKey:            crypto.NewEncryptionKey(),
+		StorageRoot:       c.t.TempDir(),
+		PathTransformFunc: store.CASPathTransformFunc,
+		Metrics:           metrics.New(),
+		Logger:            slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	if c.Configure != nil {
+		c.Configure(i, &fileServerOpts)
+	}
+	tr := p2p.NewMemoryTransport(c.Network, p2p.TCPTransportOpts{
+		ListenAddr: Addr(i),
+		Decoder:    p2p.DefaultDecoder{},
+		Metrics:    fileServerOpts.Metrics,
+		Logger:     fileServerOpts.Logger,
+	})
+	fileServerOpts.Transport = tr
+
+	s := server.NewFileServer(fileServerOpts)
+	tr.HandshakeFunc = p2p.IdentityHandshake(s.SignKey)
+	tr.Gater = s
+	tr.OnPeer = s.OnPeer
+	tr.OnPeerClose = s.OnPeerClose
+	tr.OnMisbehave = s.OnMisbehave
+
+	done := make(chan error, 1)
+	go func() { done <- s.Start() }()
+
+	c.Nodes = append(c.Nodes, s)
+	c.transports = append(c.transports, tr)
+	c.done = append(c.done, done)
+	c.stopped = append(c.stopped, false)
+
+	select {
+	case <-tr.Listening():
+	case err := <-done:
+		c.stopped[i] = true
+		c.t.Fatalf("node %d did not start: %v", i, err)
+	case <-time.After(c.Timeout):
+		c.t.Fatalf("node %d did not start within %s", i, c.Timeout)
+	}
+}
+
+// Connect 让节点 i 连接节点 j，等待双方都记录了对方
+func (c *Cluster) Connect(i, j int) {
+	c.t.Helper()
+
+	if err := c.Nodes[i].Transport.Dial(Addr(j)); err != nil {
+		c.t.Fatalf("node %d: dial node %d: %v", i, j, err)
+	}
+	c.WaitFor(fmt.Sprintf("node %d and node %d to connect", i, j), func() bool {
+		return c.connected(i, j) && c.connected(j, i)
+	})
+}
+
+// connected 节点 i 是否有来自节点 j 的连接(任意方向)
+func (c *Cluster) connected(i, j int) bool {
+	host, _, _ := net.SplitHostPort(Addr(j))
+	for _, addr := range c.Nodes[i].Peers() {
+		if strings.HasPrefix(addr, host+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// Stop 停止节点 i，等待其他节点发现连接断开
+func (c *Cluster) Stop(i int) {
+	c.t.Helper()
+
+	if c.stopped[i] {
+		return
+	}
+	c.Nodes[i].Stop()
+	if err := <-c.done[i]; err != nil {
+		c.t.Errorf("node %d: %v", i, err)
+	}
+	c.stopped[i] = true
+
+	c.WaitFor(fmt.Sprintf("peers of node %d to notice it stopped", i), func() bool {
+		for j := range c.Nodes {
+			if j != i && !c.stopped[j] && c.connected(j, i) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Close 停止所有节点，可以重复调用
+func (c *Cluster) Close() {
+	for i, s := range c.Nodes {
+		if c.stopped[i] {
+			continue
+		}
+		s.Stop()
+		<-c.done[i]
+		c.stopped[i] = true
+	}
+}
+
+// WaitFor 等待 cond 成立，超过 Timeout 时测试失败
+func (c *Cluster) WaitFor(what string, cond func() bool) {
+	c.t.Helper()
+
+	deadline := time.Now().Add(c.Timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,141 @@
+package servertest
+
+import (
+	"bytes"
+	"distributed_file_storage/server"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestTopologies(t *testing.T) {
+	tests := []struct {
+		name     string
+		topology Topology
+		want     int
+	}{
+		{"full mesh", FullMesh, 6},
+		{"star", Star, 3},
+		{"line", Line, 3},
+		{"ring", Ring, 4},
+	}
+	for _, tt := range tests {
+		if have := len(tt.topology(4)); have != tt.want {
+			t.Errorf("%s: have %d connections between 4 nodes, want %d", tt.name, have, tt.want)
+		}
+	}
+}
+
+func TestClusterReplication(t *testing.T) {
+	c := NewCluster(t, ClusterOpts{Nodes: 3})
+	owner := c.Nodes[0]
+	data := []byte("replicated across the cluster")
+
+	if err := owner.Store("notes.txt", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	c.WaitFor("replicas on every peer", func() bool {
+		for _, s := range c.Nodes[1:] {
+			if status, _ := s.Status(); status.Replicas.Objects != 1 {
+				return false
+			}
+		}
+		return true
+	})
+
+	// 删除本地副本后从其他节点取回
+	if err := owner.FileServerOpts.Store.Delete(owner.ID, "notes.txt"); err != nil {
+		t.Fatal(err)
+	}
+	c.Stop(1)
+	r, err := owner.Get("notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(b, data) {
+		t.Errorf("have %q, want %q", b, data)
+	}
+}
+
+func TestClusterErasure(t *testing.T) {
+	c := NewCluster(t, ClusterOpts{
+		Nodes: 4,
+		Configure: func(i int, opts *server.FileServerOpts) {
+			if i == 0 {
+				opts.Erasure = server.ErasureOpts{DataShards: 2, ParityShards: 1}
+			}
+		},
+	})
+	owner := c.Nodes[0]
+	data := bytes.Repeat([]byte("sharded "), 1000)
+
+	if err := owner.Store("notes.txt", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	c.WaitFor("one shard on every peer", func() bool {
+		for _, s := range c.Nodes[1:] {
+			if status, _ := s.Status(); status.Replicas.Objects != 1 {
+				return false
+			}
+		}
+		return true
+	})
+
+	// 丢失一个分片后仍然可以恢复
+	if err := owner.FileServerOpts.Store.Delete(owner.ID, "notes.txt"); err != nil {
+		t.Fatal(err)
+	}
+	c.Stop(2)
+	r, err := owner.Get("notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(b, data) {
+		t.Errorf("have %d bytes, want %d", len(b), len(data))
+	}
+
+	// 没有副本的节点立即回复，不需要等到超时
+	start := time.Now()
+	if _, err := owner.Get("missing.txt"); !errors.Is(err, server.ErrNotFound) {
+		t.Errorf("have %v, want ErrNotFound", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("get of a missing file took %s", elapsed)
+	}
+}
+
+func TestClusterTopology(t *testing.T) {
+	c := NewCluster(t, ClusterOpts{
+		Nodes:    4,
+		Topology: Line,
+		Configure: func(i int, opts *server.FileServerOpts) {
+			opts.ReplicationFactor = 1
+		},
+	})
+	for i, want := range []int{1, 2, 2, 1} {
+		if have := len(c.Nodes[i].Peers()); have != want {
+			t.Errorf("node %d: have %d peers, want %d", i, have, want)
+		}
+	}
+
+	// 握手确认了对方的身份
+	for _, p := range c.Nodes[0].PeerStatus() {
+		if p.Identity != c.Nodes[1].Identity() {
+			t.Errorf("have identity %q, want node 1", p.Identity)
+		}
+	}
+
+	c.Stop(1)
+	if have := len(c.Nodes[0].Peers()); have != 0 {
+		t.Errorf("node 0: have %d peers after node 1 stopped, want 0", have)
+	}
+	c.Connect(0, 2)
+	if have := len(c.Nodes[2].Peers()); have != 2 {
+		t.Errorf("node 2: have %d peers, want 2", have)
+	}
+}
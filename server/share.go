@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"distributed_file_storage/codec"
+	"distributed_file_storage/crypto"
+	"distributed_file_storage/store"
+	"distributed_file_storage/trace"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// 共享：owner 用接收方的公钥加密对象的数据密钥，发布到保存副本的节点上。
+// 接收方用 Share 向这些节点请求 owner 命名空间中的副本，节点只在有共享给它的数据密钥时回复
+
+// ErrNotShared 对象没有共享给请求方
+var ErrNotShared = errors.New("object is not shared with this recipient")
+
+// Share 共享给其他 owner 的一个对象。String() 的结果交给接收方，用于 GetShared
+type Share struct {
+	Owner    string `json:"owner"`
+	ObjectID string `json:"object_id"`
+	Version  string `json:"version,omitempty"`
+	Token    string `json:"-"` // 节点要求授权时随请求出示的令牌，不属于 String() 的结果
+}
+
+// String 返回 <owner>/<对象标识>[@<版本>]
+func (sh Share) String() string {
+	s := sh.Owner + "/" + sh.ObjectID
+	if sh.Version != "" {
+		s += "@" + sh.Version
+	}
+	return s
+}
+
+// ParseShare 解析 Share.String() 的结果
+func ParseShare(s string) (Share, error) {
+	var sh Share
+	rest, version, _ := strings.Cut(s, "@")
+	owner, id, ok := strings.Cut(rest, "/")
+	if !ok || owner == "" || id == "" {
+		return sh, fmt.Errorf("malformed share %q (want <owner>/<object id>[@<version>])", s)
+	}
+	return Share{Owner: owner, ObjectID: id, Version: version}, nil
+}
+
+// SharePublicKey 返回本节点接收共享文件的公钥
+func (s *FileServer) SharePublicKey() string {
+	pub, _ := crypto.SharePublicKey(s.ShareKey)
+	return pub
+}
+
+// Share 把 key 的最新版本共享给公钥为 recipient 的节点。之后写入的版本需要重新共享；
+// 接收方可能已经保存了数据密钥，所以撤销共享只能重新写入文件(新的数据密钥)
+func (s *FileServer) Share(key, recipient string) (Share, error) {
+	meta, err := s.store.Stat(s.ID, key)
+	if err != nil {
+		return Share{}, err
+	}
+	if meta.DataKey == "" {
+		return Share{}, fmt.Errorf("share %s: object was written before per-object data keys, write it again first", key)
+	}
+	dataKey, err := s.dataKey(meta.DataKey)
+	if err != nil {
+		return Share{}, err
+	}
+	// 轮换之前写入的对象以旧主密钥作为数据密钥，不能交给其他节点
+	current, previous := s.keys.masters()
+	for _, master := range append([][]byte{current}, previous...) {
+		if bytes.Equal(master, dataKey) {
+			return Share{}, fmt.Errorf("share %s: the data key of this object is a master key, write it again first", key)
+		}
+	}
+
+	sealed, err := crypto.SealKey(recipient, dataKey)
+	if err != nil {
+		return Share{}, err
+	}
+	share := Share{Owner: s.ID, ObjectID: s.objectIDFor(meta), Version: meta.Version}
+
+	msg := Message{
+		Payload: MessageShareKey{
+			ID:        s.ID,
+			Key:       share.ObjectID,
+			Version:   meta.Version,
+			Recipient: recipient,
+			DataKey:   sealed,
+			Shards:    shardCount(meta),
+		},
+	}
+	if err := s.broadcast(&msg); err != nil {
+		return share, err
+	}
+
+	// 本地也记录共享给了谁
+	err = s.store.UpdateMeta(s.ID, key, meta.Version, func(m *store.ObjectMeta) {
+		if m.Shares == nil {
+			m.Shares = make(map[string]string)
+		}
+		m.Shares[recipient] = sealed
+	})
+	s.logger.Info("shared file", "key", key, "recipient", recipient)
+
+	return share, err
+}
+
+// GetShared 读取其他 owner 共享给本节点的文件
+func (s *FileServer) GetShared(share Share) (io.ReadCloser, error) {
+	ctx, span := s.Tracer.Start(context.Background(), "FileServer.GetShared")
+	defer span.End()
+	span.SetAttr("node_id", s.ID)
+	span.SetAttr("share", share.String())
+
+	r, err := s.getShared(ctx, span, share)
+	span.SetError(err)
+
+	return r, err
+}
+
+func (s *FileServer) getShared(ctx context.Context, span *trace.Span, share Share) (io.ReadCloser, error) {
+	ctx = contextWithToken(ctx, share.Token)
+	recipient := s.SharePublicKey()
+	unwrap := func(sealed string) ([]byte, error) {
+		return crypto.OpenKey(s.ShareKey, sealed)
+	}
+
+	req := MessageGetFile{Key: share.ObjectID, ID: share.Owner, Version: share.Version, Recipient: recipient}
+	h, data, err := s.fetchCopy(ctx, span, req, share.String(), unwrap)
+	if errors.Is(err, ErrNotFound) {
+		// owner 开启了纠删码时节点上只有分片
+		shardReq := MessageGetShards{Key: share.ObjectID, ID: share.Owner, Version: share.Version, Shards: MaxShards, Recipient: recipient}
+		var sh shardHeader
+		if sh, data, err = s.fetchShardsFrom(ctx, shardReq, share.String(), unwrap); err == nil {
+			h = sh.fileHeader
+			span.SetAttr("served_by", "shards")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return codec.NewReader(h.Codec, io.NopCloser(bytes.NewReader(data)))
+}
+
+// sharedKey 返回副本中共享给 recipient 的数据密钥
+func sharedKey(meta store.ObjectMeta, recipient string) (string, error) {
+	sealed, ok := meta.Shares[recipient]
+	if !ok {
+		return "", fmt.Errorf("%s: %w", meta.Key, ErrNotShared)
+	}
+	return sealed, nil
+}
+
+func (s *FileServer) handleMessageShareKey(from string, msg MessageShareKey) error {
+	keys := []string{msg.Key}
+	for i := 0; i < msg.Shards && i < MaxShards; i++ {
+		keys = append(keys, shardKey(msg.Key, i))
+	}
+
+	for _, key := range keys {
+		err := s.store.UpdateMeta(msg.ID, key, msg.Version, func(m *store.ObjectMeta) {
+			if m.Shares == nil {
+				m.Shares = make(map[string]string)
+			}
+			m.Shares[msg.Recipient] = msg.DataKey
+		})
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		s.logger.Debug("published shared data key", "key", key, "recipient", msg.Recipient, "peer", from)
+	}
+
+	return nil
+}
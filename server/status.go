@@ -0,0 +1,174 @@
+package server
+
+import (
+	"distributed_file_storage/crypto"
+	"distributed_file_storage/store"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProtocolVersion 节点之间消息格式的版本，不兼容的修改需要加一
+const ProtocolVersion = 10
+
+// Version 构建版本，发布时通过 -ldflags "-X distributed_file_storage/server.Version=..." 设置
+var Version = "dev"
+
+// Status 节点当前的运行状态，由 admin 接口返回
+type Status struct {
+	NodeID          string          `json:"node_id"`
+	ListenAddr      string          `json:"listen_addr"`
+	Version         string          `json:"version"`
+	GoVersion       string          `json:"go_version"`
+	ProtocolVersion int             `json:"protocol_version"`
+	StartedAt       time.Time       `json:"started_at"`
+	Peers           []PeerStatus    `json:"peers"`
+	Transfers       []TransferInfo  `json:"transfers"`
+	Store           store.Usage     `json:"store"`    // 本节点自己的文件
+	Replicas        store.Usage     `json:"replicas"` // 替其他节点保存的副本
+	StorageRoot     string          `json:"storage_root"`
+	Quota           QuotaStatus     `json:"quota"`
+	LastGC          *store.GCReport `json:"last_gc,omitempty"`
+	MasterKeyID     string          `json:"master_key_id"`
+	ShareKey        string          `json:"share_key"` // 其他 owner 共享文件给本节点时使用的公钥
+	Identity        string          `json:"identity"`  // 对请求和授权令牌签名的公钥
+	AuthRequired    bool            `json:"auth_required"`
+	PreviousKeys    int             `json:"previous_keys"` // 轮换前还没有停用的主密钥数
+	Bans            []BanInfo       `json:"bans"`          // 因为不当行为被暂时封禁的身份和 IP
+	Audit           *AuditStatus    `json:"audit,omitempty"`
+}
+
+// PeerStatus 一个已连接的节点
+type PeerStatus struct {
+	Addr        string    `json:"addr"`
+	Outbound    bool      `json:"outbound"` // true 表示由本节点主动连接
+	ConnectedAt time.Time `json:"connected_at"`
+	Score       float64   `json:"score"`              // 信誉分数，Get 优先使用分数高的节点
+	Identity    string    `json:"identity,omitempty"` // 握手确认的签名公钥
+}
+
+// TransferInfo 一个正在进行的数据传输
+type TransferInfo struct {
+	ID        uint64    `json:"id"`
+	Kind      string    `json:"kind"` // store | get | serve | receive
+	Key       string    `json:"key"`
+	Peer      string    `json:"peer,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+const (
+	transferStore   = "store"
+	transferGet     = "get"
+	transferServe   = "serve"
+	transferReceive = "receive"
+)
+
+// transfers 记录正在进行的传输
+type transfers struct {
+	mu     sync.Mutex
+	nextID atomic.Uint64
+	active map[uint64]TransferInfo
+}
+
+// begin 登记一个传输，返回的函数在传输结束时调用
+func (t *transfers) begin(kind, key, peer string) func() {
+	info := TransferInfo{
+		ID:        t.nextID.Add(1),
+		Kind:      kind,
+		Key:       key,
+		Peer:      peer,
+		StartedAt: time.Now().UTC(),
+	}
+
+	t.mu.Lock()
+	if t.active == nil {
+		t.active = make(map[uint64]TransferInfo)
+	}
+	t.active[info.ID] = info
+	t.mu.Unlock()
+
+	return func() {
+		t.mu.Lock()
+		delete(t.active, info.ID)
+		t.mu.Unlock()
+	}
+}
+
+func (t *transfers) list() []TransferInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	list := make([]TransferInfo, 0, len(t.active))
+	for _, info := range t.active {
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Status 返回节点 ID、已连接节点、正在进行的传输以及存储占用
+func (s *FileServer) Status() (Status, error) {
+	own, err := s.store.Usage(s.ID)
+	if err != nil {
+		return Status{}, err
+	}
+	all, err := s.store.Usage("")
+	if err != nil {
+		return Status{}, err
+	}
+	quota, err := s.QuotaStatus()
+	if err != nil {
+		return Status{}, err
+	}
+
+	return Status{
+		NodeID:          s.ID,
+		ListenAddr:      s.Transport.Addr(),
+		Version:         Version,
+		GoVersion:       runtime.Version(),
+		ProtocolVersion: ProtocolVersion,
+		StartedAt:       s.startedAt,
+		Peers:           s.PeerStatus(),
+		Transfers:       s.transfers.list(),
+		Store:           own,
+		Replicas: store.Usage{
+			Objects: all.Objects - own.Objects,
+			Bytes:   all.Bytes - own.Bytes,
+		},
+		StorageRoot:  s.StorageRoot,
+		Quota:        quota,
+		LastGC:       s.gc.lastReport(),
+		MasterKeyID:  crypto.KeyID(s.masterKey()),
+		ShareKey:     s.SharePublicKey(),
+		Identity:     s.Identity(),
+		AuthRequired: s.Auth.Required,
+		PreviousKeys: len(s.PreviousKeys()),
+		Bans:         s.Bans(),
+		Audit:        s.AuditStatus(),
+	}, nil
+}
+
+// PeerStatus 返回已连接节点的方向、连接时间和信誉分数，按地址排序
+func (s *FileServer) PeerStatus() []PeerStatus {
+	s.peerLock.RLock()
+	defer s.peerLock.RUnlock()
+
+	list := make([]PeerStatus, 0, len(s.peers))
+	for addr, peer := range s.peers {
+		list = append(list, PeerStatus{
+			Addr:        addr,
+			Outbound:    peer.Outbound(),
+			ConnectedAt: s.peerSince[addr],
+			Score:       s.reputation.score(peerSubject(peer)),
+			Identity:    peer.Identity(),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Addr < list[j].Addr
+	})
+	return list
+}
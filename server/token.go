@@ -0,0 +1,189 @@
+package server
+
+import (
+	"distributed_file_storage/crypto"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// 授权令牌：owner(或 ACL 授权的节点)签名的一条授权链。持有者可以把自己的权限委托给其他节点，
+// 委托时权限只能减少、过期时间只能提前、范围只能缩小到一个对象。令牌只在出示它的请求方是链上最后一个
+// 接收方(Subject)时有效
+
+const (
+	// maxTokenDepth 一个令牌最多经过几次委托
+	maxTokenDepth = 8
+	// defaultTokenTTL 没有指定有效期时签发的令牌的有效期
+	defaultTokenTTL = 24 * time.Hour
+)
+
+// Capability 授权链中的一环：Issuer 把对 Owner 命名空间(或其中的 Object)的 Perms 权限授予 Subject
+type Capability struct {
+	Issuer  string     `json:"iss"`
+	Subject string     `json:"sub"`
+	Owner   string     `json:"owner"`
+	Object  string     `json:"object,omitempty"`
+	Perms   Permission `json:"perms"`
+	Expires int64      `json:"exp"` // Unix 秒
+	Sig     []byte     `json:"sig,omitempty"`
+}
+
+// digest 签名的内容，包含上一环的签名，链中的环不能被替换或重新排列
+func (c Capability) digest(parentSig []byte) []byte {
+	c.Sig = nil
+	b, _ := json.Marshal(c)
+	return append(append([]byte("fs capability\n"), b...), parentSig...)
+}
+
+// TokenOpts 签发或委托令牌的参数
+type TokenOpts struct {
+	Subject     string        // 接收方的签名公钥
+	Key         string        // 只授权一个文件，为空表示整个命名空间。委托时忽略，范围与上一环相同
+	Permissions Permission    // 委托时为空表示与上一环相同
+	TTL         time.Duration // 为空时签发的令牌有效 24 小时，委托的令牌与上一环同时过期
+}
+
+// ParseToken 解码令牌，不校验签名
+func ParseToken(token string) ([]Capability, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token: %w", err)
+	}
+	var chain []Capability
+	if err := json.Unmarshal(b, &chain); err != nil {
+		return nil, fmt.Errorf("malformed token: %w", err)
+	}
+	if len(chain) == 0 || len(chain) > maxTokenDepth {
+		return nil, fmt.Errorf("malformed token: %d capabilities", len(chain))
+	}
+	return chain, nil
+}
+
+func encodeToken(chain []Capability) string {
+	b, _ := json.Marshal(chain)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// IssueToken 签发一个令牌，授权 Subject 访问本节点命名空间中的文件
+func (s *FileServer) IssueToken(opts TokenOpts) (string, error) {
+	if err := checkSubject(opts.Subject); err != nil {
+		return "", err
+	}
+	if opts.Permissions == 0 {
+		return "", fmt.Errorf("issue token: no permissions")
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = defaultTokenTTL
+	}
+
+	c := Capability{
+		Issuer:  s.Identity(),
+		Subject: opts.Subject,
+		Owner:   s.ID,
+		Perms:   opts.Permissions,
+		Expires: time.Now().Add(opts.TTL).Unix(),
+	}
+	if opts.Key != "" {
+		c.Object = s.objectID(opts.Key)
+	}
+	c.Sig = crypto.Sign(s.SignKey, c.digest(nil))
+
+	s.logger.Info("issued token", "subject", opts.Subject, "key", opts.Key, "perms", opts.Permissions.String())
+	return encodeToken([]Capability{c}), nil
+}
+
+// DelegateToken 把签发给本节点的令牌委托给 opts.Subject，权限和有效期不能超过 parent
+func (s *FileServer) DelegateToken(parent string, opts TokenOpts) (string, error) {
+	chain, err := ParseToken(parent)
+	if err != nil {
+		return "", err
+	}
+	if len(chain) == maxTokenDepth {
+		return "", fmt.Errorf("delegate token: already delegated %d times", maxTokenDepth-1)
+	}
+	if err := checkSubject(opts.Subject); err != nil {
+		return "", err
+	}
+
+	last := chain[len(chain)-1]
+	if last.Subject != s.Identity() {
+		return "", fmt.Errorf("delegate token: the token was issued to %.16s, not to this node", last.Subject)
+	}
+	c := Capability{
+		Issuer:  s.Identity(),
+		Subject: opts.Subject,
+		Owner:   last.Owner,
+		Object:  last.Object,
+		Perms:   opts.Permissions,
+		Expires: last.Expires,
+	}
+	if c.Perms == 0 {
+		c.Perms = last.Perms
+	}
+	if !last.Perms.Has(c.Perms) {
+		return "", fmt.Errorf("delegate token: cannot grant %s with a %s token", c.Perms, last.Perms)
+	}
+	if opts.TTL > 0 {
+		c.Expires = min(c.Expires, time.Now().Add(opts.TTL).Unix())
+	}
+	c.Sig = crypto.Sign(s.SignKey, c.digest(last.Sig))
+
+	return encodeToken(append(chain, c)), nil
+}
+
+// verifyToken 检查令牌是否允许 signer 发出 req
+func (s *FileServer) verifyToken(token, signer string, req request) error {
+	chain, err := ParseToken(token)
+	if err != nil {
+		return err
+	}
+
+	root := chain[0]
+	if !s.allowed(root.Issuer, root.Owner, root.Object, root.Perms) {
+		return fmt.Errorf("token issuer %.16s may not grant %s on %.16s", root.Issuer, root.Perms, root.Owner)
+	}
+
+	var parentSig []byte
+	for i, c := range chain {
+		if i > 0 {
+			p := chain[i-1]
+			switch {
+			case c.Issuer != p.Subject:
+				return fmt.Errorf("token: capability %d was not issued by the subject of the previous one", i)
+			case c.Owner != p.Owner, p.Object != "" && c.Object != p.Object:
+				return fmt.Errorf("token: capability %d widens the scope", i)
+			case !p.Perms.Has(c.Perms), c.Expires > p.Expires:
+				return fmt.Errorf("token: capability %d widens the permissions", i)
+			}
+		}
+		if err := crypto.Verify(c.Issuer, c.digest(parentSig), c.Sig); err != nil {
+			return fmt.Errorf("token: capability %d: %w", i, err)
+		}
+		parentSig = c.Sig
+	}
+
+	last := chain[len(chain)-1]
+	switch {
+	case time.Now().Unix() >= last.Expires:
+		return fmt.Errorf("token expired at %s", time.Unix(last.Expires, 0).UTC().Format(time.RFC3339))
+	case last.Subject != signer:
+		return fmt.Errorf("token was issued to %.16s", last.Subject)
+	case last.Owner != req.Owner, last.Object != "" && last.Object != req.Key:
+		return fmt.Errorf("token does not cover %.16s/%.16s", req.Owner, req.Key)
+	case !last.Perms.Has(req.Op):
+		return fmt.Errorf("token grants %s, not %s", last.Perms, req.Op)
+	}
+	return nil
+}
+
+// checkSubject 接收方必须是一个签名公钥
+func checkSubject(subject string) error {
+	b, err := hex.DecodeString(subject)
+	if err != nil || len(b) != 32 {
+		return fmt.Errorf("subject %q is not a node identity", subject)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"distributed_file_storage/codec"
+	"distributed_file_storage/crypto"
+	"distributed_file_storage/store"
+	"distributed_file_storage/trace"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// newVersionID 生成按时间排序的版本 ID：16 位十六进制纳秒时间戳加 8 位随机数
+func newVersionID() string {
+	var suffix [4]byte
+	rand.Read(suffix[:])
+	return fmt.Sprintf("%016x%08x", time.Now().UnixNano(), binary.BigEndian.Uint32(suffix[:]))
+}
+
+// statVersion 返回指定版本的元数据，version 为空时返回最新版本
+func (s *FileServer) statVersion(id, key, version string) (store.ObjectMeta, error) {
+	if version == "" {
+		return s.store.Stat(id, key)
+	}
+
+	versions, err := s.store.ListVersions(id, key)
+	if err != nil {
+		return store.ObjectMeta{}, err
+	}
+	for _, meta := range versions {
+		if meta.Version == version {
+			return meta, nil
+		}
+	}
+	return store.ObjectMeta{}, fmt.Errorf("stat %s@%s: %w", key, version, ErrNotFound)
+}
+
+// GetVersion 读取文件的指定版本，本地没有时从网络中的节点获取(不会保存到本地)
+func (s *FileServer) GetVersion(key, version string) (io.ReadCloser, error) {
+	if version == "" {
+		return s.Get(key)
+	}
+
+	ctx, span := s.Tracer.Start(context.Background(), "FileServer.GetVersion")
+	defer span.End()
+	span.SetAttr("node_id", s.ID)
+	span.SetAttr("key", key)
+	span.SetAttr("version", version)
+
+	if r, err := s.openLocal(ctx, key, version); err == nil {
+		span.SetAttr("served_by", "local")
+		return r, nil
+	}
+
+	if s.Erasure.Enabled() {
+		if h, data, err := s.fetchShards(ctx, key, version); err == nil {
+			span.SetAttr("served_by", "shards")
+			return codec.NewReader(h.Codec, io.NopCloser(bytes.NewReader(data)))
+		}
+	}
+
+	req := MessageGetFile{Key: s.objectID(key), ID: s.ID, Version: version}
+	h, data, err := s.fetchCopy(ctx, span, req, key, s.dataKey)
+	span.SetError(err)
+	if err != nil {
+		return nil, err
+	}
+
+	return codec.NewReader(h.Codec, io.NopCloser(bytes.NewReader(data)))
+}
+
+// fetchCopy 从第一个能解密的节点取回完整副本，返回解密并去掉填充后(解压前)的数据，不保存到本地。
+// unwrap 解开副本中的数据密钥
+func (s *FileServer) fetchCopy(ctx context.Context, span *trace.Span, req MessageGetFile, label string, unwrap func(string) ([]byte, error)) (fileHeader, []byte, error) {
+	var (
+		buf   bytes.Buffer
+		found fileHeader
+	)
+	err := s.fetchFrom(ctx, req, label, func(peer string, h fileHeader, r io.Reader) error {
+		if found.Size != 0 {
+			return nil
+		}
+		dataKey, err := unwrap(h.DataKey)
+		if err != nil {
+			return nil
+		}
+		if _, err := crypto.CopyDecrypt(dataKey, r, &buf); err != nil {
+			buf.Reset()
+			return nil
+		}
+		found = h
+		span.SetAttr("served_by", peer)
+		return nil
+	})
+	if err == nil && found.Size == 0 {
+		err = fmt.Errorf("get %s: %w", label, ErrNotFound)
+	}
+	if err != nil {
+		return found, nil, err
+	}
+
+	data, _, err := unpadData(found.Padding, buf.Bytes())
+	return found, data, err
+}
+
+// ListVersions 列出本地文件的所有版本，最新的在前
+func (s *FileServer) ListVersions(key string) ([]store.ObjectMeta, error) {
+	return s.store.ListVersions(s.ID, key)
+}
+
+// DeleteVersion 删除文件的一个版本，并通知网络中的节点删除对应的副本
+func (s *FileServer) DeleteVersion(key, version string) error {
+	meta, _ := s.statVersion(s.ID, key, version)
+	objectID := s.objectID(key)
+	if err := s.store.DeleteVersion(s.ID, key, version); err != nil {
+		return err
+	}
+
+	msg := Message{
+		Payload: MessageDeleteFile{
+			Key:     objectID,
+			ID:      s.ID,
+			Version: version,
+			Shards:  shardCount(meta),
+		},
+	}
+
+	return s.broadcast(&msg)
+}
+
+// Rollback 把指定版本的内容作为一个新版本写入，旧版本保持不变
+func (s *FileServer) Rollback(key, version string) error {
+	r, err := s.GetVersion(key, version)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return s.Store(key, r)
+}
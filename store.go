@@ -1,187 +0,0 @@
-package main
-
-import (
-	"crypto/sha1"
-	"encoding/hex"
-	"errors"
-	"fmt"
-	"io"
-	"log"
-	"os"
-	"path/filepath"
-	"strings"
-)
-
-const defaultRootFolderName = "ggnetwork"
-
-// CAS(Content-Addressable Storage，内容可寻址存储)
-
-// CASPathTransformFunc 将一个字符串 key 转换为一个基于其内容哈希的多级目录路径
-func CASPathTransformFunc(key string) PathKey {
-	hash := sha1.Sum([]byte(key))
-	hashStr := hex.EncodeToString(hash[:]) // [20]byte -> []byte
-
-	blockSize := 5
-	sliceLen := len(hashStr) / blockSize
-	paths := make([]string, sliceLen)
-
-	for i := 0; i < sliceLen; i++ {
-		from := i * blockSize
-		to := from + blockSize
-		paths[i] = hashStr[from:to]
-	}
-
-	return PathKey{
-		Pathname: filepath.Join(paths...),
-		Filename: hashStr,
-	}
-}
-
-type PathTransformFunc func(string) PathKey
-
-type PathKey struct {
-	Pathname string // 文件路径
-	Filename string // 文件名
-}
-
-func (p PathKey) FirstPathname() string {
-	path := strings.Split(p.Pathname, "/")
-	if len(path) == 0 {
-		return ""
-	}
-	return path[0]
-}
-
-// FullPath 完整路径
-func (p PathKey) FullPath() string {
-	return fmt.Sprintf("%s/%s", p.Pathname, p.Filename)
-}
-
-type StoreOpts struct {
-	Root              string            // 所有文件根路径
-	PathTransformFunc PathTransformFunc // key 转换为 pathName
-}
-
-var DefaultPathTransformFunc = func(key string) PathKey {
-	return PathKey{
-		Pathname: key,
-		Filename: key,
-	}
-}
-
-type Store struct {
-	StoreOpts
-}
-
-func NewStore(opts StoreOpts) *Store {
-	if opts.PathTransformFunc == nil {
-		opts.PathTransformFunc = DefaultPathTransformFunc
-	}
-	if opts.Root == "" {
-		opts.Root = defaultRootFolderName
-	}
-	return &Store{
-		StoreOpts: opts,
-	}
-}
-
-// Has 是否存在
-func (s *Store) Has(id, key string) bool {
-	pathKey := s.PathTransformFunc(key)
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
-
-	_, err := os.Stat(fullPathWithRoot)
-	if errors.Is(err, os.ErrNotExist) {
-		return false
-	}
-	return true
-}
-
-func (s *Store) Clear() error {
-	return os.RemoveAll(s.Root)
-}
-
-func (s *Store) Delete(id, key string) error {
-	pathKey := s.PathTransformFunc(key)
-	defer func() {
-		log.Printf("delete [%s] form disk", pathKey.Filename)
-	}()
-
-	firstNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FirstPathname())
-	return os.RemoveAll(firstNameWithRoot)
-}
-
-func (s *Store) Write(id, key string, r io.Reader) (int64, error) {
-	return s.writeStream(id, key, r)
-}
-
-func (s *Store) writeDecrypt(encKey []byte, id, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
-	if err != nil {
-		return 0, err
-	}
-
-	n, err := copyDecrypt(encKey, r, f)
-	if err != nil {
-		return 0, err
-	}
-
-	log.Printf("written (%d) bytes to disk: %s................................................", n, s.Root)
-
-	return int64(n), nil
-}
-
-func (s *Store) openFileForWriting(id, key string) (*os.File, error) {
-	pathKey := s.PathTransformFunc(key)
-	pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.Pathname)
-
-	if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {
-		return nil, err
-	}
-
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
-
-	return os.Create(fullPathWithRoot)
-}
-
-func (s *Store) writeStream(id, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
-	if err != nil {
-		return 0, err
-	}
-
-	// io.Copy 会从 io.Reader (r) 中读取数据，并写入 io.Writer (f)
-	// 直到 r 返回 io.EOF 或发生错误
-	// TODO 如果 r 是一个阻塞的I/O源（如网络连接），io.Copy 将会等待数据
-	// 直到所有数据被读取完毕，这可能导致函数长时间阻塞
-	n, err := io.Copy(f, r)
-	if err != nil {
-		return 0, err
-	}
-
-	log.Printf("written (%d) bytes to disk: %s................................................", n, s.Root)
-
-	return n, nil
-}
-
-// Read 读取不直接返回字节切片，而是返回读取器，更加灵活
-func (s *Store) Read(id, key string) (int64, io.Reader, error) {
-	return s.readStream(id, key)
-}
-
-func (s *Store) readStream(id, key string) (int64, io.ReadCloser, error) {
-	pathKey := s.PathTransformFunc(key)
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
-
-	file, err := os.Open(fullPathWithRoot)
-	if err != nil {
-		return 0, nil, err
-	}
-
-	fi, err := file.Stat()
-	if err != nil {
-		return 0, nil, err
-	}
-
-	return fi.Size(), file, nil
-}
@@ -0,0 +1,179 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GCOpts 控制一次垃圾回收
+type GCOpts struct {
+	GracePeriod    time.Duration // 比这更新的文件和目录可能还在写入，不处理
+	FilesPerSecond int           // 每秒最多检查的文件和目录数，用来限制 I/O，0 表示不限制
+}
+
+// GCReport 一次垃圾回收清理掉的内容
+type GCReport struct {
+	StartedAt         time.Time     `json:"started_at"`
+	Duration          time.Duration `json:"duration"`
+	Scanned           int64         `json:"scanned"`
+	IncompleteFiles   int64         `json:"incomplete_files"`   // 中断的写入留下的 .partial 文件
+	UnreferencedFiles int64         `json:"unreferenced_files"` // 没有数据文件的元数据
+	EmptyDirs         int64         `json:"empty_dirs"`
+	BytesReclaimed    int64         `json:"bytes_reclaimed"`
+}
+
+// Collector 由支持垃圾回收的 Store 实现
+type Collector interface {
+	GC(ctx context.Context, opts GCOpts) (GCReport, error)
+}
+
+// GC 扫描 Root，删除中断的写入、孤立的元数据文件以及空目录。
+// 其他文件都不删除：旧版本写入的对象没有元数据，Root 中也可能有不属于 Store 的文件
+func (s *DiskStore) GC(ctx context.Context, opts GCOpts) (GCReport, error) {
+	report := GCReport{StartedAt: time.Now().UTC()}
+	defer func() {
+		report.Duration = time.Since(report.StartedAt)
+	}()
+
+	var (
+		throttle = newThrottle(opts.FilesPerSecond)
+		cutoff   = time.Now().Add(-opts.GracePeriod)
+		dirs     []string
+		// 本次回收删除过内容的目录，它们的修改时间已经被刷新，不再按 GracePeriod 判断
+		touched = make(map[string]bool)
+	)
+
+	err := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// 扫描期间被删除的文件直接跳过
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if err := throttle.wait(ctx); err != nil {
+			return err
+		}
+		report.Scanned++
+
+		// Root 和 owner 目录本身不删除
+		if d.IsDir() {
+			if rel, _ := filepath.Rel(s.Root, path); strings.Contains(rel, string(filepath.Separator)) {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+
+		fi, err := d.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.ModTime().After(cutoff) {
+			return nil
+		}
+
+		switch {
+		case strings.HasSuffix(path, partialFileSuffix):
+			if s.reclaim(path, fi.Size(), &report) {
+				report.IncompleteFiles++
+				touched[filepath.Dir(path)] = true
+			}
+		case strings.HasSuffix(path, metaFileSuffix):
+			if exists(strings.TrimSuffix(path, metaFileSuffix)) {
+				return nil
+			}
+			if s.reclaim(path, fi.Size(), &report) {
+				report.UnreferencedFiles++
+				touched[filepath.Dir(path)] = true
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return report, nil
+	}
+	if err != nil {
+		return report, err
+	}
+
+	// 从最深的目录开始删除，这样父目录在子目录删除后也能变空
+	sort.Slice(dirs, func(i, j int) bool {
+		return len(dirs[i]) > len(dirs[j])
+	})
+	for _, dir := range dirs {
+		if err := throttle.wait(ctx); err != nil {
+			return report, err
+		}
+		if !touched[dir] {
+			fi, err := os.Stat(dir)
+			if err != nil || fi.ModTime().After(cutoff) {
+				continue
+			}
+		}
+		// os.Remove 只能删除空目录
+		if err := os.Remove(dir); err == nil {
+			report.EmptyDirs++
+			touched[filepath.Dir(dir)] = true
+		}
+	}
+
+	return report, nil
+}
+
+func (s *DiskStore) reclaim(path string, size int64, report *GCReport) bool {
+	if err := os.Remove(path); err != nil {
+		s.Logger.Warn("gc: failed to remove file", "path", path, "err", err)
+		return false
+	}
+	s.Logger.Debug("gc: removed file", "path", path, "bytes", size)
+	report.BytesReclaimed += size
+	return true
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+// throttle 把操作限制在每秒 n 次以内
+type throttle struct {
+	interval time.Duration
+	next     time.Time
+}
+
+func newThrottle(perSecond int) *throttle {
+	if perSecond <= 0 {
+		return &throttle{}
+	}
+	return &throttle{interval: time.Second / time.Duration(perSecond)}
+}
+
+func (t *throttle) wait(ctx context.Context) error {
+	if t.interval == 0 {
+		return ctx.Err()
+	}
+
+	now := time.Now()
+	if t.next.After(now) {
+		timer := time.NewTimer(t.next.Sub(now))
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+		now = t.next
+	}
+	t.next = now.Add(t.interval)
+
+	return nil
+}
@@ -0,0 +1,520 @@
+// Package store 把文件按 owner id 分目录保存在本地磁盘上
+package store
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRootFolderName = "ggnetwork"
+	metaFileSuffix        = ".meta"
+	partialFileSuffix     = ".partial"  // 写入中的文件，完成后重命名
+	versionsDirSuffix     = ".versions" // <文件>.versions/<版本 ID> 保存旧版本
+)
+
+// CAS(Content-Addressable Storage，内容可寻址存储)
+
+// CASPathTransformFunc 将一个字符串 key 转换为一个基于其内容哈希的多级目录路径
+func CASPathTransformFunc(key string) PathKey {
+	hash := sha1.Sum([]byte(key))
+	hashStr := hex.EncodeToString(hash[:]) // [20]byte -> []byte
+
+	blockSize := 5
+	sliceLen := len(hashStr) / blockSize
+	paths := make([]string, sliceLen)
+
+	for i := 0; i < sliceLen; i++ {
+		from := i * blockSize
+		to := from + blockSize
+		paths[i] = hashStr[from:to]
+	}
+
+	return PathKey{
+		Pathname: filepath.Join(paths...),
+		Filename: hashStr,
+	}
+}
+
+type PathTransformFunc func(string) PathKey
+
+type PathKey struct {
+	Pathname string // 文件路径
+	Filename string // 文件名
+}
+
+func (p PathKey) FirstPathname() string {
+	path := strings.Split(p.Pathname, "/")
+	if len(path) == 0 {
+		return ""
+	}
+	return path[0]
+}
+
+// FullPath 完整路径
+func (p PathKey) FullPath() string {
+	return fmt.Sprintf("%s/%s", p.Pathname, p.Filename)
+}
+
+// ObjectMeta 对象元数据，以 <文件名>.meta 的形式与数据文件放在一起
+type ObjectMeta struct {
+	Key        string            `json:"key"`
+	Size       int64             `json:"size"`
+	ModTime    time.Time         `json:"mod_time"`
+	ExpiresAt  *time.Time        `json:"expires_at,omitempty"`  // 为空表示永不过期
+	Version    string            `json:"version,omitempty"`     // 为空表示没有开启版本
+	Codec      string            `json:"codec,omitempty"`       // 压缩算法，为空表示没有压缩
+	StoredSize int64             `json:"stored_size,omitempty"` // 磁盘上的字节数，为 0 时与 Size 相同
+	Erasure    *ErasureInfo      `json:"erasure,omitempty"`     // 按纠删码分片保存时的切分参数
+	Encrypted  bool              `json:"encrypted,omitempty"`   // 数据用 owner 的密钥加密保存，Size 是解密后的字节数
+	DataKey    string            `json:"data_key,omitempty"`    // 用 owner 主密钥包装的数据密钥，为空表示直接用主密钥加密
+	KeyedID    bool              `json:"keyed_id,omitempty"`    // 其他节点上的副本使用 HMAC 标识，否则是旧的 md5 标识
+	Padding    string            `json:"padding,omitempty"`     // 节点之间传输和保存的密文使用的填充方案，真实长度在密文中
+	Shares     map[string]string `json:"shares,omitempty"`      // 接收方的公钥 → 用该公钥加密的数据密钥
+	Signer     string            `json:"signer,omitempty"`      // 副本上传者的签名公钥
+	Signature  string            `json:"signature,omitempty"`   // 上传者对副本内容和元数据的签名
+}
+
+// ErasureInfo 对象按纠删码切分时的参数，保存在完整对象和每个分片的元数据中
+type ErasureInfo struct {
+	Stripe       string `json:"stripe"` // 每次切分随机生成，用来区分同一个 key 不同写入的分片
+	DataShards   int    `json:"data_shards"`
+	ParityShards int    `json:"parity_shards"`
+	Size         int64  `json:"size"` // 切分前的字节数
+}
+
+// Shards 分片总数
+func (e ErasureInfo) Shards() int {
+	return e.DataShards + e.ParityShards
+}
+
+// DiskSize 对象在磁盘上占用的字节数
+func (m ObjectMeta) DiskSize() int64 {
+	if m.StoredSize > 0 {
+		return m.StoredSize
+	}
+	return m.Size
+}
+
+// Expired 对象在 now 时是否已经过期
+func (m ObjectMeta) Expired(now time.Time) bool {
+	return m.ExpiresAt != nil && !now.Before(*m.ExpiresAt)
+}
+
+// WriteOpts 随对象一起保存到元数据中的选项
+type WriteOpts struct {
+	ExpiresAt time.Time    // 零值表示永不过期
+	Version   string       // 不为空时保留当前版本，新写入的数据成为最新版本
+	Codec     string       // 写入的数据使用的压缩算法
+	Size      int64        // 压缩前的字节数，0 表示与写入的字节数相同
+	Erasure   *ErasureInfo // 不为空时是纠删码对象的完整副本或其中一个分片
+	Encrypted bool         // 写入的是密文，此时 Size 必须是明文的字节数
+	DataKey   string       // 包装后的数据密钥
+	KeyedID   bool         // 其他节点上的副本使用 HMAC 标识
+	Padding   string       // 副本的密文使用的填充方案
+	Signer    string       // 上传者的签名公钥
+	Signature string       // 上传者对内容哈希和元数据的签名(base64)
+}
+
+type StoreOpts struct {
+	Root              string            // 所有文件根路径
+	PathTransformFunc PathTransformFunc // key 转换为 pathName
+	Logger            *slog.Logger      // 为空时使用 slog.Default()
+}
+
+var DefaultPathTransformFunc = func(key string) PathKey {
+	return PathKey{
+		Pathname: key,
+		Filename: key,
+	}
+}
+
+// ErrNotFound 对象不存在，可以用 errors.Is 判断
+var ErrNotFound = errors.New("object not found")
+
+// Store 按 owner id 和 key 存取对象，已过期的对象视为不存在
+type Store interface {
+	Has(id, key string) bool
+	Read(id, key string) (int64, io.ReadCloser, error)
+	Write(id, key string, r io.Reader, opts WriteOpts) (int64, error)
+	Delete(id, key string) error
+	Rename(id, from, to string) error
+	ReadVersion(id, key, version string) (int64, io.ReadCloser, error)
+	ListVersions(id, key string) ([]ObjectMeta, error)
+	DeleteVersion(id, key, version string) error
+	UpdateMeta(id, key, version string, update func(*ObjectMeta)) error
+	Stat(id, key string) (ObjectMeta, error)
+	List(id string) ([]ObjectMeta, error)
+	Usage(id string) (Usage, error)
+	Owners() ([]string, error)
+	Expire(now time.Time) (Usage, error)
+	Clear() error
+}
+
+// Usage 磁盘占用情况
+type Usage struct {
+	Objects int64 `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// DiskStore 基于本地文件系统的 Store 实现
+type DiskStore struct {
+	StoreOpts
+}
+
+func NewDiskStore(opts StoreOpts) *DiskStore {
+	if opts.PathTransformFunc == nil {
+		opts.PathTransformFunc = DefaultPathTransformFunc
+	}
+	if opts.Root == "" {
+		opts.Root = defaultRootFolderName
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	return &DiskStore{
+		StoreOpts: opts,
+	}
+}
+
+// Has 是否存在
+func (s *DiskStore) Has(id, key string) bool {
+	pathKey := s.PathTransformFunc(key)
+	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+
+	_, err := os.Stat(fullPathWithRoot)
+	if errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+	return !s.expired(id, key)
+}
+
+// expired 读取元数据判断对象是否过期，没有元数据的对象不会过期
+func (s *DiskStore) expired(id, key string) bool {
+	meta, err := s.readMeta(s.metaPath(id, key))
+	return err == nil && meta.Expired(time.Now())
+}
+
+func (s *DiskStore) Clear() error {
+	return os.RemoveAll(s.Root)
+}
+
+func (s *DiskStore) Delete(id, key string) error {
+	if !s.Has(id, key) {
+		return fmt.Errorf("delete %s: %w", key, ErrNotFound)
+	}
+
+	pathKey := s.PathTransformFunc(key)
+	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+	if err := s.remove(fullPathWithRoot); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(fullPathWithRoot + versionsDirSuffix); err != nil {
+		return err
+	}
+
+	s.Logger.Debug("deleted from disk", "owner", id, "key", key)
+	return nil
+}
+
+// remove 只删除数据文件和元数据，空目录由 GC 清理，避免误删共用前缀目录的其他对象
+func (s *DiskStore) remove(fullPathWithRoot string) error {
+	if err := os.Remove(fullPathWithRoot); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(fullPathWithRoot + metaFileSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *DiskStore) Write(id, key string, r io.Reader, opts WriteOpts) (int64, error) {
+	return s.writeStream(id, key, r, opts)
+}
+
+// openFileForWriting 创建 <完整路径>.partial，写完后由 writeStream 重命名
+func (s *DiskStore) openFileForWriting(id, key string) (*os.File, error) {
+	pathKey := s.PathTransformFunc(key)
+	pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.Pathname)
+
+	if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+
+	f, err := os.Create(fullPathWithRoot + partialFileSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		// GC 可能刚好删除了这个空目录，重新创建一次
+		if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {
+			return nil, err
+		}
+		f, err = os.Create(fullPathWithRoot + partialFileSuffix)
+	}
+	return f, err
+}
+
+func (s *DiskStore) writeStream(id, key string, r io.Reader, opts WriteOpts) (int64, error) {
+	f, err := s.openFileForWriting(id, key)
+	if err != nil {
+		return 0, err
+	}
+	partial := f.Name()
+
+	// io.Copy 会从 io.Reader (r) 中读取数据，并写入 io.Writer (f)
+	// 直到 r 返回 io.EOF 或发生错误
+	// TODO 如果 r 是一个阻塞的I/O源（如网络连接），io.Copy 将会等待数据
+	// 直到所有数据被读取完毕，这可能导致函数长时间阻塞
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && opts.Version != "" {
+		err = s.archive(id, key, opts.Version)
+	}
+	if err == nil {
+		err = os.Rename(partial, strings.TrimSuffix(partial, partialFileSuffix))
+	}
+	if err != nil {
+		// 进程在这里之前退出时，残留的 .partial 文件由 GC 清理
+		os.Remove(partial)
+		return 0, err
+	}
+
+	if err := s.writeMeta(id, key, n, opts); err != nil {
+		return 0, err
+	}
+
+	s.Logger.Debug("written to disk", "owner", id, "key", key, "bytes", n)
+
+	return n, nil
+}
+
+// Read 读取不直接返回字节切片，而是返回读取器，更加灵活。调用方负责关闭
+func (s *DiskStore) Read(id, key string) (int64, io.ReadCloser, error) {
+	return s.readStream(id, key)
+}
+
+func (s *DiskStore) readStream(id, key string) (int64, io.ReadCloser, error) {
+	if s.expired(id, key) {
+		return 0, nil, fmt.Errorf("read %s: %w", key, ErrNotFound)
+	}
+
+	pathKey := s.PathTransformFunc(key)
+	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+
+	file, err := os.Open(fullPathWithRoot)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil, fmt.Errorf("read %s: %w", key, ErrNotFound)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return 0, nil, err
+	}
+
+	return fi.Size(), file, nil
+}
+
+func (s *DiskStore) metaPath(id, key string) string {
+	pathKey := s.PathTransformFunc(key)
+	return fmt.Sprintf("%s/%s/%s%s", s.Root, id, pathKey.FullPath(), metaFileSuffix)
+}
+
+func (s *DiskStore) writeMeta(id, key string, size int64, opts WriteOpts) error {
+	meta := ObjectMeta{
+		Key:       key,
+		Size:      size,
+		ModTime:   time.Now().UTC(),
+		Version:   opts.Version,
+		Codec:     opts.Codec,
+		Erasure:   opts.Erasure,
+		Encrypted: opts.Encrypted,
+		DataKey:   opts.DataKey,
+		KeyedID:   opts.KeyedID,
+		Padding:   opts.Padding,
+		Signer:    opts.Signer,
+		Signature: opts.Signature,
+	}
+	if (opts.Size > 0 || opts.Encrypted) && opts.Size != size {
+		meta.Size = opts.Size
+		meta.StoredSize = size
+	}
+	if !opts.ExpiresAt.IsZero() {
+		expiresAt := opts.ExpiresAt.UTC()
+		meta.ExpiresAt = &expiresAt
+	}
+
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.metaPath(id, key), b, 0o644)
+}
+
+func (s *DiskStore) readMeta(path string) (ObjectMeta, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+
+	var meta ObjectMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return ObjectMeta{}, err
+	}
+	return meta, nil
+}
+
+// Stat 返回对象的元数据
+func (s *DiskStore) Stat(id, key string) (ObjectMeta, error) {
+	meta, err := s.readMeta(s.metaPath(id, key))
+	if errors.Is(err, os.ErrNotExist) || err == nil && meta.Expired(time.Now()) {
+		return ObjectMeta{}, fmt.Errorf("stat %s: %w", key, ErrNotFound)
+	}
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	return meta, nil
+}
+
+// List 列出某个 id 名下所有未过期对象的最新版本
+func (s *DiskStore) List(id string) ([]ObjectMeta, error) {
+	var (
+		metas []ObjectMeta
+		now   = time.Now()
+	)
+
+	err := filepath.WalkDir(filepath.Join(s.Root, id), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && strings.HasSuffix(path, versionsDirSuffix) {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || !strings.HasSuffix(path, metaFileSuffix) {
+			return nil
+		}
+
+		meta, err := s.readMeta(path)
+		if err != nil {
+			return err
+		}
+		if !meta.Expired(now) {
+			metas = append(metas, meta)
+		}
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	return metas, err
+}
+
+// Usage 统计某个 id 名下的对象数和字节数，id 为空时统计所有 owner
+func (s *DiskStore) Usage(id string) (Usage, error) {
+	var usage Usage
+
+	err := filepath.WalkDir(filepath.Join(s.Root, id), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, metaFileSuffix) || strings.HasSuffix(path, partialFileSuffix) {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		usage.Objects++
+		usage.Bytes += fi.Size()
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return Usage{}, nil
+	}
+
+	return usage, err
+}
+
+// Owners 列出 Root 下所有 owner id
+func (s *DiskStore) Owners() ([]string, error) {
+	entries, err := os.ReadDir(s.Root)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, e := range entries {
+		if e.IsDir() {
+			ids = append(ids, e.Name())
+		}
+	}
+	return ids, nil
+}
+
+// Expire 删除所有 owner 名下在 now 时已经过期的对象，返回删除的对象数和字节数
+func (s *DiskStore) Expire(now time.Time) (Usage, error) {
+	var usage Usage
+
+	err := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// 扫描期间被删除的文件直接跳过
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, metaFileSuffix) {
+			return nil
+		}
+
+		meta, err := s.readMeta(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !meta.Expired(now) {
+			return nil
+		}
+
+		fullPathWithRoot := strings.TrimSuffix(path, metaFileSuffix)
+		var size int64
+		if fi, err := os.Stat(fullPathWithRoot); err == nil {
+			size = fi.Size()
+		}
+		if err := s.remove(fullPathWithRoot); err != nil {
+			return err
+		}
+
+		s.Logger.Debug("expired object removed", "key", meta.Key, "bytes", size, "expires_at", meta.ExpiresAt)
+		usage.Objects++
+		usage.Bytes += size
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return Usage{}, nil
+	}
+
+	return usage, err
+}
@@ -0,0 +1,353 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"distributed_file_storage/crypto"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPathTransformFunc(t *testing.T) {
+	key := "momsbestpicture"
+	pathKey := CASPathTransformFunc(key)
+	expectedFilename := "6804429f74181a63c50c3d81d733a12f14a353ff"
+	expectedPathName := "68044/29f74/181a6/3c50c/3d81d/733a1/2f14a/353ff"
+	if pathKey.Pathname != expectedPathName {
+		t.Errorf("have %s, want %s", pathKey.Pathname, expectedPathName)
+	}
+	if pathKey.Filename != expectedFilename {
+		t.Errorf("have %s, want %s", pathKey.Filename, expectedFilename)
+	}
+}
+
+// TestStore 主测试函数
+func TestStore(t *testing.T) {
+	s := newStore()
+	id := crypto.GenerateID()
+	defer teardown(t, s)
+
+	for i := 0; i < 50; i++ {
+
+		key := fmt.Sprintf("foo_%d", i)
+		data := []byte("some jpg bytes")
+
+		// 写入
+		if _, err := s.writeStream(id, key, bytes.NewReader(data), WriteOpts{}); err != nil {
+			t.Error(err)
+		}
+
+		// 是否存在
+		if ok := s.Has(id, key); !ok {
+			t.Errorf("expected to have key %s", key)
+		}
+
+		// 读取
+		_, r, err := s.Read(id, key)
+		if err != nil {
+			t.Error(err)
+		}
+
+		b, _ := ioutil.ReadAll(r)
+		r.Close()
+		if bytes.Compare(data, b) != 0 {
+			t.Errorf("have %s, want %s", b, data)
+		}
+		fmt.Println(string(b))
+
+		// 删除
+		if err = s.Delete(id, key); err != nil {
+			t.Error(err)
+		}
+
+		// 是否存在
+		if ok := s.Has(id, key); ok {
+			t.Errorf("expected to NOT have key %s", key)
+		}
+	}
+}
+
+func TestStoreNotFound(t *testing.T) {
+	s := newStore()
+	defer teardown(t, s)
+
+	if _, _, err := s.Read("nobody", "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("have %v, want ErrNotFound", err)
+	}
+	if err := s.Delete("nobody", "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("have %v, want ErrNotFound", err)
+	}
+}
+
+func TestStoreExpiry(t *testing.T) {
+	s := NewDiskStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+	id := crypto.GenerateID()
+	data := []byte("build artifact")
+
+	if _, err := s.Write(id, "old", bytes.NewReader(data), WriteOpts{ExpiresAt: time.Now().Add(-time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write(id, "new", bytes.NewReader(data), WriteOpts{ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write(id, "forever", bytes.NewReader(data), WriteOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 过期但还没被清理的对象也读不到
+	if s.Has(id, "old") {
+		t.Errorf("expected expired object to be hidden")
+	}
+	if _, _, err := s.Read(id, "old"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("read: have %v, want ErrNotFound", err)
+	}
+	if _, err := s.Stat(id, "old"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("stat: have %v, want ErrNotFound", err)
+	}
+	if meta, err := s.Stat(id, "new"); err != nil || meta.ExpiresAt == nil {
+		t.Errorf("expected expiry in metadata: %+v %v", meta, err)
+	}
+	if objects, _ := s.List(id); len(objects) != 2 {
+		t.Errorf("have %d objects listed, want 2", len(objects))
+	}
+
+	usage, err := s.Expire(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Objects != 1 || usage.Bytes != int64(len(data)) {
+		t.Errorf("unexpected expire result: %+v", usage)
+	}
+
+	usage, _ = s.Expire(time.Now().Add(2 * time.Hour))
+	if usage.Objects != 1 || !s.Has(id, "forever") {
+		t.Errorf("expected only new to expire later: %+v", usage)
+	}
+}
+
+func TestStoreVersions(t *testing.T) {
+	s := NewDiskStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+	id := crypto.GenerateID()
+
+	for _, v := range []string{"v1", "v2", "v3"} {
+		if _, err := s.Write(id, "doc", bytes.NewReader([]byte("content "+v)), WriteOpts{Version: v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 副本重传同一个版本不会产生新的历史
+	if _, err := s.Write(id, "doc", bytes.NewReader([]byte("content v3")), WriteOpts{Version: "v3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := s.ListVersions(id, "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := versionIDs(versions); have != "v3,v2,v1" {
+		t.Fatalf("have versions %s, want v3,v2,v1", have)
+	}
+	if objects, _ := s.List(id); len(objects) != 1 || objects[0].Version != "v3" {
+		t.Errorf("expected only the latest version to be listed: %+v", objects)
+	}
+
+	_, r, err := s.ReadVersion(id, "doc", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	r.Close()
+	if string(b) != "content v1" {
+		t.Errorf("have %q, want %q", b, "content v1")
+	}
+
+	// 只修改元数据，最新版本和历史版本分别保存
+	for _, v := range []string{"v3", "v1"} {
+		if err := s.UpdateMeta(id, "doc", v, func(m *ObjectMeta) { m.DataKey = "key-" + v }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if versions, _ := s.ListVersions(id, "doc"); versions[0].DataKey != "key-v3" || versions[1].DataKey != "" || versions[2].DataKey != "key-v1" {
+		t.Errorf("unexpected data keys after update: %+v", versions)
+	}
+	if err := s.UpdateMeta(id, "missing", "", func(*ObjectMeta) {}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("have %v, want ErrNotFound", err)
+	}
+
+	// 删除最新版本后，上一个版本成为最新版本
+	if err := s.DeleteVersion(id, "doc", "v3"); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err := s.Stat(id, "doc"); err != nil || meta.Version != "v2" {
+		t.Errorf("have latest %+v (%v), want v2", meta, err)
+	}
+	if err := s.DeleteVersion(id, "doc", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteVersion(id, "doc", "v1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("have %v, want ErrNotFound", err)
+	}
+
+	if _, err := s.Write(id, "doc", bytes.NewReader([]byte("content v4")), WriteOpts{Version: "v4"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(id, "doc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ListVersions(id, "doc"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected all versions to be deleted, have %v", err)
+	}
+}
+
+func TestStoreRename(t *testing.T) {
+	s := NewDiskStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+	id := crypto.GenerateID()
+
+	for _, v := range []string{"v1", "v2"} {
+		if _, err := s.Write(id, "old", bytes.NewReader([]byte("content "+v)), WriteOpts{Version: v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Rename(id, "old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has(id, "old") {
+		t.Errorf("old key still exists after rename")
+	}
+
+	versions, err := s.ListVersions(id, "new")
+	if err != nil || versionIDs(versions) != "v2,v1" {
+		t.Fatalf("have versions %+v (%v), want v2,v1", versions, err)
+	}
+	for _, v := range versions {
+		if v.Key != "new" {
+			t.Errorf("version %s: have key %q in meta", v.Version, v.Key)
+		}
+	}
+	_, r, err := s.ReadVersion(id, "new", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	r.Close()
+	if string(b) != "content v1" {
+		t.Errorf("have %q, want %q", b, "content v1")
+	}
+
+	// 目标已经存在时保留目标
+	if _, err := s.Write(id, "stale", bytes.NewReader([]byte("stale")), WriteOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rename(id, "stale", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err := s.Stat(id, "new"); err != nil || meta.Version != "v2" || s.Has(id, "stale") {
+		t.Errorf("expected new to be kept and stale to be deleted: %+v (%v)", meta, err)
+	}
+	if err := s.Rename(id, "missing", "new"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("have %v, want ErrNotFound", err)
+	}
+}
+
+func versionIDs(metas []ObjectMeta) string {
+	ids := make([]string, len(metas))
+	for i, meta := range metas {
+		ids[i] = meta.Version
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestStoreGC(t *testing.T) {
+	s := NewDiskStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+	id := crypto.GenerateID()
+
+	for _, key := range []string{"keep", "deleted", "legacy", "no-data"} {
+		if _, err := s.Write(id, key, bytes.NewReader([]byte("some jpg bytes")), WriteOpts{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete(id, "deleted"); err != nil {
+		t.Fatal(err)
+	}
+	// 旧版本写入的对象没有元数据
+	os.Remove(s.metaPath(id, "legacy"))
+	os.Remove(strings.TrimSuffix(s.metaPath(id, "no-data"), metaFileSuffix))
+
+	// 中断的写入
+	partial := strings.TrimSuffix(s.metaPath(id, "partial"), metaFileSuffix) + partialFileSuffix
+	os.MkdirAll(filepath.Dir(partial), os.ModePerm)
+	os.WriteFile(partial, []byte("half"), 0o644)
+
+	// 宽限期内什么都不删除
+	report, err := s.GC(context.Background(), GCOpts{GracePeriod: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.IncompleteFiles+report.UnreferencedFiles+report.EmptyDirs != 0 {
+		t.Errorf("expected nothing to be reclaimed inside the grace period: %+v", report)
+	}
+
+	report, err = s.GC(context.Background(), GCOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.IncompleteFiles != 1 || report.UnreferencedFiles != 1 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+	// 除了 keep 和 legacy 之外，每个 key 都留下一整条 8 层的 CAS 目录
+	if report.EmptyDirs != 3*8 {
+		t.Errorf("have %d empty dirs reclaimed, want %d", report.EmptyDirs, 3*8)
+	}
+	if report.BytesReclaimed == 0 {
+		t.Errorf("expected reclaimed bytes to be reported")
+	}
+
+	for _, key := range []string{"keep", "legacy"} {
+		if _, r, err := s.Read(id, key); err != nil {
+			t.Errorf("%s: %v", key, err)
+		} else {
+			r.Close()
+		}
+	}
+	objects, _ := s.List(id)
+	if len(objects) != 1 {
+		t.Errorf("have %d objects, want 1", len(objects))
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	th := newThrottle(100)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		th.wait(context.Background())
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Errorf("5 operations at 100/s took %s", d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := th.wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("have %v, want context.Canceled", err)
+	}
+}
+
+func newStore() *DiskStore {
+	opts := StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+	}
+	return NewDiskStore(opts)
+}
+
+// teardown 清除
+func teardown(t *testing.T, s *DiskStore) {
+	if err := s.Clear(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,210 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 最新版本保存在对象原来的路径上，旧版本保存在 <文件>.versions/<版本 ID>，
+// 同样带有 .meta 元数据。版本 ID 按时间排序，由写入方生成并随副本发送，所以各节点一致
+
+func (s *DiskStore) versionsDir(id, key string) string {
+	pathKey := s.PathTransformFunc(key)
+	return fmt.Sprintf("%s/%s/%s%s", s.Root, id, pathKey.FullPath(), versionsDirSuffix)
+}
+
+// archive 在写入 version 之前把当前版本移到 versions 目录，没有版本的旧数据直接被覆盖
+func (s *DiskStore) archive(id, key, version string) error {
+	current, err := s.readMeta(s.metaPath(id, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// 同一个版本重复写入(例如副本重传)时直接覆盖
+	if current.Version == "" || current.Version == version {
+		return nil
+	}
+
+	dir := s.versionsDir(id, key)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	fullPathWithRoot := strings.TrimSuffix(s.metaPath(id, key), metaFileSuffix)
+	if err := os.Rename(fullPathWithRoot, dir+"/"+current.Version); err != nil {
+		return err
+	}
+	return os.Rename(fullPathWithRoot+metaFileSuffix, dir+"/"+current.Version+metaFileSuffix)
+}
+
+// ReadVersion 读取指定版本，调用方负责关闭
+func (s *DiskStore) ReadVersion(id, key, version string) (int64, io.ReadCloser, error) {
+	if meta, err := s.Stat(id, key); err == nil && meta.Version == version {
+		return s.readStream(id, key)
+	}
+
+	path := s.versionsDir(id, key) + "/" + version
+	if meta, err := s.readMeta(path + metaFileSuffix); err != nil || meta.Expired(time.Now()) {
+		return 0, nil, fmt.Errorf("read %s@%s: %w", key, version, ErrNotFound)
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil, fmt.Errorf("read %s@%s: %w", key, version, ErrNotFound)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return 0, nil, err
+	}
+
+	return fi.Size(), file, nil
+}
+
+// ListVersions 返回对象所有未过期的版本，最新的在前
+func (s *DiskStore) ListVersions(id, key string) ([]ObjectMeta, error) {
+	var (
+		versions []ObjectMeta
+		now      = time.Now()
+	)
+
+	dir := s.versionsDir(id, key)
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), metaFileSuffix) {
+			continue
+		}
+		meta, err := s.readMeta(dir + "/" + e.Name())
+		if err != nil {
+			return nil, err
+		}
+		if !meta.Expired(now) {
+			versions = append(versions, meta)
+		}
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version > versions[j].Version
+	})
+
+	// 最新版本始终在第一个，即使它是关闭版本后写入的(没有版本 ID)
+	if meta, err := s.Stat(id, key); err == nil {
+		versions = append([]ObjectMeta{meta}, versions...)
+	}
+
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("versions %s: %w", key, ErrNotFound)
+	}
+	return versions, nil
+}
+
+// UpdateMeta 只修改对象某个版本(为空时是最新版本)的元数据，数据文件不变
+func (s *DiskStore) UpdateMeta(id, key, version string, update func(*ObjectMeta)) error {
+	path := s.metaPath(id, key)
+	if version != "" {
+		if current, err := s.Stat(id, key); err != nil || current.Version != version {
+			path = s.versionsDir(id, key) + "/" + version + metaFileSuffix
+		}
+	}
+
+	meta, err := s.readMeta(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("update %s: %w", key, ErrNotFound)
+	}
+	if err != nil {
+		return err
+	}
+	update(&meta)
+
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	// 先写临时文件再重命名，中断时不会留下损坏的元数据
+	if err := os.WriteFile(path+partialFileSuffix, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+partialFileSuffix, path)
+}
+
+// Rename 把对象连同所有版本改名为 to。to 已经存在时保留 to，删除 from
+func (s *DiskStore) Rename(id, from, to string) error {
+	src := strings.TrimSuffix(s.metaPath(id, from), metaFileSuffix)
+	if _, err := os.Stat(src); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("rename %s: %w", from, ErrNotFound)
+	}
+	dst := strings.TrimSuffix(s.metaPath(id, to), metaFileSuffix)
+	if _, err := os.Stat(dst); err == nil {
+		return s.Delete(id, from)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	for _, suffix := range []string{"", metaFileSuffix, versionsDirSuffix} {
+		if err := os.Rename(src+suffix, dst+suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	// 元数据中的 key 也要更新
+	versions, err := s.ListVersions(id, to)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		err := s.UpdateMeta(id, to, v.Version, func(m *ObjectMeta) { m.Key = to })
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+
+	s.Logger.Debug("renamed on disk", "owner", id, "from", from, "to", to)
+	return nil
+}
+
+// DeleteVersion 删除一个版本。删除最新版本时，上一个版本成为最新版本
+func (s *DiskStore) DeleteVersion(id, key, version string) error {
+	dir := s.versionsDir(id, key)
+
+	current, err := s.Stat(id, key)
+	if err != nil || current.Version != version {
+		if _, err := os.Stat(dir + "/" + version + metaFileSuffix); errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("delete %s@%s: %w", key, version, ErrNotFound)
+		}
+		return s.remove(dir + "/" + version)
+	}
+
+	fullPathWithRoot := strings.TrimSuffix(s.metaPath(id, key), metaFileSuffix)
+	if err := s.remove(fullPathWithRoot); err != nil {
+		return err
+	}
+
+	versions, err := s.ListVersions(id, key)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	previous := dir + "/" + versions[0].Version
+	if err := os.Rename(previous, fullPathWithRoot); err != nil {
+		return err
+	}
+	return os.Rename(previous+metaFileSuffix, fullPathWithRoot+metaFileSuffix)
+}
@@ -0,0 +1,50 @@
+package trace
+
+import (
+	"context"
+	"sync"
+)
+
+// InMemoryExporter 把 span 保存在内存中，用于测试
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func NewInMemoryExporter() *InMemoryExporter {
+	return &InMemoryExporter{}
+}
+
+func (e *InMemoryExporter) ExportSpan(span SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+func (e *InMemoryExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+// Spans 返回目前收到的所有 span 的副本
+func (e *InMemoryExporter) Spans() []SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]SpanData(nil), e.spans...)
+}
+
+// Find 返回名称为 name 的所有 span
+func (e *InMemoryExporter) Find(name string) []SpanData {
+	var spans []SpanData
+	for _, span := range e.Spans() {
+		if span.Name == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+func (e *InMemoryExporter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = nil
+}
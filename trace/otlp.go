@@ -0,0 +1,266 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultOTLPBatchSize     = 256
+	defaultOTLPFlushInterval = 5 * time.Second
+)
+
+type OTLPExporterOpts struct {
+	Endpoint      string        // OTLP/HTTP 地址，例如 http://localhost:4318
+	ServiceName   string        // resource 的 service.name
+	BatchSize     int           // 攒够多少个 span 发送一次
+	FlushInterval time.Duration // 最长多久发送一次
+	Client        *http.Client
+	Logger        *slog.Logger
+}
+
+// OTLPExporter 按 OTLP/HTTP JSON 协议把 span 批量发送到 {Endpoint}/v1/traces
+type OTLPExporter struct {
+	OTLPExporterOpts
+
+	spanch chan SpanData
+	quitch chan struct{}
+	donech chan struct{}
+	once   sync.Once
+}
+
+func NewOTLPExporter(opts OTLPExporterOpts) *OTLPExporter {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultOTLPBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultOTLPFlushInterval
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	opts.Endpoint = strings.TrimRight(opts.Endpoint, "/")
+
+	e := &OTLPExporter{
+		OTLPExporterOpts: opts,
+		spanch:           make(chan SpanData, opts.BatchSize*4),
+		quitch:           make(chan struct{}),
+		donech:           make(chan struct{}),
+	}
+	go e.loop()
+
+	return e
+}
+
+// ExportSpan 不会阻塞调用方，队列满时丢弃 span
+func (e *OTLPExporter) ExportSpan(span SpanData) {
+	select {
+	case e.spanch <- span:
+	default:
+		e.Logger.Warn("otlp exporter queue full, dropping span", "span", span.Name)
+	}
+}
+
+// Shutdown 发送剩余的 span 并停止后台协程
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	e.once.Do(func() {
+		close(e.quitch)
+	})
+
+	select {
+	case <-e.donech:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *OTLPExporter) loop() {
+	defer close(e.donech)
+
+	ticker := time.NewTicker(e.FlushInterval)
+	defer ticker.Stop()
+
+	var batch []SpanData
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.send(batch); err != nil {
+			e.Logger.Warn("otlp export failed", "spans", len(batch), "err", err)
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case span := <-e.spanch:
+			batch = append(batch, span)
+			if len(batch) >= e.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.quitch:
+			for {
+				select {
+				case span := <-e.spanch:
+					batch = append(batch, span)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *OTLPExporter) send(spans []SpanData) error {
+	b, err := json.Marshal(otlpRequest(e.ServiceName, spans))
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.Client.Post(e.Endpoint+"/v1/traces", "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("otlp collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// 以下类型对应 OTLP ExportTraceServiceRequest 的 JSON 编码
+
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 0 unset, 2 error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+const otlpSpanKindInternal = 1
+
+func otlpRequest(service string, spans []SpanData) otlpExportRequest {
+	out := make([]otlpSpan, len(spans))
+	for i, span := range spans {
+		out[i] = otlpSpan{
+			TraceID:           span.TraceID.String(),
+			SpanID:            span.SpanID.String(),
+			Name:              span.Name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+		}
+		if !span.ParentID.IsZero() {
+			out[i].ParentSpanID = span.ParentID.String()
+		}
+		if span.Err != "" {
+			out[i].Status = otlpStatus{Code: 2, Message: span.Err}
+		}
+	}
+
+	return otlpExportRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: otlpAttributes(map[string]any{"service.name": service}),
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "distributed_file_storage"},
+				Spans: out,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(attrs map[string]any) []otlpKeyValue {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	kvs := make([]otlpKeyValue, 0, len(keys))
+	for _, k := range keys {
+		var v otlpAnyValue
+		switch x := attrs[k].(type) {
+		case string:
+			v.StringValue = &x
+		case int:
+			s := strconv.Itoa(x)
+			v.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(x, 10)
+			v.IntValue = &s
+		case float64:
+			v.DoubleValue = &x
+		case bool:
+			v.BoolValue = &x
+		default:
+			s := fmt.Sprint(x)
+			v.StringValue = &s
+		}
+		kvs = append(kvs, otlpKeyValue{Key: k, Value: v})
+	}
+	return kvs
+}
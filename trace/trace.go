@@ -0,0 +1,152 @@
+// Package trace 实现最简单的分布式追踪：生成 span，通过 Message 在节点之间传递上下文，并交给 Exporter 导出
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+func (id TraceID) IsZero() bool { return id == TraceID{} }
+
+func (id SpanID) IsZero() bool { return id == SpanID{} }
+
+// SpanContext 随 Message 在节点之间传递的追踪上下文
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+func (sc SpanContext) IsValid() bool {
+	return !sc.TraceID.IsZero() && !sc.SpanID.IsZero()
+}
+
+// SpanData 结束后交给 Exporter 的 span
+type SpanData struct {
+	Name       string
+	TraceID    TraceID
+	SpanID     SpanID
+	ParentID   SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]any
+	Err        string
+}
+
+func (d SpanData) Duration() time.Duration {
+	return d.End.Sub(d.Start)
+}
+
+// Exporter 接收结束的 span
+type Exporter interface {
+	ExportSpan(SpanData)
+	Shutdown(ctx context.Context) error
+}
+
+// Tracer 创建 span，exporter 为空时 span 不会被导出，但上下文仍然会传递
+type Tracer struct {
+	exporter Exporter
+}
+
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+type spanKey struct{}
+
+// Start 以 ctx 中的 span(或远端传来的上下文)为父节点开始一个新的 span
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	parent := SpanContextFromContext(ctx)
+
+	span := &Span{
+		tracer: t,
+		data: SpanData{
+			Name:       name,
+			TraceID:    parent.TraceID,
+			ParentID:   parent.SpanID,
+			Start:      time.Now(),
+			Attributes: make(map[string]any),
+		},
+	}
+	if span.data.TraceID.IsZero() {
+		rand.Read(span.data.TraceID[:])
+	}
+	rand.Read(span.data.SpanID[:])
+
+	return context.WithValue(ctx, spanKey{}, span.Context()), span
+}
+
+// ContextWithRemote 把从其他节点收到的上下文放入 ctx，之后开始的 span 以它为父节点
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	if !sc.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, sc)
+}
+
+// SpanContextFromContext 取出 ctx 中当前的追踪上下文
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(spanKey{}).(SpanContext)
+	return sc
+}
+
+// Span 一次操作，调用 End 后导出
+type Span struct {
+	tracer *Tracer
+
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+func (s *Span) Context() SpanContext {
+	return SpanContext{TraceID: s.data.TraceID, SpanID: s.data.SpanID}
+}
+
+func (s *Span) SetAttr(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Attributes[key] = value
+}
+
+// SetError 记录错误，err 为空时什么也不做
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Err = err.Error()
+}
+
+// End 结束 span，重复调用只有第一次有效
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	if s.tracer.exporter != nil {
+		s.tracer.exporter.ExportSpan(data)
+	}
+}
+
+func (s *Span) String() string {
+	return fmt.Sprintf("%s trace=%s span=%s", s.data.Name, s.data.TraceID, s.data.SpanID)
+}
@@ -0,0 +1,89 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpanParentChild(t *testing.T) {
+	exp := NewInMemoryExporter()
+	tracer := NewTracer(exp)
+
+	ctx, parent := tracer.Start(context.Background(), "parent")
+	_, child := tracer.Start(ctx, "child")
+	child.SetAttr("bytes", int64(42))
+	child.SetError(errors.New("boom"))
+	child.End()
+	parent.End()
+	parent.End()
+
+	spans := exp.Spans()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "child", spans[0].Name)
+	assert.Equal(t, parent.Context().TraceID, spans[0].TraceID)
+	assert.Equal(t, parent.Context().SpanID, spans[0].ParentID)
+	assert.Equal(t, "boom", spans[0].Err)
+	assert.Equal(t, int64(42), spans[0].Attributes["bytes"])
+	assert.True(t, spans[1].ParentID.IsZero())
+}
+
+func TestContextWithRemote(t *testing.T) {
+	exp := NewInMemoryExporter()
+	tracer := NewTracer(exp)
+
+	_, remote := tracer.Start(context.Background(), "remote")
+	sc := remote.Context()
+
+	ctx := ContextWithRemote(context.Background(), sc)
+	_, span := tracer.Start(ctx, "local")
+	span.End()
+
+	local := exp.Find("local")[0]
+	assert.Equal(t, sc.TraceID, local.TraceID)
+	assert.Equal(t, sc.SpanID, local.ParentID)
+
+	// 无效的上下文被忽略，开始新的 trace
+	ctx = ContextWithRemote(context.Background(), SpanContext{})
+	assert.False(t, SpanContextFromContext(ctx).IsValid())
+}
+
+func TestOTLPExporter(t *testing.T) {
+	reqch := make(chan otlpExportRequest, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		var req otlpExportRequest
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&req))
+		reqch <- req
+	}))
+	defer ts.Close()
+
+	exp := NewOTLPExporter(OTLPExporterOpts{
+		Endpoint:      ts.URL,
+		ServiceName:   "fs-test",
+		FlushInterval: time.Hour,
+	})
+	tracer := NewTracer(exp)
+
+	ctx, parent := tracer.Start(context.Background(), "FileServer.Get")
+	_, child := tracer.Start(ctx, "store.read")
+	child.SetAttr("key", "picture.png")
+	child.End()
+	parent.End()
+
+	assert.Nil(t, exp.Shutdown(context.Background()))
+
+	req := <-reqch
+	assert.Equal(t, "fs-test", *req.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "store.read", spans[0].Name)
+	assert.Equal(t, parent.Context().SpanID.String(), spans[0].ParentSpanID)
+	assert.Equal(t, "picture.png", *spans[0].Attributes[0].Value.StringValue)
+}